@@ -1,25 +1,78 @@
 import { ElectronAPI } from '@electron-toolkit/preload'
 import IRatchetDetail from "../renderer/src/interfaces/IRatchetDetail";
 import IMessage from "../renderer/src/interfaces/IMessage";
+import IAttachmentDescriptor from "../renderer/src/interfaces/IAttachmentDescriptor";
 import { decryptblob } from "../renderer/src/crypto/cryptoLib";
 
 declare global {
+  // failures of the core library come back as an Error with a stable code
+  interface CoreError extends Error {
+    code:
+      | 'WRONG_PIN'
+      | 'IDENTITY_KEY_CHANGED'
+      | 'UNTRUSTED_IDENTITY'
+      | 'INVALID_CERTIFICATE'
+      | 'NO_INTERNAL_KEY'
+      | 'WRONG_RATCHET'
+      | 'DUPLICATE_MESSAGE'
+      | 'TOO_MANY_SKIPPED'
+      | 'NOT_NEW_SESSION'
+      | 'UNSUPPORTED_VERSION'
+      | 'TAMPERED_STORE'
+      | 'BAD_SIGNATURE'
+      | 'KEY_SUITE_MISMATCH'
+      | 'INVALID_KEY'
+      | 'INVALID_MESSAGE'
+      | 'DIGEST_MISMATCH'
+      | 'INVALID_ATTACHMENT'
+      | 'REPLAYED_FRAME'
+      | 'INVALID_FRAME'
+      | 'UNKNOWN_CALL'
+      | 'INVALID_ARGUMENT'
+      | 'DECRYPT_FAILED'
+      | 'UNKNOWN'
+    identityKeyChanged?: boolean
+  }
+
   interface Window {
     Go: any
     startUp: (pinValue: string) => Promise<void>
-    generateInternalKeyBundle: () => Promise<string>
+    generateInternalKeyBundle: (suite?: string) => Promise<string | CoreError>
     populateExternalKeyBundle: () => Promise<{keyId: string, keyBundle: string}>
-    regeneratePreKey: () => Promise<{keyId: string, keyBundle: string}>
+    regeneratePreKey: (gracePeriod?: number) => Promise<{keyId: string, keyBundle: string}>
     saveInternalKey: () => Promise<any>
+    internalKeyNeedsMigration: () => Promise<boolean>
+    generateOneTimeKeys: (count: number) => Promise<any>
     populateExternalKeyBundle: () => Promise<void>
-    initRatchetFromInternal: (keyBundle: string) => Promise<any>
-    initRatchetFromExternal: (externalKey: string,ephemeralKey: string, ratchetId: string ) => Promise<{ratchetId: string}>
-    loadRatchet: (ratchetDetail: string) => Promise<string>
-    saveRatchet: (ratchetId: string) => Promise<IRatchetDetail>
-    loadInternalKey: (internalKey: string) => Promise<string>
-    sendMessage: (ratchetId: string, isBinary: boolean, message: string) => Promise<any>
+    getSafetyNumber: (username: string, otherUsername: string, keyBundle: string) => Promise<{numeric: string, scannable: string} | CoreError>
+    compareSafetyNumber: (username: string, otherUsername: string, keyBundle: string, scannable: string) => Promise<boolean | CoreError>
+    markContactVerified: (otherUsername: string, keyBundle: string, verified: boolean) => Promise<boolean | CoreError>
+    isContactVerified: (otherUsername: string, keyBundle: string) => Promise<boolean>
+    getTrustedIdentity: (otherUsername: string) => Promise<{identityKey: string, firstSeenAt: number, changedKey?: string} | null>
+    acceptIdentityKeyChange: (otherUsername: string, keyBundle: string) => Promise<boolean | CoreError>
+    initRatchetFromInternal: (keyBundle: string, otherUsername: string) => Promise<any>
+    initRatchetFromExternal: (externalKey: string,ephemeralKey: string, ratchetId: string, preKeyId?: string, oneTimeKeyId?: string, pqCipherText?: string, protocolVersion?: number, otherUsername?: string ) => Promise<{ratchetId: string, identityKeyChanged?: boolean}>
+    initSessionReset: (keyBundle: string, otherUsername: string, ratchetId: string, failedIndexes?: number[]) => Promise<{ratchetId: string, reset: any, identityKeyChanged?: boolean}>
+    acceptSessionReset: (reset: string, keyBundle: string, otherUsername: string) => Promise<{ratchetId: string, unrecoverableIndexes: number[], identityKeyChanged?: boolean}>
+    loadRatchet: (ratchetDetail: string) => Promise<string | CoreError>
+    ratchetNeedsMigration: (ratchetId: string) => Promise<boolean>
+    saveRatchet: (ratchetId: string) => Promise<IRatchetDetail | CoreError>
+    loadInternalKey: (internalKey: string) => Promise<string | CoreError>
+    sendMessage: (ratchetId: string, isBinary: boolean, message: string) => Promise<any | CoreError>
     isRatchetExist: (ratchetId: string) => Promise<boolean>
-    receiveMessage: (data: string) => Promise<string>
+    setRatchetPadding: (ratchetId: string, padding: number) => Promise<boolean | CoreError>
+    receiveMessage: (data: string | Uint8Array) => Promise<string | CoreError>
+    encodeMessage: (message: string) => Promise<Uint8Array>
+    decodeSocketFrame: (frame: Uint8Array) => Promise<Record<string, any> | CoreError>
+    sealMessage: (otherUsername: string, certificate: string, deliveryToken: string | undefined, message: Uint8Array) => Promise<string | CoreError>
+    encryptAttachment: (content: Uint8Array, contentType: string, fileName: string, thumbnail?: Uint8Array) => Promise<{blob: Uint8Array, descriptor: IAttachmentDescriptor} | CoreError>
+    decryptAttachment: (blob: Uint8Array, descriptor: string) => Promise<Uint8Array | CoreError>
+    initVoipSessionFromInternal: (keyBundle: string, otherUsername: string) => Promise<{callId: string, ephemeralKey: string, preKeyId: string, protocolVersion: number, identityKeyChanged?: boolean} | CoreError>
+    initVoipSessionFromExternal: (keyBundle: string, ephemeralKey: string, protocolVersion: number | undefined, otherUsername: string, preKeyId?: string) => Promise<{callId: string, identityKeyChanged?: boolean} | CoreError>
+    encryptVoipFrame: (callId: string, frame: Uint8Array) => Promise<Uint8Array | CoreError>
+    decryptVoipFrame: (callId: string, frame: Uint8Array) => Promise<Uint8Array | CoreError>
+    closeVoipSession: (callId: string) => Promise<boolean>
+    openSealedMessage: (envelope: string, serverKey: string) => Promise<{senderUsername?: string, deliveryToken?: string, message?: Uint8Array, identityKeyChanged?: boolean} | CoreError>
     electron: ElectronAPI
     api: {
       readAuthFile(): Promise<string>
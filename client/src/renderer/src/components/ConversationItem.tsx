@@ -5,6 +5,14 @@ import IConversation from '../interfaces/IConversation'
 import chatRepository from '../repositories/chat-repository'
 import userRepository from '../repositories/user-repository'
 import IMessage from '../interfaces/IMessage'
+import { acceptSessionReset, initTrustedRatchet, isCoreError, resetSession } from '../utils'
+import { toast } from 'react-toastify'
+import {
+  KEY_CHANGED_EVENT,
+  SESSION_RESET_ACK_EVENT,
+  SESSION_RESET_EVENT
+} from '../configs/consts'
+import useWebSocketStore from '../stores/useWebSocketStore'
 
 type ConversationItemProps = {
   conversation: IConversation
@@ -23,13 +31,21 @@ const ConversationItem = (props: ConversationItemProps) => {
     setMessageSearches,
     setCurrentIdxSearch
   } = useConversationStore()
+  const { websocket } = useWebSocketStore()
 
   const createRatchet = async () => {
     const res = await userRepository.getExternalUserKey(conversation.receiver)
-    const initRatchetRes = await window.initRatchetFromInternal(JSON.stringify(res.data))
+    const keyBundle = JSON.stringify(res.data)
+    const initRatchetRes = await initTrustedRatchet(conversation.receiver, keyBundle, () =>
+      window.initRatchetFromInternal(keyBundle, conversation.receiver)
+    )
     await chatRepository.initChatSession({
       chatSessionId: initRatchetRes.ratchetId,
       ephemeralKey: initRatchetRes.ephemeralKey,
+      preKeyId: initRatchetRes.preKeyId,
+      oneTimeKeyId: initRatchetRes.oneTimeKeyId,
+      pqCipherText: initRatchetRes.pqCipherText,
+      protocolVersion: initRatchetRes.protocolVersion,
       receiverUserName: conversation.receiver
     })
     const ratchetDetail = await window.saveRatchet(initRatchetRes.ratchetId)
@@ -86,16 +102,40 @@ const ConversationItem = (props: ConversationItemProps) => {
           }) as IMessage
       )
 
+      // indexes of pending messages the ratchet could not decrypt
+      const failedIndexes: number[] = []
       for (let i = 0; i < res?.data?.length; i++) {
         const item = res.data[i]
+        if (item.type === KEY_CHANGED_EVENT) {
+          toast.warn(`Khóa định danh của ${item.senderUsername} đã thay đổi`)
+          continue
+        }
+        if (item.type === SESSION_RESET_EVENT) {
+          // the other side already started over, failures of the old ratchet are settled
+          await acceptSessionReset(websocket, item.senderUsername, item.additionalData)
+          failedIndexes.length = 0
+          continue
+        }
+        if (item.type === SESSION_RESET_ACK_EVENT) {
+          toast.info(`Đã đặt lại phiên với ${item.senderUsername}`)
+          continue
+        }
         const content = await window.receiveMessage(
           JSON.stringify({
             chatSessionId: item.chatSessionId,
             index: item.index,
             cipherMessage: item.cipherMessage,
-            isBinary: item.isBinary
+            chainIndex: item.chainIndex,
+            previousChainLength: item.previousChainLength,
+            ratchetKey: item.ratchetKey,
+            isBinary: item.isBinary,
+            padding: item.padding
           })
         )
+        if (content == null || isCoreError(content)) {
+          if (content?.code !== 'DUPLICATE_MESSAGE') failedIndexes.push(item.index)
+          continue
+        }
 
         console.log(content)
 
@@ -104,7 +144,7 @@ const ConversationItem = (props: ConversationItemProps) => {
           index: item.index,
           sender: item.senderUsername,
           type: item.type,
-          filePath: content + ':' + item.filePath,
+          filePath: item.filePath ? content + ':' + item.filePath : content,
           isDeleted: item.isDeleted
         }
 
@@ -114,6 +154,9 @@ const ConversationItem = (props: ConversationItemProps) => {
         const ratchetDetail = await window.saveRatchet(item.chatSessionId!)
         await window.api.changeRatchetDetail(item.senderUsername!, ratchetDetail)
       }
+      if (failedIndexes.length > 0) {
+        await resetSession(websocket, conversation.receiver, conversation.id, failedIndexes)
+      }
 
       /*isNewConversation &&
         (await window.api.addMessageToRatchet(conversation.receiver, newMessages))*/
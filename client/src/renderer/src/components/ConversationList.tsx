@@ -10,6 +10,10 @@ import {
   CHAT_NEW_EVENT,
   FILE_TYPE,
   IMAGE_TYPE,
+  KEY_CHANGED_EVENT,
+  PRE_KEY_STALE_EVENT,
+  SESSION_RESET_ACK_EVENT,
+  SESSION_RESET_EVENT,
   TEXT_TYPE,
   VIDEO_TYPE
 } from '../configs/consts'
@@ -19,6 +23,9 @@ import chatRepository from '../repositories/chat-repository'
 import useCallStore from '../stores/useCallStore'
 import userRepository from '../repositories/user-repository'
 import IMessage from '../interfaces/IMessage'
+import IAuthFile from '../interfaces/IAuthFile'
+import authRepository from '../repositories/auth-repository'
+import { acceptSessionReset, initTrustedRatchet, isCoreError, resetSession } from '../utils'
 
 const ConversationList = () => {
   const {
@@ -37,7 +44,7 @@ const ConversationList = () => {
     setCaller,
     initWS,
     setVoipToken,
-    setEncKey,
+    setCallId,
     setInitCallType,
     setEnableAudio,
     setEnableVideo,
@@ -47,10 +54,18 @@ const ConversationList = () => {
 
   // eslint-disable-next-line
   const createRatchet = useCallback(async (additionalData: any, senderUserName: string) => {
-    const ratchetRes = await window.initRatchetFromExternal(
-      JSON.stringify(additionalData.senderKeyBundle),
-      additionalData.ephemeralKey,
-      additionalData.chatSessionId
+    const keyBundle = JSON.stringify(additionalData.senderKeyBundle)
+    const ratchetRes = await initTrustedRatchet(senderUserName, keyBundle, () =>
+      window.initRatchetFromExternal(
+        keyBundle,
+        additionalData.ephemeralKey,
+        additionalData.chatSessionId,
+        additionalData.preKeyId,
+        additionalData.oneTimeKeyId,
+        additionalData.pqCipherText,
+        additionalData.protocolVersion,
+        senderUserName
+      )
     )
     await chatRepository.completeChatSession(ratchetRes.ratchetId)
     const ratchetDetail = await window.saveRatchet(ratchetRes.ratchetId)
@@ -60,7 +75,14 @@ const ConversationList = () => {
   useEffect(() => {
     if (!websocket) return
     websocket.onmessage = async (msg) => {
-      const data = JSON.parse(msg.data)
+      const data =
+        typeof msg.data === 'string'
+          ? JSON.parse(msg.data)
+          : await window.decodeSocketFrame(new Uint8Array(msg.data))
+      if (isCoreError(data)) {
+        console.log('cannot read socket frame', data)
+        return
+      }
       console.log('data', data)
       switch (data.type) {
         case CHAT_NEW_EVENT: {
@@ -77,6 +99,49 @@ const ConversationList = () => {
           break
         }
 
+        case PRE_KEY_STALE_EVENT: {
+          // keep the replaced pre key for the server grace period so pending handshakes still complete
+          const externalKeyBundle = await window.regeneratePreKey(
+            data.additionalData.preKeyGracePeriod
+          )
+          const keyJSON = await window.saveInternalKey()
+          const keySaved = JSON.parse(await window.api.readAuthFile()) as IAuthFile
+          keyJSON.pin = keySaved.pin
+          await window.api.writeAuthFile(keyJSON)
+          await authRepository.uploadExternalKey(externalKeyBundle)
+          break
+        }
+
+        case KEY_CHANGED_EVENT: {
+          // the next session with this contact is refused until the new key is accepted
+          toast.warn(`Khóa định danh của ${data.senderUsername} đã thay đổi`)
+          break
+        }
+
+        case SESSION_RESET_EVENT: {
+          const unrecoverableIndexes = await acceptSessionReset(
+            websocket,
+            data.senderUsername,
+            data.additionalData
+          )
+          if (unrecoverableIndexes?.length) {
+            toast.warn(
+              `Phiên trò chuyện với ${data.senderUsername} đã được đặt lại, ${unrecoverableIndexes.length} tin nhắn không thể khôi phục`
+            )
+          }
+          break
+        }
+
+        case SESSION_RESET_ACK_EVENT: {
+          const unrecoverableIndexes: number[] = data.additionalData?.unrecoverableIndexes ?? []
+          toast.info(
+            unrecoverableIndexes.length
+              ? `Đã đặt lại phiên với ${data.senderUsername}, không thể khôi phục tin nhắn ${unrecoverableIndexes.join(', ')}`
+              : `Đã đặt lại phiên với ${data.senderUsername}`
+          )
+          break
+        }
+
         case TEXT_TYPE:
         case IMAGE_TYPE:
         case VIDEO_TYPE:
@@ -84,22 +149,35 @@ const ConversationList = () => {
           let mediaContent = ''
           if (data.type === IMAGE_TYPE) mediaContent = 'Người dùng đã gửi ảnh'
           else if (data.type === VIDEO_TYPE) mediaContent = 'Người dùng đã gửi video'
+          else if (data.type === FILE_TYPE) mediaContent = 'Người dùng đã gửi một tệp tin'
 
           const content = await window.receiveMessage(
             JSON.stringify({
               chatSessionId: data.chatSessionId,
               index: data.index,
               cipherMessage: data.cipherMessage,
-              isBinary: data.isBinary
+              chainIndex: data.chainIndex,
+              previousChainLength: data.previousChainLength,
+              ratchetKey: data.ratchetKey,
+              isBinary: data.isBinary,
+              padding: data.padding
             })
           )
+          if (content == null || isCoreError(content)) {
+            // a duplicate is dropped, otherwise the ratchet is broken, start over and let the sender know what was lost
+            if (content?.code !== 'DUPLICATE_MESSAGE') {
+              await resetSession(websocket, data.senderUsername, data.chatSessionId, [data.index])
+            }
+            break
+          }
 
           const newMessage: IMessage = {
             index: data.index,
             content: mediaContent == '' ? content : mediaContent,
             type: data.type,
             sender: data.senderUsername,
-            filePath: content + ':' + data.filePath,
+            // the content of an attachment message is its descriptor, older senders put the key there
+            filePath: data.filePath ? content + ':' + data.filePath : content,
             isDeleted: false
           }
 
@@ -115,7 +193,7 @@ const ConversationList = () => {
           )
           const newConversations = [...conversations]
           if (!newConversations[conversationIndex]) return
-          newConversations[conversationIndex].lastMessage = content
+          newConversations[conversationIndex].lastMessage = newMessage.content
 
           const temp = newConversations[conversationIndex]
           temp.isReaded = temp.id === currentRatchetId
@@ -144,13 +222,17 @@ const ConversationList = () => {
           setCaller(data.senderUsername)
           setVoipToken(data.cipherMessage)
           const res = await userRepository.getExternalUserKey(data.senderUsername)
-          const ratchetRes = await window.initRatchetFromExternal(
-            JSON.stringify(res.data),
-            data.plainMessage,
-            ''
+          const keyBundle = JSON.stringify(res.data)
+          const voipRes = await initTrustedRatchet(data.senderUsername, keyBundle, () =>
+            window.initVoipSessionFromExternal(
+              keyBundle,
+              data.plainMessage,
+              data.additionalData ?? undefined,
+              data.senderUsername,
+              data.preKeyId
+            )
           )
-          const ratchetDetail = await window.saveRatchet(ratchetRes.ratchetId)
-          setEncKey(ratchetDetail.root_key)
+          setCallId(voipRes.callId)
           break
         }
 
@@ -168,13 +250,17 @@ const ConversationList = () => {
           setCaller(data.senderUsername)
           setVoipToken(data.cipherMessage)
           const res = await userRepository.getExternalUserKey(data.senderUsername)
-          const ratchetRes = await window.initRatchetFromExternal(
-            JSON.stringify(res.data),
-            data.plainMessage,
-            ''
+          const keyBundle = JSON.stringify(res.data)
+          const voipRes = await initTrustedRatchet(data.senderUsername, keyBundle, () =>
+            window.initVoipSessionFromExternal(
+              keyBundle,
+              data.plainMessage,
+              data.additionalData ?? undefined,
+              data.senderUsername,
+              data.preKeyId
+            )
           )
-          const ratchetDetail = await window.saveRatchet(ratchetRes.ratchetId)
-          setEncKey(ratchetDetail.root_key)
+          setCallId(voipRes.callId)
           break
         }
 
@@ -5,9 +5,8 @@ import useConversationStore from '../stores/useConversationStore'
 import useWebSocketStore from '../stores/useWebSocketStore'
 import useAuthStore from '../stores/useAuthStore'
 import { FILE_TYPE, IMAGE_TYPE, TEXT_TYPE, VIDEO_TYPE } from '../configs/consts'
-import uploadRepository from '../repositories/upload-repository'
-import { encryptblobBrowser } from '../crypto/cryptoLib'
 import IMessage from '../interfaces/IMessage'
+import { uploadAttachment } from '../utils'
 
 type MessageFormProps = {
   handleScroll: (content: string) => void
@@ -45,7 +44,11 @@ const MessageForm = (props: MessageFormProps) => {
         chatSessionId: currentRatchetId,
         index: res.index,
         cipherMessage: res.cipherMessage,
-        isBinary: res.isBinary
+        chainIndex: res.chainIndex,
+        previousChainLength: res.previousChainLength,
+        ratchetKey: res.ratchetKey,
+        isBinary: res.isBinary,
+        padding: res.padding
       })
     )
     const newMessage: IMessage = {
@@ -79,141 +82,85 @@ const MessageForm = (props: MessageFormProps) => {
     await window.api.changeRatchetDetail(currentConversation!, ratchetDetail)
   }
 
-  const handleSendImage = async (e: FormEvent<HTMLInputElement>) => {
-    const file = e.currentTarget.files?.[0]
-    if (!file) return
-    const mimeType = file.type
-    const randomKey = await window.api.random32Bytes()
-    const reader = new FileReader()
-    reader.onload = async (e) => {
-      const encryptedBlob = await encryptblobBrowser(
-        new Blob([e!.target!.result as ArrayBuffer]),
-        randomKey
-      )
-
-      const formData = new FormData()
-      formData.set('upload', encryptedBlob)
-      const res = await uploadRepository.uploadFile(formData)
-      const chatType = mimeType.split('/')[0] === 'image' ? IMAGE_TYPE : VIDEO_TYPE
-
-      const resMsg = await window.sendMessage(currentRatchetId!, false, randomKey)
-      websocket?.send(
-        JSON.stringify({
-          type: chatType,
-          senderUsername: userInfo?.userName,
-          filePath: res.data.filePath + ':' + mimeType,
-          plainMessage: res.data.filePath,
-          chatSessionId: currentRatchetId,
-          index: resMsg.index,
-          cipherMessage: resMsg.cipherMessage,
-          isBinary: false
-        })
-      )
-      const newMessage: IMessage = {
-        index: resMsg.index,
-        content: chatType === IMAGE_TYPE ? 'Bạn đã gửi một ảnh' : 'Bạn đã gửi một video',
-        filePath: randomKey + ':' + res.data.filePath + ':' + mimeType,
+  // the descriptor of the uploaded blob is the message content, the server only sees the file id
+  const sendAttachment = async (
+    file: File,
+    chatType: typeof IMAGE_TYPE | typeof VIDEO_TYPE | typeof FILE_TYPE,
+    content: string,
+    lastMessage: string
+  ) => {
+    const descriptor = await uploadAttachment(file)
+    const descriptorJson = JSON.stringify(descriptor)
+
+    const resMsg = await window.sendMessage(currentRatchetId!, false, descriptorJson)
+    websocket?.send(
+      JSON.stringify({
         type: chatType,
-        sender: userInfo!.userName,
-        isDeleted: false
-      }
+        senderUsername: userInfo?.userName,
+        plainMessage: '',
+        chatSessionId: currentRatchetId,
+        index: resMsg.index,
+        cipherMessage: resMsg.cipherMessage,
+        chainIndex: resMsg.chainIndex,
+        previousChainLength: resMsg.previousChainLength,
+        ratchetKey: resMsg.ratchetKey,
+        isBinary: false,
+        padding: resMsg.padding
+      })
+    )
+    const newMessage: IMessage = {
+      index: resMsg.index,
+      content: content,
+      filePath: descriptorJson,
+      type: chatType,
+      sender: userInfo!.userName,
+      isDeleted: false
+    }
 
-      await window.api.addMessageToRatchet(currentConversation!, [newMessage])
+    await window.api.addMessageToRatchet(currentConversation!, [newMessage])
 
-      setMessages([...messages, newMessage])
+    setMessages([...messages, newMessage])
 
-      const conversationIndex = conversations.findIndex(
-        (item) => item.receiver === currentConversation
-      )
-      const newConversations = [...conversations]
-      newConversations[conversationIndex].lastMessage =
-        chatType === IMAGE_TYPE ? 'Người dùng đã gửi một ảnh' : 'Người dùng đã gửi một video'
-      const temp = newConversations[conversationIndex]
-      newConversations.splice(conversationIndex, 1)
-      newConversations.unshift(temp)
-      setConversations(newConversations)
+    const conversationIndex = conversations.findIndex(
+      (item) => item.receiver === currentConversation
+    )
+    const newConversations = [...conversations]
+    newConversations[conversationIndex].lastMessage = lastMessage
+    const temp = newConversations[conversationIndex]
+    newConversations.splice(conversationIndex, 1)
+    newConversations.unshift(temp)
+    setConversations(newConversations)
 
-      setContent('')
-      handleScroll(res.data.filePath)
-    }
-    reader.readAsArrayBuffer(file)
+    setContent('')
+    handleScroll(descriptor.fileId)
 
     // save new ratchet detail
     const ratchetDetail = await window.saveRatchet(currentRatchetId!)
     await window.api.changeRatchetDetail(currentConversation!, ratchetDetail)
   }
 
-  const handleSendFile = async (e: FormEvent<HTMLInputElement>) => {
+  const handleSendImage = async (e: FormEvent<HTMLInputElement>) => {
     const file = e.currentTarget.files?.[0]
     if (!file) return
-    const mimeType = file.type
-    const fileName = file.name
-    const fileSize = file.size
-    const randomKey = await window.api.random32Bytes()
-    const reader = new FileReader()
-    reader.onload = async (e) => {
-      const encryptedBlob = await encryptblobBrowser(
-        new Blob([e!.target!.result as ArrayBuffer]),
-        randomKey
-      )
-
-      const formData = new FormData()
-      formData.set('upload', encryptedBlob)
-      const res = await uploadRepository.uploadFile(formData)
-
-      const resMsg = await window.sendMessage(currentRatchetId!, false, randomKey)
-      websocket?.send(
-        JSON.stringify({
-          type: FILE_TYPE,
-          senderUsername: userInfo?.userName,
-          filePath: res.data.filePath + ':' + mimeType + ':' + fileName + ':' + fileSize / 1024,
-          plainMessage: res.data.filePath,
-          chatSessionId: currentRatchetId,
-          index: resMsg.index,
-          cipherMessage: resMsg.cipherMessage,
-          isBinary: false
-        })
-      )
-      const newMessage: IMessage = {
-        index: resMsg.index,
-        content: 'Người dùng đã gửi một tệp tin',
-        filePath:
-          randomKey +
-          ':' +
-          res.data.filePath +
-          ':' +
-          mimeType +
-          ':' +
-          fileName +
-          ':' +
-          fileSize / 1024,
-        type: FILE_TYPE,
-        sender: userInfo!.userName,
-        isDeleted: false
+    try {
+      if (file.type.split('/')[0] === 'image') {
+        await sendAttachment(file, IMAGE_TYPE, 'Bạn đã gửi một ảnh', 'Người dùng đã gửi một ảnh')
+      } else {
+        await sendAttachment(file, VIDEO_TYPE, 'Bạn đã gửi một video', 'Người dùng đã gửi một video')
       }
-
-      await window.api.addMessageToRatchet(currentConversation!, [newMessage])
-
-      setMessages([...messages, newMessage])
-
-      const conversationIndex = conversations.findIndex(
-        (item) => item.receiver === currentConversation
-      )
-      const newConversations = [...conversations]
-      newConversations[conversationIndex].lastMessage = 'Bạn dùng đã gửi một tệp tin'
-      const temp = newConversations[conversationIndex]
-      newConversations.splice(conversationIndex, 1)
-      newConversations.unshift(temp)
-      setConversations(newConversations)
-
-      setContent('')
-      handleScroll(res.data.filePath)
+    } catch (error) {
+      console.error('ERROR', error)
     }
-    reader.readAsArrayBuffer(file)
+  }
 
-    // save new ratchet detail
-    const ratchetDetail = await window.saveRatchet(currentRatchetId!)
-    await window.api.changeRatchetDetail(currentConversation!, ratchetDetail)
+  const handleSendFile = async (e: FormEvent<HTMLInputElement>) => {
+    const file = e.currentTarget.files?.[0]
+    if (!file) return
+    try {
+      await sendAttachment(file, FILE_TYPE, 'Người dùng đã gửi một tệp tin', 'Bạn dùng đã gửi một tệp tin')
+    } catch (error) {
+      console.error('ERROR', error)
+    }
   }
 
   return (
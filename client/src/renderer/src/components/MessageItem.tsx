@@ -8,6 +8,7 @@ import uploadRepository from '../repositories/upload-repository'
 import { decryptblobBrowser } from '../crypto/cryptoLib'
 import useConversationStore from '../stores/useConversationStore'
 import { toast } from 'react-toastify'
+import { downloadAttachment, parseAttachmentDescriptor } from '../utils'
 
 type MessageItemProps = {
   message: IMessage
@@ -76,6 +77,22 @@ const MessageItem = (props: MessageItemProps) => {
     if (message.type !== TEXT_TYPE && message.filePath) {
       ;(async function() {
         console.log(message)
+        const descriptor = parseAttachmentDescriptor(message.filePath!)
+        if (descriptor) {
+          try {
+            const decryptedData = await downloadAttachment(descriptor)
+            setContent(URL.createObjectURL(decryptedData))
+          } catch (error) {
+            console.error('ERROR', error)
+            return
+          }
+          if (message.type === FILE_TYPE) {
+            setFileName(descriptor.fileName ?? '')
+            setFileSize(Math.floor(descriptor.size / 1024))
+          }
+          return
+        }
+
         const [randomKey, filePath, , filename, fileSize] = message.filePath!.split(':')
         const res = await uploadRepository.downloadFile(filePath!)
         const responseBlob = await res.data
@@ -8,6 +8,7 @@ import { CALL_VIDEO_EVENT, CHAT_AUDIO_EVENT } from '../configs/consts'
 import callRepository from '../repositories/call-repository'
 import useAuthStore from '../stores/useAuthStore'
 import userRepository from '../repositories/user-repository'
+import { initTrustedRatchet } from '../utils'
 
 type MessageSearchProps = {
   handleScrollToMessage: (messageIndex: number) => void
@@ -25,7 +26,7 @@ const MessageSearch = (props: MessageSearchProps) => {
     setCaller,
     setTypeCall,
     setVoipToken,
-    setEncKey
+    setCallId
   } = useCallStore()
   const {
     messages,
@@ -56,17 +57,19 @@ const MessageSearch = (props: MessageSearchProps) => {
   const handleAudioCall = async () => {
     try {
       const otherUserKeyBundle = await userRepository.getExternalUserKey(currentConversation!)
-      const initRatchetRes = await window.initRatchetFromInternal(
-        JSON.stringify(otherUserKeyBundle.data)
+      const keyBundle = JSON.stringify(otherUserKeyBundle.data)
+      const voipRes = await initTrustedRatchet(currentConversation!, keyBundle, () =>
+        window.initVoipSessionFromInternal(keyBundle, currentConversation!)
       )
       const res = await callRepository.initVOIP(
         currentConversation!,
         CHAT_AUDIO_EVENT,
-        initRatchetRes.ephemeralKey
+        voipRes.ephemeralKey,
+        voipRes.protocolVersion,
+        voipRes.preKeyId
       )
-      const ratchetInfo = await window.saveRatchet(initRatchetRes.ratchetId)
       setVoipToken(res.data.voipSession)
-      setEncKey(ratchetInfo.root_key)
+      setCallId(voipRes.callId)
       setCaller(userInfo!.userName)
       setStatus('calling')
       setEnableAudio(true)
@@ -81,17 +84,19 @@ const MessageSearch = (props: MessageSearchProps) => {
   const handleVideoCall = async () => {
     try {
       const otherUserKeyBundle = await userRepository.getExternalUserKey(currentConversation!)
-      const initRatchetRes = await window.initRatchetFromInternal(
-        JSON.stringify(otherUserKeyBundle.data)
+      const keyBundle = JSON.stringify(otherUserKeyBundle.data)
+      const voipRes = await initTrustedRatchet(currentConversation!, keyBundle, () =>
+        window.initVoipSessionFromInternal(keyBundle, currentConversation!)
       )
       const res = await callRepository.initVOIP(
         currentConversation!,
         CALL_VIDEO_EVENT,
-        initRatchetRes.ephemeralKey
+        voipRes.ephemeralKey,
+        voipRes.protocolVersion,
+        voipRes.preKeyId
       )
-      const ratchetInfo = await window.saveRatchet(initRatchetRes.ratchetId)
       setVoipToken(res.data.voipSession)
-      setEncKey(ratchetInfo.root_key)
+      setCallId(voipRes.callId)
       setCaller(userInfo!.userName)
       setStatus('calling')
       setEnableAudio(true)
@@ -10,6 +10,7 @@ import { Loader2 } from 'lucide-react'
 import IAuthFile from '../interfaces/IAuthFile'
 import axiosInstance from '../libs/axios'
 import { compareSync } from 'bcryptjs'
+import { isCoreError } from '../utils'
 
 const PinAuthentication = ({ children }: { children: ReactNode }) => {
   const navigate = useNavigate()
@@ -38,7 +39,18 @@ const PinAuthentication = ({ children }: { children: ReactNode }) => {
 
         const internalKey = await window.api.getInternalKey()
         if (internalKey) {
-          await window.loadInternalKey(internalKey)
+          const loadRes = await window.loadInternalKey(internalKey)
+          if (isCoreError(loadRes)) {
+            if (loadRes.code !== 'WRONG_PIN') throw loadRes
+            setErrorMessage('Mã pin không đúng')
+            return
+          }
+          // stores encrypted with the bare pin are rewritten with the pin kdf
+          if (await window.internalKeyNeedsMigration()) {
+            const keyJSON = await window.saveInternalKey()
+            keyJSON.pin = keySaved.pin
+            await window.api.writeAuthFile(keyJSON)
+          }
         }
 
         const [userInfoRes, authToken] = await Promise.all([
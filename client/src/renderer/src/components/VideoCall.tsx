@@ -2,13 +2,13 @@ import clsx from 'clsx'
 import { ChevronLeft, ChevronRight, Phone } from 'lucide-react'
 import { useEffect, useRef, useState } from 'react'
 import useCallStore from '../stores/useCallStore'
-import { decryptblobVoip, encryptblobVoip } from '../crypto/cryptoLib'
 import { AUDIO_MIME_TYPE, CHAT_CLOSE, VIDEO_MIME_TYPE } from '../configs/consts'
 import useWebSocketStore from '../stores/useWebSocketStore'
 import useAuthStore from '../stores/useAuthStore'
+import { isCoreError } from '../utils'
 
 const VideoCall = () => {
-  const { caller, enableVideo, enableAudio, myWS, encKey, turnOffCall } = useCallStore()
+  const { caller, enableVideo, enableAudio, myWS, callId, turnOffCall } = useCallStore()
   const { websocket } = useWebSocketStore()
   const { userInfo } = useAuthStore()
 
@@ -44,9 +44,8 @@ const VideoCall = () => {
   }
 
   useEffect(() => {
-    if (!myWS || !encKey) return
+    if (!myWS || !callId) return
 
-    const ENC_KEY = encKey.substring(0, 16)
     const mimeType = enableVideo ? VIDEO_MIME_TYPE : AUDIO_MIME_TYPE
     console.log('mimeType', mimeType)
     console.log('enableAudio', enableAudio)
@@ -79,8 +78,10 @@ const VideoCall = () => {
               return
             }
             if (myWS.readyState === myWS.CONNECTING) return
-            encryptblobVoip(event.data, ENC_KEY).then((result) => {
-              myWS.send(result)
+            event.data.arrayBuffer().then(async (data) => {
+              const frame = await window.encryptVoipFrame(callId, new Uint8Array(data))
+              if (!frame || isCoreError(frame)) return
+              myWS.send(frame)
             })
           }
           localRecorder.start(100)
@@ -119,37 +120,34 @@ const VideoCall = () => {
 
     // WS handler
     myWS.onmessage = (msg) => {
-      const blob = new Blob([msg.data], {
-        type: mimeType
-      })
-      decryptblobVoip(blob, ENC_KEY).then((result) => {
-        result
-          .slice(0, result.size)
-          .arrayBuffer()
-          .then((data) => {
-            remoteArrayBuffer.push(data)
-            if (
-              remoteMediaSource.readyState === 'open' &&
-              remoteSrcBuffer &&
-              remoteSrcBuffer.updating === false
-            ) {
-              const blob = remoteArrayBuffer.shift()
-              // eslint-disable-next-line @typescript-eslint/ban-ts-comment
-              // @ts-ignore
-              remoteSrcBuffer.appendBuffer(blob)
-              if (remoteVideoRef.current != null) {
-                if (
-                  remoteVideoRef.current.buffered.length &&
-                  remoteVideoRef.current.buffered.end(0) -
-                  remoteVideoRef.current.buffered.start(0) >
-                  400
-                ) {
-                  remoteSrcBuffer.remove(0, remoteVideoRef.current.buffered.end(0) - 400)
-                }
+      // replayed or forged frames are dropped
+      new Blob([msg.data])
+        .arrayBuffer()
+        .then((sealed) => window.decryptVoipFrame(callId, new Uint8Array(sealed)))
+        .then((frame) => {
+          if (!frame || isCoreError(frame)) return
+          remoteArrayBuffer.push(frame.buffer as ArrayBuffer)
+          if (
+            remoteMediaSource.readyState === 'open' &&
+            remoteSrcBuffer &&
+            remoteSrcBuffer.updating === false
+          ) {
+            const blob = remoteArrayBuffer.shift()
+            // eslint-disable-next-line @typescript-eslint/ban-ts-comment
+            // @ts-ignore
+            remoteSrcBuffer.appendBuffer(blob)
+            if (remoteVideoRef.current != null) {
+              if (
+                remoteVideoRef.current.buffered.length &&
+                remoteVideoRef.current.buffered.end(0) -
+                remoteVideoRef.current.buffered.start(0) >
+                400
+              ) {
+                remoteSrcBuffer.remove(0, remoteVideoRef.current.buffered.end(0) - 400)
               }
             }
-          })
-      })
+          }
+        })
     }
   }, [myWS])
 
@@ -12,6 +12,7 @@ export const RATCHET_FILE = 'ratchet.json'
 export const AUTH_FILE = 'auth.json'
 // export const AUTH_FILE = 'auth2.json'
 export const AVATAR_FILE = 'avatar'
+export const ONE_TIME_KEY_BATCH_SIZE = 20
 
 export const TEXT_TYPE = 'CHAT_TEXT' as const
 export const IMAGE_TYPE = 'CHAT_IMAGE' as const
@@ -25,6 +26,11 @@ export const CHAT_VIDEO_EVENT = 'CHAT_VIDEO'
 export const CALL_VIDEO_EVENT = 'CALL_VIDEO'
 export const CHAT_AUDIO_EVENT = 'CHAT_AUDIO'
 export const ACCEPT_CALL_EVENT = 'CHAT_ACCEPT'
+export const PRE_KEY_STALE_EVENT = 'PRE_KEY_STALE'
+export const KEY_CHANGED_EVENT = 'KEY_CHANGED'
+export const SESSION_RESET_EVENT = 'SESSION_RESET'
+export const SESSION_RESET_ACK_EVENT = 'SESSION_RESET_ACK'
+export const SEALED_MESSAGE_EVENT = 'SEALED_MESSAGE'
 
 export const AVATAR_DEFAULT = 'https://source.unsplash.com/RZrIJ8C0860'
 
@@ -47,18 +47,6 @@ export async function encryptblobBrowser(blob, rawKey) {
   return new Blob([result])
 }
 
-export async function encryptblobVoip(blob, rawKey) {
-  const byteArray = new TextEncoder().encode(rawKey)
-  const buffer = byteArray.buffer
-  const key = await window.crypto.subtle.importKey('raw', buffer, 'AES-CBC', true, [
-    'encrypt',
-    'decrypt'
-  ])
-  const data = await blob.arrayBuffer()
-  const result = await window.crypto.subtle.encrypt(algorithm, key, data)
-  return new Blob([result])
-}
-
 export async function decryptblobBrowser(encblob, rawKey) {
   const key = await window.crypto.subtle.importKey(
     'raw',
@@ -71,15 +59,3 @@ export async function decryptblobBrowser(encblob, rawKey) {
   const decryptedData = await window.crypto.subtle.decrypt(algorithm, key, data)
   return new Blob([decryptedData])
 }
-
-export async function decryptblobVoip(encblob, rawKey) {
-  const byteArray = new TextEncoder().encode(rawKey)
-  const buffer = byteArray.buffer
-  const key = await window.crypto.subtle.importKey('raw', buffer, 'AES-CBC', true, [
-    'encrypt',
-    'decrypt'
-  ])
-  const data = await encblob.arrayBuffer()
-  const decryptedData = await window.crypto.subtle.decrypt(algorithm, key, data)
-  return new Blob([decryptedData])
-}
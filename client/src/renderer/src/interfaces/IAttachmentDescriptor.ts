@@ -0,0 +1,13 @@
+// what the receiver needs to find, check and decrypt an uploaded attachment,
+// it is only ever sent inside a ratchet message
+interface IAttachmentDescriptor {
+  fileId: string
+  key: string
+  digest: string
+  size: number
+  contentType: string
+  fileName?: string
+  thumbnail?: string
+}
+
+export default IAttachmentDescriptor
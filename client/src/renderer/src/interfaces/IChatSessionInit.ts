@@ -1,6 +1,10 @@
 interface IChatSessionInit {
   chatSessionId: string
   ephemeralKey: string
+  preKeyId?: string
+  oneTimeKeyId?: string
+  pqCipherText?: string
+  protocolVersion?: number
   receiverUserName: string
 }
 
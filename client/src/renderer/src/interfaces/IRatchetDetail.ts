@@ -6,6 +6,11 @@ interface IRatchetDetail {
   total_message_recv: number
   missing_message_keys: null | string[]
   rachet_id: string
+  my_identity_key?: string
+  your_identity_key?: string
+  created_at?: number
+  last_used_at?: number
+  mac?: string
 }
 
 export default IRatchetDetail
@@ -6,6 +6,7 @@ import IResponse from '../interfaces/IResponse'
 const authRepository = {
   getUserInfo: () => axiosInstance.get('/user'),
   uploadExternalKey: (data) => axiosInstance.post('/user/uploadKey', data),
+  uploadOneTimeKeys: (data) => axiosInstance.post('/user/oneTimeKeys', data),
   login: (data: IAuthData): Promise<IResponse<ILoginResponse>> =>
     axiosInstance.post('/auth/login', { ...data, loginType: 'password' }),
   register: (data: IAuthData) => axiosInstance.post('/auth/register', data),
@@ -5,10 +5,12 @@ const callRepository = {
   initVOIP: (
     username: string,
     callType: typeof CALL_VIDEO_EVENT | typeof CHAT_AUDIO_EVENT,
-    ephemeralKey: string
+    ephemeralKey: string,
+    protocolVersion: number,
+    preKeyId: string
   ) =>
     axiosInstance.put(
-      `/voip/init?userId=${username}&callType=${callType}&ephemeralKey=${ephemeralKey}`
+      `/voip/init?userId=${username}&callType=${callType}&ephemeralKey=${encodeURIComponent(ephemeralKey)}&protocolVersion=${protocolVersion}&preKeyId=${encodeURIComponent(preKeyId)}`
     )
 }
 
@@ -0,0 +1,27 @@
+import axiosInstance from '../libs/axios'
+
+const sealedSenderRepository = {
+  getSenderCertificate: (): Promise<{
+    data: { certificate: string; expiresAt: number; serverKey: string }
+  }> => axiosInstance.get('/sealedSender/certificate'),
+  registerDeliveryToken: (deliveryToken: string) =>
+    axiosInstance.put('/sealedSender/deliveryToken', { deliveryToken }),
+  // sent with the delivery token of the receiver only, the server must not learn who sends
+  sendSealedMessage: (receiverUserName: string, deliveryToken: string, envelope: string) =>
+    axiosInstance.post(
+      '/sealedSender/message',
+      { receiverUserName, envelope },
+      {
+        transformRequest: [
+          (data, headers) => {
+            delete headers['Authorization']
+            headers['X-Delivery-Token'] = deliveryToken
+            return JSON.stringify(data)
+          }
+        ]
+      }
+    ),
+  getSealedMessages: () => axiosInstance.get('/message/sealed')
+}
+
+export default sealedSenderRepository
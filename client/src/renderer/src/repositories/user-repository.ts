@@ -4,6 +4,7 @@ import IResponse from '../interfaces/IResponse'
 const userRepository = {
   searchUser: (search: string) => axiosInstance.get(`/user/search?keyWord=${search}`),
   getExternalUserKey: (userId: string) => axiosInstance.get(`/user/${userId}/externalKey`),
+  getIdentityKeyHistory: (userId: string) => axiosInstance.get(`/user/${userId}/keyHistory`),
   uploadAvatar: (formData: FormData): Promise<IResponse<{ filePath: string }>> =>
     axiosInstance.post('/file/avatar', formData, {
       headers: {
@@ -9,6 +9,7 @@ import { useCallback, useEffect } from 'react'
 import IConversation from '../interfaces/IConversation'
 import useAuthStore from '../stores/useAuthStore'
 import ReceivingCallModal from '../components/ReceivingCallModal'
+import { initTrustedRatchet, isCoreError } from '../utils'
 
 const HomeScreen = () => {
   const { status } = useCallStore()
@@ -18,8 +19,20 @@ const HomeScreen = () => {
   const initRatchet = async () => {
     try {
       const ratchetList = await window.api.getRatchetDetailList(userInfo!.userName)
+      const chatSessions = await window.api.getOldChatSessions(userInfo!.userName)
       for (const ratchet of ratchetList) {
-        await window.loadRatchet(JSON.stringify(ratchet))
+        const ratchetId = await window.loadRatchet(JSON.stringify(ratchet))
+        if (isCoreError(ratchetId)) {
+          console.error('ERROR', ratchetId.code, ratchetId.message)
+          continue
+        }
+        // ratchets encrypted with the bare pin or saved without a mac are rewritten
+        if (ratchetId && (await window.ratchetNeedsMigration(ratchetId))) {
+          const chatSession = chatSessions.find((item) => item.ratchetId === ratchetId)
+          if (!chatSession) continue
+          const ratchetDetail = await window.saveRatchet(ratchetId)
+          await window.api.changeRatchetDetail(chatSession.receiver, ratchetDetail)
+        }
       }
     } catch (error) {
       console.error('ERROR', error)
@@ -46,10 +59,18 @@ const HomeScreen = () => {
 
       if (res) {
         for (const item of res.data) {
-          const ratchetRes = await window.initRatchetFromExternal(
-            JSON.stringify(item.senderKeyBundle),
-            item.ephemeralKey,
-            item.chatSessionId
+          const keyBundle = JSON.stringify(item.senderKeyBundle)
+          const ratchetRes = await initTrustedRatchet(item.senderUserName, keyBundle, () =>
+            window.initRatchetFromExternal(
+              keyBundle,
+              item.ephemeralKey,
+              item.chatSessionId,
+              item.preKeyId,
+              item.oneTimeKeyId,
+              item.pqCipherText,
+              item.protocolVersion,
+              item.senderUserName
+            )
           )
           await chatRepository.completeChatSession(ratchetRes.ratchetId)
           const ratchetDetail = await window.saveRatchet(ratchetRes.ratchetId)
@@ -5,7 +5,12 @@ import { HOME_PAGE, SIGN_IN_PAGE } from '../configs/routes'
 import { toast } from 'react-toastify'
 import authRepository from '../repositories/auth-repository'
 import PinInput from 'react-pin-input'
-import { ACCESS_TOKEN_KEY, AVATAR_DEFAULT, IMAGE_URL } from '../configs/consts'
+import {
+  ACCESS_TOKEN_KEY,
+  AVATAR_DEFAULT,
+  IMAGE_URL,
+  ONE_TIME_KEY_BATCH_SIZE
+} from '../configs/consts'
 import axiosInstance from '../libs/axios'
 import useAuthStore from '../stores/useAuthStore'
 import { hashSync } from 'bcryptjs'
@@ -51,6 +56,7 @@ const SignUpScreen = () => {
     try {
       await window.startUp(pinValue)
       await window.generateInternalKeyBundle()
+      const oneTimeKeys = await window.generateOneTimeKeys(ONE_TIME_KEY_BATCH_SIZE)
       const keyJSON = await window.saveInternalKey()
 
       keyJSON.pin = hashSync(pinValue, 10)
@@ -75,6 +81,7 @@ const SignUpScreen = () => {
         authRepository.getAuthToken(),
         authRepository.uploadExternalKey(externalKeyBundle)
       ])
+      await authRepository.uploadOneTimeKeys(oneTimeKeys)
 
       userInfoRes.data.avatar = userInfoRes.data.avatar
         ? IMAGE_URL + userInfoRes.data.avatar
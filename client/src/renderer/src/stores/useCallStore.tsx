@@ -18,8 +18,9 @@ type IVideoCallStore = {
   setEnableVideo: (value: boolean) => void
   enableAudio: boolean
   setEnableAudio: (value: boolean) => void
-  encKey: string | null
-  setEncKey: (value: string | null) => void
+  // the call keys stay in the core, frames are sealed under this id
+  callId: string | null
+  setCallId: (value: string | null) => void
   turnOffCall: () => void
   initCallType: string | null
   setInitCallType: (type: 'FROM_CALLER' | 'FROM_RECIEVER') => void
@@ -51,8 +52,8 @@ const useCallStore = create<IVideoCallStore>((set, getState) => ({
   setEnableAudio: (value: boolean) => set(() => ({ enableAudio: value })),
   enableVideo: false,
   setEnableVideo: (value: boolean) => set(() => ({ enableVideo: value })),
-  encKey: null,
-  setEncKey: (value: string | null) => set(() => ({ encKey: value })),
+  callId: null,
+  setCallId: (value: string | null) => set(() => ({ callId: value })),
   initCallType: null,
   setInitCallType: (value: 'FROM_CALLER' | 'FROM_RECIEVER') => set(() => ({ initCallType: value })),
   turnOffCall: () => {
@@ -61,6 +62,9 @@ const useCallStore = create<IVideoCallStore>((set, getState) => ({
       getState().myWS!.close()
       set(() => ({ myWS: null }))
     }
+    if (getState().callId) {
+      window.closeVoipSession(getState().callId!)
+    }
     set(() => ({
       voipToken: null,
       status: 'idle',
@@ -68,7 +72,7 @@ const useCallStore = create<IVideoCallStore>((set, getState) => ({
       typeCall: null,
       enableAudio: false,
       enableVideo: false,
-      encKey: null,
+      callId: null,
       initCallType: null
     }))
   }
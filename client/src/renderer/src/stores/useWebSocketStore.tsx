@@ -11,10 +11,12 @@ interface ISocketStoreType {
 const useWebSocketStore = create<ISocketStoreType>((setState, getState) => ({
   websocket: null,
   initWebSocket: () => {
-    const WEB_SOCKET_URL = `${SOCKET_URL}/ws?authToken=${useAuthStore.getState().authToken}`
+    // messages come as binary frames when the server has them enabled, json otherwise
+    const WEB_SOCKET_URL = `${SOCKET_URL}/ws?authToken=${useAuthStore.getState().authToken}&binaryFrames=true`
 
     if (WEB_SOCKET_URL && !getState().websocket) {
       const _websocket = new WebSocket(WEB_SOCKET_URL)
+      _websocket.binaryType = 'arraybuffer'
 
       _websocket.onopen = () => {
         console.log('main ws connected')
@@ -1,4 +1,8 @@
-import { IMAGE_URL } from './configs/consts'
+import { IMAGE_URL, SESSION_RESET_ACK_EVENT, SESSION_RESET_EVENT } from './configs/consts'
+import IAuthFile from './interfaces/IAuthFile'
+import userRepository from './repositories/user-repository'
+import uploadRepository from './repositories/upload-repository'
+import IAttachmentDescriptor from './interfaces/IAttachmentDescriptor'
 
 export const b64toBlob = (b64Data: string, contentType = '', sliceSize = 512) => {
   const byteCharacters = atob(b64Data)
@@ -21,3 +25,111 @@ export const b64toBlob = (b64Data: string, contentType = '', sliceSize = 512) =>
 }
 
 export const getImageFromServer = (filePath: string) => `${IMAGE_URL}` + filePath
+
+// the core library returns its failures instead of throwing them
+export const isCoreError = (res: unknown): res is CoreError =>
+  res instanceof Error && 'code' in res
+
+// the file is encrypted by the core library before upload, the server only gets the blob
+export const uploadAttachment = async (file: File): Promise<IAttachmentDescriptor> => {
+  const content = new Uint8Array(await file.arrayBuffer())
+  const res = await window.encryptAttachment(content, file.type, file.name)
+  if (isCoreError(res)) throw res
+  const formData = new FormData()
+  formData.set('upload', new Blob([res.blob]))
+  const uploadRes = await uploadRepository.uploadFile(formData)
+  return { ...res.descriptor, fileId: uploadRes.data.filePath }
+}
+
+// the blob is checked against the digest of the descriptor before it is decrypted
+export const downloadAttachment = async (descriptor: IAttachmentDescriptor) => {
+  const res = await uploadRepository.downloadFile(descriptor.fileId)
+  const blob = new Uint8Array(await (res.data as Blob).arrayBuffer())
+  const content = await window.decryptAttachment(blob, JSON.stringify(descriptor))
+  if (isCoreError(content)) throw content
+  return new Blob([content], { type: descriptor.contentType })
+}
+
+// attachment messages keep the descriptor as json, older ones key:fileId:mimeType[:name:size]
+export const parseAttachmentDescriptor = (filePath: string): IAttachmentDescriptor | null =>
+  filePath.startsWith('{') ? (JSON.parse(filePath) as IAttachmentDescriptor) : null
+
+// the internal key also carries the trusted identity keys of contacts
+export const persistInternalKey = async () => {
+  const keyJSON = await window.saveInternalKey()
+  const keySaved = JSON.parse(await window.api.readAuthFile()) as IAuthFile
+  keyJSON.pin = keySaved.pin
+  await window.api.writeAuthFile(keyJSON)
+}
+
+// no session is set up with a changed identity key until the user accepts it
+export const initTrustedRatchet = async <T extends { identityKeyChanged?: boolean }>(
+  username: string,
+  keyBundle: string,
+  init: () => Promise<T>
+): Promise<Exclude<T, CoreError>> => {
+  let res = await init()
+  if (res?.identityKeyChanged) {
+    const accepted = window.confirm(
+      `Khóa định danh của ${username} đã thay đổi. Bạn có muốn tin tưởng khóa mới không?`
+    )
+    if (!accepted) throw new Error(`Identity key of ${username} changed`)
+    await window.acceptIdentityKeyChange(username, keyBundle)
+    res = await init()
+  }
+  if (isCoreError(res)) throw res
+  await persistInternalKey()
+  return res as Exclude<T, CoreError>
+}
+
+// a reset ratchet keeps the chat session id, the chat file is only missing when it was lost too
+const persistResetRatchet = async (username: string, ratchetId: string) => {
+  const ratchetDetail = await window.saveRatchet(ratchetId)
+  if (await window.api.getRatchetId(username)) {
+    await window.api.changeRatchetDetail(username, ratchetDetail)
+  } else {
+    await window.api.createRatchetFile(username, ratchetDetail, ratchetId)
+  }
+}
+
+// the side that cannot decrypt anymore starts over with a fresh handshake
+export const resetSession = async (
+  websocket: WebSocket | null,
+  username: string,
+  ratchetId: string,
+  failedIndexes: number[]
+) => {
+  const res = await userRepository.getExternalUserKey(username)
+  const keyBundle = JSON.stringify(res.data)
+  const resetRes = await initTrustedRatchet(username, keyBundle, () =>
+    window.initSessionReset(keyBundle, username, ratchetId, failedIndexes)
+  )
+  if (!resetRes) throw new Error(`Cannot reset session with ${username}`)
+  await persistResetRatchet(username, resetRes.ratchetId)
+  websocket?.send(
+    JSON.stringify({
+      type: SESSION_RESET_EVENT,
+      chatSessionId: resetRes.ratchetId,
+      additionalData: resetRes.reset
+    })
+  )
+}
+
+// the other side reports back which of our messages it will never read
+// eslint-disable-next-line
+export const acceptSessionReset = async (websocket: WebSocket | null, username: string, reset: any) => {
+  const keyBundle = JSON.stringify(reset.senderKeyBundle)
+  const acceptRes = await initTrustedRatchet(username, keyBundle, () =>
+    window.acceptSessionReset(JSON.stringify(reset), keyBundle, username)
+  )
+  if (!acceptRes) throw new Error(`Cannot accept session reset of ${username}`)
+  await persistResetRatchet(username, acceptRes.ratchetId)
+  websocket?.send(
+    JSON.stringify({
+      type: SESSION_RESET_ACK_EVENT,
+      chatSessionId: acceptRes.ratchetId,
+      additionalData: { unrecoverableIndexes: acceptRes.unrecoverableIndexes }
+    })
+  )
+  return acceptRes.unrecoverableIndexes
+}
@@ -0,0 +1,227 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/aes"
+	"lidx-core-lib/crypto/kdf"
+)
+
+// An attachment is encrypted under a random key of its own before it is
+// uploaded, the server only ever stores the blob. From v2 on the blob is
+//
+//	version 1 byte
+//	stream  the content sealed as an aes stream
+//
+// v1 blobs are still read, they were
+//
+//	version   1 byte
+//	chunkSize uint32, plain text size of every chunk but the last
+//	chunks    each sealed in the v3 cipher format, the associated data is the
+//	          header, the chunk index and whether it is the last chunk
+//
+// The descriptor travels inside a ratchet message and holds what is needed to
+// find, check and open the blob
+const (
+	ATTACHMENT_VERSION_1 byte = 0x01
+	ATTACHMENT_VERSION_2 byte = 0x02
+)
+
+const (
+	DEFAULT_CHUNK_SIZE = aes.DEFAULT_STREAM_CHUNK_SIZE
+	MAX_THUMBNAIL_SIZE = 64 * 1024
+	v1HeaderSize       = 5
+	// v3 cipher format overhead of every v1 chunk, format byte, nonce and tag
+	v1ChunkOverhead = 1 + 12 + 16
+)
+
+type Descriptor struct {
+	// Id the server gave the uploaded blob, set once the upload is done
+	FileId      string
+	Key         []byte
+	Digest      []byte
+	Size        uint64
+	ContentType string
+	FileName    string
+	Thumbnail   []byte
+}
+
+type DescriptorDto struct {
+	FileId      string `json:"fileId"`
+	Key         string `json:"key"`
+	Digest      string `json:"digest"`
+	Size        uint64 `json:"size"`
+	ContentType string `json:"contentType"`
+	FileName    string `json:"fileName,omitempty"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+}
+
+// Encrypt seals content under a fresh key, the returned descriptor has no
+// file id until the blob is uploaded
+func Encrypt(content []byte, contentType string, fileName string, thumbnail []byte) ([]byte, *Descriptor, error) {
+	if len(thumbnail) > MAX_THUMBNAIL_SIZE {
+		return nil, nil, fmt.Errorf("Thumbnail is larger than %d bytes", MAX_THUMBNAIL_SIZE)
+	}
+	key, err := common.RandomByt(kdf.KEY_SIZE)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot generate attachment key: %w", err)
+	}
+	cipherKey, err := kdf.DeriveKey(key, kdf.LABEL_ATTACHMENT)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunkCount := len(content)/DEFAULT_CHUNK_SIZE + 1
+	var blob bytes.Buffer
+	blob.Grow(1 + aes.STREAM_HEADER_SIZE + len(content) + chunkCount*aes.STREAM_TAG_SIZE)
+	blob.WriteByte(ATTACHMENT_VERSION_2)
+	stream, err := aes.NewStreamWriter(&blob, cipherKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot encrypt attachment: %w", err)
+	}
+	if _, err := stream.Write(content); err != nil {
+		return nil, nil, fmt.Errorf("Cannot encrypt attachment: %w", err)
+	}
+	if err := stream.Close(); err != nil {
+		return nil, nil, fmt.Errorf("Cannot encrypt attachment: %w", err)
+	}
+	digest := sha256.Sum256(blob.Bytes())
+	return blob.Bytes(), &Descriptor{
+		Key:         key,
+		Digest:      digest[:],
+		Size:        uint64(len(content)),
+		ContentType: contentType,
+		FileName:    fileName,
+		Thumbnail:   thumbnail,
+	}, nil
+}
+
+// Decrypt checks the downloaded blob against the digest before opening it,
+// nothing is returned unless every chunk opens and the size matches
+func (d *Descriptor) Decrypt(blob []byte) ([]byte, error) {
+	digest := sha256.Sum256(blob)
+	if !bytes.Equal(digest[:], d.Digest) {
+		return nil, ErrDigestMismatch
+	}
+	cipherKey, err := kdf.DeriveKey(d.Key, kdf.LABEL_ATTACHMENT)
+	if err != nil {
+		return nil, err
+	}
+	// The plain text is never larger than the blob, whatever size the
+	// descriptor claims
+	capacity := min(d.Size, uint64(len(blob)))
+	var content []byte
+	switch {
+	case len(blob) > 0 && blob[0] == ATTACHMENT_VERSION_2:
+		content, err = decryptV2(blob[1:], cipherKey, capacity)
+	case len(blob) > 0 && blob[0] == ATTACHMENT_VERSION_1:
+		content, err = decryptV1(blob, cipherKey, capacity)
+	default:
+		return nil, fmt.Errorf("%w: unknown attachment format", ErrInvalidAttachment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(content)) != d.Size {
+		return nil, fmt.Errorf("%w: expected %d bytes but got %d", ErrInvalidAttachment, d.Size, len(content))
+	}
+	return content, nil
+}
+
+func decryptV2(sealed []byte, cipherKey []byte, capacity uint64) ([]byte, error) {
+	stream, err := aes.NewStreamReader(bytes.NewReader(sealed), cipherKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAttachment, err)
+	}
+	content := bytes.NewBuffer(make([]byte, 0, capacity))
+	if _, err := content.ReadFrom(stream); err != nil {
+		if errors.Is(err, aes.ErrStreamAuth) {
+			return nil, fmt.Errorf("Cannot decrypt attachment: %w: %w", common.ErrDecryptFailed, err)
+		}
+		return nil, fmt.Errorf("Cannot decrypt attachment: %w", err)
+	}
+	return content.Bytes(), nil
+}
+
+func decryptV1(blob []byte, cipherKey []byte, capacity uint64) ([]byte, error) {
+	if len(blob) < v1HeaderSize {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidAttachment)
+	}
+	header := blob[:v1HeaderSize]
+	chunkSize := int(binary.BigEndian.Uint32(header[1:]))
+	if chunkSize == 0 || chunkSize > aes.MAX_STREAM_CHUNK_SIZE {
+		return nil, fmt.Errorf("%w: invalid chunk size %d", ErrInvalidAttachment, chunkSize)
+	}
+	content := make([]byte, 0, capacity)
+	rest := blob[v1HeaderSize:]
+	for index := uint64(0); ; index++ {
+		sealedSize := min(len(rest), chunkSize+v1ChunkOverhead)
+		last := sealedSize == len(rest)
+		chunk, err := common.OpenWithKey(rest[:sealedSize], cipherKey, chunkAssociatedData(header, index, last))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decrypt attachment chunk %d: %w", index, err)
+		}
+		content = append(content, chunk...)
+		rest = rest[sealedSize:]
+		if last {
+			return content, nil
+		}
+	}
+}
+
+func chunkAssociatedData(header []byte, index uint64, last bool) []byte {
+	associatedData := binary.BigEndian.AppendUint64(bytes.Clone(header), index)
+	if last {
+		return append(associatedData, 0x01)
+	}
+	return append(associatedData, 0x00)
+}
+
+func NewDescriptorFromJson(jsonString string) (*Descriptor, error) {
+	var descriptorDto DescriptorDto
+	err := json.Unmarshal([]byte(jsonString), &descriptorDto)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read descriptor: %w", ErrInvalidAttachment, err)
+	}
+	return NewDescriptorFromDto(&descriptorDto)
+}
+
+func NewDescriptorFromDto(descriptorDto *DescriptorDto) (*Descriptor, error) {
+	key := common.DecodeToByte(descriptorDto.Key)
+	if len(key) != kdf.KEY_SIZE {
+		return nil, fmt.Errorf("%w: invalid key size %d", ErrInvalidAttachment, len(key))
+	}
+	digest := common.DecodeToByte(descriptorDto.Digest)
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("%w: invalid digest size %d", ErrInvalidAttachment, len(digest))
+	}
+	thumbnail := common.DecodeToByte(descriptorDto.Thumbnail)
+	if len(thumbnail) > MAX_THUMBNAIL_SIZE {
+		return nil, fmt.Errorf("%w: thumbnail is larger than %d bytes", ErrInvalidAttachment, MAX_THUMBNAIL_SIZE)
+	}
+	return &Descriptor{
+		FileId:      descriptorDto.FileId,
+		Key:         key,
+		Digest:      digest,
+		Size:        descriptorDto.Size,
+		ContentType: descriptorDto.ContentType,
+		FileName:    descriptorDto.FileName,
+		Thumbnail:   thumbnail,
+	}, nil
+}
+
+func (d *Descriptor) ToDto() *DescriptorDto {
+	return &DescriptorDto{
+		FileId:      d.FileId,
+		Key:         common.EncodeToString(d.Key),
+		Digest:      common.EncodeToString(d.Digest),
+		Size:        d.Size,
+		ContentType: d.ContentType,
+		FileName:    d.FileName,
+		Thumbnail:   common.EncodeToString(d.Thumbnail),
+	}
+}
@@ -0,0 +1,12 @@
+package attachment
+
+import "errors"
+
+var (
+	// ErrDigestMismatch is returned when the downloaded blob is not the one
+	// the descriptor was made for
+	ErrDigestMismatch = errors.New("Attachment digest does not match")
+	// ErrInvalidAttachment is returned for a blob or a descriptor that cannot
+	// be read, a truncated blob or a size that does not match
+	ErrInvalidAttachment = errors.New("Invalid attachment")
+)
@@ -0,0 +1,14 @@
+package common
+
+import "errors"
+
+// Failures callers of the core library tell apart with errors.Is, the
+// returned errors wrap them with the details
+var (
+	// ErrDecryptFailed is returned when a cipher text does not open, it was
+	// altered, sealed under another key or associated data, or is no cipher
+	// text at all
+	ErrDecryptFailed = errors.New("Cannot decrypt")
+	// ErrWrongPIN is returned when a store does not open with the given PIN
+	ErrWrongPIN = errors.New("Wrong PIN")
+)
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"lidx-core-lib/crypto/kdf"
+	"sync"
+)
+
+const (
+	PIN_KDF_ARGON2ID = "argon2id"
+	// RFC 9106 second recommended option, with a single lane since the wasm
+	// build runs on one thread
+	DEFAULT_PIN_KDF_TIME    uint32 = 3
+	DEFAULT_PIN_KDF_MEMORY  uint32 = 64 * 1024
+	DEFAULT_PIN_KDF_THREADS uint8  = 1
+	pinKdfSaltSize                 = 16
+	// Upper bounds on the cost a store may ask for, memory is in KiB
+	maxPinKdfTime   uint32 = 16
+	maxPinKdfMemory uint32 = 1024 * 1024
+)
+
+// PinKdfStore is kept next to the keys of a store, stores without one were
+// written when the PIN itself was the key material
+type PinKdfStore struct {
+	Algorithm string `json:"algorithm"`
+	Salt      string `json:"salt"`
+	Time      uint32 `json:"time"`
+	Memory    uint32 `json:"memory"`
+	Threads   uint8  `json:"threads"`
+	// Shared stores take their key from the PIN key with HKDF and the store
+	// id, so any number of them costs a single Argon2id run
+	Shared bool `json:"shared,omitempty"`
+}
+
+// PinKdf turns the PIN into the key a store is encrypted with, the key is
+// cached so saving the same store again does not pay for Argon2id every time.
+// Only a keyed hash of the PIN is kept to tell whether it changed
+type PinKdf struct {
+	mu       sync.Mutex
+	params   PinKdfStore
+	pinMac   []byte
+	storeKey []byte
+}
+
+// NewPinKdf uses a fresh random salt and the default cost
+func NewPinKdf() (*PinKdf, error) {
+	salt, err := RandomByt(pinKdfSaltSize)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot generate salt: %w", err)
+	}
+	return &PinKdf{
+		params: PinKdfStore{
+			Algorithm: PIN_KDF_ARGON2ID,
+			Salt:      EncodeToString(salt),
+			Time:      DEFAULT_PIN_KDF_TIME,
+			Memory:    DEFAULT_PIN_KDF_MEMORY,
+			Threads:   DEFAULT_PIN_KDF_THREADS,
+		},
+	}, nil
+}
+
+func LoadPinKdf(store *PinKdfStore) (*PinKdf, error) {
+	if store.Algorithm != PIN_KDF_ARGON2ID {
+		return nil, fmt.Errorf("Unknown PIN KDF %s", store.Algorithm)
+	}
+	if len(DecodeToByte(store.Salt)) == 0 {
+		return nil, fmt.Errorf("Missing PIN KDF salt")
+	}
+	if store.Time == 0 || store.Time > maxPinKdfTime || store.Threads == 0 || store.Memory < 8*uint32(store.Threads) || store.Memory > maxPinKdfMemory {
+		return nil, fmt.Errorf("Invalid PIN KDF parameters")
+	}
+	if !store.Shared {
+		return &PinKdf{params: *store}, nil
+	}
+	sharedPinKdfs.Lock()
+	defer sharedPinKdfs.Unlock()
+	if pinKdf, ok := sharedPinKdfs.byParams[*store]; ok {
+		return pinKdf, nil
+	}
+	pinKdf := &PinKdf{params: *store}
+	sharedPinKdfs.byParams[*store] = pinKdf
+	if sharedPinKdfs.current == nil {
+		sharedPinKdfs.current = pinKdf
+	}
+	return pinKdf, nil
+}
+
+// sharedPinKdfs keeps one PinKdf per set of shared parameters, stores loaded
+// with the same salt reuse the key it derived
+var sharedPinKdfs = struct {
+	sync.Mutex
+	byParams map[PinKdfStore]*PinKdf
+	current  *PinKdf
+}{byParams: map[PinKdfStore]*PinKdf{}}
+
+// SharedPinKdf is the PinKdf new shared stores are written with, the one of
+// the first shared store loaded or else a fresh one
+func SharedPinKdf() (*PinKdf, error) {
+	sharedPinKdfs.Lock()
+	defer sharedPinKdfs.Unlock()
+	if sharedPinKdfs.current != nil {
+		return sharedPinKdfs.current, nil
+	}
+	pinKdf, err := NewPinKdf()
+	if err != nil {
+		return nil, err
+	}
+	pinKdf.params.Shared = true
+	sharedPinKdfs.byParams[pinKdf.params] = pinKdf
+	sharedPinKdfs.current = pinKdf
+	return pinKdf, nil
+}
+
+// DeriveKey returns the key derived from PIN, it is only computed again when
+// called with a different PIN
+func (p *PinKdf) DeriveKey(PIN []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	salt := DecodeToByte(p.params.Salt)
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(PIN)
+	pinMac := mac.Sum(nil)
+	if p.storeKey != nil && hmac.Equal(p.pinMac, pinMac) {
+		return p.storeKey
+	}
+	p.pinMac = pinMac
+	p.storeKey = kdf.DoPinKDF(PIN, salt, p.params.Time, p.params.Memory, p.params.Threads)
+	return p.storeKey
+}
+
+// DeriveStoreKey returns the key of the store named storeId, that is the key
+// from DeriveKey unless the PinKdf is shared
+func (p *PinKdf) DeriveStoreKey(PIN []byte, storeId string) ([]byte, error) {
+	storeKey := p.DeriveKey(PIN)
+	if !p.params.Shared {
+		return storeKey, nil
+	}
+	return kdf.DeriveKey(storeKey, kdf.LABEL_STORE_KEY+storeId)
+}
+
+// IsShared tells whether stores written with p get their own key from it
+func (p *PinKdf) IsShared() bool {
+	return p.params.Shared
+}
+
+func (p *PinKdf) Save() *PinKdfStore {
+	params := p.params
+	return &params
+}
@@ -92,34 +92,143 @@ func SkipError(value interface{}, _ error) interface{} {
 	return value
 }
 
-func EncryptAndHash(plainText, key []byte) ([]byte, error) {
+// Cipher text formats written by EncryptData and friends
+//
+//	v1: sha256(plain text) | nonce | AES-128-GCM output, no version byte
+//	v2: 0x02 | nonce | AES-128-GCM output
+//	v3: 0x03 | nonce | AES-256-GCM output
+//
+// v1 leaks whether two cipher texts carry the same plain text, it is only
+// read now so older stores and messages still open. v2 is still written for
+// sessions of protocol v1
+const (
+	CIPHER_FORMAT_V2 byte = 0x02
+	CIPHER_FORMAT_V3 byte = 0x03
+	gcmNonceSize          = 12
+	gcmTagSize            = 16
+	v1HashSize            = 32
+)
+
+// EncryptData seals stored data, the AES-256 key is derived from key under
+// the storage label
+func EncryptData(plainText, key []byte) ([]byte, error) {
+	storageKey, err := kdf.DeriveKey(key, kdf.LABEL_STORAGE)
+	if err != nil {
+		return nil, err
+	}
+	return SealWithKey(plainText, storageKey, nil)
+}
+
+// DecryptData reads every format EncryptData has ever written
+func DecryptData(cipherText, key []byte) ([]byte, error) {
+	if len(cipherText) > 0 && cipherText[0] == CIPHER_FORMAT_V3 {
+		storageKey, err := kdf.DeriveKey(key, kdf.LABEL_STORAGE)
+		if err != nil {
+			return nil, err
+		}
+		plainText, err := OpenWithKey(cipherText, storageKey, nil)
+		if err == nil {
+			return plainText, nil
+		}
+	}
+	return LegacyDecryptWithAD(cipherText, key, nil)
+}
+
+// SealWithKey writes the v3 format with key used as the AES-256 key as is, it
+// has to be a derived 32 byte key
+func SealWithKey(plainText, key, associatedData []byte) ([]byte, error) {
+	if len(key) != kdf.KEY_SIZE {
+		return nil, fmt.Errorf("Invalid key size %d", len(key))
+	}
+	cipherText, nonce, err := aes.AesGCMEncryptWithAD(key, plainText, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt: %w", err)
+	}
+	return ConcatBytes([]byte{CIPHER_FORMAT_V3}, nonce, cipherText), nil
+}
+
+// OpenWithKey only reads the v3 format
+func OpenWithKey(cipherText, key, associatedData []byte) ([]byte, error) {
+	if len(key) != kdf.KEY_SIZE {
+		return nil, fmt.Errorf("Invalid key size %d", len(key))
+	}
+	if len(cipherText) < 1+gcmNonceSize+gcmTagSize || cipherText[0] != CIPHER_FORMAT_V3 {
+		return nil, fmt.Errorf("%w: not a v3 cipher text", ErrDecryptFailed)
+	}
+	nonce := cipherText[1 : 1+gcmNonceSize]
+	plainText, err := aes.AesGCMDecryptWithAD(key, cipherText[1+gcmNonceSize:], nonce, associatedData)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plainText, nil
+}
+
+// LegacyEncryptWithAD writes the v2 format, the messages of protocol v1
+// sessions are still sealed with it
+func LegacyEncryptWithAD(plainText, key, associatedData []byte) ([]byte, error) {
 	encrypKey, err := kdf.DoKDF(key)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot make pass phase")
 	}
-	cipherText, nonce, err := aes.AesGCMEncrypt(encrypKey, plainText)
+	cipherText, nonce, err := aes.AesGCMEncryptWithAD(encrypKey, plainText, associatedData)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot encrypt ", err)
+		return nil, fmt.Errorf("Cannot encrypt: %w", err)
 	}
-	hash := sha256.Sum256(plainText)
-	return ConcatBytes(hash[:], nonce, cipherText), nil
+	return ConcatBytes([]byte{CIPHER_FORMAT_V2}, nonce, cipherText), nil
 }
 
-func DecryptHashedData(cipherText, key []byte) ([]byte, error) {
+// LegacyDecryptWithAD reads the v2 and v1 formats, a v1 hash may start with
+// the v2 version byte so v1 is still tried when v2 does not open
+func LegacyDecryptWithAD(cipherText, key, associatedData []byte) ([]byte, error) {
 	encrypKey, err := kdf.DoKDF(key)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot make pass phase")
 	}
-	hash := cipherText[0:32]
-	nonce := cipherText[32:44]
-	cipherData := cipherText[44:]
-	plainText, err := aes.AesGCMDecrypt(encrypKey, cipherData, nonce)
+	if len(cipherText) >= 1+gcmNonceSize+gcmTagSize && cipherText[0] == CIPHER_FORMAT_V2 {
+		nonce := cipherText[1 : 1+gcmNonceSize]
+		plainText, err := aes.AesGCMDecryptWithAD(encrypKey, cipherText[1+gcmNonceSize:], nonce, associatedData)
+		if err == nil {
+			return plainText, nil
+		}
+	}
+	return decryptV1(encrypKey, cipherText, associatedData)
+}
+
+func decryptV1(encrypKey, cipherText, associatedData []byte) ([]byte, error) {
+	if len(cipherText) < v1HashSize+gcmNonceSize {
+		return nil, fmt.Errorf("%w: cipher text too short", ErrDecryptFailed)
+	}
+	hash := cipherText[0:v1HashSize]
+	nonce := cipherText[v1HashSize : v1HashSize+gcmNonceSize]
+	cipherData := cipherText[v1HashSize+gcmNonceSize:]
+	plainText, err := aes.AesGCMDecryptWithAD(encrypKey, cipherData, nonce, associatedData)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot decrypt")
+		return nil, ErrDecryptFailed
 	}
 	plainHash := sha256.Sum256(plainText)
 	if bytes.Compare(hash, plainHash[:]) != 0 {
-		return nil, fmt.Errorf("Hash not equals")
+		return nil, fmt.Errorf("%w: hash not equals", ErrDecryptFailed)
 	}
 	return plainText, nil
 }
+
+// EncryptAndHash writes the v1 format.
+//
+// Deprecated: v1 leaks a hash of the plain text, use EncryptData.
+func EncryptAndHash(plainText, key []byte) ([]byte, error) {
+	encrypKey, err := kdf.DoKDF(key)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot make pass phase")
+	}
+	cipherText, nonce, err := aes.AesGCMEncrypt(encrypKey, plainText)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt: %w", err)
+	}
+	hash := sha256.Sum256(plainText)
+	return ConcatBytes(hash[:], nonce, cipherText), nil
+}
+
+// Deprecated: use DecryptData, which reads both formats.
+func DecryptHashedData(cipherText, key []byte) ([]byte, error) {
+	return DecryptData(cipherText, key)
+}
@@ -9,9 +9,15 @@ import (
 )
 
 func AesGCMEncrypt(key, plainText []byte) ([]byte, []byte, error) {
+	return AesGCMEncryptWithAD(key, plainText, nil)
+}
+
+// AesGCMEncryptWithAD also authenticates associatedData, the same data has to
+// be given back to decrypt
+func AesGCMEncryptWithAD(key, plainText, associatedData []byte) ([]byte, []byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("", err)
+		return nil, nil, fmt.Errorf("%w", err)
 	}
 
 	nonce := make([]byte, 12)
@@ -21,23 +27,27 @@ func AesGCMEncrypt(key, plainText []byte) ([]byte, []byte, error) {
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, nil, fmt.Errorf("", err)
+		return nil, nil, fmt.Errorf("%w", err)
 	}
 
-	ciphertext := aesgcm.Seal(nil, nonce, plainText, nil)
+	ciphertext := aesgcm.Seal(nil, nonce, plainText, associatedData)
 	return ciphertext, nonce, nil
 }
 
 func AesGCMDecrypt(key, cipherText, nonce []byte) ([]byte, error) {
+	return AesGCMDecryptWithAD(key, cipherText, nonce, nil)
+}
+
+func AesGCMDecryptWithAD(key, cipherText, nonce, associatedData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
-	return aesgcm.Open(nil, nonce, cipherText, nil)
+	return aesgcm.Open(nil, nonce, cipherText, associatedData)
 }
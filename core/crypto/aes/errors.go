@@ -0,0 +1,11 @@
+package aes
+
+import "errors"
+
+var (
+	// ErrStreamAuth is returned when a chunk of a stream does not open, it was
+	// altered, moved, or the stream was cut short
+	ErrStreamAuth = errors.New("Cannot authenticate stream chunk")
+	// ErrInvalidStream is returned for a stream header that cannot be read
+	ErrInvalidStream = errors.New("Invalid stream")
+)
@@ -0,0 +1,320 @@
+package aes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A stream is sealed chunk by chunk so it never has to fit in memory, it
+// follows the STREAM construction of Hoang, Reyhanitabar, Rogaway and Vizár
+//
+//	version     1 byte
+//	chunkSize   uint32, plain text size of every chunk but the last
+//	noncePrefix 7 random bytes
+//	chunks      AES-256-GCM, chunkSize + 16 bytes each, the last may be shorter
+//
+// The nonce of a chunk is the prefix, the chunk index as uint32 and 0x01 for
+// the last chunk or 0x00 otherwise, the header is the associated data of every
+// chunk. Moving a chunk changes its index, and a stream cut at a chunk
+// boundary fails as its new last chunk was not sealed as the last one. Chunks
+// open on their own so a range can be read without the rest of the stream
+const STREAM_VERSION_1 byte = 0x01
+
+const (
+	DEFAULT_STREAM_CHUNK_SIZE = 64 * 1024
+	MAX_STREAM_CHUNK_SIZE     = 16 * 1024 * 1024
+	STREAM_HEADER_SIZE        = 12
+	STREAM_TAG_SIZE           = 16
+	streamNoncePrefixSize     = 7
+)
+
+type streamCipher struct {
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+}
+
+func newStreamCipher(key, header []byte) (*streamCipher, error) {
+	if len(header) != STREAM_HEADER_SIZE || header[0] != STREAM_VERSION_1 {
+		return nil, fmt.Errorf("%w: unknown stream format", ErrInvalidStream)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[1:5]))
+	if chunkSize == 0 || chunkSize > MAX_STREAM_CHUNK_SIZE {
+		return nil, fmt.Errorf("%w: invalid chunk size %d", ErrInvalidStream, chunkSize)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &streamCipher{aead: aesgcm, header: header, chunkSize: chunkSize}, nil
+}
+
+func (s *streamCipher) sealedChunkSize() int {
+	return s.chunkSize + STREAM_TAG_SIZE
+}
+
+func (s *streamCipher) nonce(index uint64, last bool) ([]byte, error) {
+	if index > math.MaxUint32 {
+		return nil, fmt.Errorf("Stream is longer than %d chunks", uint64(math.MaxUint32)+1)
+	}
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, s.header[5:]...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(index))
+	if last {
+		return append(nonce, 0x01), nil
+	}
+	return append(nonce, 0x00), nil
+}
+
+func (s *streamCipher) seal(chunk []byte, index uint64, last bool) ([]byte, error) {
+	nonce, err := s.nonce(index, last)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nil, nonce, chunk, s.header), nil
+}
+
+func (s *streamCipher) open(sealed []byte, index uint64, last bool) ([]byte, error) {
+	nonce, err := s.nonce(index, last)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := s.aead.Open(nil, nonce, sealed, s.header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: chunk %d", ErrStreamAuth, index)
+	}
+	return chunk, nil
+}
+
+// StreamWriter seals what is written to it into w, Close has to be called to
+// seal the last chunk
+type StreamWriter struct {
+	w      io.Writer
+	cipher *streamCipher
+	buffer []byte
+	index  uint64
+	closed bool
+}
+
+func NewStreamWriter(w io.Writer, key []byte) (*StreamWriter, error) {
+	return NewStreamWriterWithChunkSize(w, key, DEFAULT_STREAM_CHUNK_SIZE)
+}
+
+// NewStreamWriterWithChunkSize writes the header right away, key has to be a
+// derived 32 byte key and may seal more than one stream
+func NewStreamWriterWithChunkSize(w io.Writer, key []byte, chunkSize int) (*StreamWriter, error) {
+	if chunkSize <= 0 || chunkSize > MAX_STREAM_CHUNK_SIZE {
+		return nil, fmt.Errorf("Invalid chunk size %d", chunkSize)
+	}
+	header := make([]byte, STREAM_HEADER_SIZE)
+	header[0] = STREAM_VERSION_1
+	binary.BigEndian.PutUint32(header[1:5], uint32(chunkSize))
+	if _, err := io.ReadFull(rand.Reader, header[5:]); err != nil {
+		return nil, fmt.Errorf("Cannot generate nonce prefix: %w", err)
+	}
+	streamCipher, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{
+		w:      w,
+		cipher: streamCipher,
+		buffer: make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, fmt.Errorf("Stream is closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data shows it is not the last
+		if len(s.buffer) == s.cipher.chunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), s.cipher.chunkSize-len(s.buffer))
+		s.buffer = append(s.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk, w itself is left open
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+func (s *StreamWriter) flush(last bool) error {
+	sealed, err := s.cipher.seal(s.buffer, s.index, last)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+	s.index++
+	s.buffer = s.buffer[:0]
+	return nil
+}
+
+// StreamReader opens a stream written by StreamWriter from its start, every
+// chunk is authenticated before any of it is returned and the end of the
+// stream only reads as io.EOF when the last chunk was sealed as the last
+type StreamReader struct {
+	r      io.Reader
+	cipher *streamCipher
+	// Sealed bytes read so far, one byte more than a chunk tells whether
+	// another chunk follows
+	buffer []byte
+	filled int
+	plain  []byte
+	index  uint64
+	done   bool
+}
+
+func NewStreamReader(r io.Reader, key []byte) (*StreamReader, error) {
+	header := make([]byte, STREAM_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: cannot read header: %w", ErrInvalidStream, err)
+	}
+	streamCipher, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{
+		r:      r,
+		cipher: streamCipher,
+		buffer: make([]byte, streamCipher.sealedChunkSize()+1),
+	}, nil
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *StreamReader) nextChunk() error {
+	n, err := io.ReadFull(s.r, s.buffer[s.filled:])
+	s.filled += n
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := s.filled < len(s.buffer)
+	chunkEnd := min(s.filled, s.cipher.sealedChunkSize())
+	chunk, err := s.cipher.open(s.buffer[:chunkEnd], s.index, last)
+	if err != nil {
+		return err
+	}
+	s.filled = copy(s.buffer, s.buffer[chunkEnd:s.filled])
+	s.plain = chunk
+	s.index++
+	s.done = last
+	return nil
+}
+
+// StreamReaderAt reads ranges of a stream of a known size, only the chunks a
+// range covers are read and opened. A stream cut short is only noticed when
+// its last chunk is read
+type StreamReaderAt struct {
+	r          io.ReaderAt
+	cipher     *streamCipher
+	sealedSize int64
+	chunkCount int64
+	size       int64
+}
+
+// NewStreamReaderAt takes the size of the whole stream, header included
+func NewStreamReaderAt(r io.ReaderAt, sealedSize int64, key []byte) (*StreamReaderAt, error) {
+	header := make([]byte, STREAM_HEADER_SIZE)
+	if n, err := r.ReadAt(header, 0); n < len(header) {
+		return nil, fmt.Errorf("%w: cannot read header: %w", ErrInvalidStream, err)
+	}
+	streamCipher, err := newStreamCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+	bodySize := sealedSize - STREAM_HEADER_SIZE
+	sealedChunkSize := int64(streamCipher.sealedChunkSize())
+	chunkCount := (bodySize + sealedChunkSize - 1) / sealedChunkSize
+	if bodySize < STREAM_TAG_SIZE || bodySize-(chunkCount-1)*sealedChunkSize < STREAM_TAG_SIZE {
+		return nil, fmt.Errorf("%w: stream is truncated", ErrStreamAuth)
+	}
+	return &StreamReaderAt{
+		r:          r,
+		cipher:     streamCipher,
+		sealedSize: sealedSize,
+		chunkCount: chunkCount,
+		size:       bodySize - chunkCount*STREAM_TAG_SIZE,
+	}, nil
+}
+
+// Size is the size of the plain text
+func (s *StreamReaderAt) Size() int64 {
+	return s.size
+}
+
+// ReadAt reads plain text from off, it returns io.EOF with what is left when
+// the range goes past the end
+func (s *StreamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset %d", off)
+	}
+	chunkSize := int64(s.cipher.chunkSize)
+	n := 0
+	for n < len(p) && off < s.size {
+		index := off / chunkSize
+		chunk, err := s.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], chunk[off-index*chunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *StreamReaderAt) readChunk(index int64) ([]byte, error) {
+	sealedChunkSize := int64(s.cipher.sealedChunkSize())
+	start := STREAM_HEADER_SIZE + index*sealedChunkSize
+	sealed := make([]byte, min(sealedChunkSize, s.sealedSize-start))
+	if n, err := s.r.ReadAt(sealed, start); n < len(sealed) {
+		return nil, err
+	}
+	return s.cipher.open(sealed, uint64(index), index == s.chunkCount-1)
+}
@@ -0,0 +1,118 @@
+package ecc
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"lidx-core-lib/common"
+	"math/big"
+)
+
+// Curve25519 keys are kept in their Ed25519 form so one key can sign, for key
+// agreement both sides are mapped onto X25519 the same way libsodium does it
+
+type Curve25519PublicKey struct {
+	publicKey ed25519.PublicKey
+}
+
+type Curve25519PrivateKey struct {
+	privateKey ed25519.PrivateKey
+}
+
+var curve25519Prime, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+func generateCurve25519KeyPair() *ECKeyPair {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	return &ECKeyPair{
+		privateKey: &Curve25519PrivateKey{privateKey: priv},
+		publicKey:  &Curve25519PublicKey{publicKey: pub},
+	}
+}
+
+func deserializeCurve25519PublicKey(input []byte) (IECPublicKey, error) {
+	if len(input) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: cannot read public key", ErrInvalidKey)
+	}
+	return &Curve25519PublicKey{
+		publicKey: append(ed25519.PublicKey(nil), input...),
+	}, nil
+}
+
+func deserializeCurve25519PrivateKey(input []byte) (IECPrivateKey, error) {
+	if len(input) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%w: cannot read private key", ErrInvalidKey)
+	}
+	return &Curve25519PrivateKey{
+		privateKey: ed25519.NewKeyFromSeed(input),
+	}, nil
+}
+
+func (pub *Curve25519PublicKey) Serialize() ([]byte, error) {
+	return tagKey(SUITE_CURVE25519, pub.publicKey), nil
+}
+
+func (pub *Curve25519PublicKey) Suite() KeySuite {
+	return SUITE_CURVE25519
+}
+
+// x25519 maps the Edwards point onto the Montgomery curve, u = (1 + y) / (1 - y)
+func (pub *Curve25519PublicKey) x25519() (*ecdh.PublicKey, error) {
+	le := make([]byte, len(pub.publicKey))
+	for i, b := range pub.publicKey {
+		le[len(le)-1-i] = b
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, curve25519Prime)
+	if denominator.ModInverse(denominator, curve25519Prime) == nil {
+		return nil, fmt.Errorf("%w: not on the curve", ErrInvalidKey)
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator).Mod(u, curve25519Prime)
+	uBytes := u.FillBytes(make([]byte, 32))
+	for i, j := 0, len(uBytes)-1; i < j; i, j = i+1, j-1 {
+		uBytes[i], uBytes[j] = uBytes[j], uBytes[i]
+	}
+	return ecdh.X25519().NewPublicKey(uBytes)
+}
+
+func (priv *Curve25519PrivateKey) Serialize(PIN []byte) ([]byte, error) {
+	ePKey, err := common.EncryptData(tagKey(SUITE_CURVE25519, priv.privateKey.Seed()), PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt private key: %w", err)
+	}
+	return ePKey, nil
+}
+
+func (priv *Curve25519PrivateKey) Suite() KeySuite {
+	return SUITE_CURVE25519
+}
+
+// The X25519 scalar is the same clamped hash of the seed Ed25519 signs with
+func (priv *Curve25519PrivateKey) x25519() (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(priv.privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+func (priv *Curve25519PrivateKey) CalculateCommonSecret(otherPub IECPublicKey) ([]byte, error) {
+	otherKey, ok := otherPub.(*Curve25519PublicKey)
+	if !ok {
+		return nil, ErrKeySuiteMismatch
+	}
+	dhPriv, err := priv.x25519()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot caculate common secret: %w", err)
+	}
+	dhPub, err := otherKey.x25519()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot caculate common secret: %w", err)
+	}
+	result, err := dhPriv.ECDH(dhPub)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot caculate common secret")
+	}
+	return result, nil
+}
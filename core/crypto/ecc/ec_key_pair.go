@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"lidx-core-lib/common"
 )
@@ -24,16 +25,43 @@ func NewECKeyPair(publicKey IECPublicKey, privateKey IECPrivateKey) *ECKeyPair {
 type ECKeyPair struct {
 	publicKey  IECPublicKey
 	privateKey IECPrivateKey
+	pinKdf     *common.PinKdf
 }
 
+// Clear wipes the private key, only the public key can be used afterwards
+func (e *ECKeyPair) Clear() {
+	switch privateKey := e.privateKey.(type) {
+	case *MyPrivateKey:
+		privateKey.privateKey.D.SetInt64(0)
+	case *Curve25519PrivateKey:
+		clear(privateKey.privateKey)
+	}
+	e.privateKey = nil
+}
+
+// ECKeyPairStore only carries PinKdf when saved on its own, a key pair saved
+// inside another store is encrypted with the key of that store
 type ECKeyPairStore struct {
-	PublicKey   string `json:"public_key,omitempty"`
-	PrivateKey  string `json:"private_key,omitempty"`
-	PrivateHash string `json:"private_hash,omitempty"`
-	PublicHash  string `json:"public_hash,omitempty"`
+	PublicKey   string              `json:"public_key,omitempty"`
+	PrivateKey  string              `json:"private_key,omitempty"`
+	PrivateHash string              `json:"private_hash,omitempty"`
+	PublicHash  string              `json:"public_hash,omitempty"`
+	PinKdf      *common.PinKdfStore `json:"pin_kdf,omitempty"`
 }
 
+// DeSerializeKey stretches PIN with the KDF of the store when it has one,
+// otherwise PIN is used as is, which is the case for key pairs nested in
+// another store and for stores written before the KDF existed
 func DeSerializeKey(keyStore *ECKeyPairStore, PIN []byte) (*ECKeyPair, error) {
+	var pinKdf *common.PinKdf
+	if keyStore.PinKdf != nil {
+		loadedKdf, err := common.LoadPinKdf(keyStore.PinKdf)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load key store: %w", err)
+		}
+		pinKdf = loadedKdf
+		PIN = pinKdf.DeriveKey(PIN)
+	}
 	var pubKey, privKey []byte
 	var pubHash, privHash []byte
 	pubKey = common.DecodeToByte(keyStore.PublicKey)
@@ -43,19 +71,22 @@ func DeSerializeKey(keyStore *ECKeyPairStore, PIN []byte) (*ECKeyPair, error) {
 	currentPubHash := sha256.Sum256(pubKey)
 	currentPrivHash := sha256.Sum256(privKey)
 	if bytes.Compare(currentPubHash[:], pubHash) != 0 && bytes.Compare(currentPrivHash[:], privHash) != 0 {
-		return nil, fmt.Errorf("Key store hash not match")
+		return nil, fmt.Errorf("%w: key store hash not match", ErrInvalidKey)
 	}
 	mPrivKey, err := DeserializePrivateKey(privKey, PIN)
-	if err != nil {
-		return nil, fmt.Errorf("", err)
+	if errors.Is(err, common.ErrDecryptFailed) {
+		return nil, fmt.Errorf("%w: %w", common.ErrWrongPIN, err)
+	} else if err != nil {
+		return nil, err
 	}
 	mPubKey, err := DeserializePublicKey(pubKey)
 	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, err
 	}
 	return &ECKeyPair{
 		privateKey: mPrivKey,
 		publicKey:  mPubKey,
+		pinKdf:     pinKdf,
 	}, nil
 }
 
@@ -63,34 +94,17 @@ func DeSerializeKeyStoreString(jsonString string, PIN []byte) (*ECKeyPair, error
 	var keyStore ECKeyPairStore
 	err := json.Unmarshal([]byte(jsonString), &keyStore)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot load key store")
-	}
-	var pubKey, privKey []byte
-	var pubHash, privHash []byte
-	pubKey = common.DecodeToByte(keyStore.PublicKey)
-	privKey = common.DecodeToByte(keyStore.PrivateKey)
-	pubHash = common.DecodeToByte(keyStore.PublicHash)
-	privHash = common.DecodeToByte(keyStore.PrivateHash)
-	currentPubHash := sha256.Sum256(pubKey)
-	currentPrivHash := sha256.Sum256(privKey)
-	if bytes.Compare(currentPubHash[:], pubHash) != 0 && bytes.Compare(currentPrivHash[:], privHash) != 0 {
-		return nil, fmt.Errorf("Key store hash not match")
-	}
-	mPrivKey, err := DeserializePrivateKey(privKey, PIN)
-	if err != nil {
-		return nil, fmt.Errorf("", err)
-	}
-	mPubKey, err := DeserializePublicKey(pubKey)
-	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, fmt.Errorf("Cannot load key store: %w", err)
 	}
-	return &ECKeyPair{
-		privateKey: mPrivKey,
-		publicKey:  mPubKey,
-	}, nil
+	return DeSerializeKey(&keyStore, PIN)
 }
 
+// GenerateKeyPair generates a key pair of the default suite
 func GenerateKeyPair() *ECKeyPair {
+	return GenerateKeyPairWithSuite(DEFAULT_KEY_SUITE)
+}
+
+func generateP384KeyPair() *ECKeyPair {
 	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	return &ECKeyPair{
 		privateKey: NewPrivateKey(priv),
@@ -103,17 +117,39 @@ func (e *ECKeyPair) PublicKey() IECPublicKey {
 	return e.publicKey
 }
 
+// Suite returns the key suite of the key pair.
+func (e *ECKeyPair) Suite() KeySuite {
+	return e.publicKey.Suite()
+}
+
 // PrivateKey returns the private key from the key pair.
 func (e *ECKeyPair) PrivateKey() IECPrivateKey {
 	return e.privateKey
 }
 
-func (e *ECKeyPair) Save(PIN []byte) *ECKeyPairStore {
+// Save writes a self contained store, the private key is encrypted with a key
+// stretched from PIN by Argon2id
+func (e *ECKeyPair) Save(PIN []byte) (*ECKeyPairStore, error) {
+	if e.pinKdf == nil {
+		pinKdf, err := common.NewPinKdf()
+		if err != nil {
+			return nil, err
+		}
+		e.pinKdf = pinKdf
+	}
+	keyStore := e.SaveWithKey(e.pinKdf.DeriveKey(PIN))
+	keyStore.PinKdf = e.pinKdf.Save()
+	return keyStore, nil
+}
+
+// SaveWithKey encrypts the private key with storeKey as is, for key pairs
+// saved inside a store that already derived its key from the PIN
+func (e *ECKeyPair) SaveWithKey(storeKey []byte) *ECKeyPairStore {
 	var pubKey, privKey []byte
 	var pubHash, privHash [32]byte
 	var _ error
 	pubKey, _ = e.PublicKey().Serialize()
-	privKey, _ = e.PrivateKey().Serialize(PIN)
+	privKey, _ = e.PrivateKey().Serialize(storeKey)
 	pubHash = sha256.Sum256(pubKey)
 	privHash = sha256.Sum256(privKey)
 	return &ECKeyPairStore{
@@ -9,22 +9,40 @@ import (
 
 type IECPrivateKey interface {
 	Serialize(PIN []byte) ([]byte, error)
-	PrivateKey() *ecdsa.PrivateKey
+	Suite() KeySuite
 	CalculateCommonSecret(otherPub IECPublicKey) ([]byte, error)
 }
 
+// MyPrivateKey is a P-384 private key
 type MyPrivateKey struct {
 	privateKey *ecdsa.PrivateKey
 }
 
-func DeserializePrivateKey(input []byte, PIN []byte) (*MyPrivateKey, error) {
-	decryptData, err := common.DecryptHashedData(input, PIN)
+// DeserializePrivateKey decrypts a private key of any suite
+func DeserializePrivateKey(input []byte, PIN []byte) (IECPrivateKey, error) {
+	decryptData, err := common.DecryptData(input, PIN)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot decryp private key", err)
+		return nil, fmt.Errorf("Cannot decryp private key: %w", err)
 	}
-	privKey, err := x509.ParseECPrivateKey(decryptData)
+	if len(decryptData) == 0 {
+		return nil, fmt.Errorf("%w: cannot read private key", ErrInvalidKey)
+	}
+	switch decryptData[0] {
+	case legacyDerTag:
+		return deserializeP384PrivateKey(decryptData)
+	case byte(SUITE_P384):
+		return deserializeP384PrivateKey(decryptData[1:])
+	case byte(SUITE_CURVE25519):
+		return deserializeCurve25519PrivateKey(decryptData[1:])
+	default:
+		return nil, fmt.Errorf("%w: unknown key suite %d", ErrInvalidKey, decryptData[0])
+	}
+}
+
+func deserializeP384PrivateKey(input []byte) (IECPrivateKey, error) {
+	privKey, err := x509.ParseECPrivateKey(input)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read private key", err)
+		return nil, fmt.Errorf("%w: cannot read private key: %w", ErrInvalidKey, err)
 	}
 	return &MyPrivateKey{
 		privateKey: privKey,
@@ -32,8 +50,12 @@ func DeserializePrivateKey(input []byte, PIN []byte) (*MyPrivateKey, error) {
 }
 
 func (priv *MyPrivateKey) CalculateCommonSecret(otherPub IECPublicKey) ([]byte, error) {
+	otherKey, ok := otherPub.(*MyPublicKey)
+	if !ok {
+		return nil, ErrKeySuiteMismatch
+	}
 	dhPriv, _ := priv.privateKey.ECDH()
-	dhPub, _ := otherPub.PublicKey().ECDH()
+	dhPub, _ := otherKey.PublicKey().ECDH()
 	result, err := dhPriv.ECDH(dhPub)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot caculate common secret")
@@ -41,19 +63,22 @@ func (priv *MyPrivateKey) CalculateCommonSecret(otherPub IECPublicKey) ([]byte,
 	return result, nil
 }
 
-// TODO Should encrypt this
 func (priv *MyPrivateKey) Serialize(PIN []byte) ([]byte, error) {
 	privateKey, err := x509.MarshalECPrivateKey(priv.privateKey)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot get private key")
 	}
-	ePKey, err := common.EncryptAndHash(privateKey, PIN)
+	ePKey, err := common.EncryptData(tagKey(SUITE_P384, privateKey), PIN)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot encrypt private key ", err)
+		return nil, fmt.Errorf("Cannot encrypt private key: %w", err)
 	}
 	return ePKey, nil
 }
 
+func (priv *MyPrivateKey) Suite() KeySuite {
+	return SUITE_P384
+}
+
 func (priv *MyPrivateKey) PrivateKey() *ecdsa.PrivateKey {
 	return priv.privateKey
 }
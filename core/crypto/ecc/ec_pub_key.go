@@ -2,28 +2,53 @@ package ecc
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/x509"
 	"fmt"
 	"lidx-core-lib/common"
-	"log"
 )
 
 type IECPublicKey interface {
 	Serialize() ([]byte, error)
-	PublicKey() *ecdsa.PublicKey
+	Suite() KeySuite
 }
 
+// MyPublicKey is a P-384 public key, legacy keys were read from the untagged
+// encoding and keep it so signatures made over them still verify
 type MyPublicKey struct {
 	publicKey *ecdsa.PublicKey
+	legacy    bool
 }
 
-func DeserializePublicKey(input []byte) (*MyPublicKey, error) {
+// DeserializePublicKey reads a public key of any suite
+func DeserializePublicKey(input []byte) (IECPublicKey, error) {
+	if len(input) == 0 {
+		return nil, fmt.Errorf("%w: cannot read public key", ErrInvalidKey)
+	}
+	switch input[0] {
+	case legacyDerTag:
+		return deserializeP384PublicKey(input, true)
+	case byte(SUITE_P384):
+		return deserializeP384PublicKey(input[1:], false)
+	case byte(SUITE_CURVE25519):
+		return deserializeCurve25519PublicKey(input[1:])
+	default:
+		return nil, fmt.Errorf("%w: unknown key suite %d", ErrInvalidKey, input[0])
+	}
+}
+
+func deserializeP384PublicKey(input []byte, legacy bool) (IECPublicKey, error) {
 	pubKey, err := x509.ParsePKIXPublicKey(input)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot read private key")
+		return nil, fmt.Errorf("%w: cannot read public key", ErrInvalidKey)
+	}
+	ecdsaKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve != elliptic.P384() {
+		return nil, fmt.Errorf("%w: not a P-384 key", ErrInvalidKey)
 	}
 	return &MyPublicKey{
-		publicKey: pubKey.(*ecdsa.PublicKey),
+		publicKey: ecdsaKey,
+		legacy:    legacy,
 	}, nil
 }
 
@@ -32,10 +57,16 @@ func DeserializePublicKey(input []byte) (*MyPublicKey, error) {
 func (pub *MyPublicKey) Serialize() ([]byte, error) {
 	x509encode, e := x509.MarshalPKIXPublicKey(pub.publicKey)
 	if e != nil {
-		log.Println("Cannot read internal public key ", e)
-		return nil, e
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKey, e)
 	}
-	return x509encode, nil
+	if pub.legacy {
+		return x509encode, nil
+	}
+	return tagKey(SUITE_P384, x509encode), nil
+}
+
+func (pub *MyPublicKey) Suite() KeySuite {
+	return SUITE_P384
 }
 
 func (pub *MyPublicKey) PublicKey() *ecdsa.PublicKey {
@@ -43,10 +74,11 @@ func (pub *MyPublicKey) PublicKey() *ecdsa.PublicKey {
 }
 
 func ParsePublicKey(key string) IECPublicKey {
-	genericPublicKey, _ := x509.ParsePKIXPublicKey(common.DecodeToByte(key))
-	return &MyPublicKey{
-		publicKey: genericPublicKey.(*ecdsa.PublicKey),
+	pubKey, err := DeserializePublicKey(common.DecodeToByte(key))
+	if err != nil {
+		return nil
 	}
+	return pubKey
 }
 
 func NewPublicKey(pub *ecdsa.PublicKey) IECPublicKey {
@@ -0,0 +1,27 @@
+package ecc
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidKey is returned for keys that cannot be read, of an unknown
+	// suite or not on the curve
+	ErrInvalidKey = errors.New("Invalid key")
+	// ErrKeySuiteMismatch is returned when keys of two suites are combined
+	ErrKeySuiteMismatch = errors.New("Key suite mismatch")
+	// ErrBadSignature is returned when a signature does not verify
+	ErrBadSignature = errors.New("Bad signature")
+)
+
+// VerifySignature is ISigner.Verify with an error telling why it failed
+func VerifySignature(publicKey IECPublicKey, message, sig []byte) error {
+	if publicKey == nil {
+		return fmt.Errorf("%w: missing public key", ErrInvalidKey)
+	}
+	if !FromPublicKey(publicKey).Verify(message, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
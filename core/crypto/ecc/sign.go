@@ -2,49 +2,88 @@ package ecc
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"fmt"
 )
 
 type ISigner interface {
-	Sign(hash []byte) (sig []byte, err error)
-	Verify(pubKey []byte, sig []byte) (bool, error)
+	Sign(message []byte) (sig []byte, err error)
+	Verify(message []byte, sig []byte) bool
 }
 
 type ECDSASigner struct {
-	privateKey IECPrivateKey
-	publicKey  IECPublicKey
+	privateKey *MyPrivateKey
+	publicKey  *MyPublicKey
 }
 
-func FromPrivateKey(priv IECPrivateKey) *ECDSASigner {
-	return &ECDSASigner{
-		privateKey: priv,
-	}
+type Ed25519Signer struct {
+	privateKey *Curve25519PrivateKey
+	publicKey  *Curve25519PublicKey
 }
 
-func FromPublicKey(pub IECPublicKey) *ECDSASigner {
-	return &ECDSASigner{
-		publicKey: pub,
-	}
+func FromPrivateKey(priv IECPrivateKey) ISigner {
+	return newSigner(priv, nil)
+}
+
+func FromPublicKey(pub IECPublicKey) ISigner {
+	return newSigner(nil, pub)
 }
 
-func FromKeyPair(keyPair *ECKeyPair) *ECDSASigner {
-	return &ECDSASigner{
-		publicKey:  keyPair.PublicKey(),
-		privateKey: keyPair.PrivateKey(),
+func FromKeyPair(keyPair *ECKeyPair) ISigner {
+	return newSigner(keyPair.PrivateKey(), keyPair.PublicKey())
+}
+
+// newSigner picks the signature scheme from the suite of the key, a missing
+// half of the key pair makes the matching operation fail
+func newSigner(priv IECPrivateKey, pub IECPublicKey) ISigner {
+	var suite KeySuite
+	if pub != nil {
+		suite = pub.Suite()
+	} else if priv != nil {
+		suite = priv.Suite()
 	}
+	if suite == SUITE_CURVE25519 {
+		signer := &Ed25519Signer{}
+		signer.privateKey, _ = priv.(*Curve25519PrivateKey)
+		signer.publicKey, _ = pub.(*Curve25519PublicKey)
+		return signer
+	}
+	signer := &ECDSASigner{}
+	signer.privateKey, _ = priv.(*MyPrivateKey)
+	signer.publicKey, _ = pub.(*MyPublicKey)
+	return signer
 }
 
 // return ASN1 encoded
 func (E *ECDSASigner) Sign(hash []byte) (sig []byte, err error) {
+	if E.privateKey == nil {
+		return nil, fmt.Errorf("Missing private key")
+	}
 	sig, err = ecdsa.SignASN1(rand.Reader, E.privateKey.PrivateKey(), hash)
 	if err != nil {
-		fmt.Println("Cannot sign", err)
-		return nil, err
+		return nil, fmt.Errorf("Cannot sign: %w", err)
 	}
 	return sig, nil
 }
 
 func (E *ECDSASigner) Verify(hash, sig []byte) bool {
+	if E.publicKey == nil {
+		return false
+	}
 	return ecdsa.VerifyASN1(E.publicKey.PublicKey(), hash, sig)
 }
+
+func (E *Ed25519Signer) Sign(message []byte) (sig []byte, err error) {
+	if E.privateKey == nil {
+		return nil, fmt.Errorf("Missing private key")
+	}
+	return ed25519.Sign(E.privateKey.privateKey, message), nil
+}
+
+func (E *Ed25519Signer) Verify(message, sig []byte) bool {
+	if E.publicKey == nil {
+		return false
+	}
+	return ed25519.Verify(E.publicKey.publicKey, message, sig)
+}
@@ -0,0 +1,58 @@
+package ecc
+
+import "fmt"
+
+// KeySuite identifies the curves behind a key, it is the first byte of every
+// serialized key so keys of different suites can be told apart
+type KeySuite byte
+
+const (
+	// ECDH and ECDSA on P-384
+	SUITE_P384 KeySuite = 0x01
+	// X25519 for key agreement and Ed25519 for signatures on the same key
+	SUITE_CURVE25519 KeySuite = 0x05
+)
+
+// DEFAULT_KEY_SUITE is used for keys generated without an explicit suite
+const DEFAULT_KEY_SUITE = SUITE_P384
+
+// Keys serialized before suites existed are bare P-384 x509 DER, which always
+// starts with the ASN.1 sequence tag
+const legacyDerTag = 0x30
+
+func (suite KeySuite) String() string {
+	switch suite {
+	case SUITE_P384:
+		return "P384"
+	case SUITE_CURVE25519:
+		return "CURVE25519"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", byte(suite))
+	}
+}
+
+// ParseKeySuite reads the suite advertised in a key bundle, bundles that do
+// not advertise one are P-384
+func ParseKeySuite(name string) (KeySuite, error) {
+	switch name {
+	case "", SUITE_P384.String():
+		return SUITE_P384, nil
+	case SUITE_CURVE25519.String():
+		return SUITE_CURVE25519, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown key suite %s", ErrInvalidKey, name)
+	}
+}
+
+func GenerateKeyPairWithSuite(suite KeySuite) *ECKeyPair {
+	switch suite {
+	case SUITE_CURVE25519:
+		return generateCurve25519KeyPair()
+	default:
+		return generateP384KeyPair()
+	}
+}
+
+func tagKey(suite KeySuite, key []byte) []byte {
+	return append([]byte{byte(suite)}, key...)
+}
@@ -1,18 +1,119 @@
 package kdf
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/hkdf"
+	"io"
 )
 
+// DoKDF is the 16 byte derivation of protocol v1, where it made root, chain
+// and message keys alike, only kept for v1 sessions and data
 func DoKDF(keyMaterial []byte) ([]byte, error) {
 	kdf := hkdf.New(sha256.New, keyMaterial, nil, nil)
 	result := make([]byte, 16)
 	_, err := kdf.Read(result)
 	if err != nil {
-		fmt.Println("Cannot do KDF")
-		return nil, err
+		return nil, fmt.Errorf("Cannot do KDF: %w", err)
 	}
 	return result, nil
 }
+
+// DoRootKDFV1 is the root step of protocol v1 sessions, 16 byte keys and no
+// label
+func DoRootKDFV1(rootKey, dhOutput []byte) ([]byte, []byte, error) {
+	kdf := hkdf.New(sha256.New, dhOutput, rootKey, nil)
+	result := make([]byte, 32)
+	_, err := kdf.Read(result)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot do root KDF: %w", err)
+	}
+	return result[:16], result[16:], nil
+}
+
+// KEY_SIZE is the size of every key derived from protocol v2 on
+const KEY_SIZE = 32
+
+// Labels keep keys derived from the same secret for different uses apart
+const (
+	LABEL_X3DH        = "strix/v2/x3dh"
+	LABEL_ROOT        = "strix/v2/root"
+	LABEL_STORAGE     = "strix/v2/storage"
+	LABEL_STORAGE_MAC = "strix/v2/storage-mac"
+	LABEL_VOIP        = "strix/v2/voip"
+	LABEL_ATTACHMENT  = "strix/v2/attachment"
+	// The session id is appended to it
+	LABEL_FIRST_CHAIN = "strix/v2/first-chain/"
+	// The store id is appended to it
+	LABEL_STORE_KEY = "strix/v2/store-key/"
+
+	LABEL_SEALED_EPHEMERAL = "strix/v2/sealed-sender/ephemeral"
+	LABEL_SEALED_STATIC    = "strix/v2/sealed-sender/static"
+
+	LABEL_VOIP_CALLER = "strix/v2/voip/caller-to-callee"
+	LABEL_VOIP_CALLEE = "strix/v2/voip/callee-to-caller"
+	LABEL_VOIP_REKEY  = "strix/v2/voip/rekey"
+)
+
+// Inputs of the chain step, the Double Ratchet spec recommends these
+var (
+	messageKeyInput = []byte{0x01}
+	chainKeyInput   = []byte{0x02}
+)
+
+// DeriveKey derives a 32 byte key for the use named by label
+func DeriveKey(keyMaterial []byte, label string) ([]byte, error) {
+	kdf := hkdf.New(sha256.New, keyMaterial, nil, []byte(label))
+	result := make([]byte, KEY_SIZE)
+	_, err := io.ReadFull(kdf, result)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot derive key: %w", err)
+	}
+	return result, nil
+}
+
+// DoX3DHKDF turns the concatenated handshake secrets into the first root key,
+// the input is prefixed with 32 0xFF bytes as X3DH asks
+func DoX3DHKDF(keyMaterial []byte) ([]byte, error) {
+	prefix := bytes.Repeat([]byte{0xFF}, KEY_SIZE)
+	kdf := hkdf.New(sha256.New, append(prefix, keyMaterial...), make([]byte, KEY_SIZE), []byte(LABEL_X3DH))
+	result := make([]byte, KEY_SIZE)
+	_, err := io.ReadFull(kdf, result)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot do X3DH KDF: %w", err)
+	}
+	return result, nil
+}
+
+// DoRootKDF mixes a DH output into the root key, salted with the root key,
+// and returns the next root key and a fresh chain key
+func DoRootKDF(rootKey, dhOutput []byte) ([]byte, []byte, error) {
+	kdf := hkdf.New(sha256.New, dhOutput, rootKey, []byte(LABEL_ROOT))
+	result := make([]byte, 2*KEY_SIZE)
+	_, err := io.ReadFull(kdf, result)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot do root KDF: %w", err)
+	}
+	return result[:KEY_SIZE], result[KEY_SIZE:], nil
+}
+
+// DoChainKDF moves a chain one step, the message key and the next chain key
+// come from different HMAC inputs so one never reveals the other
+func DoChainKDF(chainKey []byte) ([]byte, []byte) {
+	return hmacSha256(chainKey, chainKeyInput), hmacSha256(chainKey, messageKeyInput)
+}
+
+func hmacSha256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// DoPinKDF stretches a PIN with Argon2id into a 32 byte key, the cost
+// parameters are stored next to the salt so they can be raised later
+func DoPinKDF(PIN, salt []byte, time, memory uint32, threads uint8) []byte {
+	return argon2.IDKey(PIN, salt, time, memory, threads, 32)
+}
@@ -0,0 +1,71 @@
+package kem
+
+import (
+	"crypto/mlkem"
+	"fmt"
+	"lidx-core-lib/common"
+)
+
+// KEMKeyPair is an ML-KEM-768 key pair used as the post-quantum pre key of the
+// handshake, the private part is kept as its 64 byte seed
+type KEMKeyPair struct {
+	decapsulationKey *mlkem.DecapsulationKey768
+}
+
+type KEMKeyPairStore struct {
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+func GenerateKeyPair() *KEMKeyPair {
+	decapsulationKey, _ := mlkem.GenerateKey768()
+	return &KEMKeyPair{
+		decapsulationKey: decapsulationKey,
+	}
+}
+
+func DeSerializeKey(keyStore *KEMKeyPairStore, PIN []byte) (*KEMKeyPair, error) {
+	seed, err := common.DecryptData(common.DecodeToByte(keyStore.PrivateKey), PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt KEM key: %w", err)
+	}
+	decapsulationKey, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read KEM key: %w", err)
+	}
+	return &KEMKeyPair{
+		decapsulationKey: decapsulationKey,
+	}, nil
+}
+
+// PublicKey returns the encapsulation key the other side encapsulates to
+func (k *KEMKeyPair) PublicKey() []byte {
+	return k.decapsulationKey.EncapsulationKey().Bytes()
+}
+
+func (k *KEMKeyPair) Decapsulate(cipherText []byte) ([]byte, error) {
+	sharedSecret, err := k.decapsulationKey.Decapsulate(cipherText)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decapsulate: %w", err)
+	}
+	return sharedSecret, nil
+}
+
+func (k *KEMKeyPair) Save(PIN []byte) *KEMKeyPairStore {
+	seed, _ := common.EncryptData(k.decapsulationKey.Bytes(), PIN)
+	return &KEMKeyPairStore{
+		PublicKey:  common.EncodeToString(k.PublicKey()),
+		PrivateKey: common.EncodeToString(seed),
+	}
+}
+
+// Encapsulate creates a shared secret for the owner of publicKey, only the
+// returned cipher text has to be sent to them
+func Encapsulate(publicKey []byte) ([]byte, []byte, error) {
+	encapsulationKey, err := mlkem.NewEncapsulationKey768(publicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read KEM public key: %w", err)
+	}
+	sharedSecret, cipherText := encapsulationKey.Encapsulate()
+	return sharedSecret, cipherText, nil
+}
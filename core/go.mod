@@ -1,10 +1,13 @@
 module lidx-core-lib
 
-go 1.20
+go 1.24
+
+require (
+	github.com/google/uuid v1.3.0
+	golang.org/x/crypto v0.8.0
+)
 
 require (
-	github.com/google/uuid v1.3.0 // indirect
-	golang.org/x/crypto v0.8.0 // indirect
 	golang.org/x/net v0.9.0 // indirect
 	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/term v0.7.0 // indirect
@@ -1,28 +1,57 @@
 package keys
 
 import (
+	"crypto/sha512"
 	"encoding/json"
 	"fmt"
 	"lidx-core-lib/common"
 	"lidx-core-lib/crypto/ecc"
 )
 
+// Session protocol versions, a session keeps the version it was set up with
+//
+//	1: 16 byte keys, the same KDF output served as message and next chain key
+//	2: 32 byte keys, labelled root KDF and separate chain and message keys
+const (
+	PROTOCOL_VERSION_1       uint = 1
+	PROTOCOL_VERSION_2       uint = 2
+	CURRENT_PROTOCOL_VERSION      = PROTOCOL_VERSION_2
+)
+
+// ONE_TIME_KEY_SIGNATURE_LABEL leads the signed digest of a one-time key, the
+// server checks uploads against the same
+const ONE_TIME_KEY_SIGNATURE_LABEL = "strix/v2/one-time-key"
+
+// ExternalKeyBundle advertises in ProtocolVersion the newest session protocol
+// its owner supports, bundles that do not advertise one only support v1. The
+// pre key signature covers the version from v2 on
 type ExternalKeyBundle struct {
-	IdentityKey  ecc.IECPublicKey
-	EphemeralKey ecc.IECPublicKey
-	PreKeyId     string
-	PreKey       ecc.IECPublicKey
-	PreKeySig    []byte
+	Suite           ecc.KeySuite
+	ProtocolVersion uint
+	IdentityKey     ecc.IECPublicKey
+	PreKeyId        string
+	PreKey          ecc.IECPublicKey
+	PreKeySig       []byte
+	PQPreKey        []byte
+	PQPreKeySig     []byte
+	OneTimeKeyId    string
+	OneTimeKey      ecc.IECPublicKey
+	OneTimeKeySig   []byte
 }
 
 // Encode in base64
 type ExternalKeyBundleDto struct {
-	IdentityKey   string `json:"identityKey,omitempty"`
-	OneTimeKey    string `json:"oneTimeKey,omitempty"`
-	OneTimeKeySig string `json:"oneTimeKeySig,omitempty"`
-	PreKeyId      string `json:"preKeyId,omitempty"`
-	PreKey        string `json:"preKey,omitempty"`
-	PreKeySig     string `json:"preKeySig,omitempty"`
+	Suite           string `json:"suite,omitempty"`
+	ProtocolVersion uint   `json:"protocolVersion,omitempty"`
+	IdentityKey     string `json:"identityKey,omitempty"`
+	OneTimeKeyId    string `json:"oneTimeKeyId,omitempty"`
+	OneTimeKey      string `json:"oneTimeKey,omitempty"`
+	OneTimeKeySig   string `json:"oneTimeKeySig,omitempty"`
+	PreKeyId        string `json:"preKeyId,omitempty"`
+	PreKey          string `json:"preKey,omitempty"`
+	PreKeySig       string `json:"preKeySig,omitempty"`
+	PQPreKey        string `json:"pqPreKey,omitempty"`
+	PQPreKeySig     string `json:"pqPreKeySig,omitempty"`
 }
 
 // TODO convert base64 string to key material
@@ -30,7 +59,6 @@ func ExternalKeyFromJson(jsonString string) *ExternalKeyBundle {
 	var result ExternalKeyBundle
 	err := json.Unmarshal([]byte(jsonString), &result)
 	if err != nil {
-		fmt.Println("Cannot read external key bundle json")
 		return nil
 	}
 	return &result
@@ -38,17 +66,17 @@ func ExternalKeyFromJson(jsonString string) *ExternalKeyBundle {
 
 func NewExternalKeyBundle(
 	ik ecc.IECPublicKey,
-	ek ecc.IECPublicKey,
 	pkid string,
 	pk ecc.IECPublicKey,
 	spk []byte,
 ) *ExternalKeyBundle {
 	return &ExternalKeyBundle{
-		IdentityKey:  ik,
-		EphemeralKey: ek,
-		PreKeyId:     pkid,
-		PreKey:       pk,
-		PreKeySig:    spk,
+		Suite:           ik.Suite(),
+		ProtocolVersion: CURRENT_PROTOCOL_VERSION,
+		IdentityKey:     ik,
+		PreKeyId:        pkid,
+		PreKey:          pk,
+		PreKeySig:       spk,
 	}
 }
 
@@ -56,16 +84,44 @@ func NewExternalKeyFromJson(jsonString string) (*ExternalKeyBundle, error) {
 	var dto ExternalKeyBundleDto
 	err := json.Unmarshal([]byte(jsonString), &dto)
 	if err != nil {
-		fmt.Println(err)
-		return nil, fmt.Errorf("Cannot deserialize json")
+		return nil, fmt.Errorf("%w: cannot read key bundle: %w", ecc.ErrInvalidKey, err)
+	}
+	suite, err := ecc.ParseKeySuite(dto.Suite)
+	if err != nil {
+		return nil, err
 	}
 	iKey, _ := ecc.DeserializePublicKey(common.DecodeToByte(dto.IdentityKey))
 	pKey, _ := ecc.DeserializePublicKey(common.DecodeToByte(dto.PreKey))
+	if (iKey != nil && iKey.Suite() != suite) || (pKey != nil && pKey.Suite() != suite) {
+		return nil, fmt.Errorf("%w, bundle advertises %s", ecc.ErrKeySuiteMismatch, suite)
+	}
+	protocolVersion := dto.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = PROTOCOL_VERSION_1
+	}
 	result := &ExternalKeyBundle{
-		IdentityKey: iKey,
-		PreKeyId:    dto.PreKeyId,
-		PreKey:      pKey,
-		PreKeySig:   common.DecodeToByte(dto.PreKeySig),
+		Suite:           suite,
+		ProtocolVersion: protocolVersion,
+		IdentityKey:     iKey,
+		PreKeyId:        dto.PreKeyId,
+		PreKey:          pKey,
+		PreKeySig:       common.DecodeToByte(dto.PreKeySig),
+	}
+	if dto.PQPreKey != "" {
+		result.PQPreKey = common.DecodeToByte(dto.PQPreKey)
+		result.PQPreKeySig = common.DecodeToByte(dto.PQPreKeySig)
+	}
+	if dto.OneTimeKeyId != "" && dto.OneTimeKey != "" {
+		oKey, err := ecc.DeserializePublicKey(common.DecodeToByte(dto.OneTimeKey))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read one-time key: %w", err)
+		}
+		if oKey.Suite() != suite {
+			return nil, fmt.Errorf("%w, bundle advertises %s", ecc.ErrKeySuiteMismatch, suite)
+		}
+		result.OneTimeKeyId = dto.OneTimeKeyId
+		result.OneTimeKey = oKey
+		result.OneTimeKeySig = common.DecodeToByte(dto.OneTimeKeySig)
 	}
 	return result, nil
 }
@@ -74,38 +130,73 @@ func (keyBundle *ExternalKeyBundle) GetIdentityKey() ecc.IECPublicKey {
 	return keyBundle.IdentityKey
 }
 
-func (keyBundle *ExternalKeyBundle) GetEphemeralKey() ecc.IECPublicKey {
-	return keyBundle.EphemeralKey
-}
-
 func (keyBundle *ExternalKeyBundle) GetPreKey() (ecc.IECPublicKey, string) {
 	return keyBundle.PreKey, keyBundle.PreKeyId
 }
 
-func (keyBundle *ExternalKeyBundle) SetEphemeralKey(ePubKey *ecc.IECPublicKey) {
-	keyBundle.EphemeralKey = *ePubKey
+// GetPQPreKey returns the ML-KEM pre key, nil when the other user does not
+// support the post-quantum handshake
+func (keyBundle *ExternalKeyBundle) GetPQPreKey() []byte {
+	return keyBundle.PQPreKey
+}
+
+func (keyBundle *ExternalKeyBundle) GetOneTimeKey() (ecc.IECPublicKey, string) {
+	return keyBundle.OneTimeKey, keyBundle.OneTimeKeyId
 }
 
-func (keyBundle *ExternalKeyBundle) Verify() bool {
+// Verify checks every pre key is signed by the identity key, the error wraps
+// ecc.ErrBadSignature for a signature that does not match
+func (keyBundle *ExternalKeyBundle) Verify() error {
 	userIdentityKey := keyBundle.GetIdentityKey()
 	if userIdentityKey == nil {
-		fmt.Println("Cannot get user identity key")
-		return false
+		return fmt.Errorf("%w: missing identity key", ecc.ErrInvalidKey)
+	}
+	if keyBundle.PreKey == nil {
+		return fmt.Errorf("%w: missing pre key", ecc.ErrInvalidKey)
 	}
-	signer := ecc.FromPublicKey(userIdentityKey)
 	pKey, _ := keyBundle.PreKey.Serialize()
-	if !signer.Verify(pKey, keyBundle.PreKeySig) {
-		fmt.Println("Cannot verify user pre key")
-		return false
-	}
-	if keyBundle.PreKey != nil && !common.IsByteArrayEmpty(&keyBundle.PreKeySig) {
-		oKey, _ := keyBundle.PreKey.Serialize()
-		if !signer.Verify(oKey, keyBundle.PreKeySig) {
-			fmt.Println("Cannot verify user one-time key")
-			return false
+	if err := ecc.VerifySignature(userIdentityKey, preKeySignedPayload(pKey, keyBundle.ProtocolVersion), keyBundle.PreKeySig); err != nil {
+		return fmt.Errorf("Cannot verify pre key: %w", err)
+	}
+	if keyBundle.PQPreKey != nil {
+		if err := ecc.VerifySignature(userIdentityKey, pqPreKeyDigest(keyBundle.PQPreKey), keyBundle.PQPreKeySig); err != nil {
+			return fmt.Errorf("Cannot verify post-quantum pre key: %w", err)
 		}
 	}
-	return true
+	if keyBundle.OneTimeKey != nil {
+		oKey, _ := keyBundle.OneTimeKey.Serialize()
+		if err := ecc.VerifySignature(userIdentityKey, oneTimeKeySignedPayload(oKey, keyBundle.ProtocolVersion), keyBundle.OneTimeKeySig); err != nil {
+			return fmt.Errorf("Cannot verify one-time key: %w", err)
+		}
+	}
+	return nil
+}
+
+// preKeySignedPayload is what the identity key signs for the pre key. From v2
+// on it is a digest of the advertised protocol version and the key, so the
+// version cannot be lowered on the way without breaking the signature
+func preKeySignedPayload(preKey []byte, protocolVersion uint) []byte {
+	if protocolVersion < PROTOCOL_VERSION_2 {
+		return preKey
+	}
+	digest := sha512.Sum384(append([]byte{byte(protocolVersion)}, preKey...))
+	return digest[:]
+}
+
+// oneTimeKeySignedPayload is what the identity key signs for a one-time key, a
+// digest of the key and the protocol version led by a label so it cannot pass
+// for the signature of a pre key
+func oneTimeKeySignedPayload(oneTimeKey []byte, protocolVersion uint) []byte {
+	payload := common.ConcatBytes([]byte(ONE_TIME_KEY_SIGNATURE_LABEL), []byte{byte(protocolVersion)}, oneTimeKey)
+	digest := sha512.Sum384(payload)
+	return digest[:]
+}
+
+// pqPreKeyDigest is what the identity key signs for the post-quantum pre key,
+// ECDSA only reads as many bytes of the message as the curve order has
+func pqPreKeyDigest(pqPreKey []byte) []byte {
+	digest := sha512.Sum384(pqPreKey)
+	return digest[:]
 }
 
 func (keyBundle *ExternalKeyBundle) ToDto() *ExternalKeyBundleDto {
@@ -124,10 +215,22 @@ func (keyBundle *ExternalKeyBundle) ToDto() *ExternalKeyBundleDto {
 	iKey, _ := keyBundle.IdentityKey.Serialize()
 
 	dto := &ExternalKeyBundleDto{
-		IdentityKey: common.EncodeToString(iKey),
-		PreKeyId:    pid,
-		PreKey:      pk,
-		PreKeySig:   pks,
+		Suite:           keyBundle.IdentityKey.Suite().String(),
+		ProtocolVersion: keyBundle.ProtocolVersion,
+		IdentityKey:     common.EncodeToString(iKey),
+		PreKeyId:        pid,
+		PreKey:          pk,
+		PreKeySig:       pks,
+	}
+	if keyBundle.PQPreKey != nil {
+		dto.PQPreKey = common.EncodeToString(keyBundle.PQPreKey)
+		dto.PQPreKeySig = common.EncodeToString(keyBundle.PQPreKeySig)
+	}
+	if keyBundle.OneTimeKey != nil && keyBundle.OneTimeKeyId != "" {
+		oKey, _ := keyBundle.OneTimeKey.Serialize()
+		dto.OneTimeKeyId = keyBundle.OneTimeKeyId
+		dto.OneTimeKey = common.EncodeToString(oKey)
+		dto.OneTimeKeySig = common.EncodeToString(keyBundle.OneTimeKeySig)
 	}
 	return dto
 }
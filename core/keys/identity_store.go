@@ -0,0 +1,179 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"time"
+)
+
+// ErrIdentityKeyChanged is returned when a contact shows another identity key
+// than the one trusted on first use, the change has to be accepted before a
+// session is set up with the new key
+var ErrIdentityKeyChanged = errors.New("Identity key changed")
+
+// ErrUntrustedIdentity is returned when a contact has no trusted identity key
+// yet, nothing was ever seen from them
+var ErrUntrustedIdentity = errors.New("No trusted identity key")
+
+// TrustedIdentity is the identity key first seen for a contact, ChangedKey
+// holds the last different key seen until the change is accepted
+type TrustedIdentity struct {
+	IdentityKey []byte `json:"identity_key"`
+	FirstSeenAt int64  `json:"first_seen_at"`
+	ChangedKey  []byte `json:"changed_key,omitempty"`
+}
+
+// Encode in base64
+type TrustedIdentityDto struct {
+	IdentityKey string `json:"identityKey"`
+	FirstSeenAt int64  `json:"firstSeenAt"`
+	ChangedKey  string `json:"changedKey,omitempty"`
+}
+
+// IdentityStore remembers per username the identity key trusted on first use
+type IdentityStore struct {
+	identities map[string]*TrustedIdentity
+}
+
+func NewIdentityStore() *IdentityStore {
+	return &IdentityStore{
+		identities: make(map[string]*TrustedIdentity),
+	}
+}
+
+// LoadIdentityStore opens a store written by Save with the same key
+func LoadIdentityStore(cipherText string, storeKey []byte) (*IdentityStore, error) {
+	identityStore := NewIdentityStore()
+	if cipherText == "" {
+		return identityStore, nil
+	}
+	identityJson, err := common.DecryptData(common.DecodeToByte(cipherText), storeKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt identity store: %w", err)
+	}
+	err = json.Unmarshal(identityJson, &identityStore.identities)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read identity store: %w", err)
+	}
+	return identityStore, nil
+}
+
+// Save encrypts the store with storeKey, an empty store is saved as ""
+func (s *IdentityStore) Save(storeKey []byte) (string, error) {
+	if len(s.identities) == 0 {
+		return "", nil
+	}
+	identityJson, err := json.Marshal(s.identities)
+	if err != nil {
+		return "", fmt.Errorf("Cannot write identity store: %w", err)
+	}
+	cipherText, err := common.EncryptData(identityJson, storeKey)
+	if err != nil {
+		return "", fmt.Errorf("Cannot encrypt identity store: %w", err)
+	}
+	return common.EncodeToString(cipherText), nil
+}
+
+// Check trusts identityKey if username was never seen, otherwise the key has
+// to be the trusted one or ErrIdentityKeyChanged is returned
+func (s *IdentityStore) Check(username string, identityKey ecc.IECPublicKey) error {
+	key, err := serializeIdentityKey(username, identityKey)
+	if err != nil {
+		return err
+	}
+	trusted, existed := s.identities[username]
+	if !existed {
+		s.identities[username] = &TrustedIdentity{
+			IdentityKey: key,
+			FirstSeenAt: time.Now().UnixMilli(),
+		}
+		return nil
+	}
+	if bytes.Equal(trusted.IdentityKey, key) {
+		return nil
+	}
+	trusted.ChangedKey = key
+	return ErrIdentityKeyChanged
+}
+
+// Accept trusts identityKey for username from now on
+func (s *IdentityStore) Accept(username string, identityKey ecc.IECPublicKey) error {
+	key, err := serializeIdentityKey(username, identityKey)
+	if err != nil {
+		return err
+	}
+	s.identities[username] = &TrustedIdentity{
+		IdentityKey: key,
+		FirstSeenAt: time.Now().UnixMilli(),
+	}
+	return nil
+}
+
+// Get returns nil for a contact that was never seen
+func (s *IdentityStore) Get(username string) *TrustedIdentity {
+	return s.identities[username]
+}
+
+// TrustedIdentityKey returns the identity key trusted for username, an error
+// wrapping ErrUntrustedIdentity when there is none
+func (internalKey *InternalKeyBundle) TrustedIdentityKey(username string) (ecc.IECPublicKey, error) {
+	var trusted *TrustedIdentity
+	if internalKey.Identities != nil {
+		trusted = internalKey.Identities.Get(username)
+	}
+	if trusted == nil {
+		return nil, fmt.Errorf("%w for %s", ErrUntrustedIdentity, username)
+	}
+	identityKey, err := ecc.DeserializePublicKey(trusted.IdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read trusted identity key: %w", err)
+	}
+	return identityKey, nil
+}
+
+func (t *TrustedIdentity) ToDto() *TrustedIdentityDto {
+	result := &TrustedIdentityDto{
+		IdentityKey: common.EncodeToString(t.IdentityKey),
+		FirstSeenAt: t.FirstSeenAt,
+	}
+	if len(t.ChangedKey) != 0 {
+		result.ChangedKey = common.EncodeToString(t.ChangedKey)
+	}
+	return result
+}
+
+func serializeIdentityKey(username string, identityKey ecc.IECPublicKey) ([]byte, error) {
+	if username == "" || identityKey == nil {
+		return nil, fmt.Errorf("%w: missing identity to check", ecc.ErrInvalidKey)
+	}
+	key, err := identityKey.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize identity key: %w", err)
+	}
+	return key, nil
+}
+
+// TrustIdentity checks identityKey against the key trusted for username, the
+// internal key has to be saved afterwards to remember a first seen key
+func (internalKey *InternalKeyBundle) TrustIdentity(username string, identityKey ecc.IECPublicKey) error {
+	if internalKey.Identities == nil {
+		internalKey.Identities = NewIdentityStore()
+	}
+	return internalKey.Identities.Check(username, identityKey)
+}
+
+// AcceptIdentityChange trusts the new identityKey of username, a verified
+// mark on the old key no longer applies
+func (internalKey *InternalKeyBundle) AcceptIdentityChange(username string, identityKey ecc.IECPublicKey) error {
+	if internalKey.Identities == nil {
+		internalKey.Identities = NewIdentityStore()
+	}
+	if !internalKey.IsVerified(username, identityKey) {
+		internalKey.ClearVerified(username)
+	}
+	return internalKey.Identities.Accept(username, identityKey)
+}
@@ -4,95 +4,281 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
+	"lidx-core-lib/common"
 	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/crypto/kem"
+	"time"
 )
 
+// DEFAULT_PRE_KEY_GRACE_PERIOD is how long a replaced signed pre key is kept
+// when the server did not tell us its own grace period
+const DEFAULT_PRE_KEY_GRACE_PERIOD = 48 * time.Hour
+
+// InternalKeyBundle holds our private keys, PreKeyId is the signed pre key we
+// currently publish and PreKeyExpiredAt keeps the unix milli time at which each
+// replaced pre key may be thrown away, PQPreKeys holds the post-quantum pre key
+// published with each signed pre key under the same id. VerifiedContacts keeps
+// per username the identity key whose safety number the user has verified and
+// Identities the identity key trusted on first use
 type InternalKeyBundle struct {
-	IdentityKey  *ecc.ECKeyPair
-	EphemeralKey *ecc.ECKeyPair
-	OneTimeKey   *ecc.ECKeyPair
-	PreKeys      map[string]*ecc.ECKeyPair
+	IdentityKey      *ecc.ECKeyPair
+	PreKeyId         string
+	PreKeys          map[string]*ecc.ECKeyPair
+	PQPreKeys        map[string]*kem.KEMKeyPair
+	PreKeyExpiredAt  map[string]int64
+	OneTimeKeys      map[string]*ecc.ECKeyPair
+	VerifiedContacts map[string][]byte
+	Identities       *IdentityStore
+	pinKdf           *common.PinKdf
+	legacyStore      bool
 }
 
+// InternalKeyBundleStore keeps VerifiedContacts and Identities as encrypted
+// json, they tell who the user talks to
 type InternalKeyBundleStore struct {
-	IdentityKey *ecc.ECKeyPairStore            `json:"identity_key"`
-	PreKeys     map[string]*ecc.ECKeyPairStore `json:"pre_keys"`
+	IdentityKey      *ecc.ECKeyPairStore             `json:"identity_key"`
+	PreKeyId         string                          `json:"pre_key_id"`
+	PreKeys          map[string]*ecc.ECKeyPairStore  `json:"pre_keys"`
+	PQPreKeys        map[string]*kem.KEMKeyPairStore `json:"pq_pre_keys"`
+	PreKeyExpiredAt  map[string]int64                `json:"pre_key_expired_at"`
+	OneTimeKeys      map[string]*ecc.ECKeyPairStore  `json:"one_time_keys"`
+	VerifiedContacts string                          `json:"verified_contacts,omitempty"`
+	Identities       string                          `json:"identities,omitempty"`
+	PinKdf           *common.PinKdfStore             `json:"pin_kdf,omitempty"`
 }
 
-func LoadInternalKey(keyJsonString string, PIN []byte) *InternalKeyBundle {
+// LoadInternalKey reads a store written by Save, an error wrapping
+// common.ErrWrongPIN means PIN does not open it
+func LoadInternalKey(keyJsonString string, PIN []byte) (*InternalKeyBundle, error) {
 	var internalBundleStore InternalKeyBundleStore
 	err := json.Unmarshal([]byte(keyJsonString), &internalBundleStore)
 	if err != nil {
-		fmt.Println("Cannot parse json")
-		return nil
+		return nil, fmt.Errorf("Cannot read key store: %w", err)
+	}
+	if internalBundleStore.IdentityKey == nil {
+		return nil, fmt.Errorf("%w: missing identity key", ecc.ErrInvalidKey)
+	}
+	// Stores written before the PIN KDF are encrypted with the PIN itself
+	var pinKdf *common.PinKdf
+	if internalBundleStore.PinKdf != nil {
+		pinKdf, err = common.LoadPinKdf(internalBundleStore.PinKdf)
+		if err != nil {
+			return nil, err
+		}
+		PIN = pinKdf.DeriveKey(PIN)
+	}
+	identityKey, err := ecc.DeSerializeKey(internalBundleStore.IdentityKey, PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read identity key: %w", err)
 	}
-	identityKey, _ := ecc.DeSerializeKey(internalBundleStore.IdentityKey, PIN)
 	preKeyMap := make(map[string]*ecc.ECKeyPair)
 	for k, v := range internalBundleStore.PreKeys {
-		dKey, _ := ecc.DeSerializeKey(v, PIN)
+		dKey, err := ecc.DeSerializeKey(v, PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read pre key %s: %w", k, err)
+		}
 		preKeyMap[k] = dKey
 	}
-	return &InternalKeyBundle{
-		IdentityKey: identityKey,
-		PreKeys:     preKeyMap,
+	pqPreKeyMap := make(map[string]*kem.KEMKeyPair)
+	for k, v := range internalBundleStore.PQPreKeys {
+		dKey, err := kem.DeSerializeKey(v, PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read post-quantum pre key %s: %w", k, err)
+		}
+		pqPreKeyMap[k] = dKey
+	}
+	oneTimeKeyMap := make(map[string]*ecc.ECKeyPair)
+	for k, v := range internalBundleStore.OneTimeKeys {
+		dKey, err := ecc.DeSerializeKey(v, PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read one-time key %s: %w", k, err)
+		}
+		oneTimeKeyMap[k] = dKey
+	}
+	verifiedContacts := make(map[string][]byte)
+	if internalBundleStore.VerifiedContacts != "" {
+		verifiedJson, err := common.DecryptData(common.DecodeToByte(internalBundleStore.VerifiedContacts), PIN)
+		if err == nil {
+			err = json.Unmarshal(verifiedJson, &verifiedContacts)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read verified contacts: %w", err)
+		}
+	}
+	identities, err := LoadIdentityStore(internalBundleStore.Identities, PIN)
+	if err != nil {
+		return nil, err
+	}
+	preKeyExpiredAt := internalBundleStore.PreKeyExpiredAt
+	if preKeyExpiredAt == nil {
+		preKeyExpiredAt = make(map[string]int64)
+	}
+	internalKey := &InternalKeyBundle{
+		IdentityKey:      identityKey,
+		PreKeyId:         internalBundleStore.PreKeyId,
+		PreKeys:          preKeyMap,
+		PQPreKeys:        pqPreKeyMap,
+		PreKeyExpiredAt:  preKeyExpiredAt,
+		OneTimeKeys:      oneTimeKeyMap,
+		VerifiedContacts: verifiedContacts,
+		Identities:       identities,
+		pinKdf:           pinKdf,
+		legacyStore:      pinKdf == nil,
 	}
+	// Stores written before pre key rotation only have a single pre key
+	if internalKey.PreKeyId == "" {
+		for k := range internalKey.PreKeys {
+			if _, replaced := preKeyExpiredAt[k]; !replaced {
+				internalKey.PreKeyId = k
+			}
+		}
+	}
+	internalKey.RemoveExpiredPreKeys()
+	return internalKey, nil
 }
 
 func NewInternalKeyBundle() *InternalKeyBundle {
-	oneTimeKeys := make(map[string]*ecc.ECKeyPair)
+	return NewInternalKeyBundleWithSuite(ecc.DEFAULT_KEY_SUITE)
+}
+
+// NewInternalKeyBundleWithSuite generates a key bundle whose keys all belong to
+// the given suite, sessions can only be set up with bundles of the same suite
+func NewInternalKeyBundleWithSuite(suite ecc.KeySuite) *InternalKeyBundle {
+	preKeys := make(map[string]*ecc.ECKeyPair)
+	pqPreKeys := make(map[string]*kem.KEMKeyPair)
 	key, _ := uuid.NewUUID()
-	oneTimeKeys[key.String()] = ecc.GenerateKeyPair()
+	preKeys[key.String()] = ecc.GenerateKeyPairWithSuite(suite)
+	pqPreKeys[key.String()] = kem.GenerateKeyPair()
 	return &InternalKeyBundle{
-		IdentityKey:  ecc.GenerateKeyPair(),
-		EphemeralKey: ecc.GenerateKeyPair(),
-		OneTimeKey:   ecc.GenerateKeyPair(),
-		PreKeys:      oneTimeKeys,
+		IdentityKey:      ecc.GenerateKeyPairWithSuite(suite),
+		PreKeyId:         key.String(),
+		PreKeys:          preKeys,
+		PQPreKeys:        pqPreKeys,
+		PreKeyExpiredAt:  make(map[string]int64),
+		OneTimeKeys:      make(map[string]*ecc.ECKeyPair),
+		VerifiedContacts: make(map[string][]byte),
+		Identities:       NewIdentityStore(),
 	}
 }
 
-func (internalKey *InternalKeyBundle) Save(PIN []byte) *InternalKeyBundleStore {
-	identityKey := internalKey.IdentityKey.Save(PIN)
-	oneTimeKeyMap := make(map[string]*ecc.ECKeyPairStore)
+// Save encrypts every private key with a key stretched once from PIN, a
+// bundle loaded from a legacy store gets a fresh salt here
+func (internalKey *InternalKeyBundle) Save(PIN []byte) (*InternalKeyBundleStore, error) {
+	if internalKey.pinKdf == nil {
+		pinKdf, err := common.NewPinKdf()
+		if err != nil {
+			return nil, err
+		}
+		internalKey.pinKdf = pinKdf
+	}
+	storeKey := internalKey.pinKdf.DeriveKey(PIN)
+	identityKey := internalKey.IdentityKey.SaveWithKey(storeKey)
+	preKeyMap := make(map[string]*ecc.ECKeyPairStore)
 	for k, v := range internalKey.PreKeys {
-		oneTimeKeyMap[k] = v.Save(PIN)
+		preKeyMap[k] = v.SaveWithKey(storeKey)
 	}
-	return &InternalKeyBundleStore{
-		IdentityKey: identityKey,
-		PreKeys:     oneTimeKeyMap,
+	pqPreKeyMap := make(map[string]*kem.KEMKeyPairStore)
+	for k, v := range internalKey.PQPreKeys {
+		pqPreKeyMap[k] = v.Save(storeKey)
 	}
+	oneTimeKeyMap := make(map[string]*ecc.ECKeyPairStore)
+	for k, v := range internalKey.OneTimeKeys {
+		oneTimeKeyMap[k] = v.SaveWithKey(storeKey)
+	}
+	verifiedContacts := ""
+	if len(internalKey.VerifiedContacts) != 0 {
+		verifiedJson, _ := json.Marshal(internalKey.VerifiedContacts)
+		cipherText, err := common.EncryptData(verifiedJson, storeKey)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot save verified contacts: %w", err)
+		}
+		verifiedContacts = common.EncodeToString(cipherText)
+	}
+	identities := ""
+	if internalKey.Identities != nil {
+		var err error
+		identities, err = internalKey.Identities.Save(storeKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	internalKey.legacyStore = false
+	return &InternalKeyBundleStore{
+		IdentityKey:      identityKey,
+		PreKeyId:         internalKey.PreKeyId,
+		PreKeys:          preKeyMap,
+		PQPreKeys:        pqPreKeyMap,
+		PreKeyExpiredAt:  internalKey.PreKeyExpiredAt,
+		OneTimeKeys:      oneTimeKeyMap,
+		VerifiedContacts: verifiedContacts,
+		Identities:       identities,
+		PinKdf:           internalKey.pinKdf.Save(),
+	}, nil
 }
 
-func (internalKey *InternalKeyBundle) GenerateEphemeralKey() ecc.ECKeyPair {
-	internalKey.EphemeralKey = ecc.GenerateKeyPair()
-	return *internalKey.EphemeralKey
+// NeedsMigration tells whether the bundle was loaded from a store encrypted
+// with the bare PIN, it should be saved again to upgrade the store
+func (internalKey *InternalKeyBundle) NeedsMigration() bool {
+	return internalKey.legacyStore
 }
 
-func (internalKey *InternalKeyBundle) GeneratePreKey() ecc.ECKeyPair {
-	internalKey.OneTimeKey = ecc.GenerateKeyPair()
-	return *internalKey.OneTimeKey
+func (internalKey *InternalKeyBundle) Suite() ecc.KeySuite {
+	return internalKey.IdentityKey.Suite()
+}
+
+// GeneratePreKey replaces the signed pre key, the old one is kept for
+// gracePeriod so handshakes started against it can still be answered
+func (internalKey *InternalKeyBundle) GeneratePreKey(gracePeriod time.Duration) ecc.ECKeyPair {
+	expiredAt := time.Now().Add(gracePeriod).UnixMilli()
+	for k := range internalKey.PreKeys {
+		if _, replaced := internalKey.PreKeyExpiredAt[k]; !replaced {
+			internalKey.PreKeyExpiredAt[k] = expiredAt
+		}
+	}
+	key, _ := uuid.NewUUID()
+	preKey := ecc.GenerateKeyPairWithSuite(internalKey.Suite())
+	internalKey.PreKeyId = key.String()
+	internalKey.PreKeys[internalKey.PreKeyId] = preKey
+	if internalKey.PQPreKeys == nil {
+		internalKey.PQPreKeys = make(map[string]*kem.KEMKeyPair)
+	}
+	internalKey.PQPreKeys[internalKey.PreKeyId] = kem.GenerateKeyPair()
+	internalKey.RemoveExpiredPreKeys()
+	return *preKey
+}
+
+// RemoveExpiredPreKeys forgets the replaced pre keys whose grace period is over
+func (internalKey *InternalKeyBundle) RemoveExpiredPreKeys() {
+	currentTime := time.Now().UnixMilli()
+	for k, expiredAt := range internalKey.PreKeyExpiredAt {
+		if expiredAt <= currentTime {
+			delete(internalKey.PreKeys, k)
+			delete(internalKey.PQPreKeys, k)
+			delete(internalKey.PreKeyExpiredAt, k)
+		}
+	}
 }
 
 func (internalKey *InternalKeyBundle) GenerateExternalKey() *ExternalKeyBundle {
 	yIk := internalKey.IdentityKey
 	singer := ecc.FromKeyPair(yIk)
 
-	var pk *ecc.ECKeyPair
-	var pkId string
-
-	for k, v := range internalKey.PreKeys {
-		pkId = k
-		pk = v
-	}
+	pkId := internalKey.PreKeyId
+	pk := internalKey.PreKeys[pkId]
 
 	pkPublic, _ := pk.PublicKey().Serialize()
 
-	pkSig, _ := singer.Sign(pkPublic)
+	pkSig, _ := singer.Sign(preKeySignedPayload(pkPublic, CURRENT_PROTOCOL_VERSION))
 
-	return NewExternalKeyBundle(
+	externalKey := NewExternalKeyBundle(
 		yIk.PublicKey(),
-		nil,
 		pkId,
 		pk.PublicKey(),
 		pkSig,
 	)
+	if pqPk := internalKey.PQPreKeys[pkId]; pqPk != nil {
+		externalKey.PQPreKey = pqPk.PublicKey()
+		externalKey.PQPreKeySig, _ = singer.Sign(pqPreKeyDigest(externalKey.PQPreKey))
+	}
+	return externalKey
 }
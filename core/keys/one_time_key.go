@@ -0,0 +1,56 @@
+package keys
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+)
+
+// Encode in base64
+type OneTimeKeyDto struct {
+	KeyId  string `json:"keyId"`
+	Key    string `json:"key"`
+	KeySig string `json:"keySig"`
+}
+
+type OneTimeKeyBatchDto struct {
+	OneTimeKeys []*OneTimeKeyDto `json:"oneTimeKeys"`
+}
+
+// GenerateOneTimeKeys adds a batch of one-time pre keys to the pool and returns
+// their public part signed by the identity key, ready to be uploaded
+func (internalKey *InternalKeyBundle) GenerateOneTimeKeys(count int) (*OneTimeKeyBatchDto, error) {
+	if internalKey.OneTimeKeys == nil {
+		internalKey.OneTimeKeys = make(map[string]*ecc.ECKeyPair)
+	}
+	signer := ecc.FromKeyPair(internalKey.IdentityKey)
+	result := &OneTimeKeyBatchDto{}
+	for i := 0; i < count; i++ {
+		keyId, _ := uuid.NewUUID()
+		keyPair := ecc.GenerateKeyPairWithSuite(internalKey.Suite())
+		pubKey, _ := keyPair.PublicKey().Serialize()
+		keySig, err := signer.Sign(oneTimeKeySignedPayload(pubKey, CURRENT_PROTOCOL_VERSION))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot sign one-time key: %w", err)
+		}
+		internalKey.OneTimeKeys[keyId.String()] = keyPair
+		result.OneTimeKeys = append(result.OneTimeKeys, &OneTimeKeyDto{
+			KeyId:  keyId.String(),
+			Key:    common.EncodeToString(pubKey),
+			KeySig: common.EncodeToString(keySig),
+		})
+	}
+	return result, nil
+}
+
+// ConsumeOneTimeKey returns the one-time key with the given ID and removes it
+// from the pool, so it can never be used for a second session
+func (internalKey *InternalKeyBundle) ConsumeOneTimeKey(keyId string) (*ecc.ECKeyPair, error) {
+	keyPair := internalKey.OneTimeKeys[keyId]
+	if keyPair == nil {
+		return nil, fmt.Errorf("Unknown one-time key %s", keyId)
+	}
+	delete(internalKey.OneTimeKeys, keyId)
+	return keyPair, nil
+}
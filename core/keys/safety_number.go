@@ -0,0 +1,129 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+)
+
+// A safety number is made of one fingerprint per party, each fingerprint is
+// an iterated SHA-512 over the identity key and the username of its owner.
+// The two fingerprints are sorted so both parties get the same number
+//
+//	numeric   60 digits, 30 per fingerprint in groups of 5
+//	scannable version | lower fingerprint | higher fingerprint
+const (
+	SAFETY_NUMBER_VERSION    uint16 = 0
+	safetyNumberIterations          = 5200
+	safetyNumberFingerprint         = 32
+	safetyNumberDigitsLength        = 30
+)
+
+type SafetyNumber struct {
+	Numeric   string
+	Scannable []byte
+}
+
+// Encode in base64
+type SafetyNumberDto struct {
+	Numeric   string `json:"numeric"`
+	Scannable string `json:"scannable"`
+}
+
+// NewSafetyNumber computes the safety number of a conversation, the result
+// does not depend on which side is local
+func NewSafetyNumber(localUsername string, localIdentityKey ecc.IECPublicKey, remoteUsername string, remoteIdentityKey ecc.IECPublicKey) (*SafetyNumber, error) {
+	localFingerprint, err := identityFingerprint(localUsername, localIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	remoteFingerprint, err := identityFingerprint(remoteUsername, remoteIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(localFingerprint, remoteFingerprint) > 0 {
+		localFingerprint, remoteFingerprint = remoteFingerprint, localFingerprint
+	}
+	scannable := binary.BigEndian.AppendUint16(nil, SAFETY_NUMBER_VERSION)
+	scannable = append(scannable, localFingerprint...)
+	scannable = append(scannable, remoteFingerprint...)
+	return &SafetyNumber{
+		Numeric:   fingerprintDigits(localFingerprint) + fingerprintDigits(remoteFingerprint),
+		Scannable: scannable,
+	}, nil
+}
+
+// Matches compares a payload scanned from the other device
+func (s *SafetyNumber) Matches(scanned []byte) bool {
+	return subtle.ConstantTimeCompare(s.Scannable, scanned) == 1
+}
+
+func (s *SafetyNumber) ToDto() *SafetyNumberDto {
+	return &SafetyNumberDto{
+		Numeric:   s.Numeric,
+		Scannable: common.EncodeToString(s.Scannable),
+	}
+}
+
+func identityFingerprint(username string, identityKey ecc.IECPublicKey) ([]byte, error) {
+	if identityKey == nil || username == "" {
+		return nil, fmt.Errorf("%w: missing identity for safety number", ecc.ErrInvalidKey)
+	}
+	key, err := identityKey.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize identity key: %w", err)
+	}
+	hash := binary.BigEndian.AppendUint16(nil, SAFETY_NUMBER_VERSION)
+	hash = common.ConcatBytes(hash, key, []byte(username))
+	for i := 0; i < safetyNumberIterations; i++ {
+		sum := sha512.Sum512(common.ConcatBytes(hash, key))
+		hash = sum[:]
+	}
+	return hash[:safetyNumberFingerprint], nil
+}
+
+// fingerprintDigits turns every 5 bytes of the fingerprint into 5 digits
+func fingerprintDigits(fingerprint []byte) string {
+	result := ""
+	for i := 0; i < safetyNumberDigitsLength/5; i++ {
+		chunk := fingerprint[i*5 : i*5+5]
+		value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		result += fmt.Sprintf("%05d", value%100000)
+	}
+	return result
+}
+
+// MarkVerified records that the user compared the safety number of username
+// with identityKey, the mark is dropped when the contact shows another key
+func (internalKey *InternalKeyBundle) MarkVerified(username string, identityKey ecc.IECPublicKey) error {
+	key, err := serializeIdentityKey(username, identityKey)
+	if err != nil {
+		return err
+	}
+	if internalKey.VerifiedContacts == nil {
+		internalKey.VerifiedContacts = make(map[string][]byte)
+	}
+	internalKey.VerifiedContacts[username] = key
+	return nil
+}
+
+func (internalKey *InternalKeyBundle) ClearVerified(username string) {
+	delete(internalKey.VerifiedContacts, username)
+}
+
+// IsVerified is only true for the exact identity key that was verified
+func (internalKey *InternalKeyBundle) IsVerified(username string, identityKey ecc.IECPublicKey) bool {
+	verifiedKey, existed := internalKey.VerifiedContacts[username]
+	if !existed || identityKey == nil {
+		return false
+	}
+	key, err := identityKey.Serialize()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(verifiedKey, key)
+}
@@ -0,0 +1,187 @@
+package keys
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/crypto/kdf"
+	"time"
+)
+
+// A sealed sender envelope only names its recipient to the server, who sent
+// it is sealed to the recipient identity key in two layers
+//
+//	version      1 byte
+//	ephemeralKey uint16 length + serialized key
+//	senderKey    uint16 length + sender identity key sealed with DH(e, IKr)
+//	content      the rest, sealed with DH(IKs, IKr)
+//
+// The ephemeral layer hides the sender identity key, the static layer proves
+// the sender holds it. The content is
+//
+//	certificate   uint16 length + sender certificate
+//	deliveryToken uint16 length + token to reply sealed, may be empty
+//	message       the rest
+const SEALED_SENDER_VERSION_1 byte = 0x01
+
+// SealedMessage is what the recipient gets out of an envelope, Certificate
+// is verified and issued for the key the sender proved to hold
+type SealedMessage struct {
+	Certificate   *SenderCertificate
+	DeliveryToken []byte
+	Message       []byte
+}
+
+// SealMessage seals message for the owner of recipientIdentityKey, both
+// identity keys have to be of the same suite
+func SealMessage(internalKey *InternalKeyBundle, certificate *SenderCertificate, deliveryToken []byte, recipientIdentityKey ecc.IECPublicKey, message []byte) ([]byte, error) {
+	if !certificate.HasIdentityKey(internalKey.IdentityKey.PublicKey()) {
+		return nil, fmt.Errorf("Sender certificate was not issued for our identity key")
+	}
+	if recipientIdentityKey == nil || recipientIdentityKey.Suite() != internalKey.Suite() {
+		return nil, fmt.Errorf("Recipient identity key does not match our key suite")
+	}
+	recipientKey, err := recipientIdentityKey.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize recipient identity key: %w", err)
+	}
+	senderKey, err := internalKey.IdentityKey.PublicKey().Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize identity key: %w", err)
+	}
+	serializedCertificate := certificate.Serialize()
+	if len(serializedCertificate) > 0xffff || len(deliveryToken) > 0xffff {
+		return nil, fmt.Errorf("Sealed sender field too long")
+	}
+
+	ephemeralKey := ecc.GenerateKeyPairWithSuite(internalKey.Suite())
+	ephemeralPubKey, err := ephemeralKey.PublicKey().Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize ephemeral key: %w", err)
+	}
+	ephemeralSecret, err := ephemeralKey.PrivateKey().CalculateCommonSecret(recipientIdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate ephemeral secret: %w", err)
+	}
+	sealedSenderKey, err := sealLayer(senderKey, kdf.LABEL_SEALED_EPHEMERAL, ephemeralSecret, ephemeralPubKey, recipientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	staticSecret, err := internalKey.IdentityKey.PrivateKey().CalculateCommonSecret(recipientIdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate static secret: %w", err)
+	}
+	content := binary.BigEndian.AppendUint16(nil, uint16(len(serializedCertificate)))
+	content = append(content, serializedCertificate...)
+	content = binary.BigEndian.AppendUint16(content, uint16(len(deliveryToken)))
+	content = append(content, deliveryToken...)
+	content = append(content, message...)
+	sealedContent, err := sealLayer(content, kdf.LABEL_SEALED_STATIC, staticSecret, ephemeralPubKey, sealedSenderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []byte{SEALED_SENDER_VERSION_1}
+	result = binary.BigEndian.AppendUint16(result, uint16(len(ephemeralPubKey)))
+	result = append(result, ephemeralPubKey...)
+	result = binary.BigEndian.AppendUint16(result, uint16(len(sealedSenderKey)))
+	result = append(result, sealedSenderKey...)
+	return append(result, sealedContent...), nil
+}
+
+// OpenSealedMessage opens an envelope sealed to our identity key, the sender
+// certificate has to be signed by serverKey and valid at now
+func OpenSealedMessage(internalKey *InternalKeyBundle, serverKey ecc.IECPublicKey, envelope []byte, now time.Time) (*SealedMessage, error) {
+	if len(envelope) < 1 || envelope[0] != SEALED_SENDER_VERSION_1 {
+		return nil, fmt.Errorf("Unsupported sealed sender envelope")
+	}
+	ephemeralPubKey, rest, err := readLengthPrefixed(envelope[1:])
+	if err != nil {
+		return nil, err
+	}
+	sealedSenderKey, sealedContent, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+	recipientKey, err := internalKey.IdentityKey.PublicKey().Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize identity key: %w", err)
+	}
+
+	ephemeralKey, err := ecc.DeserializePublicKey(ephemeralPubKey)
+	if err != nil || ephemeralKey.Suite() != internalKey.Suite() {
+		return nil, fmt.Errorf("Cannot read ephemeral key")
+	}
+	ephemeralSecret, err := internalKey.IdentityKey.PrivateKey().CalculateCommonSecret(ephemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate ephemeral secret: %w", err)
+	}
+	senderKey, err := openLayer(sealedSenderKey, kdf.LABEL_SEALED_EPHEMERAL, ephemeralSecret, ephemeralPubKey, recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	senderIdentityKey, err := ecc.DeserializePublicKey(senderKey)
+	if err != nil || senderIdentityKey.Suite() != internalKey.Suite() {
+		return nil, fmt.Errorf("Cannot read sender identity key")
+	}
+
+	staticSecret, err := internalKey.IdentityKey.PrivateKey().CalculateCommonSecret(senderIdentityKey)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate static secret: %w", err)
+	}
+	content, err := openLayer(sealedContent, kdf.LABEL_SEALED_STATIC, staticSecret, ephemeralPubKey, sealedSenderKey)
+	if err != nil {
+		return nil, err
+	}
+	serializedCertificate, rest, err := readLengthPrefixed(content)
+	if err != nil {
+		return nil, err
+	}
+	deliveryToken, message, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate, err := ParseSenderCertificate(serializedCertificate)
+	if err != nil {
+		return nil, err
+	}
+	err = certificate.Verify(serverKey, now)
+	if err != nil {
+		return nil, err
+	}
+	if !certificate.HasIdentityKey(senderIdentityKey) {
+		return nil, fmt.Errorf("Sender certificate does not match the sender identity key")
+	}
+	return &SealedMessage{
+		Certificate:   certificate,
+		DeliveryToken: append([]byte(nil), deliveryToken...),
+		Message:       append([]byte(nil), message...),
+	}, nil
+}
+
+// sealLayer derives the layer key from secret and the layer context, the
+// context is also bound as associated data
+func sealLayer(plainText []byte, label string, secret, ephemeralPubKey, context []byte) ([]byte, error) {
+	associatedData := common.ConcatBytes(ephemeralPubKey, context)
+	layerKey, err := kdf.DeriveKey(common.ConcatBytes(secret, associatedData), label)
+	if err != nil {
+		return nil, err
+	}
+	return common.SealWithKey(plainText, layerKey, associatedData)
+}
+
+func openLayer(cipherText []byte, label string, secret, ephemeralPubKey, context []byte) ([]byte, error) {
+	associatedData := common.ConcatBytes(ephemeralPubKey, context)
+	layerKey, err := kdf.DeriveKey(common.ConcatBytes(secret, associatedData), label)
+	if err != nil {
+		return nil, err
+	}
+	plainText, err := common.OpenWithKey(cipherText, layerKey, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open sealed sender envelope: %w", err)
+	}
+	return plainText, nil
+}
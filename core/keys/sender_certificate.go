@@ -0,0 +1,135 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lidx-core-lib/crypto/ecc"
+	"time"
+)
+
+// A sender certificate is issued by the server for sealed sender, it binds a
+// username to its identity key until it expires
+//
+//	version     1 byte
+//	expiresAt   uint64 unix milli
+//	username    uint16 length + bytes
+//	identityKey uint16 length + serialized key
+//	signature   uint16 length + server signature over everything before
+const SENDER_CERTIFICATE_VERSION_1 byte = 0x01
+
+// ErrInvalidCertificate is returned for a sender certificate that cannot be
+// read
+var ErrInvalidCertificate = errors.New("Invalid sender certificate")
+
+type SenderCertificate struct {
+	Username    string
+	IdentityKey ecc.IECPublicKey
+	ExpiresAt   int64
+	Signature   []byte
+	signed      []byte
+}
+
+// NewSenderCertificate signs a certificate the way the server does it
+func NewSenderCertificate(serverKey *ecc.ECKeyPair, username string, identityKey ecc.IECPublicKey, expiresAt time.Time) (*SenderCertificate, error) {
+	key, err := identityKey.Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot serialize identity key: %w", err)
+	}
+	if len(username) > 0xffff || len(key) > 0xffff {
+		return nil, fmt.Errorf("Sender certificate field too long")
+	}
+	signed := []byte{SENDER_CERTIFICATE_VERSION_1}
+	signed = binary.BigEndian.AppendUint64(signed, uint64(expiresAt.UnixMilli()))
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(username)))
+	signed = append(signed, username...)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(key)))
+	signed = append(signed, key...)
+	signature, err := ecc.FromKeyPair(serverKey).Sign(signed)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot sign sender certificate: %w", err)
+	}
+	return &SenderCertificate{
+		Username:    username,
+		IdentityKey: identityKey,
+		ExpiresAt:   expiresAt.UnixMilli(),
+		Signature:   signature,
+		signed:      signed,
+	}, nil
+}
+
+// ParseSenderCertificate reads a certificate, it still has to be verified
+func ParseSenderCertificate(data []byte) (*SenderCertificate, error) {
+	if len(data) < 9 || data[0] != SENDER_CERTIFICATE_VERSION_1 {
+		return nil, fmt.Errorf("%w: unsupported version", ErrInvalidCertificate)
+	}
+	expiresAt := binary.BigEndian.Uint64(data[1:9])
+	username, rest, err := readLengthPrefixed(data[9:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+	key, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+	signed := data[:len(data)-len(rest)]
+	signature, rest, err := readLengthPrefixed(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidCertificate)
+	}
+	identityKey, err := ecc.DeserializePublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read sender identity key: %w", ErrInvalidCertificate, err)
+	}
+	return &SenderCertificate{
+		Username:    string(username),
+		IdentityKey: identityKey,
+		ExpiresAt:   int64(expiresAt),
+		Signature:   append([]byte(nil), signature...),
+		signed:      append([]byte(nil), signed...),
+	}, nil
+}
+
+func (c *SenderCertificate) Serialize() []byte {
+	result := append([]byte(nil), c.signed...)
+	result = binary.BigEndian.AppendUint16(result, uint16(len(c.Signature)))
+	return append(result, c.Signature...)
+}
+
+// Verify checks the server signature and the expiry
+func (c *SenderCertificate) Verify(serverKey ecc.IECPublicKey, now time.Time) error {
+	if err := ecc.VerifySignature(serverKey, c.signed, c.Signature); err != nil {
+		return fmt.Errorf("Invalid sender certificate signature: %w", err)
+	}
+	if now.UnixMilli() >= c.ExpiresAt {
+		return fmt.Errorf("Sender certificate expired")
+	}
+	return nil
+}
+
+// HasIdentityKey tells whether the certificate was issued for identityKey
+func (c *SenderCertificate) HasIdentityKey(identityKey ecc.IECPublicKey) bool {
+	certKey, err := c.IdentityKey.Serialize()
+	if err != nil || identityKey == nil {
+		return false
+	}
+	key, err := identityKey.Serialize()
+	return err == nil && bytes.Equal(certKey, key)
+}
+
+// readLengthPrefixed splits off a field stored behind a big endian uint16 length
+func readLengthPrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("Field too short")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < length {
+		return nil, nil, fmt.Errorf("Field too short")
+	}
+	return data[:length], data[length:], nil
+}
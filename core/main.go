@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"lidx-core-lib/attachment"
 	"lidx-core-lib/common"
 	"lidx-core-lib/crypto/ecc"
 	"lidx-core-lib/keys"
 	"lidx-core-lib/ratchet"
+	"lidx-core-lib/voip"
 	"log"
 	"syscall/js"
+	"time"
 )
 
 var INTERNAL_KEY_PREFIX = "INTERNAL_KEY_"
@@ -21,6 +25,8 @@ var EXTERNAL_KEY_STORAGE = make(map[string]*keys.ExternalKeyBundle)
 
 var RATCHET_STORAGE = make(map[string]*ratchet.Ratchet)
 
+var VOIP_STORAGE = make(map[string]*voip.Session)
+
 var PIN = ""
 
 func main() {
@@ -32,17 +38,38 @@ func main() {
 	go js.Global().Set("generateInternalKeyBundle", js.FuncOf(generateInternalKeyBundle))
 	go js.Global().Set("loadInternalKey", js.FuncOf(loadInternalKey))
 	go js.Global().Set("saveInternalKey", js.FuncOf(saveInternalKey))
+	go js.Global().Set("internalKeyNeedsMigration", js.FuncOf(internalKeyNeedsMigration))
 	go js.Global().Set("regeneratePreKey", js.FuncOf(regeneratePreKey))
+	go js.Global().Set("generateOneTimeKeys", js.FuncOf(generateOneTimeKeys))
 	go js.Global().Set("populateExternalKeyBundle", js.FuncOf(populateExternalKeyBundle))
+	go js.Global().Set("getSafetyNumber", js.FuncOf(getSafetyNumber))
+	go js.Global().Set("compareSafetyNumber", js.FuncOf(compareSafetyNumber))
+	go js.Global().Set("markContactVerified", js.FuncOf(markContactVerified))
+	go js.Global().Set("isContactVerified", js.FuncOf(isContactVerified))
+	go js.Global().Set("getTrustedIdentity", js.FuncOf(getTrustedIdentity))
+	go js.Global().Set("acceptIdentityKeyChange", js.FuncOf(acceptIdentityKeyChange))
 	go js.Global().Set("initRatchetFromInternal", js.FuncOf(initRatchetFromInternal))
 	go js.Global().Set("initRatchetFromExternal", js.FuncOf(initRatchetFromExternal))
+	go js.Global().Set("initSessionReset", js.FuncOf(initSessionReset))
+	go js.Global().Set("acceptSessionReset", js.FuncOf(acceptSessionReset))
 	go js.Global().Set("saveRatchet", js.FuncOf(saveRatchet))
 	go js.Global().Set("loadRatchet", js.FuncOf(loadRatchet))
+	go js.Global().Set("ratchetNeedsMigration", js.FuncOf(ratchetNeedsMigration))
 	go js.Global().Set("isRatchetExist", js.FuncOf(isRatchetExist))
+	go js.Global().Set("setRatchetPadding", js.FuncOf(setRatchetPadding))
 	go js.Global().Set("sendMessage", js.FuncOf(sendMessage))
 	go js.Global().Set("receiveMessage", js.FuncOf(receiveMessage))
+	go js.Global().Set("encodeMessage", js.FuncOf(encodeMessage))
+	go js.Global().Set("decodeSocketFrame", js.FuncOf(decodeSocketFrame))
+	go js.Global().Set("sealMessage", js.FuncOf(sealMessage))
+	go js.Global().Set("openSealedMessage", js.FuncOf(openSealedMessage))
+	go js.Global().Set("encryptAttachment", js.FuncOf(encryptAttachment))
+	go js.Global().Set("decryptAttachment", js.FuncOf(decryptAttachment))
 	go js.Global().Set("initVoipSessionFromInternal", js.FuncOf(initVoipSessionFromInternal))
 	go js.Global().Set("initVoipSessionFromExternal", js.FuncOf(initVoipSessionFromExternal))
+	go js.Global().Set("encryptVoipFrame", js.FuncOf(encryptVoipFrame))
+	go js.Global().Set("decryptVoipFrame", js.FuncOf(decryptVoipFrame))
+	go js.Global().Set("closeVoipSession", js.FuncOf(closeVoipSession))
 
 	<-done
 }
@@ -55,30 +82,71 @@ func startUp(this js.Value, args []js.Value) interface{} {
 }
 
 // Internal Key API
+// (1) optional arg is the key suite name, the default suite is used without it
 func generateInternalKeyBundle(this js.Value, args []js.Value) interface{} {
-	internalKey := keys.NewInternalKeyBundle()
+	suite := ecc.DEFAULT_KEY_SUITE
+	if len(args) > 0 && args[0].Type() == js.TypeString {
+		parsedSuite, err := ecc.ParseKeySuite(args[0].String())
+		if err != nil {
+			return errorToJsObject(err)
+		}
+		suite = parsedSuite
+	}
+	internalKey := keys.NewInternalKeyBundleWithSuite(suite)
 	return insertInternalKeyToStorage(internalKey)
 }
 
+// (1) optional arg is the grace period of the replaced pre key in milliseconds
+// the internal key has to be saved again after this call
 func regeneratePreKey(this js.Value, args []js.Value) interface{} {
 	internalKey := loadInternalKeyFromStorage()
-	internalKey.GeneratePreKey()
+	gracePeriod := keys.DEFAULT_PRE_KEY_GRACE_PERIOD
+	if len(args) > 0 && args[0].Type() == js.TypeNumber {
+		gracePeriod = time.Duration(args[0].Int()) * time.Millisecond
+	}
+	internalKey.GeneratePreKey(gracePeriod)
 	externalKeyBundle := internalKey.GenerateExternalKey()
 	insertExternalKeyToStorage(externalKeyBundle)
 	return convertToJsObject(externalKeyBundle.ToDto())
 }
 
+// (1) arg is number of one-time keys to generate
+// the internal key has to be saved again after this call
+func generateOneTimeKeys(this js.Value, args []js.Value) interface{} {
+	internalKey := loadInternalKeyFromStorage()
+	oneTimeKeys, err := internalKey.GenerateOneTimeKeys(args[0].Int())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return convertToJsObject(oneTimeKeys)
+}
+
 // param 1 : key json string
+// returns an error with code WRONG_PIN when the PIN given to startUp does not open it and
+// INVALID_KEY when the store has no identity key
 func loadInternalKey(this js.Value, args []js.Value) interface{} {
 	decodedPin := common.StringToByte(PIN)
-	internalKey := keys.LoadInternalKey(args[0].String(), decodedPin)
+	internalKey, err := keys.LoadInternalKey(args[0].String(), decodedPin)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 	return insertInternalKeyToStorage(internalKey)
 }
 
 func saveInternalKey(this js.Value, args []js.Value) interface{} {
 	internalKey := loadInternalKeyFromStorage()
 	decodedPin := common.StringToByte(PIN)
-	return convertToJsObject(internalKey.Save(decodedPin))
+	keyStore, err := internalKey.Save(decodedPin)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return convertToJsObject(keyStore)
+}
+
+// true when the loaded internal key store was encrypted with the bare PIN, it has to be saved again
+func internalKeyNeedsMigration(this js.Value, args []js.Value) interface{} {
+	internalKey := loadInternalKeyFromStorage()
+	return internalKey != nil && internalKey.NeedsMigration()
 }
 
 func populateExternalKeyBundle(this js.Value, args []js.Value) interface{} {
@@ -91,49 +159,195 @@ func populateExternalKeyBundle(this js.Value, args []js.Value) interface{} {
 	return convertToJsObject(externalKeyBundle.ToDto())
 }
 
+// Safety number API
+// (1) arg is our username
+// (2) is other username
+// (3) is other user external key bundle json string
+func getSafetyNumber(this js.Value, args []js.Value) interface{} {
+	safetyNumber, err := safetyNumberFromArgs(args)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return convertToJsObject(safetyNumber.ToDto())
+}
+
+// (1), (2), (3) are the args of getSafetyNumber
+// (4) is the scannable payload read from the other device, base64
+func compareSafetyNumber(this js.Value, args []js.Value) interface{} {
+	safetyNumber, err := safetyNumberFromArgs(args)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return safetyNumber.Matches(common.DecodeToByte(args[3].String()))
+}
+
+// (1) arg is other username
+// (2) is other user external key bundle json string
+// (3) is true to mark the contact verified, false to clear the mark
+// the internal key has to be saved again after this call
+func markContactVerified(this js.Value, args []js.Value) interface{} {
+	internalKey, err := requireInternalKey()
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	username := args[0].String()
+	if !args[2].Bool() {
+		internalKey.ClearVerified(username)
+		return true
+	}
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[1].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	err = internalKey.MarkVerified(username, externalKeyBundle.IdentityKey)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return true
+}
+
+// (1) arg is other username
+// (2) is other user external key bundle json string
+func isContactVerified(this js.Value, args []js.Value) interface{} {
+	internalKey := loadInternalKeyFromStorage()
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[1].String())
+	if err != nil {
+		log.Println("cannot read external key bundle")
+		return false
+	}
+	return internalKey.IsVerified(args[0].String(), externalKeyBundle.IdentityKey)
+}
+
+func safetyNumberFromArgs(args []js.Value) (*keys.SafetyNumber, error) {
+	internalKey, err := requireInternalKey()
+	if err != nil {
+		return nil, err
+	}
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[2].String())
+	if err != nil {
+		return nil, err
+	}
+	return keys.NewSafetyNumber(args[0].String(), internalKey.IdentityKey.PublicKey(), args[1].String(), externalKeyBundle.IdentityKey)
+}
+
+// Identity trust API
+// (1) arg is other username, returns nil for a contact never seen
+func getTrustedIdentity(this js.Value, args []js.Value) interface{} {
+	internalKey := loadInternalKeyFromStorage()
+	if internalKey.Identities == nil {
+		return nil
+	}
+	trusted := internalKey.Identities.Get(args[0].String())
+	if trusted == nil {
+		return nil
+	}
+	return convertToJsObject(trusted.ToDto())
+}
+
+// (1) arg is other username
+// (2) is other user external key bundle json string carrying the new identity key
+// the internal key has to be saved again after this call
+func acceptIdentityKeyChange(this js.Value, args []js.Value) interface{} {
+	internalKey, err := requireInternalKey()
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[1].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	err = internalKey.AcceptIdentityChange(args[0].String(), externalKeyBundle.IdentityKey)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return true
+}
+
 // Rachet API
-// First param is other user external key bundle
+// (1) arg is other user external key bundle
+// (2) is other username, its identity key has to match the trusted one
+// returns {identityKeyChanged: true} when the key changed since first use
+// the internal key has to be saved again after this call
 func initRatchetFromInternal(this js.Value, args []js.Value) interface{} {
 	externalKeyString := args[0].String()
 	externalKeyBundle, err := keys.NewExternalKeyFromJson(externalKeyString)
 	if err != nil {
-		log.Println("cannot read external key bundle")
-		return nil
+		return errorToJsObject(err)
 	}
 	internalKey := loadInternalKeyFromStorage()
-	if internalKey.EphemeralKey == nil {
-		internalKey.GenerateEphemeralKey()
+	err = trustIdentityFromArgs(internalKey, args, 1, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
 	}
 
-	rachet, _ := ratchet.NewRachetFromInternal(internalKey, externalKeyBundle)
+	rachet, err := ratchet.NewRachetFromInternal(internalKey, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 	insertRatchetToStorage(rachet)
-	ePubKey, _ := internalKey.EphemeralKey.PublicKey().Serialize()
+	ePubKey, _ := rachet.GetEphemeralKey().Serialize()
 
 	resultMap := make(map[string]interface{})
 	resultMap["ratchetId"] = rachet.GetId()
 	resultMap["keyBundle"] = externalKeyBundle.ToDto()
 	resultMap["ephemeralKey"] = common.EncodeToString(ePubKey)
+	resultMap["preKeyId"] = rachet.PreKeyId
+	resultMap["oneTimeKeyId"] = rachet.OneTimeKeyId
+	resultMap["pqCipherText"] = common.EncodeToString(rachet.GetPQCipherText())
+	resultMap["protocolVersion"] = rachet.ProtocolVersion
 	return convertToJsObject(resultMap)
 }
 
 // (1) arg is externalKeyJsonString
 // (2) is external ephemeralPubKeyString
 // (3) is other ratchetId
+// (4) is id of our pre key used by the other user, optional
+// (5) is one-time key id picked by the other user, optional
+// (6) is ML-KEM cipher text sent by the other user, optional
+// (7) is protocol version picked by the other user, optional
+// (8) is other username, its identity key has to match the trusted one
+// returns {identityKeyChanged: true} when the key changed since first use
+// the internal key has to be saved again after this call
 func initRatchetFromExternal(this js.Value, args []js.Value) interface{} {
 	externalKeyString := args[0].String()
 	externalEphemeralPubKeyString := args[1].String()
 	externalRatchetId := args[2].String()
+	var preKeyId string
+	if len(args) > 3 && args[3].Type() == js.TypeString {
+		preKeyId = args[3].String()
+	}
+	var oneTimeKeyId string
+	if len(args) > 4 && args[4].Type() == js.TypeString {
+		oneTimeKeyId = args[4].String()
+	}
+	var pqCipherText []byte
+	if len(args) > 5 && args[5].Type() == js.TypeString {
+		pqCipherText = common.DecodeToByte(args[5].String())
+	}
+	var protocolVersion uint
+	if len(args) > 6 && args[6].Type() == js.TypeNumber {
+		protocolVersion = uint(args[6].Int())
+	}
 	externalKeyBundle, err := keys.NewExternalKeyFromJson(externalKeyString)
 	if err != nil {
-		log.Println("cannot read external key bundle")
-		return nil
+		return errorToJsObject(err)
 	}
 
 	internalKey := loadInternalKeyFromStorage()
+	err = trustIdentityFromArgs(internalKey, args, 7, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
-	externalEphemeralPubKey, _ := ecc.DeserializePublicKey(common.DecodeToByte(externalEphemeralPubKeyString))
+	externalEphemeralPubKey, err := ecc.DeserializePublicKey(common.DecodeToByte(externalEphemeralPubKeyString))
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
-	rachet, _ := ratchet.NewRachetFromExternal(internalKey, externalKeyBundle, externalEphemeralPubKey, externalRatchetId)
+	rachet, err := ratchet.NewRachetFromExternal(internalKey, externalKeyBundle, externalEphemeralPubKey, externalRatchetId, preKeyId, oneTimeKeyId, pqCipherText, protocolVersion)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
 	insertRatchetToStorage(rachet)
 	resultMap := make(map[string]interface{})
@@ -141,65 +355,261 @@ func initRatchetFromExternal(this js.Value, args []js.Value) interface{} {
 	return convertToJsObject(resultMap)
 }
 
+// Session reset API
+// (1) arg is the current external key bundle of the other user
+// (2) is other username, its identity key has to match the trusted one
+// (3) is ratchet ID of the broken session, the new ratchet keeps it
+// (4) is the indexes of the messages we could not decrypt, optional
+// returns the new ratchet ID and the reset to send, {identityKeyChanged: true} when the key changed since first use
+// the internal key and the ratchet have to be saved again after this call
+func initSessionReset(this js.Value, args []js.Value) interface{} {
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	internalKey := loadInternalKeyFromStorage()
+	err = trustIdentityFromArgs(internalKey, args, 1, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	ratchetId := args[2].String()
+	var failedIndexes []uint
+	if len(args) > 3 && args[3].Type() == js.TypeObject {
+		for i := 0; i < args[3].Length(); i++ {
+			failedIndexes = append(failedIndexes, uint(args[3].Index(i).Int()))
+		}
+	}
+
+	rachet, reset, err := ratchet.NewSessionReset(internalKey, externalKeyBundle, ratchetId, RATCHET_STORAGE[ratchetId], failedIndexes)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	replaceRatchetInStorage(rachet)
+	resultMap := make(map[string]interface{})
+	resultMap["ratchetId"] = rachet.GetId()
+	resultMap["reset"] = reset.ToDto()
+	return convertToJsObject(resultMap)
+}
+
+// (1) arg is the reset sent by the other user as json
+// (2) is the external key bundle of the other user
+// (3) is other username, its identity key has to match the trusted one
+// returns the ratchet ID and the indexes of our messages the other user lost
+// the internal key and the ratchet have to be saved again after this call
+func acceptSessionReset(this js.Value, args []js.Value) interface{} {
+	reset, err := ratchet.NewSessionResetFromJson(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	externalKeyBundle, err := keys.NewExternalKeyFromJson(args[1].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	internalKey := loadInternalKeyFromStorage()
+	err = trustIdentityFromArgs(internalKey, args, 2, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+
+	rachet, unrecoverableIndexes, err := ratchet.AcceptSessionReset(internalKey, externalKeyBundle, reset, RATCHET_STORAGE[reset.RatchetId])
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	replaceRatchetInStorage(rachet)
+	resultMap := make(map[string]interface{})
+	resultMap["ratchetId"] = rachet.GetId()
+	resultMap["unrecoverableIndexes"] = append([]uint{}, unrecoverableIndexes...)
+	return convertToJsObject(resultMap)
+}
+
+// (1) arg is other user external key bundle
+// (2) is other username, its identity key has to match the trusted one
+// returns {callId, ephemeralKey, preKeyId, protocolVersion}, the call keys stay
+// in the core and frames are sealed with encryptVoipFrame under callId
 func initVoipSessionFromInternal(this js.Value, args []js.Value) interface{} {
 	externalKeyString := args[0].String()
 	externalKeyBundle, err := keys.NewExternalKeyFromJson(externalKeyString)
 	if err != nil {
-		log.Println("cannot read external key bundle")
-		return nil
+		return errorToJsObject(err)
 	}
 	internalKey := loadInternalKeyFromStorage()
-	if internalKey.EphemeralKey == nil {
-		internalKey.GenerateEphemeralKey()
+	err = trustIdentityFromArgs(internalKey, args, 1, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
 	}
+	// The call signaling has no room for a one-time key id or KEM cipher text
+	externalKeyBundle.OneTimeKey = nil
+	externalKeyBundle.PQPreKey = nil
 
-	rachet, _ := ratchet.NewRachetFromInternal(internalKey, externalKeyBundle)
-	ePubKey, _ := internalKey.EphemeralKey.PublicKey().Serialize()
+	rachet, err := ratchet.NewRachetFromInternal(internalKey, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	ePubKey, _ := rachet.GetEphemeralKey().Serialize()
+	callId, err := insertVoipSessionToStorage(rachet, true)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
 	resultMap := make(map[string]interface{})
-	resultMap["sessionCommonSecretKey"] = common.EncodeToString(rachet.RootKey)
+	resultMap["callId"] = callId
 	resultMap["ephemeralKey"] = common.EncodeToString(ePubKey)
+	resultMap["preKeyId"] = rachet.PreKeyId
+	resultMap["protocolVersion"] = rachet.ProtocolVersion
 	return convertToJsObject(resultMap)
 }
 
 // (1) arg is externalKeyJsonString
 // (2) is external ephemeralPubKeyString
+// (3) is protocol version picked by the caller, optional
+// (4) is other username, its identity key has to match the trusted one
+// (5) is the id of our pre key the caller used, optional, without it our
+// current pre key is taken
+// returns {callId}
 func initVoipSessionFromExternal(this js.Value, args []js.Value) interface{} {
 	externalKeyString := args[0].String()
 	externalEphemeralPubKeyString := args[1].String()
+	var protocolVersion uint
+	if len(args) > 2 && args[2].Type() == js.TypeNumber {
+		protocolVersion = uint(args[2].Int())
+	}
+	var preKeyId string
+	if len(args) > 4 && args[4].Type() == js.TypeString {
+		preKeyId = args[4].String()
+	}
 	externalKeyBundle, err := keys.NewExternalKeyFromJson(externalKeyString)
 	if err != nil {
-		log.Println("cannot read external key bundle")
-		return nil
+		return errorToJsObject(err)
 	}
 
 	internalKey := loadInternalKeyFromStorage()
+	err = trustIdentityFromArgs(internalKey, args, 3, externalKeyBundle)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
-	externalEphemeralPubKey, _ := ecc.DeserializePublicKey(common.DecodeToByte(externalEphemeralPubKeyString))
+	externalEphemeralPubKey, err := ecc.DeserializePublicKey(common.DecodeToByte(externalEphemeralPubKeyString))
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
-	rachet, _ := ratchet.NewRachetFromExternal(internalKey, externalKeyBundle, externalEphemeralPubKey, "")
+	rachet, err := ratchet.NewRachetFromExternal(internalKey, externalKeyBundle, externalEphemeralPubKey, "", preKeyId, "", nil, protocolVersion)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	callId, err := insertVoipSessionToStorage(rachet, false)
+	if err != nil {
+		return errorToJsObject(err)
+	}
 
 	resultMap := make(map[string]interface{})
-	resultMap["sessionCommonSecretKey"] = common.EncodeToString(rachet.RootKey)
+	resultMap["callId"] = callId
 	return convertToJsObject(resultMap)
 }
 
+// (1) arg is the call id
+// (2) is the media frame as Uint8Array
+// returns the sealed frame as Uint8Array
+func encryptVoipFrame(this js.Value, args []js.Value) interface{} {
+	session, err := requireVoipSession(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	frame := make([]byte, args[1].Length())
+	js.CopyBytesToGo(frame, args[1])
+	sealed, err := session.Encrypt(frame)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := js.Global().Get("Uint8Array").New(len(sealed))
+	js.CopyBytesToJS(result, sealed)
+	return result
+}
+
+// (1) arg is the call id
+// (2) is the sealed frame as Uint8Array
+// returns the media frame as Uint8Array, or an error with code
+// REPLAYED_FRAME for a frame that was already played
+func decryptVoipFrame(this js.Value, args []js.Value) interface{} {
+	session, err := requireVoipSession(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	sealed := make([]byte, args[1].Length())
+	js.CopyBytesToGo(sealed, args[1])
+	frame, err := session.Decrypt(sealed)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := js.Global().Get("Uint8Array").New(len(frame))
+	js.CopyBytesToJS(result, frame)
+	return result
+}
+
+// (1) arg is the call id, its keys are wiped once the call ends
+func closeVoipSession(this js.Value, args []js.Value) interface{} {
+	callId := args[0].String()
+	session := VOIP_STORAGE[callId]
+	if session == nil {
+		return false
+	}
+	session.Close()
+	delete(VOIP_STORAGE, callId)
+	return true
+}
+
 func saveRatchet(this js.Value, args []js.Value) interface{} {
-	ratchetId := args[0].String()
-	rachet := loadRatchetFromStorage(ratchetId)
-	if rachet == nil {
-		log.Println("cannot load ratchet")
-		return nil
+	rachet, err := requireRatchet(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	rachetStore, err := rachet.Save(common.StringToByte(PIN))
+	if err != nil {
+		return errorToJsObject(err)
 	}
-	return convertToJsObject(rachet.Save(common.StringToByte(PIN)))
+	return convertToJsObject(rachetStore)
 }
 
+// returns an error with code WRONG_PIN when the PIN given to startUp does not open it, TAMPERED_STORE
+// when the store was changed and WRONG_RATCHET when it belongs to another identity key
 func loadRatchet(this js.Value, args []js.Value) interface{} {
 	rachetJson := args[0].String()
-	rachet := ratchet.LoadRachet(rachetJson, common.StringToByte(PIN))
+	rachet, err := ratchet.LoadRachet(rachetJson, common.StringToByte(PIN))
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	if internalKey := loadInternalKeyFromStorage(); internalKey != nil {
+		if err := rachet.AttachKeyBundle(internalKey); err != nil {
+			return errorToJsObject(err)
+		}
+	}
 	return insertRatchetToStorage(rachet)
 }
 
+// (1) argument is ratchet ID, true when its store was encrypted with the bare PIN or has no MAC and has to be saved again
+func ratchetNeedsMigration(this js.Value, args []js.Value) interface{} {
+	rachet := loadRatchetFromStorage(args[0].String())
+	return rachet != nil && rachet.NeedsMigration()
+}
+
+// (1) argument is ratchet ID, (2) is the padding scheme of the messages we send, 0 none, 1 bucket, 2 padme
+// the ratchet has to be saved afterwards to keep it
+func setRatchetPadding(this js.Value, args []js.Value) interface{} {
+	rachet, err := requireRatchet(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	padding := args[1].Int()
+	if padding < 0 || padding > 0xff {
+		return errorToJsObject(fmt.Errorf("%w: unknown padding scheme %d", ratchet.ErrInvalidMessage, padding))
+	}
+	err = rachet.SetPadding(ratchet.PaddingScheme(padding))
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return true
+}
+
 func isRatchetExist(this js.Value, args []js.Value) interface{} {
 	messageJson := args[0].String()
 	storedRatchet := RATCHET_STORAGE[messageJson]
@@ -213,11 +623,9 @@ func isRatchetExist(this js.Value, args []js.Value) interface{} {
 // Message API
 // (1) argument is ratchet ID or conversion ID, (2) argument is dedicate this message is binary or not, (3) is content
 func sendMessage(this js.Value, args []js.Value) interface{} {
-	ratchetId := args[0].String()
-	rachet := loadRatchetFromStorage(ratchetId)
-	if rachet == nil {
-		log.Println("cannot find ratchet")
-		return nil
+	rachet, err := requireRatchet(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
 	}
 	isBinary := args[1].Bool()
 	content := args[2].String()
@@ -227,36 +635,264 @@ func sendMessage(this js.Value, args []js.Value) interface{} {
 	} else {
 		msg = rachet.PopulateMessage(common.StringToByte(content))
 	}
-	rachet.OnSend(msg)
-	msgDto := msg.ToDto()
-	msgDto.IsBinary = isBinary
-	return convertToJsObject(msgDto)
+	msg.IsBinary = isBinary
+	err = rachet.OnSend(msg)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return convertToJsObject(msg.ToDto())
 }
 
-// (1) argument is message dto
+// (1) argument is message dto as json or the binary envelope as Uint8Array
+// returns an error with a code when the message cannot be read, the ratchet is left as it was
 func receiveMessage(this js.Value, args []js.Value) interface{} {
-	messageJson := args[0].String()
-	var messageDto ratchet.MessageDto
-	err := json.Unmarshal([]byte(messageJson), &messageDto)
+	var recvMsg *ratchet.Message
+	var err error
+	if args[0].Type() == js.TypeObject {
+		envelope := make([]byte, args[0].Length())
+		js.CopyBytesToGo(envelope, args[0])
+		recvMsg, err = ratchet.DecodeMessage(envelope)
+	} else {
+		recvMsg, err = ratchet.CreateMessageFromJson(args[0].String())
+	}
 	if err != nil {
-		log.Println("Cannot parase json")
-		return nil
+		return errorToJsObject(err)
 	}
-	recvMsg := ratchet.CreateMessageFromDto(&messageDto)
-	rachet := loadRatchetFromStorage(recvMsg.RatchetID)
-	if rachet == nil {
-		log.Println("cannot find ratchet")
-		return nil
+	rachet, err := requireRatchet(recvMsg.RatchetID)
+	if err != nil {
+		return errorToJsObject(err)
 	}
-	rachet.OnRecieved(recvMsg)
-	if messageDto.IsBinary {
+	err = rachet.OnRecieved(recvMsg)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	if recvMsg.IsBinary {
 		return common.EncodeToString(recvMsg.PlainMessage)
 	} else {
 		return string(recvMsg.PlainMessage)
 	}
 }
 
+// (1) argument is message dto returned by sendMessage, returns the binary envelope as Uint8Array
+func encodeMessage(this js.Value, args []js.Value) interface{} {
+	msg, err := ratchet.CreateMessageFromJson(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	envelope, err := msg.Encode()
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := js.Global().Get("Uint8Array").New(len(envelope))
+	js.CopyBytesToJS(result, envelope)
+	return result
+}
+
+// (1) argument is a binary socket frame as Uint8Array
+// returns the message the way the server sends it as json, an error with code INVALID_MESSAGE
+// when the frame cannot be read
+func decodeSocketFrame(this js.Value, args []js.Value) interface{} {
+	frame := make([]byte, args[0].Length())
+	js.CopyBytesToGo(frame, args[0])
+	metadata, envelope, err := ratchet.SplitSocketFrame(frame)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	msg, err := ratchet.DecodeMessage(envelope)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(metadata, &result); err != nil {
+		return errorToJsObject(fmt.Errorf("%w: cannot read frame metadata: %w", ratchet.ErrInvalidMessage, err))
+	}
+	for field, value := range convertToJsObject(msg.ToDto()) {
+		result[field] = value
+	}
+	return result
+}
+
+// Sealed sender API
+// (1) arg is other username, its trusted identity key is the recipient key
+// (2) is our sender certificate from the server, base64
+// (3) is our delivery token so the other user can reply sealed, base64, optional
+// but its place has to be taken by undefined
+// (4) is the message envelope from encodeMessage
+// returns the sealed envelope in base64
+func sealMessage(this js.Value, args []js.Value) interface{} {
+	if len(args) < 4 || args[3].Type() != js.TypeObject {
+		return errorToJsObject(fmt.Errorf("%w: sealMessage takes a username, a certificate, a delivery token and a message", errInvalidArgument))
+	}
+	internalKey, err := requireInternalKey()
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	recipientIdentityKey, err := internalKey.TrustedIdentityKey(args[0].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	certificate, err := keys.ParseSenderCertificate(common.DecodeToByte(args[1].String()))
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	var deliveryToken []byte
+	if args[2].Type() == js.TypeString {
+		deliveryToken = common.DecodeToByte(args[2].String())
+	}
+	message := make([]byte, args[3].Length())
+	js.CopyBytesToGo(message, args[3])
+	envelope, err := keys.SealMessage(internalKey, certificate, deliveryToken, recipientIdentityKey, message)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	return common.EncodeToString(envelope)
+}
+
+// (1) arg is the sealed envelope in base64
+// (2) is the server sender certificate key, base64
+// returns {senderUsername, deliveryToken, message} with message ready for
+// receiveMessage, or {identityKeyChanged: true} when the sender key is not
+// the trusted one
+// the internal key has to be saved again after this call
+func openSealedMessage(this js.Value, args []js.Value) interface{} {
+	internalKey, err := requireInternalKey()
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	serverKey, err := ecc.DeserializePublicKey(common.DecodeToByte(args[1].String()))
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	sealedMessage, err := keys.OpenSealedMessage(internalKey, serverKey, common.DecodeToByte(args[0].String()), time.Now())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	err = internalKey.TrustIdentity(sealedMessage.Certificate.Username, sealedMessage.Certificate.IdentityKey)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	message := js.Global().Get("Uint8Array").New(len(sealedMessage.Message))
+	js.CopyBytesToJS(message, sealedMessage.Message)
+	return map[string]interface{}{
+		"senderUsername": sealedMessage.Certificate.Username,
+		"deliveryToken":  common.EncodeToString(sealedMessage.DeliveryToken),
+		"message":        message,
+	}
+}
+
+// Attachment API
+// (1) arg is the file content as Uint8Array
+// (2) is its content type, (3) its file name, may be empty
+// (4) is a thumbnail as Uint8Array, optional
+// returns {blob, descriptor}, the blob is what gets uploaded, the descriptor
+// gets the fileId of the upload and is sent inside a ratchet message
+func encryptAttachment(this js.Value, args []js.Value) interface{} {
+	content := make([]byte, args[0].Length())
+	js.CopyBytesToGo(content, args[0])
+	var thumbnail []byte
+	if len(args) > 3 && args[3].Type() == js.TypeObject {
+		thumbnail = make([]byte, args[3].Length())
+		js.CopyBytesToGo(thumbnail, args[3])
+	}
+	blob, descriptor, err := attachment.Encrypt(content, args[1].String(), args[2].String(), thumbnail)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := js.Global().Get("Uint8Array").New(len(blob))
+	js.CopyBytesToJS(result, blob)
+	return map[string]interface{}{
+		"blob":       result,
+		"descriptor": convertToJsObject(descriptor.ToDto()),
+	}
+}
+
+// (1) arg is the downloaded blob as Uint8Array
+// (2) is the descriptor received in the message, json
+// returns the file content as Uint8Array, or an error with code
+// DIGEST_MISMATCH when the blob is not the one that was sent
+func decryptAttachment(this js.Value, args []js.Value) interface{} {
+	blob := make([]byte, args[0].Length())
+	js.CopyBytesToGo(blob, args[0])
+	descriptor, err := attachment.NewDescriptorFromJson(args[1].String())
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	content, err := descriptor.Decrypt(blob)
+	if err != nil {
+		return errorToJsObject(err)
+	}
+	result := js.Global().Get("Uint8Array").New(len(content))
+	js.CopyBytesToJS(result, content)
+	return result
+}
+
 // Utils
+// trustIdentityFromArgs checks the bundle identity key against the key trusted
+// for the username at args[index], no session is set up without a username
+func trustIdentityFromArgs(internalKey *keys.InternalKeyBundle, args []js.Value, index int, externalKeyBundle *keys.ExternalKeyBundle) error {
+	if len(args) <= index || args[index].Type() != js.TypeString {
+		return fmt.Errorf("missing username of the key bundle owner")
+	}
+	return internalKey.TrustIdentity(args[index].String(), externalKeyBundle.IdentityKey)
+}
+
+// Failures of the bridge itself, the core has no notion of what is loaded
+var (
+	errNoInternalKey   = errors.New("No internal key loaded")
+	errUnknownCall     = errors.New("Unknown call")
+	errInvalidArgument = errors.New("Invalid argument")
+)
+
+// coreErrorCodes gives the stable code of each typed error of the core, the
+// first match wins so errors wrapping others come first
+var coreErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{common.ErrWrongPIN, "WRONG_PIN"},
+	{keys.ErrIdentityKeyChanged, "IDENTITY_KEY_CHANGED"},
+	{keys.ErrUntrustedIdentity, "UNTRUSTED_IDENTITY"},
+	{keys.ErrInvalidCertificate, "INVALID_CERTIFICATE"},
+	{errNoInternalKey, "NO_INTERNAL_KEY"},
+	{ratchet.ErrWrongRatchet, "WRONG_RATCHET"},
+	{ratchet.ErrDuplicateMessage, "DUPLICATE_MESSAGE"},
+	{ratchet.ErrTooManySkipped, "TOO_MANY_SKIPPED"},
+	{ratchet.ErrNotNewSession, "NOT_NEW_SESSION"},
+	{ratchet.ErrUnsupportedVersion, "UNSUPPORTED_VERSION"},
+	{ratchet.ErrTamperedStore, "TAMPERED_STORE"},
+	{ecc.ErrBadSignature, "BAD_SIGNATURE"},
+	{ecc.ErrKeySuiteMismatch, "KEY_SUITE_MISMATCH"},
+	{ecc.ErrInvalidKey, "INVALID_KEY"},
+	{ratchet.ErrInvalidMessage, "INVALID_MESSAGE"},
+	{attachment.ErrDigestMismatch, "DIGEST_MISMATCH"},
+	{attachment.ErrInvalidAttachment, "INVALID_ATTACHMENT"},
+	{voip.ErrReplayedFrame, "REPLAYED_FRAME"},
+	{voip.ErrInvalidFrame, "INVALID_FRAME"},
+	{errUnknownCall, "UNKNOWN_CALL"},
+	{errInvalidArgument, "INVALID_ARGUMENT"},
+	{common.ErrDecryptFailed, "DECRYPT_FAILED"},
+}
+
+// errorToJsObject turns a core error into a JS Error whose code is one of
+// coreErrorCodes or UNKNOWN, a changed identity key also sets
+// identityKeyChanged as the client checked before error codes
+func errorToJsObject(err error) interface{} {
+	log.Println(err)
+	code := "UNKNOWN"
+	for _, coreError := range coreErrorCodes {
+		if errors.Is(err, coreError.err) {
+			code = coreError.code
+			break
+		}
+	}
+	jsError := js.Global().Get("Error").New(err.Error())
+	jsError.Set("code", code)
+	if code == "IDENTITY_KEY_CHANGED" {
+		jsError.Set("identityKeyChanged", true)
+	}
+	return jsError
+}
+
 func convertToJsObject(data any) map[string]interface{} {
 	jsString, _ := json.Marshal(data)
 	var result map[string]interface{}
@@ -288,6 +924,14 @@ func loadInternalKeyFromStorage() *keys.InternalKeyBundle {
 	return nil
 }
 
+func requireInternalKey() (*keys.InternalKeyBundle, error) {
+	internalKey := loadInternalKeyFromStorage()
+	if internalKey == nil {
+		return nil, errNoInternalKey
+	}
+	return internalKey, nil
+}
+
 func insertExternalKeyToStorage(externalKey *keys.ExternalKeyBundle) string {
 	mapKey, _ := uuid.NewUUID()
 	EXTERNAL_KEY_STORAGE[mapKey.String()] = externalKey
@@ -317,6 +961,22 @@ func insertRatchetToStorage(rachet *ratchet.Ratchet) string {
 	return rachet.GetId()
 }
 
+// replaceRatchetInStorage swaps in the ratchet of a reset session
+func replaceRatchetInStorage(rachet *ratchet.Ratchet) string {
+	RATCHET_STORAGE[rachet.GetId()] = rachet
+	return rachet.GetId()
+}
+
+// requireRatchet is loadRatchetFromStorage for calls that report a missing
+// ratchet to JS
+func requireRatchet(ratchetId string) (*ratchet.Ratchet, error) {
+	rachet := loadRatchetFromStorage(ratchetId)
+	if rachet == nil {
+		return nil, fmt.Errorf("%w: unknown ratchet %s", ratchet.ErrWrongRatchet, ratchetId)
+	}
+	return rachet, nil
+}
+
 func loadRatchetFromStorage(ratchetId string) *ratchet.Ratchet {
 	storedRatchet := RATCHET_STORAGE[ratchetId]
 	if storedRatchet == nil {
@@ -325,3 +985,37 @@ func loadRatchetFromStorage(ratchetId string) *ratchet.Ratchet {
 	}
 	return storedRatchet
 }
+
+// insertVoipSessionToStorage derives the call keys from the handshake of
+// rachet, which is dropped afterwards along with its secret
+func insertVoipSessionToStorage(rachet *ratchet.Ratchet, isCaller bool) (string, error) {
+	voipKey, err := rachet.GetVoipKey()
+	if err != nil {
+		return "", err
+	}
+	session, err := voip.NewSession(voipKey, isCaller)
+	clear(voipKey)
+	if err != nil {
+		return "", err
+	}
+	callId, _ := uuid.NewUUID()
+	VOIP_STORAGE[callId.String()] = session
+	return callId.String(), nil
+}
+
+func requireVoipSession(callId string) (*voip.Session, error) {
+	session := loadVoipSessionFromStorage(callId)
+	if session == nil {
+		return nil, fmt.Errorf("%w %s", errUnknownCall, callId)
+	}
+	return session, nil
+}
+
+func loadVoipSessionFromStorage(callId string) *voip.Session {
+	session := VOIP_STORAGE[callId]
+	if session == nil {
+		log.Println("cannot find voip session")
+		return nil
+	}
+	return session
+}
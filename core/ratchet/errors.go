@@ -0,0 +1,26 @@
+package ratchet
+
+import "errors"
+
+var (
+	// ErrWrongRatchet is returned for a message or a reset that belongs to
+	// another session
+	ErrWrongRatchet = errors.New("Wrong rachet")
+	// ErrInvalidMessage is returned for a message or a store that cannot be
+	// read, a missing header or an unknown padding
+	ErrInvalidMessage = errors.New("Invalid message")
+	// ErrDuplicateMessage is returned for a message whose key was already used
+	// or evicted from the missing keys
+	ErrDuplicateMessage = errors.New("Duplicated or evicted message")
+	// ErrTooManySkipped is returned when a message would skip more than MaxSkip
+	// message keys
+	ErrTooManySkipped = errors.New("Too many skipped messages")
+	// ErrNotNewSession is returned when a handshake is run on a ratchet that
+	// is already set up
+	ErrNotNewSession = errors.New("Not a new session")
+	// ErrTamperedStore is returned when the MAC of a ratchet store does not
+	// match, the store was changed after it was saved
+	ErrTamperedStore = errors.New("Ratchet store was tampered with")
+	// ErrUnsupportedVersion is returned for a protocol version newer than ours
+	ErrUnsupportedVersion = errors.New("Unsupported protocol version")
+)
@@ -0,0 +1,125 @@
+package ratchet
+
+import (
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/kdf"
+)
+
+// Sessions set up before the ratchet step have no ratchet keys, both sides
+// hash a single chain forward from the root key and the key of message n is
+// the KDF applied n times to it, whichever side sent the message. They keep
+// working so stored chats still open, a session reset moves them to the
+// ratchet. Their messages have no ratchet header and their index is the
+// position in the chain
+
+func (r *Ratchet) onSendLegacyChain(message *Message) error {
+	chainKey := r.ChainSendKey
+	if r.SendChainLength == 0 {
+		chainKey = r.RootKey
+	}
+	messageKey, err := kdf.DoKDF(chainKey)
+	if err != nil {
+		return fmt.Errorf("Cannot do chain KDF: %w", err)
+	}
+	cipherMessage, err := common.LegacyEncryptWithAD(message.PlainMessage, messageKey, nil)
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt message: %w", err)
+	}
+	message.Index = r.SendChainLength + 1
+	message.ChainIndex = 0
+	message.PreviousChainLength = 0
+	message.RatchetKey = nil
+	message.Padding = PADDING_NONE
+	message.CipherMessage = cipherMessage
+	r.TotalMessageSent++
+	r.SendChainLength++
+	r.ChainSendKey = messageKey
+	return nil
+}
+
+// onRecievedLegacyChain only moves the chain forward once the message opened,
+// the caller restores the ratchet otherwise
+func (r *Ratchet) onRecievedLegacyChain(message *Message) error {
+	if message.RatchetKey != nil || message.Index == 0 || message.Padding != PADDING_NONE {
+		return fmt.Errorf("%w: not a message of a session without ratchet keys", ErrInvalidMessage)
+	}
+	if message.Index <= r.RecvChainLength {
+		return r.decryptSkippedLegacyChain(message)
+	}
+	if message.Index-r.RecvChainLength > r.MaxSkip {
+		return ErrTooManySkipped
+	}
+	chainKey := r.ChainRecieveKey
+	if r.RecvChainLength == 0 {
+		chainKey = r.RootKey
+	}
+	for r.RecvChainLength+1 < message.Index {
+		skippedKey, err := kdf.DoKDF(chainKey)
+		if err != nil {
+			return fmt.Errorf("Cannot do chain KDF: %w", err)
+		}
+		r.RecvChainLength++
+		r.putMissingKey("", r.RecvChainLength, skippedKey)
+		chainKey = skippedKey
+	}
+	messageKey, err := kdf.DoKDF(chainKey)
+	if err != nil {
+		return fmt.Errorf("Cannot do chain KDF: %w", err)
+	}
+	if err := decryptLegacyChain(message, messageKey); err != nil {
+		return err
+	}
+	r.TotalMessageRecieved++
+	r.RecvChainLength++
+	r.ChainRecieveKey = messageKey
+	return nil
+}
+
+// decryptSkippedLegacyChain opens a message behind the chain with a kept key,
+// stores written before the ratchet step kept theirs without an index so
+// each of those is tried
+func (r *Ratchet) decryptSkippedLegacyChain(message *Message) error {
+	if position, missingKey := r.findMissingKey("", message.Index); missingKey != nil {
+		if err := decryptLegacyChain(message, missingKey); err != nil {
+			return err
+		}
+		r.removeMissingKey(position)
+		r.TotalMessageRecieved++
+		return nil
+	}
+	for position, missingKey := range r.MissingMessageKeys {
+		if missingKey.RatchetKey != "" || missingKey.Index != 0 {
+			continue
+		}
+		if decryptLegacyChain(message, missingKey.Key) == nil {
+			r.removeMissingKey(position)
+			r.TotalMessageRecieved++
+			return nil
+		}
+	}
+	return ErrDuplicateMessage
+}
+
+func decryptLegacyChain(message *Message, messageKey []byte) error {
+	plainText, err := common.LegacyDecryptWithAD(message.CipherMessage, messageKey, nil)
+	if err != nil {
+		return fmt.Errorf("Cannot decrypt message: %w", err)
+	}
+	message.PlainMessage = plainText
+	return nil
+}
+
+// loadLegacyMissingKeys reads the skipped keys of a store written before the
+// ratchet step, their index was not kept
+func loadLegacyMissingKeys(missingKeys []string, PIN []byte) ([]*MissingMessageKey, error) {
+	var result []*MissingMessageKey
+	for _, missingKey := range missingKeys {
+		decryptedKey, err := common.DecryptData(common.DecodeToByte(missingKey), PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decrypt missing key: %w", err)
+		}
+		result = append(result, &MissingMessageKey{Key: decryptedKey})
+	}
+	return result, nil
+}
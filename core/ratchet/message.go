@@ -1,72 +1,181 @@
 package ratchet
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
 )
 
+// Message is one ratchet message, Padding is the scheme its plain text is
+// sealed with as chosen by the sending session
 type Message struct {
-	RatchetID     string
-	Index         uint
-	PlainMessage  []byte
-	CipherMessage []byte
+	RatchetID           string
+	Index               uint
+	ChainIndex          uint
+	PreviousChainLength uint
+	RatchetKey          ecc.IECPublicKey
+	IsBinary            bool
+	Padding             PaddingScheme
+	PlainMessage        []byte
+	CipherMessage       []byte
 }
 
 type MessageDto struct {
-	RatchetID     string `json:"chatSessionId"`
-	Index         uint   `json:"index"`
-	CipherMessage string `json:"cipherMessage"`
-	IsBinary      bool   `json:"isBinary"`
+	RatchetID           string `json:"chatSessionId"`
+	Index               uint   `json:"index"`
+	ChainIndex          uint   `json:"chainIndex"`
+	PreviousChainLength uint   `json:"previousChainLength"`
+	RatchetKey          string `json:"ratchetKey"`
+	CipherMessage       string `json:"cipherMessage"`
+	IsBinary            bool   `json:"isBinary"`
+	Padding             uint8  `json:"padding,omitempty"`
 }
 
-func CreateMessageFromDto(messageDto *MessageDto) *Message {
-	return &Message{
-		RatchetID:     messageDto.RatchetID,
-		Index:         messageDto.Index,
-		PlainMessage:  nil,
-		CipherMessage: common.DecodeToByte(messageDto.CipherMessage),
+func CreateMessageFromDto(messageDto *MessageDto) (*Message, error) {
+	ratchetKey, err := parseRatchetKey(messageDto.RatchetKey)
+	if err != nil {
+		return nil, err
 	}
+	return &Message{
+		RatchetID:           messageDto.RatchetID,
+		Index:               messageDto.Index,
+		ChainIndex:          messageDto.ChainIndex,
+		PreviousChainLength: messageDto.PreviousChainLength,
+		RatchetKey:          ratchetKey,
+		IsBinary:            messageDto.IsBinary,
+		Padding:             PaddingScheme(messageDto.Padding),
+		PlainMessage:        nil,
+		CipherMessage:       common.DecodeToByte(messageDto.CipherMessage),
+	}, nil
 }
 
-func CreateMessageFromJson(jsonString string) *Message {
+func CreateMessageFromJson(jsonString string) (*Message, error) {
 	var messageDto MessageDto
 	err := json.Unmarshal([]byte(jsonString), &messageDto)
 	if err != nil {
-		fmt.Println(err)
-		fmt.Println("Cannot parase json")
-		return nil
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
 	}
-	return &Message{
-		RatchetID:     messageDto.RatchetID,
-		Index:         messageDto.Index,
-		PlainMessage:  nil,
-		CipherMessage: common.DecodeToByte(messageDto.CipherMessage),
+	return CreateMessageFromDto(&messageDto)
+}
+
+// Encrypt seals the message of a protocol v1 session and authenticates its
+// header together with associatedData, so the header and the padding have to
+// be filled in before
+func (m *Message) Encrypt(key []byte, associatedData []byte) error {
+	padded, err := m.Padding.Pad(m.PlainMessage)
+	if err != nil {
+		return err
+	}
+	cipherMessage, err := common.LegacyEncryptWithAD(padded, key, common.ConcatBytes(associatedData, m.header()))
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt message: %w", err)
 	}
+	m.CipherMessage = cipherMessage
+	return nil
 }
 
-func (m *Message) Encrypt(key []byte) {
-	var e error
-	m.CipherMessage, e = common.EncryptAndHash(m.PlainMessage, key)
-	if e != nil {
-		fmt.Println("Cannot encrypt message ", e)
-		return
+// Decrypt fails when the cipher text, the header or associatedData was altered
+func (m *Message) Decrypt(key []byte, associatedData []byte) error {
+	if !m.Padding.IsValid() {
+		return fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, uint8(m.Padding))
 	}
+	prePlainText, err := common.LegacyDecryptWithAD(m.CipherMessage, key, common.ConcatBytes(associatedData, m.header()))
+	if err != nil {
+		return fmt.Errorf("Cannot decrypt message: %w", err)
+	}
+	return m.unpad(prePlainText)
 }
 
-func (m *Message) Decrypt(key []byte) {
-	prePlainText, err := common.DecryptHashedData(m.CipherMessage, key)
+// Seal is Encrypt for protocol v2 sessions, messageKey is the 32 byte key of
+// the chain step and is used for AES-256 as is
+func (m *Message) Seal(messageKey []byte, associatedData []byte) error {
+	padded, err := m.Padding.Pad(m.PlainMessage)
+	if err != nil {
+		return err
+	}
+	cipherMessage, err := common.SealWithKey(padded, messageKey, common.ConcatBytes(associatedData, m.header()))
 	if err != nil {
-		fmt.Println("Cannot decrypt message ", err)
-		return
+		return fmt.Errorf("Cannot encrypt message: %w", err)
 	}
-	m.PlainMessage = prePlainText
+	m.CipherMessage = cipherMessage
+	return nil
+}
+
+func (m *Message) Open(messageKey []byte, associatedData []byte) error {
+	if !m.Padding.IsValid() {
+		return fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, uint8(m.Padding))
+	}
+	prePlainText, err := common.OpenWithKey(m.CipherMessage, messageKey, common.ConcatBytes(associatedData, m.header()))
+	if err != nil {
+		return fmt.Errorf("Cannot decrypt message: %w", err)
+	}
+	return m.unpad(prePlainText)
+}
+
+func (m *Message) unpad(padded []byte) error {
+	plainText, err := m.Padding.Unpad(padded)
+	if err != nil {
+		return fmt.Errorf("Cannot decrypt message: %w", err)
+	}
+	m.PlainMessage = plainText
+	return nil
+}
+
+// header encodes every field of the message header, strings and keys are
+// length prefixed so no two headers share an encoding. The padding scheme is
+// only appended when set so unpadded messages keep the earlier encoding
+func (m *Message) header() []byte {
+	var ratchetKey []byte
+	if m.RatchetKey != nil {
+		ratchetKey, _ = m.RatchetKey.Serialize()
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(m.RatchetID)))
+	header = append(header, m.RatchetID...)
+	header = binary.BigEndian.AppendUint64(header, uint64(m.Index))
+	header = binary.BigEndian.AppendUint64(header, uint64(m.ChainIndex))
+	header = binary.BigEndian.AppendUint64(header, uint64(m.PreviousChainLength))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(ratchetKey)))
+	header = append(header, ratchetKey...)
+	if m.IsBinary {
+		header = append(header, 1)
+	} else {
+		header = append(header, 0)
+	}
+	if m.Padding != PADDING_NONE {
+		header = append(header, byte(m.Padding))
+	}
+	return header
 }
 
 func (m *Message) ToDto() *MessageDto {
+	var ratchetKey string
+	if m.RatchetKey != nil {
+		serializedKey, _ := m.RatchetKey.Serialize()
+		ratchetKey = common.EncodeToString(serializedKey)
+	}
 	return &MessageDto{
-		RatchetID:     m.RatchetID,
-		Index:         m.Index,
-		CipherMessage: common.EncodeToString(m.CipherMessage),
+		RatchetID:           m.RatchetID,
+		Index:               m.Index,
+		ChainIndex:          m.ChainIndex,
+		PreviousChainLength: m.PreviousChainLength,
+		RatchetKey:          ratchetKey,
+		CipherMessage:       common.EncodeToString(m.CipherMessage),
+		IsBinary:            m.IsBinary,
+		Padding:             uint8(m.Padding),
+	}
+}
+
+// parseRatchetKey returns nil for a message without ratchet key, OnRecieved
+// refuses those
+func parseRatchetKey(ratchetKey string) (ecc.IECPublicKey, error) {
+	if ratchetKey == "" {
+		return nil, nil
+	}
+	pubKey, err := ecc.DeserializePublicKey(common.DecodeToByte(ratchetKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read ratchet key: %w", ErrInvalidMessage, err)
 	}
+	return pubKey, nil
 }
@@ -0,0 +1,95 @@
+package ratchet
+
+import (
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+)
+
+// Default limits of the skipped message key cache, MAX_SKIP is how many keys a
+// single message may skip over and MAX_MISSING_KEYS is how many keys are kept
+const (
+	DEFAULT_MAX_SKIP         uint = 1000
+	DEFAULT_MAX_MISSING_KEYS uint = 2000
+)
+
+// MissingMessageKey is the key of a message we skipped over, it is found by the
+// ratchet key of its chain and its index in that chain
+type MissingMessageKey struct {
+	RatchetKey string
+	Index      uint
+	Key        []byte
+}
+
+type MissingMessageKeyStore struct {
+	RatchetKey string `json:"ratchet_key"`
+	Index      uint   `json:"index"`
+	Key        string `json:"key"`
+}
+
+func ratchetKeyId(ratchetKey ecc.IECPublicKey) string {
+	serializedKey, err := ratchetKey.Serialize()
+	if err != nil {
+		return ""
+	}
+	return common.EncodeToString(serializedKey)
+}
+
+// putMissingKey caches a skipped message key, when the cache is full the oldest
+// keys are evicted first
+func (r *Ratchet) putMissingKey(ratchetKey string, index uint, key []byte) {
+	r.MissingMessageKeys = append(r.MissingMessageKeys, &MissingMessageKey{
+		RatchetKey: ratchetKey,
+		Index:      index,
+		Key:        key,
+	})
+	if overflow := len(r.MissingMessageKeys) - int(r.MaxMissingKeys); overflow > 0 {
+		r.MissingMessageKeys = r.MissingMessageKeys[overflow:]
+	}
+}
+
+// findMissingKey looks up the key of a skipped message
+func (r *Ratchet) findMissingKey(ratchetKey string, index uint) (int, []byte) {
+	for i, missingKey := range r.MissingMessageKeys {
+		if missingKey.RatchetKey == ratchetKey && missingKey.Index == index {
+			return i, missingKey.Key
+		}
+	}
+	return -1, nil
+}
+
+func (r *Ratchet) removeMissingKey(position int) {
+	r.MissingMessageKeys = append(r.MissingMessageKeys[:position], r.MissingMessageKeys[position+1:]...)
+}
+
+func saveMissingKeys(missingKeys []*MissingMessageKey, PIN []byte) ([]*MissingMessageKeyStore, error) {
+	var result []*MissingMessageKeyStore
+	for _, missingKey := range missingKeys {
+		encryptedKey, err := common.EncryptData(missingKey.Key, PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot encrypt missing key: %w", err)
+		}
+		result = append(result, &MissingMessageKeyStore{
+			RatchetKey: missingKey.RatchetKey,
+			Index:      missingKey.Index,
+			Key:        common.EncodeToString(encryptedKey),
+		})
+	}
+	return result, nil
+}
+
+func loadMissingKeys(missingKeyStores []*MissingMessageKeyStore, PIN []byte) ([]*MissingMessageKey, error) {
+	var result []*MissingMessageKey
+	for _, missingKeyStore := range missingKeyStores {
+		decryptedKey, err := common.DecryptData(common.DecodeToByte(missingKeyStore.Key), PIN)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decrypt missing key: %w", err)
+		}
+		result = append(result, &MissingMessageKey{
+			RatchetKey: missingKeyStore.RatchetKey,
+			Index:      missingKeyStore.Index,
+			Key:        decryptedKey,
+		})
+	}
+	return result, nil
+}
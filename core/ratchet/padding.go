@@ -0,0 +1,112 @@
+package ratchet
+
+import (
+	"fmt"
+	"lidx-core-lib/keys"
+	"math/bits"
+)
+
+// PaddingScheme hides the length of the plain text inside the sealed content.
+// The padded content ends with a 0x80 marker followed by zeros (ISO/IEC
+// 7816-4) so it can be stripped whatever the scheme, the scheme is part of
+// the authenticated header
+type PaddingScheme uint8
+
+const (
+	// PADDING_NONE keeps the sealed content as long as the plain text, it is
+	// what sessions saved before padding and v1 sessions use
+	PADDING_NONE PaddingScheme = iota
+	// PADDING_BUCKET rounds the content up to a multiple of PADDING_BUCKET_SIZE
+	PADDING_BUCKET
+	// PADDING_PADME rounds the content up to a Padmé length, at most about
+	// 12% overhead while leaking O(log log n) bits of the length
+	PADDING_PADME
+)
+
+const PADDING_BUCKET_SIZE = 256
+
+const paddingMarker byte = 0x80
+
+// DefaultPaddingScheme is what a new session starts with, v1 peers predate
+// padding and cannot strip it
+func DefaultPaddingScheme(protocolVersion uint) PaddingScheme {
+	if protocolVersion < keys.PROTOCOL_VERSION_2 {
+		return PADDING_NONE
+	}
+	return PADDING_PADME
+}
+
+func (s PaddingScheme) IsValid() bool {
+	return s <= PADDING_PADME
+}
+
+func (s PaddingScheme) String() string {
+	switch s {
+	case PADDING_NONE:
+		return "none"
+	case PADDING_BUCKET:
+		return "bucket"
+	case PADDING_PADME:
+		return "padme"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// PaddedLength is the length of content padded from a plain text of
+// length, the marker included
+func (s PaddingScheme) PaddedLength(length int) int {
+	switch s {
+	case PADDING_BUCKET:
+		return (length/PADDING_BUCKET_SIZE + 1) * PADDING_BUCKET_SIZE
+	case PADDING_PADME:
+		return padmeLength(length + 1)
+	default:
+		return length
+	}
+}
+
+// Pad returns a padded copy of plainText
+func (s PaddingScheme) Pad(plainText []byte) ([]byte, error) {
+	if !s.IsValid() {
+		return nil, fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, uint8(s))
+	}
+	if s == PADDING_NONE {
+		return plainText, nil
+	}
+	padded := make([]byte, s.PaddedLength(len(plainText)))
+	copy(padded, plainText)
+	padded[len(plainText)] = paddingMarker
+	return padded, nil
+}
+
+// Unpad strips the padding added by Pad, the content was authenticated
+// before so a malformed padding means the sender did not pad it
+func (s PaddingScheme) Unpad(padded []byte) ([]byte, error) {
+	if !s.IsValid() {
+		return nil, fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, uint8(s))
+	}
+	if s == PADDING_NONE {
+		return padded, nil
+	}
+	end := len(padded) - 1
+	for end >= 0 && padded[end] == 0x00 {
+		end--
+	}
+	if end < 0 || padded[end] != paddingMarker {
+		return nil, fmt.Errorf("%w: invalid padding", ErrInvalidMessage)
+	}
+	return padded[:end], nil
+}
+
+// padmeLength rounds length up so only the top O(log log length) bits of it
+// may be set
+func padmeLength(length int) int {
+	if length < 2 {
+		return length
+	}
+	exponent := bits.Len(uint(length)) - 1
+	mantissaBits := bits.Len(uint(exponent))
+	mask := (1 << (exponent - mantissaBits)) - 1
+	return (length + mask) &^ mask
+}
@@ -1,35 +1,59 @@
 package ratchet
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"lidx-core-lib/common"
 	"lidx-core-lib/crypto/ecc"
 	"lidx-core-lib/crypto/kdf"
+	"lidx-core-lib/crypto/kem"
 	"lidx-core-lib/keys"
+	"time"
 )
 
 type IRatchet interface {
 	GetId() string
 	GetTotalSent() uint
 	GetTotalRecieved() uint
-	InitNewSession()
-	InitRecievedSession(yourEphemeralPubKey ecc.IECPublicKey)
+	InitNewSession() error
+	InitRecievedSession(yourEphemeralPubKey ecc.IECPublicKey, preKeyId string, oneTimeKeyId string, pqCipherText []byte) error
 	PopulateMessage(content []byte) *Message
-	OnSend(message *Message)
-	OnRecieved(message *Message)
-	Save(PIN []byte) *RachetStore
+	OnSend(message *Message) error
+	OnRecieved(message *Message) error
+	Save(PIN []byte) (*RachetStore, error)
 }
 
 type RachetStore struct {
-	RachetId           string   `json:"rachet_id"`
-	RootKey            string   `json:"root_key"`
-	ChainSendKey       string   `json:"chain_send_key"`
-	ChainRecvKey       string   `json:"chain_recv_key"`
-	TotalMessageSent   uint     `json:"total_message_sent"`
-	TotalMessageRecv   uint     `json:"total_message_recv"`
-	MissingMessageKeys []string `json:"missing_message_keys"`
+	RachetId            string                    `json:"rachet_id"`
+	RootKey             string                    `json:"root_key"`
+	ChainSendKey        string                    `json:"chain_send_key"`
+	ChainRecvKey        string                    `json:"chain_recv_key"`
+	DHSendKey           *ecc.ECKeyPairStore       `json:"dh_send_key"`
+	DHRecvKey           string                    `json:"dh_recv_key"`
+	SendChainLength     uint                      `json:"send_chain_length"`
+	RecvChainLength     uint                      `json:"recv_chain_length"`
+	PreviousChainLength uint                      `json:"previous_chain_length"`
+	TotalMessageSent    uint                      `json:"total_message_sent"`
+	TotalMessageRecv    uint                      `json:"total_message_recv"`
+	MaxSkip             uint                      `json:"max_skip"`
+	MaxMissingKeys      uint                      `json:"max_missing_keys"`
+	PostQuantum         bool                      `json:"post_quantum"`
+	ProtocolVersion     uint                      `json:"protocol_version"`
+	Padding             uint8                     `json:"padding"`
+	AssociatedData      string                    `json:"associated_data"`
+	MissingMessageKeys  []*MissingMessageKeyStore `json:"skipped_message_keys"`
+	// Skipped keys of stores written before the ratchet step, only read
+	LegacyMissingKeys []string            `json:"missing_message_keys,omitempty"`
+	PinKdf            *common.PinKdfStore `json:"pin_kdf,omitempty"`
+	// Our identity key tells which key bundle the ratchet belongs to, the
+	// other user's is checked against the one they publish
+	MyIdentityKey   string `json:"my_identity_key,omitempty"`
+	YourIdentityKey string `json:"your_identity_key,omitempty"`
+	CreatedAt       int64  `json:"created_at,omitempty"`
+	LastUsedAt      int64  `json:"last_used_at,omitempty"`
+	Mac             string `json:"mac,omitempty"`
 }
 
 type Ratchet struct {
@@ -39,86 +63,249 @@ type Ratchet struct {
 	RootKey              []byte
 	ChainSendKey         []byte
 	ChainRecieveKey      []byte
-	MissingMessageKeys   [][]byte
+	DHSendKey            *ecc.ECKeyPair
+	DHRecvKey            ecc.IECPublicKey
+	SendChainLength      uint
+	RecvChainLength      uint
+	PreviousChainLength  uint
+	MissingMessageKeys   []*MissingMessageKey
+	MaxSkip              uint
+	MaxMissingKeys       uint
 	TotalMessageSent     uint
 	TotalMessageRecieved uint
 	RootKeyEncrypted     bool
+	// Signed pre key and one-time pre key of the responder used by the
+	// handshake, the initiator sends them along with its ephemeral key
+	PreKeyId     string
+	OneTimeKeyId string
+	// Whether the handshake also mixed in an ML-KEM shared secret
+	PostQuantum bool
+	// Picked by the initiator from what both bundles support, it decides the
+	// KDFs and the message format for the whole session
+	ProtocolVersion uint
+	// Padding scheme of the messages we send, sessions saved before padding
+	// load without any
+	Padding PaddingScheme
+	// Identity keys of the initiator and the responder, authenticated with
+	// every message
+	AssociatedData []byte
+	// When the session was set up and last sent or received a message, in
+	// unix milli
+	CreatedAt  int64
+	LastUsedAt int64
+	// X3DH output, our ephemeral public key and the ML-KEM cipher text, only
+	// available on a freshly initialized session
+	sharedSecret []byte
+	ephemeralKey ecc.IECPublicKey
+	pqCipherText []byte
+	// Stretches the PIN the ratchet is saved with, nil until the first save
+	// for ratchets loaded from a store written before the PIN KDF
+	pinKdf      *common.PinKdf
+	legacyStore bool
+	// Set for sessions set up before the ratchet step, see legacy_chain.go
+	legacyChain bool
+	// Our identity key, kept for loaded ratchets until MyKeyBundle is
+	// attached again
+	myIdentityKey ecc.IECPublicKey
 }
 
 func NewRachetFromInternal(internalKeyBundle *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle) (*Ratchet, error) {
-	if !externalBundle.Verify() {
-		fmt.Println("Cannot verify external key bundle")
-		return nil, fmt.Errorf("Cannot verify external key bundle")
-	}
 	id, _ := uuid.NewUUID()
+	return newRachetFromInternal(internalKeyBundle, externalBundle, id.String())
+}
+
+func newRachetFromInternal(internalKeyBundle *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle, ratchetId string) (*Ratchet, error) {
+	if err := externalBundle.Verify(); err != nil {
+		return nil, fmt.Errorf("Cannot verify external key bundle: %w", err)
+	}
+	if externalBundle.Suite != internalKeyBundle.Suite() {
+		return nil, fmt.Errorf("%w, we use %s but the other user uses %s", ecc.ErrKeySuiteMismatch, internalKeyBundle.Suite(), externalBundle.Suite)
+	}
+	// The version is covered by the pre key signature Verify checked, a
+	// bundle lowered to v1 on the way does not get here
+	protocolVersion := externalBundle.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = keys.PROTOCOL_VERSION_1
+	}
+	protocolVersion = min(protocolVersion, keys.CURRENT_PROTOCOL_VERSION)
 	ratchet := &Ratchet{
-		RatchetId:            id.String(),
+		RatchetId:            ratchetId,
 		MyKeyBundle:          internalKeyBundle,
 		YourKeyBundle:        externalBundle,
 		TotalMessageSent:     0,
 		TotalMessageRecieved: 0,
+		MaxSkip:              DEFAULT_MAX_SKIP,
+		MaxMissingKeys:       DEFAULT_MAX_MISSING_KEYS,
 		RootKeyEncrypted:     true,
+		ProtocolVersion:      protocolVersion,
+		Padding:              DefaultPaddingScheme(protocolVersion),
+		CreatedAt:            time.Now().UnixMilli(),
+	}
+	ratchet.LastUsedAt = ratchet.CreatedAt
+	if err := ratchet.InitNewSession(); err != nil {
+		return nil, fmt.Errorf("Cannot init session: %w", err)
 	}
-	ratchet.InitNewSession()
 	return ratchet, nil
 }
 
-func NewRachetFromExternal(internalKeyBundle *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle, yourEphemeralPubKey ecc.IECPublicKey, ratchetId string) (*Ratchet, error) {
+// NewRachetFromExternal answers a handshake, protocolVersion is the version
+// the initiator picked, 0 for initiators that predate versioning
+func NewRachetFromExternal(internalKeyBundle *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle, yourEphemeralPubKey ecc.IECPublicKey, ratchetId string, preKeyId string, oneTimeKeyId string, pqCipherText []byte, protocolVersion uint) (*Ratchet, error) {
+	if protocolVersion == 0 {
+		protocolVersion = keys.PROTOCOL_VERSION_1
+	}
+	if protocolVersion > keys.CURRENT_PROTOCOL_VERSION {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, protocolVersion)
+	}
 	ratchet := &Ratchet{
 		RatchetId:            ratchetId,
 		MyKeyBundle:          internalKeyBundle,
 		YourKeyBundle:        externalBundle,
 		TotalMessageSent:     0,
 		TotalMessageRecieved: 0,
+		MaxSkip:              DEFAULT_MAX_SKIP,
+		MaxMissingKeys:       DEFAULT_MAX_MISSING_KEYS,
 		RootKeyEncrypted:     true,
+		ProtocolVersion:      protocolVersion,
+		Padding:              DefaultPaddingScheme(protocolVersion),
+		CreatedAt:            time.Now().UnixMilli(),
+	}
+	ratchet.LastUsedAt = ratchet.CreatedAt
+	err := ratchet.InitRecievedSession(yourEphemeralPubKey, preKeyId, oneTimeKeyId, pqCipherText)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot init session: %w", err)
 	}
-	ratchet.InitRecievedSession(yourEphemeralPubKey)
 	return ratchet, nil
 }
 
-func LoadRachet(rachetJsonString string, PIN []byte) *Ratchet {
+// LoadRachet reads a store written by Save, an error wrapping
+// common.ErrWrongPIN means PIN does not open it and ErrTamperedStore that the
+// store was changed since. The ratchet comes back without our key bundle,
+// AttachKeyBundle gives it back
+func LoadRachet(rachetJsonString string, PIN []byte) (*Ratchet, error) {
 	var rachetStore RachetStore
 	err := json.Unmarshal([]byte(rachetJsonString), &rachetStore)
 	if err != nil {
-		fmt.Println("Cannot parase json")
-		return nil
+		return nil, fmt.Errorf("%w: cannot read ratchet store: %w", ErrInvalidMessage, err)
+	}
+	var pinKdf *common.PinKdf
+	if rachetStore.PinKdf != nil {
+		pinKdf, err = common.LoadPinKdf(rachetStore.PinKdf)
+		if err != nil {
+			return nil, err
+		}
+		PIN, err = pinKdf.DeriveStoreKey(PIN, rachetStore.RachetId)
+		if err != nil {
+			return nil, err
+		}
 	}
-	rootKey, err := common.DecryptHashedData(common.DecodeToByte(rachetStore.RootKey), PIN)
+	// The root key is the first thing opened with PIN, failing there means
+	// the PIN is wrong rather than the store broken
+	rootKey, err := common.DecryptData(common.DecodeToByte(rachetStore.RootKey), PIN)
 	if err != nil {
-		fmt.Println("Cannot decrypt key")
-		return nil
+		return nil, fmt.Errorf("%w: %w", common.ErrWrongPIN, err)
 	}
-	chainSendKey, err := common.DecryptHashedData(common.DecodeToByte(rachetStore.ChainSendKey), PIN)
+	missingMac, err := verifyStoreMac(&rachetStore, PIN)
 	if err != nil {
-		fmt.Println("Cannot decrypt key")
-		return nil
+		return nil, err
 	}
-	chainRecvKey, err := common.DecryptHashedData(common.DecodeToByte(rachetStore.ChainRecvKey), PIN)
+	chainSendKey, err := common.DecryptData(common.DecodeToByte(rachetStore.ChainSendKey), PIN)
 	if err != nil {
-		fmt.Println("Cannot decrypt key")
-		return nil
+		return nil, fmt.Errorf("Cannot read sending chain key: %w", err)
 	}
-	var missingKeys [][]byte
-	for _, missKey := range rachetStore.MissingMessageKeys {
-		decryptedMissKey, err := common.DecryptHashedData(common.DecodeToByte(missKey), PIN)
+	chainRecvKey, err := common.DecryptData(common.DecodeToByte(rachetStore.ChainRecvKey), PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read receiving chain key: %w", err)
+	}
+	// Sessions set up before the ratchet step have no ratchet keys
+	legacyChain := rachetStore.DHSendKey == nil
+	var dhSendKey *ecc.ECKeyPair
+	var dhRecvKey ecc.IECPublicKey
+	if !legacyChain {
+		dhSendKey, err = ecc.DeSerializeKey(rachetStore.DHSendKey, PIN)
 		if err != nil {
-			fmt.Println("Cannot ecnrypt key")
-			return nil
+			return nil, fmt.Errorf("Cannot read ratchet key: %w", err)
+		}
+		if rachetStore.DHRecvKey != "" {
+			dhRecvKey, err = ecc.DeserializePublicKey(common.DecodeToByte(rachetStore.DHRecvKey))
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read ratchet key: %w", err)
+			}
 		}
-		missingKeys = append(missingKeys, decryptedMissKey)
+	}
+	missingKeys, err := loadMissingKeys(rachetStore.MissingMessageKeys, PIN)
+	if err != nil {
+		return nil, err
+	}
+	legacyMissingKeys, err := loadLegacyMissingKeys(rachetStore.LegacyMissingKeys, PIN)
+	if err != nil {
+		return nil, err
+	}
+	missingKeys = append(missingKeys, legacyMissingKeys...)
+	sendChainLength := rachetStore.SendChainLength
+	recvChainLength := rachetStore.RecvChainLength
+	if legacyChain && rachetStore.PinKdf == nil {
+		// Stores written before the ratchet step only counted messages
+		sendChainLength = rachetStore.TotalMessageSent
+		recvChainLength = rachetStore.TotalMessageRecv
+	}
+	maxSkip := rachetStore.MaxSkip
+	if maxSkip == 0 {
+		maxSkip = DEFAULT_MAX_SKIP
+	}
+	maxMissingKeys := rachetStore.MaxMissingKeys
+	if maxMissingKeys == 0 {
+		maxMissingKeys = DEFAULT_MAX_MISSING_KEYS
+	}
+	protocolVersion := rachetStore.ProtocolVersion
+	if protocolVersion == 0 {
+		protocolVersion = keys.PROTOCOL_VERSION_1
+	}
+	padding := PaddingScheme(rachetStore.Padding)
+	if !padding.IsValid() {
+		return nil, fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, rachetStore.Padding)
+	}
+	myIdentityKey, err := deserializeIdentityKey(rachetStore.MyIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	yourIdentityKey, err := deserializeIdentityKey(rachetStore.YourIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	var yourKeyBundle *keys.ExternalKeyBundle
+	if yourIdentityKey != nil {
+		yourKeyBundle = identityOnlyBundle(yourIdentityKey, protocolVersion)
 	}
 	return &Ratchet{
 		RatchetId:            rachetStore.RachetId,
 		MyKeyBundle:          nil,
-		YourKeyBundle:        nil,
+		YourKeyBundle:        yourKeyBundle,
 		RootKey:              rootKey,
 		ChainSendKey:         chainSendKey,
 		ChainRecieveKey:      chainRecvKey,
+		DHSendKey:            dhSendKey,
+		DHRecvKey:            dhRecvKey,
+		SendChainLength:      sendChainLength,
+		RecvChainLength:      recvChainLength,
+		PreviousChainLength:  rachetStore.PreviousChainLength,
 		MissingMessageKeys:   missingKeys,
+		MaxSkip:              maxSkip,
+		MaxMissingKeys:       maxMissingKeys,
 		TotalMessageSent:     rachetStore.TotalMessageSent,
 		TotalMessageRecieved: rachetStore.TotalMessageRecv,
 		RootKeyEncrypted:     false,
-	}
+		PostQuantum:          rachetStore.PostQuantum,
+		ProtocolVersion:      protocolVersion,
+		Padding:              padding,
+		AssociatedData:       common.DecodeToByte(rachetStore.AssociatedData),
+		CreatedAt:            rachetStore.CreatedAt,
+		LastUsedAt:           rachetStore.LastUsedAt,
+		pinKdf:               pinKdf,
+		legacyStore:          pinKdf == nil || !pinKdf.IsShared() || missingMac,
+		legacyChain:          legacyChain,
+		myIdentityKey:        myIdentityKey,
+	}, nil
 }
 
 func (r *Ratchet) GetId() string {
@@ -133,6 +320,51 @@ func (r *Ratchet) GetTotalRecieved() uint {
 	return r.TotalMessageRecieved
 }
 
+// SetPadding picks the padding scheme of the messages we send from now on,
+// the other side strips whatever scheme a message names. v1 peers predate
+// padding so v1 sessions stay unpadded
+func (r *Ratchet) SetPadding(padding PaddingScheme) error {
+	if !padding.IsValid() {
+		return fmt.Errorf("%w: unknown padding scheme %d", ErrInvalidMessage, uint8(padding))
+	}
+	if padding != PADDING_NONE && r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return fmt.Errorf("%w: protocol v%d sessions cannot pad messages", ErrUnsupportedVersion, r.ProtocolVersion)
+	}
+	r.Padding = padding
+	return nil
+}
+
+// GetSharedSecret returns the X3DH output of a session that was just
+// initialized, it is not kept when the session is saved
+func (r *Ratchet) GetSharedSecret() []byte {
+	return r.sharedSecret
+}
+
+// GetVoipKey returns the call key of a session that was just initialized,
+// from v2 on it is derived under its own label instead of being the X3DH
+// output itself
+func (r *Ratchet) GetVoipKey() ([]byte, error) {
+	if r.sharedSecret == nil {
+		return nil, ErrNotNewSession
+	}
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return r.sharedSecret, nil
+	}
+	return kdf.DeriveKey(r.sharedSecret, kdf.LABEL_VOIP)
+}
+
+// GetEphemeralKey returns the public part of the ephemeral key generated for
+// this session, the other side needs it to answer the handshake
+func (r *Ratchet) GetEphemeralKey() ecc.IECPublicKey {
+	return r.ephemeralKey
+}
+
+// GetPQCipherText returns the ML-KEM cipher text of a session we just
+// initiated, it is nil when the other user has no post-quantum pre key
+func (r *Ratchet) GetPQCipherText() []byte {
+	return r.pqCipherText
+}
+
 func (r *Ratchet) PopulateMessage(content []byte) *Message {
 	return &Message{
 		Index:        r.TotalMessageSent,
@@ -141,162 +373,540 @@ func (r *Ratchet) PopulateMessage(content []byte) *Message {
 	}
 }
 
-func (r *Ratchet) InitNewSession() {
+// InitNewSession runs the handshake of the initiator against YourKeyBundle,
+// the ratchet is only set up once every step succeeded
+func (r *Ratchet) InitNewSession() error {
 	if !r.RootKeyEncrypted {
-		fmt.Println("Not a new session")
-		return
+		return ErrNotNewSession
+	}
+	pkB, pkId := r.YourKeyBundle.GetPreKey()
+	ikB := r.YourKeyBundle.GetIdentityKey()
+	if pkB == nil || ikB == nil {
+		return fmt.Errorf("%w: incomplete key bundle", ecc.ErrInvalidKey)
 	}
 	// Performance X3DH
 	ikA := r.MyKeyBundle.IdentityKey.PrivateKey()
-	pkB, _ := r.YourKeyBundle.GetPreKey()
-	dh1, _ := ikA.CalculateCommonSecret(pkB)
-
-	ekA := r.MyKeyBundle.EphemeralKey.PrivateKey()
-	ikB := r.YourKeyBundle.GetIdentityKey()
-	dh2, _ := ekA.CalculateCommonSecret(ikB)
-
-	dh3, _ := ekA.CalculateCommonSecret(pkB)
+	dh1, err := ikA.CalculateCommonSecret(pkB)
+	if err != nil {
+		return err
+	}
 
-	var preKdf []byte
+	// A new ephemeral key for every handshake, its private part is wiped as
+	// soon as the handshake secret is derived
+	ephemeralKeyPair := ecc.GenerateKeyPairWithSuite(r.MyKeyBundle.Suite())
+	defer ephemeralKeyPair.Clear()
+	ekA := ephemeralKeyPair.PrivateKey()
+	dh2, err := ekA.CalculateCommonSecret(ikB)
+	if err != nil {
+		return err
+	}
+	dh3, err := ekA.CalculateCommonSecret(pkB)
+	if err != nil {
+		return err
+	}
+	preKdf := common.ConcatBytes(dh1, dh2, dh3)
 
-	/*opkB, _ := r.YourKeyBundle.GetPreKey()
-	if opkB != nil {
-		dh4, _ := ekA.CalculateCommonSecret(opkB)
-		preKdf = common.ConcatBytes(dh1, dh2, dh3, dh4)
-	} else {
-		preKdf = common.ConcatBytes(dh1, dh2, dh3)
-	}*/
+	var oneTimeKeyId string
+	if opkB, opkId := r.YourKeyBundle.GetOneTimeKey(); opkB != nil {
+		dh4, err := ekA.CalculateCommonSecret(opkB)
+		if err != nil {
+			return err
+		}
+		preKdf = common.ConcatBytes(preKdf, dh4)
+		oneTimeKeyId = opkId
+	}
 
-	preKdf = common.ConcatBytes(dh1, dh2, dh3)
+	// PQXDH, the KEM secret is mixed in after the DH outputs so the root key
+	// stays safe as long as either ECDH or ML-KEM holds
+	var pqCipherText []byte
+	if pqpkB := r.YourKeyBundle.GetPQPreKey(); pqpkB != nil {
+		pqSecret, cipherText, err := kem.Encapsulate(pqpkB)
+		if err != nil {
+			return fmt.Errorf("Cannot encapsulate: %w", err)
+		}
+		preKdf = common.ConcatBytes(preKdf, pqSecret)
+		pqCipherText = cipherText
+	}
 
-	rootKey, e := kdf.DoKDF(preKdf)
-	if e != nil {
-		print("Cannot generate root key", e)
-		return
+	sharedSecret, err := r.x3dhKDF(preKdf)
+	if err != nil {
+		return fmt.Errorf("Cannot generate root key: %w", err)
+	}
+	// Our first ratchet key is a key of its own against the other user's pre
+	// key, it reaches them in the header of our first message
+	ratchetKeyPair := ecc.GenerateKeyPairWithSuite(r.MyKeyBundle.Suite())
+	dhOut, err := ratchetKeyPair.PrivateKey().CalculateCommonSecret(pkB)
+	if err != nil {
+		return fmt.Errorf("Cannot calculate ratchet secret: %w", err)
+	}
+	rootKey, chainSendKey, err := r.rootKDF(sharedSecret, dhOut)
+	if err != nil {
+		return fmt.Errorf("Cannot generate chain key: %w", err)
 	}
+	chainRecvKey, err := r.firstChainKey(sharedSecret)
+	if err != nil {
+		return err
+	}
+
+	r.sharedSecret = sharedSecret
+	r.myIdentityKey = r.MyKeyBundle.IdentityKey.PublicKey()
+	r.PreKeyId = pkId
+	r.OneTimeKeyId = oneTimeKeyId
+	r.pqCipherText = pqCipherText
+	r.PostQuantum = pqCipherText != nil
+	r.AssociatedData = associatedData(r.ProtocolVersion, r.MyKeyBundle.IdentityKey.PublicKey(), ikB)
+	r.ephemeralKey = ephemeralKeyPair.PublicKey()
+	r.DHSendKey = ratchetKeyPair
+	r.DHRecvKey = pkB
 	r.RootKey = rootKey
+	r.ChainSendKey = chainSendKey
+	r.ChainRecieveKey = chainRecvKey
 	r.RootKeyEncrypted = false
+	return nil
 }
 
-func (r *Ratchet) InitRecievedSession(ephemeralKey ecc.IECPublicKey) {
+// InitRecievedSession answers the handshake of the initiator, preKeyId is the
+// id of our signed pre key it used, empty means our current one, pqCipherText
+// is only sent when it encapsulated to our post-quantum pre key. The one-time
+// key is only consumed once the session is set up
+func (r *Ratchet) InitRecievedSession(ephemeralKey ecc.IECPublicKey, preKeyId string, oneTimeKeyId string, pqCipherText []byte) error {
 	if !r.RootKeyEncrypted {
-		fmt.Println("Not a new session")
-		return
+		return ErrNotNewSession
 	}
-	// Performance X3DH
-	var aPreKeyPair *ecc.ECKeyPair
-	aPreKeyPair = nil
-	for _, v := range r.MyKeyBundle.PreKeys {
-		aPreKeyPair = v
+	if ephemeralKey == nil {
+		return fmt.Errorf("%w: missing ephemeral key", ecc.ErrInvalidKey)
+	}
+	if common.IsStringEmpty(&preKeyId) {
+		preKeyId = r.MyKeyBundle.PreKeyId
+	}
+	aPreKeyPair := r.MyKeyBundle.PreKeys[preKeyId]
+	if aPreKeyPair == nil {
+		return fmt.Errorf("Unknown pre key %s", preKeyId)
 	}
+	// Performance X3DH
 	pkA := aPreKeyPair.PrivateKey()
 	ikB := r.YourKeyBundle.GetIdentityKey()
-	dh1, _ := pkA.CalculateCommonSecret(ikB)
+	dh1, err := pkA.CalculateCommonSecret(ikB)
+	if err != nil {
+		return err
+	}
 
 	ikA := r.MyKeyBundle.IdentityKey.PrivateKey()
 	ekB := ephemeralKey
-	dh2, _ := ikA.CalculateCommonSecret(ekB)
-
-	dh3, _ := pkA.CalculateCommonSecret(ekB)
+	dh2, err := ikA.CalculateCommonSecret(ekB)
+	if err != nil {
+		return err
+	}
+	dh3, err := pkA.CalculateCommonSecret(ekB)
+	if err != nil {
+		return err
+	}
+	preKdf := common.ConcatBytes(dh1, dh2, dh3)
 
-	var preKdf []byte
+	if !common.IsStringEmpty(&oneTimeKeyId) {
+		opkA := r.MyKeyBundle.OneTimeKeys[oneTimeKeyId]
+		if opkA == nil {
+			return fmt.Errorf("Unknown one-time key %s", oneTimeKeyId)
+		}
+		dh4, err := opkA.PrivateKey().CalculateCommonSecret(ekB)
+		if err != nil {
+			return err
+		}
+		preKdf = common.ConcatBytes(preKdf, dh4)
+	}
 
-	/*_, pkId := r.YourKeyBundle.GetPreKey()
-	if !common.IsStringEmpty(&pkId) {
-		var opkA *ecc.ECKeyPair
-		opkA = nil
-		for _, v := range r.MyKeyBundle.PreKeys {
-			opkA = v
+	if len(pqCipherText) > 0 {
+		pqPreKey := r.MyKeyBundle.PQPreKeys[preKeyId]
+		if pqPreKey == nil {
+			return fmt.Errorf("Unknown post-quantum pre key %s", preKeyId)
 		}
-		if opkA != nil {
-			dh4, _ := opkA.PrivateKey().CalculateCommonSecret(ekB)
-			preKdf = common.ConcatBytes(dh1, dh2, dh3, dh4)
+		pqSecret, err := pqPreKey.Decapsulate(pqCipherText)
+		if err != nil {
+			return err
 		}
-	} else {
-		preKdf = common.ConcatBytes(dh1, dh2, dh3)
-	}*/
+		preKdf = common.ConcatBytes(preKdf, pqSecret)
+	}
 
-	preKdf = common.ConcatBytes(dh1, dh2, dh3)
+	sharedSecret, err := r.x3dhKDF(preKdf)
+	if err != nil {
+		return fmt.Errorf("Cannot generate root key: %w", err)
+	}
 
-	rootKey, e := kdf.DoKDF(preKdf)
-	if e != nil {
-		fmt.Println("Cannot generate root key", e)
-		return
+	// The initiator ratchets from its first ratchet key against our pre key,
+	// we step once it arrives with the first message. What we send before
+	// goes on the first chain
+	chainSendKey, err := r.firstChainKey(sharedSecret)
+	if err != nil {
+		return err
 	}
-	r.RootKey = rootKey
+	if !common.IsStringEmpty(&oneTimeKeyId) {
+		if _, err = r.MyKeyBundle.ConsumeOneTimeKey(oneTimeKeyId); err != nil {
+			return err
+		}
+		r.OneTimeKeyId = oneTimeKeyId
+	}
+	r.RootKey = sharedSecret
+	r.DHSendKey = aPreKeyPair
+	r.ChainSendKey = chainSendKey
+	r.sharedSecret = sharedSecret
+	r.myIdentityKey = r.MyKeyBundle.IdentityKey.PublicKey()
+	r.PreKeyId = preKeyId
+	r.PostQuantum = len(pqCipherText) > 0
+	r.AssociatedData = associatedData(r.ProtocolVersion, ikB, r.MyKeyBundle.IdentityKey.PublicKey())
 	r.RootKeyEncrypted = false
+	return nil
 }
 
-func (r *Ratchet) OnSend(message *Message) {
+func (r *Ratchet) OnSend(message *Message) error {
 	message.RatchetID = r.RatchetId
-	var encryptedKey []byte
-	if r.TotalMessageSent == 0 {
-		encryptedKey, _ = kdf.DoKDF(r.RootKey)
-	} else {
-		encryptedKey, _ = kdf.DoKDF(r.ChainSendKey)
+	if r.legacyChain {
+		if err := r.onSendLegacyChain(message); err != nil {
+			return err
+		}
+		r.LastUsedAt = time.Now().UnixMilli()
+		return nil
+	}
+	chainKey, messageKey, err := r.chainKDF(r.ChainSendKey)
+	if err != nil {
+		return err
+	}
+	message.Index = r.TotalMessageSent + 1
+	message.ChainIndex = r.SendChainLength + 1
+	message.PreviousChainLength = r.PreviousChainLength
+	message.RatchetKey = r.DHSendKey.PublicKey()
+	message.Padding = r.Padding
+	if err := r.encryptMessage(message, messageKey); err != nil {
+		return err
 	}
-	message.Encrypt(encryptedKey)
 	r.TotalMessageSent++
-	r.ChainSendKey = encryptedKey
-	message.Index = r.TotalMessageSent
+	r.SendChainLength++
+	r.ChainSendKey = chainKey
+	r.LastUsedAt = time.Now().UnixMilli()
+	return nil
 }
 
-func (r *Ratchet) OnRecieved(message *Message) {
+// OnRecieved decrypts the message, the ratchet is only moved forward when the
+// message and its header turn out to be authentic
+func (r *Ratchet) OnRecieved(message *Message) error {
 	if message.RatchetID != r.RatchetId {
-		fmt.Println("Wrong rachet")
-		return
-	}
-	var decryptKey []byte
-	if (r.TotalMessageRecieved + 1) < message.Index {
-		offset := (message.Index - r.TotalMessageRecieved)
-		decryptKey, _ = kdf.DoKDF(r.RootKey)
-		for i := 0; i < int(offset)-1; i++ {
-			decryptKey, _ = kdf.DoKDF(decryptKey)
-			r.ChainRecieveKey = decryptKey
-			r.MissingMessageKeys = append(r.MissingMessageKeys, decryptKey)
+		return ErrWrongRatchet
+	}
+	if r.legacyChain {
+		state := r.saveState()
+		if err := r.onRecievedLegacyChain(message); err != nil {
+			r.restoreState(state)
+			return err
+		}
+		r.LastUsedAt = time.Now().UnixMilli()
+		return nil
+	}
+	if message.RatchetKey == nil || message.ChainIndex == 0 {
+		return fmt.Errorf("%w: missing ratchet header", ErrInvalidMessage)
+	}
+	chainId := ratchetKeyId(message.RatchetKey)
+	if position, missingKey := r.findMissingKey(chainId, message.ChainIndex); missingKey != nil {
+		if err := r.decryptMessage(message, missingKey); err != nil {
+			return err
+		}
+		r.removeMissingKey(position)
+		r.TotalMessageRecieved++
+		r.LastUsedAt = time.Now().UnixMilli()
+		return nil
+	}
+	state := r.saveState()
+	if err := r.decryptInChain(message); err != nil {
+		r.restoreState(state)
+		return err
+	}
+	r.LastUsedAt = time.Now().UnixMilli()
+	return nil
+}
+
+func (r *Ratchet) decryptInChain(message *Message) error {
+	if !isSameKey(message.RatchetKey, r.DHRecvKey) {
+		if err := r.skipMessageKeys(message.PreviousChainLength); err != nil {
+			return err
 		}
-	} else if r.TotalMessageRecieved == 0 {
-		decryptKey, _ = kdf.DoKDF(r.RootKey)
-	} else {
-		decryptKey, _ = kdf.DoKDF(r.ChainRecieveKey)
+		if err := r.dhRatchetStep(message.RatchetKey); err != nil {
+			return fmt.Errorf("Cannot do ratchet step: %w", err)
+		}
+	} else if message.ChainIndex <= r.RecvChainLength {
+		return ErrDuplicateMessage
+	}
+	if err := r.skipMessageKeys(message.ChainIndex - 1); err != nil {
+		return err
+	}
+	chainKey, messageKey, err := r.chainKDF(r.ChainRecieveKey)
+	if err != nil {
+		return err
+	}
+	if err := r.decryptMessage(message, messageKey); err != nil {
+		return err
 	}
-	message.Decrypt(decryptKey)
 	r.TotalMessageRecieved++
-	r.ChainRecieveKey = decryptKey
+	r.RecvChainLength++
+	r.ChainRecieveKey = chainKey
+	return nil
+}
+
+// ratchetState is the part of the ratchet a received message may change
+type ratchetState struct {
+	rootKey             []byte
+	chainSendKey        []byte
+	chainRecieveKey     []byte
+	dhSendKey           *ecc.ECKeyPair
+	dhRecvKey           ecc.IECPublicKey
+	sendChainLength     uint
+	recvChainLength     uint
+	previousChainLength uint
+	missingMessageKeys  []*MissingMessageKey
+}
+
+func (r *Ratchet) saveState() *ratchetState {
+	return &ratchetState{
+		rootKey:             r.RootKey,
+		chainSendKey:        r.ChainSendKey,
+		chainRecieveKey:     r.ChainRecieveKey,
+		dhSendKey:           r.DHSendKey,
+		dhRecvKey:           r.DHRecvKey,
+		sendChainLength:     r.SendChainLength,
+		recvChainLength:     r.RecvChainLength,
+		previousChainLength: r.PreviousChainLength,
+		missingMessageKeys:  append([]*MissingMessageKey(nil), r.MissingMessageKeys...),
+	}
+}
+
+func (r *Ratchet) restoreState(state *ratchetState) {
+	r.RootKey = state.rootKey
+	r.ChainSendKey = state.chainSendKey
+	r.ChainRecieveKey = state.chainRecieveKey
+	r.DHSendKey = state.dhSendKey
+	r.DHRecvKey = state.dhRecvKey
+	r.SendChainLength = state.sendChainLength
+	r.RecvChainLength = state.recvChainLength
+	r.PreviousChainLength = state.previousChainLength
+	r.MissingMessageKeys = state.missingMessageKeys
+}
+
+// associatedData is bound to every message of the session, the initiator's
+// identity key always comes first, from v2 on it is led by the protocol
+// version so both sides have to agree on it
+func associatedData(protocolVersion uint, initiatorKey, responderKey ecc.IECPublicKey) []byte {
+	initiator, _ := initiatorKey.Serialize()
+	responder, _ := responderKey.Serialize()
+	if protocolVersion < keys.PROTOCOL_VERSION_2 {
+		return common.ConcatBytes(initiator, responder)
+	}
+	return common.ConcatBytes([]byte{byte(protocolVersion)}, initiator, responder)
 }
 
-func (r *Ratchet) Save(PIN []byte) *RachetStore {
-	encryptedRootKey, err := common.EncryptAndHash(r.RootKey, PIN)
+// firstChainKey is the chain the responder sends on until the first ratchet
+// key of the initiator arrives, it is bound to the session id
+func (r *Ratchet) firstChainKey(sharedSecret []byte) ([]byte, error) {
+	chainKey, err := kdf.DeriveKey(sharedSecret, kdf.LABEL_FIRST_CHAIN+r.RatchetId)
 	if err != nil {
-		fmt.Println("Cannot ecnrypt key")
-		return nil
+		return nil, fmt.Errorf("Cannot generate chain key: %w", err)
+	}
+	return chainKey, nil
+}
+
+func (r *Ratchet) x3dhKDF(keyMaterial []byte) ([]byte, error) {
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return kdf.DoKDF(keyMaterial)
+	}
+	return kdf.DoX3DHKDF(keyMaterial)
+}
+
+func (r *Ratchet) rootKDF(rootKey, dhOutput []byte) ([]byte, []byte, error) {
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return kdf.DoRootKDFV1(rootKey, dhOutput)
+	}
+	return kdf.DoRootKDF(rootKey, dhOutput)
+}
+
+// chainKDF returns the next chain key and the message key of this step, v1
+// sessions use one output for both
+func (r *Ratchet) chainKDF(chainKey []byte) ([]byte, []byte, error) {
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		messageKey, err := kdf.DoKDF(chainKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot do chain KDF: %w", err)
+		}
+		return messageKey, messageKey, nil
 	}
-	encryptedChainSendKey, err := common.EncryptAndHash(r.ChainSendKey, PIN)
+	nextChainKey, messageKey := kdf.DoChainKDF(chainKey)
+	return nextChainKey, messageKey, nil
+}
+
+func (r *Ratchet) encryptMessage(message *Message, messageKey []byte) error {
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return message.Encrypt(messageKey, r.AssociatedData)
+	}
+	return message.Seal(messageKey, r.AssociatedData)
+}
+
+func (r *Ratchet) decryptMessage(message *Message, messageKey []byte) error {
+	if r.ProtocolVersion < keys.PROTOCOL_VERSION_2 {
+		return message.Decrypt(messageKey, r.AssociatedData)
+	}
+	return message.Open(messageKey, r.AssociatedData)
+}
+
+// dhRatchetStep derives a new receiving chain from the other side's new
+// ratchet key, then generates our next ratchet key and sending chain
+func (r *Ratchet) dhRatchetStep(yourRatchetKey ecc.IECPublicKey) error {
+	dhOut, err := r.DHSendKey.PrivateKey().CalculateCommonSecret(yourRatchetKey)
 	if err != nil {
-		fmt.Println("Cannot ecnrypt key")
-		return nil
+		return err
+	}
+	rootKey, chainRecvKey, err := r.rootKDF(r.RootKey, dhOut)
+	if err != nil {
+		return err
+	}
+	nextSendKey := ecc.GenerateKeyPairWithSuite(r.DHSendKey.Suite())
+	dhOut, err = nextSendKey.PrivateKey().CalculateCommonSecret(yourRatchetKey)
+	if err != nil {
+		return err
 	}
-	encryptedRecvSendKey, err := common.EncryptAndHash(r.ChainRecieveKey, PIN)
+	rootKey, chainSendKey, err := r.rootKDF(rootKey, dhOut)
 	if err != nil {
-		fmt.Println("Cannot ecnrypt key")
+		return err
+	}
+	r.PreviousChainLength = r.SendChainLength
+	r.SendChainLength = 0
+	r.RecvChainLength = 0
+	r.DHRecvKey = yourRatchetKey
+	r.DHSendKey = nextSendKey
+	r.RootKey = rootKey
+	r.ChainRecieveKey = chainRecvKey
+	r.ChainSendKey = chainSendKey
+	return nil
+}
+
+// skipMessageKeys moves the receiving chain forward until it reaches the given
+// length, keeping the keys of messages we have not seen yet
+func (r *Ratchet) skipMessageKeys(until uint) error {
+	if r.RecvChainLength >= until || common.IsByteArrayEmpty(&r.ChainRecieveKey) {
 		return nil
 	}
-	var missingKeys []string
-	for _, missKey := range r.MissingMessageKeys {
-		encryptedMissKey, err := common.EncryptAndHash(missKey, PIN)
+	if until-r.RecvChainLength > r.MaxSkip {
+		return ErrTooManySkipped
+	}
+	chainId := ratchetKeyId(r.DHRecvKey)
+	for r.RecvChainLength < until {
+		chainKey, skippedKey, err := r.chainKDF(r.ChainRecieveKey)
 		if err != nil {
-			fmt.Println("Cannot ecnrypt key")
-			return nil
+			return err
 		}
-		missingKeys = append(missingKeys, common.EncodeToString(encryptedMissKey))
+		r.RecvChainLength++
+		r.putMissingKey(chainId, r.RecvChainLength, skippedKey)
+		r.ChainRecieveKey = chainKey
 	}
-	return &RachetStore{
-		RachetId:           r.RatchetId,
-		RootKey:            common.EncodeToString(encryptedRootKey),
-		ChainSendKey:       common.EncodeToString(encryptedChainSendKey),
-		ChainRecvKey:       common.EncodeToString(encryptedRecvSendKey),
-		TotalMessageSent:   r.GetTotalSent(),
-		TotalMessageRecv:   r.GetTotalRecieved(),
-		MissingMessageKeys: missingKeys,
+	return nil
+}
+
+func isSameKey(a, b ecc.IECPublicKey) bool {
+	if a == nil || b == nil {
+		return false
 	}
+	aBytes, _ := a.Serialize()
+	bBytes, _ := b.Serialize()
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// Save encrypts the ratchet with a key derived from the stretched PIN all
+// ratchets share and the ratchet id, so saving after every message and loading
+// many ratchets stays cheap. The store is closed by a MAC over all of its
+// fields
+func (r *Ratchet) Save(PIN []byte) (*RachetStore, error) {
+	if r.pinKdf == nil || !r.pinKdf.IsShared() {
+		pinKdf, err := common.SharedPinKdf()
+		if err != nil {
+			return nil, err
+		}
+		r.pinKdf = pinKdf
+	}
+	PIN, err := r.pinKdf.DeriveStoreKey(PIN, r.RatchetId)
+	if err != nil {
+		return nil, err
+	}
+	encryptedRootKey, err := common.EncryptData(r.RootKey, PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt root key: %w", err)
+	}
+	encryptedChainSendKey, err := common.EncryptData(r.ChainSendKey, PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt sending chain key: %w", err)
+	}
+	encryptedRecvSendKey, err := common.EncryptData(r.ChainRecieveKey, PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encrypt receiving chain key: %w", err)
+	}
+	var dhSendKey *ecc.ECKeyPairStore
+	var dhRecvKey string
+	if !r.legacyChain {
+		dhSendKey = r.DHSendKey.SaveWithKey(PIN)
+		// The responder has none until the first message arrives
+		if r.DHRecvKey != nil {
+			serializedKey, err := r.DHRecvKey.Serialize()
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read ratchet key: %w", err)
+			}
+			dhRecvKey = common.EncodeToString(serializedKey)
+		}
+	}
+	missingKeys, err := saveMissingKeys(r.MissingMessageKeys, PIN)
+	if err != nil {
+		return nil, err
+	}
+	myIdentityKey, err := serializeIdentityKey(r.myIdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	var yourIdentityKey string
+	if r.YourKeyBundle != nil {
+		yourIdentityKey, err = serializeIdentityKey(r.YourKeyBundle.GetIdentityKey())
+		if err != nil {
+			return nil, err
+		}
+	}
+	store := &RachetStore{
+		RachetId:            r.RatchetId,
+		RootKey:             common.EncodeToString(encryptedRootKey),
+		ChainSendKey:        common.EncodeToString(encryptedChainSendKey),
+		ChainRecvKey:        common.EncodeToString(encryptedRecvSendKey),
+		DHSendKey:           dhSendKey,
+		DHRecvKey:           dhRecvKey,
+		SendChainLength:     r.SendChainLength,
+		RecvChainLength:     r.RecvChainLength,
+		PreviousChainLength: r.PreviousChainLength,
+		TotalMessageSent:    r.GetTotalSent(),
+		TotalMessageRecv:    r.GetTotalRecieved(),
+		MaxSkip:             r.MaxSkip,
+		MaxMissingKeys:      r.MaxMissingKeys,
+		PostQuantum:         r.PostQuantum,
+		ProtocolVersion:     r.ProtocolVersion,
+		Padding:             uint8(r.Padding),
+		AssociatedData:      common.EncodeToString(r.AssociatedData),
+		MissingMessageKeys:  missingKeys,
+		PinKdf:              r.pinKdf.Save(),
+		MyIdentityKey:       myIdentityKey,
+		YourIdentityKey:     yourIdentityKey,
+		CreatedAt:           r.CreatedAt,
+		LastUsedAt:          r.LastUsedAt,
+	}
+	mac, err := storeMac(store, PIN)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot authenticate ratchet store: %w", err)
+	}
+	store.Mac = common.EncodeToString(mac)
+	r.legacyStore = false
+	return store, nil
+}
+
+// NeedsMigration tells whether the ratchet was loaded from a store encrypted
+// with the bare PIN or a PIN key of its own or written without a MAC, it
+// should be saved again to upgrade the store
+func (r *Ratchet) NeedsMigration() bool {
+	return r.legacyStore
 }
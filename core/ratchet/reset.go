@@ -0,0 +1,182 @@
+package ratchet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/keys"
+	"slices"
+)
+
+// SessionReset replaces a ratchet one side cannot decrypt with anymore, a
+// lost store, a reinstall or a corrupted chain, by a fresh X3DH under the
+// same ratchet id. The side that failed sends it along with how far it got,
+// ReceivedIndex is how many messages it decrypted and FailedIndexes the
+// indexes it could not
+type SessionReset struct {
+	RatchetId       string
+	EphemeralKey    ecc.IECPublicKey
+	PreKeyId        string
+	OneTimeKeyId    string
+	PQCipherText    []byte
+	ProtocolVersion uint
+	ReceivedIndex   uint
+	FailedIndexes   []uint
+}
+
+type SessionResetDto struct {
+	RatchetId       string `json:"chatSessionId"`
+	EphemeralKey    string `json:"ephemeralKey"`
+	PreKeyId        string `json:"preKeyId,omitempty"`
+	OneTimeKeyId    string `json:"oneTimeKeyId,omitempty"`
+	PQCipherText    string `json:"pqCipherText,omitempty"`
+	ProtocolVersion uint   `json:"protocolVersion"`
+	ReceivedIndex   uint   `json:"receivedIndex"`
+	FailedIndexes   []uint `json:"failedIndexes,omitempty"`
+}
+
+// NewSessionReset sets up the replacement of the ratchet ratchetId with the
+// current bundle of the other user, broken is what is left of the old
+// ratchet and may be nil when its store is gone
+func NewSessionReset(internalKey *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle, ratchetId string, broken *Ratchet, failedIndexes []uint) (*Ratchet, *SessionReset, error) {
+	if broken != nil && broken.RatchetId != ratchetId {
+		return nil, nil, ErrWrongRatchet
+	}
+	rachet, err := newRachetFromInternal(internalKey, externalBundle, ratchetId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot reset session: %w", err)
+	}
+	var receivedIndex uint
+	if broken != nil {
+		receivedIndex = broken.TotalMessageRecieved
+	}
+	return rachet, &SessionReset{
+		RatchetId:       ratchetId,
+		EphemeralKey:    rachet.GetEphemeralKey(),
+		PreKeyId:        rachet.PreKeyId,
+		OneTimeKeyId:    rachet.OneTimeKeyId,
+		PQCipherText:    rachet.GetPQCipherText(),
+		ProtocolVersion: rachet.ProtocolVersion,
+		ReceivedIndex:   receivedIndex,
+		FailedIndexes:   failedIndexes,
+	}, nil
+}
+
+// AcceptSessionReset answers a reset, externalBundle is the bundle of the
+// initiator whose identity key has to be checked before. current is our
+// ratchet for the session, nil when we lost it too, a reset between other
+// identity keys than the ones of current is refused. It returns the new
+// ratchet and the indexes of the messages we sent the initiator will never
+// read
+func AcceptSessionReset(internalKey *keys.InternalKeyBundle, externalBundle *keys.ExternalKeyBundle, reset *SessionReset, current *Ratchet) (*Ratchet, []uint, error) {
+	if current != nil && current.RatchetId != reset.RatchetId {
+		return nil, nil, ErrWrongRatchet
+	}
+	if reset.EphemeralKey == nil {
+		return nil, nil, fmt.Errorf("%w: missing ephemeral key", ErrInvalidMessage)
+	}
+	// The identity keys are checked before the handshake, which consumes our
+	// one-time key
+	if current != nil {
+		// Sessions set up before the ratchet step bound no identity keys, the
+		// initiator's key was checked against the trusted one before
+		initiator, _ := current.identityKeys()
+		boundIdentity := !current.legacyChain || initiator != nil
+		resetKeys := &Ratchet{
+			ProtocolVersion: keys.PROTOCOL_VERSION_1,
+			AssociatedData:  associatedData(keys.PROTOCOL_VERSION_1, externalBundle.GetIdentityKey(), internalKey.IdentityKey.PublicKey()),
+		}
+		if boundIdentity && !sameIdentityKeys(current, resetKeys) {
+			return nil, nil, fmt.Errorf("%w: session reset comes from another identity key", ErrWrongRatchet)
+		}
+	}
+	rachet, err := NewRachetFromExternal(internalKey, externalBundle, reset.EphemeralKey, reset.RatchetId, reset.PreKeyId, reset.OneTimeKeyId, reset.PQCipherText, reset.ProtocolVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot reset session: %w", err)
+	}
+	if current == nil {
+		return rachet, nil, nil
+	}
+	return rachet, unrecoverableIndexes(current.TotalMessageSent, reset), nil
+}
+
+func NewSessionResetFromJson(jsonString string) (*SessionReset, error) {
+	var resetDto SessionResetDto
+	err := json.Unmarshal([]byte(jsonString), &resetDto)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read session reset: %w", ErrInvalidMessage, err)
+	}
+	ephemeralKey, err := ecc.DeserializePublicKey(common.DecodeToByte(resetDto.EphemeralKey))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read ephemeral key: %w", err)
+	}
+	return &SessionReset{
+		RatchetId:       resetDto.RatchetId,
+		EphemeralKey:    ephemeralKey,
+		PreKeyId:        resetDto.PreKeyId,
+		OneTimeKeyId:    resetDto.OneTimeKeyId,
+		PQCipherText:    common.DecodeToByte(resetDto.PQCipherText),
+		ProtocolVersion: resetDto.ProtocolVersion,
+		ReceivedIndex:   resetDto.ReceivedIndex,
+		FailedIndexes:   resetDto.FailedIndexes,
+	}, nil
+}
+
+func (s *SessionReset) ToDto() *SessionResetDto {
+	ephemeralKey, _ := s.EphemeralKey.Serialize()
+	return &SessionResetDto{
+		RatchetId:       s.RatchetId,
+		EphemeralKey:    common.EncodeToString(ephemeralKey),
+		PreKeyId:        s.PreKeyId,
+		OneTimeKeyId:    s.OneTimeKeyId,
+		PQCipherText:    common.EncodeToString(s.PQCipherText),
+		ProtocolVersion: s.ProtocolVersion,
+		ReceivedIndex:   s.ReceivedIndex,
+		FailedIndexes:   s.FailedIndexes,
+	}
+}
+
+// unrecoverableIndexes lists the messages we sent after the ones the
+// initiator got and the ones it failed on, ReceivedIndex is a count so a
+// message that was skipped and never arrived is reported too
+func unrecoverableIndexes(totalSent uint, reset *SessionReset) []uint {
+	var result []uint
+	for index := reset.ReceivedIndex + 1; index <= totalSent; index++ {
+		result = append(result, index)
+	}
+	for _, index := range reset.FailedIndexes {
+		if index > 0 && index <= reset.ReceivedIndex {
+			result = append(result, index)
+		}
+	}
+	slices.Sort(result)
+	return slices.Compact(result)
+}
+
+// sameIdentityKeys tells whether both ratchets were set up between the same
+// two identity keys, whoever initiated them
+func sameIdentityKeys(a, b *Ratchet) bool {
+	aInitiator, aResponder := a.identityKeys()
+	bInitiator, bResponder := b.identityKeys()
+	if aInitiator == nil || bInitiator == nil {
+		return false
+	}
+	return bytes.Equal(aInitiator, bInitiator) && bytes.Equal(aResponder, bResponder) ||
+		bytes.Equal(aInitiator, bResponder) && bytes.Equal(aResponder, bInitiator)
+}
+
+// identityKeys splits the associated data back into the serialized identity
+// keys of the initiator and the responder, both are of the same suite
+func (r *Ratchet) identityKeys() ([]byte, []byte) {
+	associatedData := r.AssociatedData
+	if r.ProtocolVersion >= keys.PROTOCOL_VERSION_2 && len(associatedData) > 0 {
+		associatedData = associatedData[1:]
+	}
+	if len(associatedData) == 0 || len(associatedData)%2 != 0 {
+		return nil, nil
+	}
+	half := len(associatedData) / 2
+	return associatedData[:half], associatedData[half:]
+}
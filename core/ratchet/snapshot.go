@@ -0,0 +1,105 @@
+package ratchet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/crypto/kdf"
+	"lidx-core-lib/keys"
+)
+
+// storeMac authenticates every field of the store but the MAC itself, the
+// key comes from the same stretched PIN the store is encrypted with
+func storeMac(store *RachetStore, storeKey []byte) ([]byte, error) {
+	macKey, err := kdf.DeriveKey(storeKey, kdf.LABEL_STORAGE_MAC)
+	if err != nil {
+		return nil, err
+	}
+	unsigned := *store
+	unsigned.Mac = ""
+	content, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot write ratchet store: %w", err)
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(content)
+	return mac.Sum(nil), nil
+}
+
+// verifyStoreMac checks the MAC of a store. Only stores written before the
+// PIN KDF and the ratchet step have none, they are reported as legacy so they
+// get saved again. Any other store without one was stripped of it
+func verifyStoreMac(store *RachetStore, storeKey []byte) (bool, error) {
+	if store.Mac == "" {
+		if store.PinKdf != nil || store.ProtocolVersion != 0 || store.DHSendKey != nil {
+			return false, fmt.Errorf("%w: missing MAC", ErrTamperedStore)
+		}
+		return true, nil
+	}
+	expected, err := storeMac(store, storeKey)
+	if err != nil {
+		return false, err
+	}
+	if !hmac.Equal(expected, common.DecodeToByte(store.Mac)) {
+		return false, ErrTamperedStore
+	}
+	return false, nil
+}
+
+// AttachKeyBundle gives a loaded ratchet our key bundle back so it can check
+// the other user and set up a new session, the bundle has to hold the
+// identity key the session was set up with
+func (r *Ratchet) AttachKeyBundle(internalKey *keys.InternalKeyBundle) error {
+	ourKey := internalKey.IdentityKey.PublicKey()
+	if r.myIdentityKey != nil {
+		if !isSameKey(r.myIdentityKey, ourKey) {
+			return fmt.Errorf("%w: ratchet belongs to another identity key", ErrWrongRatchet)
+		}
+	} else if !r.legacyChain {
+		// Every store with a MAC names our identity key, only sessions set
+		// up before the ratchet step kept none and take ours from now on
+		return fmt.Errorf("%w: ratchet store does not name its identity key", ErrWrongRatchet)
+	}
+	r.MyKeyBundle = internalKey
+	r.myIdentityKey = ourKey
+	return nil
+}
+
+// identityOnlyBundle is what a loaded ratchet knows about the other user,
+// enough to check their identity key but not to start a handshake
+func identityOnlyBundle(identityKey ecc.IECPublicKey, protocolVersion uint) *keys.ExternalKeyBundle {
+	return &keys.ExternalKeyBundle{
+		Suite:           identityKey.Suite(),
+		ProtocolVersion: protocolVersion,
+		IdentityKey:     identityKey,
+	}
+}
+
+// serializeIdentityKey is the base64 form of an identity key kept in the
+// store, empty when it is not known
+func serializeIdentityKey(identityKey ecc.IECPublicKey) (string, error) {
+	if identityKey == nil {
+		return "", nil
+	}
+	serialized, err := identityKey.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("Cannot read identity key: %w", err)
+	}
+	return common.EncodeToString(serialized), nil
+}
+
+// deserializeIdentityKey reads an identity key written by
+// serializeIdentityKey, nil when none was kept
+func deserializeIdentityKey(identityKey string) (ecc.IECPublicKey, error) {
+	if identityKey == "" {
+		return nil, nil
+	}
+	key, err := ecc.DeserializePublicKey(common.DecodeToByte(identityKey))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read identity key: %w", err)
+	}
+	return key, nil
+}
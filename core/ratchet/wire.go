@@ -0,0 +1,183 @@
+package ratchet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lidx-core-lib/crypto/ecc"
+)
+
+// Binary envelope of a message, every envelope starts with the version of the
+// protocol that produced it so older clients can refuse what they cannot read
+//
+//	version   1 byte
+//	flags     1 byte, bit 0 is set for binary content, bits 1-2 are the padding scheme,
+//	          the other bits are reserved and have to be clear
+//	ratchetId uint16 length + bytes
+//	index, chainIndex, previousChainLength as uvarint
+//	ratchetKey uint16 length + bytes
+//	cipher    uint32 length + bytes, the sealed content with its MAC
+const (
+	WIRE_VERSION_1       byte = 0x01
+	CURRENT_WIRE_VERSION      = WIRE_VERSION_1
+)
+
+const (
+	wireFlagBinary       byte = 0x01
+	wireFlagPaddingShift      = 1
+	wireFlagPaddingMask  byte = 0x03
+	wireFlagKnown             = wireFlagBinary | wireFlagPaddingMask<<wireFlagPaddingShift
+)
+
+// Encode packs the message into the binary envelope, the message has to be
+// encrypted before
+func (m *Message) Encode() ([]byte, error) {
+	if len(m.CipherMessage) == 0 {
+		return nil, fmt.Errorf("Message is not encrypted")
+	}
+	var ratchetKey []byte
+	if m.RatchetKey != nil {
+		serializedKey, err := m.RatchetKey.Serialize()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot encode ratchet key: %w", err)
+		}
+		ratchetKey = serializedKey
+	}
+	if len(m.RatchetID) > 0xffff || len(ratchetKey) > 0xffff {
+		return nil, fmt.Errorf("Message header too long")
+	}
+	var flags byte
+	if m.IsBinary {
+		flags |= wireFlagBinary
+	}
+	if m.Padding > PaddingScheme(wireFlagPaddingMask) {
+		return nil, fmt.Errorf("Unknown padding scheme %d", uint8(m.Padding))
+	}
+	flags |= byte(m.Padding) << wireFlagPaddingShift
+	result := []byte{CURRENT_WIRE_VERSION, flags}
+	result = binary.BigEndian.AppendUint16(result, uint16(len(m.RatchetID)))
+	result = append(result, m.RatchetID...)
+	result = binary.AppendUvarint(result, uint64(m.Index))
+	result = binary.AppendUvarint(result, uint64(m.ChainIndex))
+	result = binary.AppendUvarint(result, uint64(m.PreviousChainLength))
+	result = binary.BigEndian.AppendUint16(result, uint16(len(ratchetKey)))
+	result = append(result, ratchetKey...)
+	result = binary.BigEndian.AppendUint32(result, uint32(len(m.CipherMessage)))
+	return append(result, m.CipherMessage...), nil
+}
+
+// DecodeMessage reads a binary envelope back into a message ready for
+// OnRecieved
+func DecodeMessage(data []byte) (*Message, error) {
+	reader := wireReader{data: data}
+	version := reader.byte()
+	if reader.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, reader.err)
+	}
+	if version != WIRE_VERSION_1 {
+		return nil, fmt.Errorf("%w: unsupported wire version %d", ErrInvalidMessage, version)
+	}
+	flags := reader.byte()
+	if flags&^wireFlagKnown != 0 {
+		return nil, fmt.Errorf("%w: unknown envelope flags %#x", ErrInvalidMessage, flags)
+	}
+	ratchetId := reader.bytes(int(reader.uint16()))
+	index := reader.uvarint()
+	chainIndex := reader.uvarint()
+	previousChainLength := reader.uvarint()
+	ratchetKey := reader.bytes(int(reader.uint16()))
+	cipherMessage := reader.bytes(int(reader.uint32()))
+	if reader.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, reader.err)
+	}
+	if len(reader.data) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrInvalidMessage)
+	}
+	msg := &Message{
+		RatchetID:           string(ratchetId),
+		Index:               uint(index),
+		ChainIndex:          uint(chainIndex),
+		PreviousChainLength: uint(previousChainLength),
+		IsBinary:            flags&wireFlagBinary != 0,
+		Padding:             PaddingScheme(flags >> wireFlagPaddingShift & wireFlagPaddingMask),
+		CipherMessage:       append([]byte(nil), cipherMessage...),
+	}
+	if len(ratchetKey) != 0 {
+		pubKey, err := ecc.DeserializePublicKey(ratchetKey)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot read ratchet key: %w", ErrInvalidMessage, err)
+		}
+		msg.RatchetKey = pubKey
+	}
+	return msg, nil
+}
+
+// SplitSocketFrame splits a binary frame relayed by the server into the json
+// it routes on and the envelope, see server/router/wire.go
+//
+//	metadata uint32 length + MessageDto json of the server without the ratchet fields
+//	envelope the rest of the frame
+func SplitSocketFrame(frame []byte) ([]byte, []byte, error) {
+	reader := wireReader{data: frame}
+	metadata := reader.bytes(int(reader.uint32()))
+	if reader.err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidMessage, reader.err)
+	}
+	return metadata, reader.data, nil
+}
+
+// wireReader consumes the envelope front to back, the first failure sticks
+// so the fields can be read without checking each one
+type wireReader struct {
+	data []byte
+	err  error
+}
+
+func (r *wireReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = fmt.Errorf("envelope too short")
+		return nil
+	}
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *wireReader) byte() byte {
+	result := r.bytes(1)
+	if result == nil {
+		return 0
+	}
+	return result[0]
+}
+
+func (r *wireReader) uint16() uint16 {
+	result := r.bytes(2)
+	if result == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(result)
+}
+
+func (r *wireReader) uint32() uint32 {
+	result := r.bytes(4)
+	if result == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(result)
+}
+
+func (r *wireReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	result, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return result
+}
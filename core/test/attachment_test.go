@@ -0,0 +1,107 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"lidx-core-lib/attachment"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/aes"
+	"testing"
+)
+
+func encryptAttachment(t *testing.T, content []byte) ([]byte, *attachment.Descriptor) {
+	blob, descriptor, err := attachment.Encrypt(content, "image/png", "cat.png", []byte("THUMBNAIL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.FileId = "file-id"
+	return blob, descriptor
+}
+
+// withDigest gives the descriptor of a blob changed after upload, so the
+// chunks are checked and not only the digest
+func withDigest(descriptor *attachment.Descriptor, blob []byte) *attachment.Descriptor {
+	digest := sha256.Sum256(blob)
+	changed := *descriptor
+	changed.Digest = digest[:]
+	return &changed
+}
+
+func TestAttachment(t *testing.T) {
+	for _, size := range []int{0, 1, attachment.DEFAULT_CHUNK_SIZE, 2*attachment.DEFAULT_CHUNK_SIZE + 7} {
+		content := bytes.Repeat([]byte{0x42}, size)
+		blob, descriptor := encryptAttachment(t, content)
+		// Short content turns up in any ciphertext by chance
+		if size >= 16 && bytes.Contains(blob, content[:min(size, 64)]) {
+			t.Fatal("Blob contains the plain content")
+		}
+
+		descriptorJson, _ := json.Marshal(descriptor.ToDto())
+		received, err := attachment.NewDescriptorFromJson(string(descriptorJson))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.FileId != "file-id" || received.ContentType != "image/png" || received.FileName != "cat.png" || string(received.Thumbnail) != "THUMBNAIL" {
+			t.Fatal("Descriptor lost its fields")
+		}
+		decrypted, err := received.Decrypt(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Fatalf("Attachment of %d bytes does not round trip", size)
+		}
+	}
+}
+
+func TestAttachmentFreshKey(t *testing.T) {
+	content := common.StringToByte("SAME CONTENT")
+	aBlob, aDescriptor := encryptAttachment(t, content)
+	bBlob, bDescriptor := encryptAttachment(t, content)
+	if bytes.Equal(aDescriptor.Key, bDescriptor.Key) || bytes.Equal(aBlob, bBlob) {
+		t.Fatal("Attachments share a key")
+	}
+	if _, err := bDescriptor.Decrypt(aBlob); !errors.Is(err, attachment.ErrDigestMismatch) {
+		t.Fatalf("Expected a digest mismatch but got %v", err)
+	}
+}
+
+func TestAttachmentTampered(t *testing.T) {
+	content := bytes.Repeat([]byte{0x42}, 2*attachment.DEFAULT_CHUNK_SIZE+7)
+	blob, descriptor := encryptAttachment(t, content)
+
+	tampered := bytes.Clone(blob)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := descriptor.Decrypt(tampered); !errors.Is(err, attachment.ErrDigestMismatch) {
+		t.Fatalf("Expected a digest mismatch but got %v", err)
+	}
+	if _, err := withDigest(descriptor, tampered).Decrypt(tampered); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+
+	// A blob cut after a whole chunk still fails, the chunk was not the last
+	headerSize := 1 + aes.STREAM_HEADER_SIZE
+	sealedChunkSize := attachment.DEFAULT_CHUNK_SIZE + aes.STREAM_TAG_SIZE
+	truncated := blob[:headerSize+sealedChunkSize]
+	if _, err := withDigest(descriptor, truncated).Decrypt(truncated); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+
+	// Swapping the first two chunks breaks their index
+	reordered := common.ConcatBytes(blob[:headerSize], blob[headerSize+sealedChunkSize:headerSize+2*sealedChunkSize], blob[headerSize:headerSize+sealedChunkSize], blob[headerSize+2*sealedChunkSize:])
+	if _, err := withDigest(descriptor, reordered).Decrypt(reordered); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+
+	wrongSize := *descriptor
+	wrongSize.Size++
+	if _, err := wrongSize.Decrypt(blob); !errors.Is(err, attachment.ErrInvalidAttachment) {
+		t.Fatalf("Expected an invalid attachment error but got %v", err)
+	}
+
+	if _, err := attachment.NewDescriptorFromJson(`{"key":"AAAA"}`); !errors.Is(err, attachment.ErrInvalidAttachment) {
+		t.Fatalf("Expected an invalid attachment error but got %v", err)
+	}
+}
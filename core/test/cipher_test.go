@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/kdf"
+	"lidx-core-lib/ratchet"
+	"testing"
+)
+
+func TestCipherFormat(t *testing.T) {
+	key := common.StringToByte("1234")
+	plainText := common.StringToByte("ok")
+
+	cipherText, err := common.EncryptData(plainText, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cipherText[0] != common.CIPHER_FORMAT_V3 {
+		t.Fatal("Cipher text does not start with the format version")
+	}
+	plainHash := sha256.Sum256(plainText)
+	if bytes.Contains(cipherText, plainHash[:]) {
+		t.Fatal("Cipher text carries the plain text hash")
+	}
+	decrypted, err := common.DecryptData(cipherText, key)
+	if err != nil || !bytes.Equal(decrypted, plainText) {
+		t.Fatal("Cannot decrypt v2 cipher text")
+	}
+
+	tampered := append([]byte(nil), cipherText...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := common.DecryptData(tampered, key); err == nil {
+		t.Fatal("Tampered cipher text was decrypted")
+	}
+	if _, err := common.DecryptData(cipherText, common.StringToByte("4321")); err == nil {
+		t.Fatal("Cipher text was decrypted with the wrong key")
+	}
+}
+
+func TestCipherFormatReadsV1(t *testing.T) {
+	key := common.StringToByte("1234")
+	plainText := common.StringToByte("written before v2")
+
+	// Enough samples that some v1 hashes start with the v2 version byte
+	for i := 0; i < 512; i++ {
+		v1CipherText, err := common.EncryptAndHash(append(plainText, byte(i), byte(i>>8)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := common.DecryptData(v1CipherText, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, append(plainText, byte(i), byte(i>>8))) {
+			t.Fatal("Cannot decrypt v1 cipher text")
+		}
+	}
+}
+
+func TestCipherFormatReadsV2(t *testing.T) {
+	key := common.StringToByte("1234")
+	plainText := common.StringToByte("written before v3")
+
+	v2CipherText, err := common.LegacyEncryptWithAD(plainText, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2CipherText[0] != common.CIPHER_FORMAT_V2 {
+		t.Fatal("Legacy cipher text does not start with the v2 version")
+	}
+	decrypted, err := common.DecryptData(v2CipherText, key)
+	if err != nil || !bytes.Equal(decrypted, plainText) {
+		t.Fatal("Cannot decrypt v2 cipher text")
+	}
+	if _, err := common.OpenWithKey(v2CipherText, make([]byte, 32), nil); err == nil {
+		t.Fatal("v2 cipher text was opened as v3")
+	}
+}
+
+func TestCipherFormatMessages(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	first := sendOnly(aRachet, "SAME CONTENT")
+	second := sendOnly(aRachet, "SAME CONTENT")
+	for _, msg := range []*ratchet.Message{first, second} {
+		if msg.CipherMessage[0] != common.CIPHER_FORMAT_V3 {
+			t.Fatal("Message is not sealed with the v3 format")
+		}
+	}
+	if bytes.Equal(first.CipherMessage[:33], second.CipherMessage[:33]) {
+		t.Fatal("Messages with the same content share a prefix")
+	}
+	for _, msg := range []*ratchet.Message{first, second} {
+		received := readMessage(t, msg.ToDto())
+		if err := bRachet.OnRecieved(received); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKDFSeparation(t *testing.T) {
+	secret := common.StringToByte("shared secret")
+	storageKey, _ := kdf.DeriveKey(secret, kdf.LABEL_STORAGE)
+	voipKey, _ := kdf.DeriveKey(secret, kdf.LABEL_VOIP)
+	attachmentKey, _ := kdf.DeriveKey(secret, kdf.LABEL_ATTACHMENT)
+	if len(storageKey) != kdf.KEY_SIZE || bytes.Equal(storageKey, voipKey) || bytes.Equal(storageKey, attachmentKey) || bytes.Equal(voipKey, attachmentKey) {
+		t.Fatal("Labels do not separate derived keys")
+	}
+
+	chainKey, messageKey := kdf.DoChainKDF(storageKey)
+	if len(chainKey) != kdf.KEY_SIZE || len(messageKey) != kdf.KEY_SIZE || bytes.Equal(chainKey, messageKey) {
+		t.Fatal("Chain step does not separate chain and message keys")
+	}
+	nextChainKey, nextMessageKey := kdf.DoChainKDF(chainKey)
+	if bytes.Equal(nextChainKey, chainKey) || bytes.Equal(nextMessageKey, messageKey) {
+		t.Fatal("Chain step does not move the chain")
+	}
+
+	rootKey, rootChainKey, err := kdf.DoRootKDF(storageKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rootKey) != kdf.KEY_SIZE || len(rootChainKey) != kdf.KEY_SIZE || bytes.Equal(rootKey, rootChainKey) {
+		t.Fatal("Root step does not give two 32 byte keys")
+	}
+}
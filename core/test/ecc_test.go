@@ -2,6 +2,10 @@ package test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"fmt"
 	"lidx-core-lib/crypto/ecc"
 	"testing"
@@ -34,3 +38,78 @@ func TestEccDh(t *testing.T) {
 		t.Error("Fail DH")
 	}
 }
+
+func TestEccCurve25519(t *testing.T) {
+	aKeyPair := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+	bKeyPair := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+
+	msg := []byte("TEST STRING")
+	sig, err := ecc.FromKeyPair(aKeyPair).Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecc.FromPublicKey(aKeyPair.PublicKey()).Verify(msg, sig) {
+		t.Fatal("Cannot verify Ed25519 signature")
+	}
+	if ecc.FromPublicKey(bKeyPair.PublicKey()).Verify(msg, sig) {
+		t.Fatal("Signature verified with the wrong key")
+	}
+
+	aSecret, err := aKeyPair.PrivateKey().CalculateCommonSecret(bKeyPair.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSecret, _ := bKeyPair.PrivateKey().CalculateCommonSecret(aKeyPair.PublicKey())
+	if len(aSecret) != 32 || !bytes.Equal(aSecret, bSecret) {
+		t.Fatal("Fail X25519")
+	}
+
+	if _, err := aKeyPair.PrivateKey().CalculateCommonSecret(ecc.GenerateKeyPair().PublicKey()); err == nil {
+		t.Fatal("DH across key suites was accepted")
+	}
+}
+
+func TestEccSuiteSerialization(t *testing.T) {
+	pin := []byte("1234")
+	for _, suite := range []ecc.KeySuite{ecc.SUITE_P384, ecc.SUITE_CURVE25519} {
+		keyPair := ecc.GenerateKeyPairWithSuite(suite)
+		pubKey, _ := keyPair.PublicKey().Serialize()
+		if pubKey[0] != byte(suite) {
+			t.Fatalf("Public key of %s is not tagged", suite)
+		}
+		keyStore, err := keyPair.Save(pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loadedKey, err := ecc.DeSerializeKey(keyStore, pin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loadedPubKey, _ := loadedKey.PublicKey().Serialize()
+		if loadedKey.Suite() != suite || !bytes.Equal(pubKey, loadedPubKey) {
+			t.Fatalf("Cannot reload key of %s", suite)
+		}
+		aSecret, _ := keyPair.PrivateKey().CalculateCommonSecret(keyPair.PublicKey())
+		bSecret, _ := loadedKey.PrivateKey().CalculateCommonSecret(keyPair.PublicKey())
+		if !bytes.Equal(aSecret, bSecret) {
+			t.Fatalf("Reloaded private key of %s differs", suite)
+		}
+	}
+}
+
+func TestEccLegacyP384Key(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	legacyKey, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+
+	pubKey, err := ecc.DeserializePublicKey(legacyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pubKey.Suite() != ecc.SUITE_P384 {
+		t.Fatal("Untagged key is not P-384")
+	}
+	serializedKey, _ := pubKey.Serialize()
+	if !bytes.Equal(serializedKey, legacyKey) {
+		t.Fatal("Untagged key changed its encoding")
+	}
+}
@@ -0,0 +1,201 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/keys"
+	"lidx-core-lib/ratchet"
+	"testing"
+)
+
+// ratchetSnapshot is what a failed operation must leave as it was
+func ratchetSnapshot(r *ratchet.Ratchet) []byte {
+	dhSendKey, _ := r.DHSendKey.PublicKey().Serialize()
+	// A responder has no ratchet key of the other side before the first message
+	var dhRecvKey []byte
+	if r.DHRecvKey != nil {
+		dhRecvKey, _ = r.DHRecvKey.Serialize()
+	}
+	return common.ConcatBytes(r.RootKey, r.ChainSendKey, r.ChainRecieveKey, dhSendKey, dhRecvKey,
+		[]byte{byte(r.SendChainLength), byte(r.RecvChainLength), byte(r.TotalMessageRecieved), byte(len(r.MissingMessageKeys))})
+}
+
+func TestErrorTamperedMessage(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	sendAndReceive(t, aRachet, bRachet, "BEFORE")
+
+	msg := sendOnly(aRachet, "TAMPERED")
+	dto := msg.ToDto()
+	cipherMessage := common.DecodeToByte(dto.CipherMessage)
+	cipherMessage[len(cipherMessage)-1] ^= 0x01
+	dto.CipherMessage = common.EncodeToString(cipherMessage)
+
+	before := ratchetSnapshot(bRachet)
+	err := bRachet.OnRecieved(readMessage(t, dto))
+	if !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+	if !bytes.Equal(before, ratchetSnapshot(bRachet)) {
+		t.Fatal("Failed message changed the ratchet")
+	}
+	if err := bRachet.OnRecieved(readMessage(t, msg.ToDto())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorWrongRatchet(t *testing.T) {
+	aRachet, _ := newSessionPair(t)
+	_, otherRachet := newSessionPair(t)
+
+	before := ratchetSnapshot(otherRachet)
+	err := otherRachet.OnRecieved(sendOnly(aRachet, "WRONG RATCHET"))
+	if !errors.Is(err, ratchet.ErrWrongRatchet) {
+		t.Fatalf("Expected a wrong ratchet error but got %v", err)
+	}
+	if !bytes.Equal(before, ratchetSnapshot(otherRachet)) {
+		t.Fatal("Failed message changed the ratchet")
+	}
+}
+
+func TestErrorDuplicateAndSkippedMessages(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+
+	msg := sendOnly(aRachet, "ONCE")
+	if err := bRachet.OnRecieved(readMessage(t, msg.ToDto())); err != nil {
+		t.Fatal(err)
+	}
+	if err := bRachet.OnRecieved(readMessage(t, msg.ToDto())); !errors.Is(err, ratchet.ErrDuplicateMessage) {
+		t.Fatalf("Expected a duplicate message error but got %v", err)
+	}
+
+	bRachet.MaxSkip = 2
+	for i := 0; i < 3; i++ {
+		sendOnly(aRachet, "SKIPPED")
+	}
+	before := ratchetSnapshot(bRachet)
+	if err := bRachet.OnRecieved(sendOnly(aRachet, "TOO FAR")); !errors.Is(err, ratchet.ErrTooManySkipped) {
+		t.Fatalf("Expected a too many skipped error but got %v", err)
+	}
+	if !bytes.Equal(before, ratchetSnapshot(bRachet)) {
+		t.Fatal("Failed message changed the ratchet")
+	}
+}
+
+func TestErrorInvalidMessage(t *testing.T) {
+	if _, err := ratchet.CreateMessageFromJson("{"); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
+	}
+	if _, err := ratchet.CreateMessageFromDto(&ratchet.MessageDto{RatchetKey: "AAAA"}); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
+	}
+	if _, err := ratchet.DecodeMessage([]byte{0x7f}); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
+	}
+}
+
+func TestErrorBadBundleSignature(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bExternalKeyBundle := keys.NewInternalKeyBundle().GenerateExternalKey()
+	bExternalKeyBundle.PreKeySig = append([]byte(nil), bExternalKeyBundle.PreKeySig...)
+	bExternalKeyBundle.PreKeySig[len(bExternalKeyBundle.PreKeySig)-1] ^= 0x01
+
+	if err := bExternalKeyBundle.Verify(); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("Expected a bad signature error but got %v", err)
+	}
+	if _, err := ratchet.NewRachetFromInternal(aKey, bExternalKeyBundle); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("Expected a bad signature error but got %v", err)
+	}
+}
+
+// The whole post-quantum pre key is signed, not only what fits an ECDSA
+// signature of the suite
+func TestErrorBadPQPreKeySignature(t *testing.T) {
+	bExternalKeyBundle := keys.NewInternalKeyBundle().GenerateExternalKey()
+	if err := bExternalKeyBundle.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	bExternalKeyBundle.PQPreKey = bytes.Clone(bExternalKeyBundle.PQPreKey)
+	bExternalKeyBundle.PQPreKey[len(bExternalKeyBundle.PQPreKey)-1] ^= 0x01
+	if err := bExternalKeyBundle.Verify(); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("Expected a bad signature error but got %v", err)
+	}
+	bExternalKeyBundle.PQPreKey[len(bExternalKeyBundle.PQPreKey)-1] ^= 0x01
+	bExternalKeyBundle.PQPreKey[100] ^= 0x01
+	if _, err := ratchet.NewRachetFromInternal(keys.NewInternalKeyBundle(), bExternalKeyBundle); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("Expected a bad signature error but got %v", err)
+	}
+}
+
+func TestErrorHandshakeKeepsState(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	batch, err := bKey.GenerateOneTimeKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aRachet.InitNewSession(); !errors.Is(err, ratchet.ErrNotNewSession) {
+		t.Fatalf("Expected a not new session error but got %v", err)
+	}
+
+	// An ephemeral key of another suite fails the handshake, the one-time key
+	// it named stays in the pool
+	otherSuiteKey := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519).PublicKey()
+	_, err = ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), otherSuiteKey, aRachet.GetId(), aRachet.PreKeyId, batch.OneTimeKeys[0].KeyId, nil, aRachet.ProtocolVersion)
+	if !errors.Is(err, ecc.ErrKeySuiteMismatch) {
+		t.Fatalf("Expected a key suite mismatch error but got %v", err)
+	}
+	if len(bKey.OneTimeKeys) != 1 {
+		t.Fatal("Failed handshake consumed the one-time key")
+	}
+
+	if _, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", nil, keys.CURRENT_PROTOCOL_VERSION+1); !errors.Is(err, ratchet.ErrUnsupportedVersion) {
+		t.Fatalf("Expected an unsupported version error but got %v", err)
+	}
+}
+
+func TestErrorPadding(t *testing.T) {
+	aRachet, _ := newSessionPair(t)
+	if err := aRachet.SetPadding(ratchet.PaddingScheme(0x7f)); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
+	}
+	v1Rachet, err := ratchet.NewRachetFromInternal(keys.NewInternalKeyBundle(), version1Bundle(t, keys.NewInternalKeyBundle()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v1Rachet.SetPadding(ratchet.PADDING_PADME); !errors.Is(err, ratchet.ErrUnsupportedVersion) {
+		t.Fatalf("Expected an unsupported version error but got %v", err)
+	}
+	if v1Rachet.Padding != ratchet.PADDING_NONE {
+		t.Fatal("Failed padding change was kept")
+	}
+}
+
+func TestErrorIdentity(t *testing.T) {
+	internalKey := keys.NewInternalKeyBundle()
+	if _, err := internalKey.TrustedIdentityKey("nobody"); !errors.Is(err, keys.ErrUntrustedIdentity) {
+		t.Fatalf("Expected an untrusted identity error but got %v", err)
+	}
+	if _, err := keys.NewExternalKeyFromJson("{"); !errors.Is(err, ecc.ErrInvalidKey) {
+		t.Fatalf("Expected an invalid key error but got %v", err)
+	}
+	// A bundle without an identity key cannot be verified nor accepted
+	if err := internalKey.MarkVerified("other", nil); !errors.Is(err, ecc.ErrInvalidKey) {
+		t.Fatalf("Expected an invalid key error but got %v", err)
+	}
+	if err := internalKey.AcceptIdentityChange("other", nil); !errors.Is(err, ecc.ErrInvalidKey) {
+		t.Fatalf("Expected an invalid key error but got %v", err)
+	}
+	if _, err := keys.NewSafetyNumber("me", internalKey.IdentityKey.PublicKey(), "other", nil); !errors.Is(err, ecc.ErrInvalidKey) {
+		t.Fatalf("Expected an invalid key error but got %v", err)
+	}
+	if _, err := keys.ParseSenderCertificate([]byte{keys.SENDER_CERTIFICATE_VERSION_1, 0x00}); !errors.Is(err, keys.ErrInvalidCertificate) {
+		t.Fatalf("Expected an invalid certificate error but got %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/crypto/kem"
+	"lidx-core-lib/keys"
+	"testing"
+	"time"
+)
+
+func TestPreKeyRotation(t *testing.T) {
+	pin := common.StringToByte("1234")
+	internalKey := keys.NewInternalKeyBundle()
+	oldPreKeyId := internalKey.PreKeyId
+
+	internalKey.GeneratePreKey(time.Hour)
+	if internalKey.PreKeyId == oldPreKeyId {
+		t.Fatal("Pre key was not replaced")
+	}
+	if internalKey.GenerateExternalKey().PreKeyId != internalKey.PreKeyId {
+		t.Fatal("External key does not publish the new pre key")
+	}
+	if internalKey.PreKeys[oldPreKeyId] == nil {
+		t.Fatal("Old pre key was dropped before its grace period")
+	}
+
+	keyJson := saveInternalKey(t, internalKey, pin)
+	loadedKey := loadInternalKey(t, keyJson, pin)
+	if loadedKey.PreKeyId != internalKey.PreKeyId || len(loadedKey.PreKeys) != 2 {
+		t.Fatal("Pre keys were not restored")
+	}
+
+	newPreKeyId := loadedKey.PreKeyId
+	loadedKey.GeneratePreKey(-time.Second)
+	if loadedKey.PreKeys[newPreKeyId] != nil {
+		t.Fatal("Pre key was kept after its grace period")
+	}
+	if loadedKey.PreKeys[oldPreKeyId] == nil || len(loadedKey.PreKeys) != 2 {
+		t.Fatal("Pre key in its grace period was dropped")
+	}
+}
+
+func TestPinKdfStore(t *testing.T) {
+	pin := common.StringToByte("1234")
+	internalKey := keys.NewInternalKeyBundle()
+
+	keyStore, err := internalKey.Save(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyStore.PinKdf == nil || keyStore.PinKdf.Algorithm != common.PIN_KDF_ARGON2ID || keyStore.PinKdf.Salt == "" {
+		t.Fatal("Store does not record its PIN KDF")
+	}
+	otherStore, _ := keys.NewInternalKeyBundle().Save(pin)
+	if otherStore.PinKdf.Salt == keyStore.PinKdf.Salt {
+		t.Fatal("Two stores share a salt")
+	}
+
+	keyJson, _ := json.Marshal(keyStore)
+	loadedKey := loadInternalKey(t, keyJson, pin)
+	if loadedKey.IdentityKey == nil || loadedKey.NeedsMigration() {
+		t.Fatal("Cannot load store")
+	}
+	if !bytes.Equal(publicKeyBytes(loadedKey.IdentityKey), publicKeyBytes(internalKey.IdentityKey)) {
+		t.Fatal("Identity key changed through save and load")
+	}
+	if _, err := keys.LoadInternalKey(string(keyJson), common.StringToByte("4321")); !errors.Is(err, common.ErrWrongPIN) {
+		t.Fatalf("Store was opened with the wrong PIN: %v", err)
+	}
+
+	standaloneStore, err := internalKey.IdentityKey.Save(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	standaloneJson, _ := json.Marshal(standaloneStore)
+	standaloneKey, err := ecc.DeSerializeKeyStoreString(string(standaloneJson), pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(publicKeyBytes(standaloneKey), publicKeyBytes(internalKey.IdentityKey)) {
+		t.Fatal("Key pair changed through save and load")
+	}
+	if _, err := ecc.DeSerializeKeyStoreString(string(standaloneJson), common.StringToByte("4321")); err == nil {
+		t.Fatal("Key pair was opened with the wrong PIN")
+	}
+}
+
+func TestPinKdfMigration(t *testing.T) {
+	pin := common.StringToByte("1234")
+	internalKey := keys.NewInternalKeyBundle()
+
+	// Stores used to be encrypted with the PIN itself
+	legacyStore := &keys.InternalKeyBundleStore{
+		IdentityKey:     internalKey.IdentityKey.SaveWithKey(pin),
+		PreKeyId:        internalKey.PreKeyId,
+		PreKeys:         map[string]*ecc.ECKeyPairStore{internalKey.PreKeyId: internalKey.PreKeys[internalKey.PreKeyId].SaveWithKey(pin)},
+		PQPreKeys:       map[string]*kem.KEMKeyPairStore{internalKey.PreKeyId: internalKey.PQPreKeys[internalKey.PreKeyId].Save(pin)},
+		PreKeyExpiredAt: map[string]int64{},
+	}
+	legacyJson, _ := json.Marshal(legacyStore)
+	loadedKey := loadInternalKey(t, legacyJson, pin)
+	if loadedKey.IdentityKey == nil || len(loadedKey.PQPreKeys) != 1 {
+		t.Fatal("Cannot load legacy store")
+	}
+	if !loadedKey.NeedsMigration() {
+		t.Fatal("Legacy store is not marked for migration")
+	}
+
+	migratedStore, err := loadedKey.Save(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migratedStore.PinKdf == nil || loadedKey.NeedsMigration() {
+		t.Fatal("Legacy store was not migrated")
+	}
+	migratedJson, _ := json.Marshal(migratedStore)
+	migratedKey := loadInternalKey(t, migratedJson, pin)
+	if migratedKey.IdentityKey == nil || migratedKey.NeedsMigration() {
+		t.Fatal("Cannot load migrated store")
+	}
+	if !bytes.Equal(publicKeyBytes(migratedKey.IdentityKey), publicKeyBytes(internalKey.IdentityKey)) {
+		t.Fatal("Identity key changed through migration")
+	}
+}
+
+func publicKeyBytes(keyPair *ecc.ECKeyPair) []byte {
+	result, _ := keyPair.PublicKey().Serialize()
+	return result
+}
+
+func TestSafetyNumber(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	aIdentity := aKey.IdentityKey.PublicKey()
+	bIdentity := bKey.IdentityKey.PublicKey()
+
+	aNumber, err := keys.NewSafetyNumber("alice", aIdentity, "bob", bIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bNumber, err := keys.NewSafetyNumber("bob", bIdentity, "alice", aIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aNumber.Numeric) != 60 || aNumber.Numeric != bNumber.Numeric {
+		t.Fatal("Both sides do not get the same safety number")
+	}
+	if !aNumber.Matches(bNumber.Scannable) {
+		t.Fatal("Scanned safety number does not match")
+	}
+
+	again, _ := keys.NewSafetyNumber("alice", aIdentity, "bob", bIdentity)
+	if again.Numeric != aNumber.Numeric {
+		t.Fatal("Safety number is not stable")
+	}
+	otherKey, _ := keys.NewSafetyNumber("alice", aIdentity, "bob", keys.NewInternalKeyBundle().IdentityKey.PublicKey())
+	if otherKey.Numeric == aNumber.Numeric || aNumber.Matches(otherKey.Scannable) {
+		t.Fatal("Safety number does not change with the identity key")
+	}
+	otherName, _ := keys.NewSafetyNumber("alice", aIdentity, "mallory", bIdentity)
+	if otherName.Numeric == aNumber.Numeric {
+		t.Fatal("Safety number does not change with the username")
+	}
+	if _, err := keys.NewSafetyNumber("alice", aIdentity, "", bIdentity); err == nil {
+		t.Fatal("Safety number was computed without a username")
+	}
+}
+
+func TestVerifiedContactStore(t *testing.T) {
+	pin := common.StringToByte("1234")
+	internalKey := keys.NewInternalKeyBundle()
+	bIdentity := keys.NewInternalKeyBundle().IdentityKey.PublicKey()
+	if internalKey.IsVerified("bob", bIdentity) {
+		t.Fatal("Contact is verified before being marked")
+	}
+	if err := internalKey.MarkVerified("bob", bIdentity); err != nil {
+		t.Fatal(err)
+	}
+
+	keyJson := saveInternalKey(t, internalKey, pin)
+	loadedKey := loadInternalKey(t, keyJson, pin)
+	if !loadedKey.IsVerified("bob", bIdentity) {
+		t.Fatal("Verified contact was not restored")
+	}
+	if loadedKey.IsVerified("bob", keys.NewInternalKeyBundle().IdentityKey.PublicKey()) {
+		t.Fatal("Verified mark applies to another identity key")
+	}
+	loadedKey.ClearVerified("bob")
+	keyJson = saveInternalKey(t, loadedKey, pin)
+	if loadInternalKey(t, keyJson, pin).IsVerified("bob", bIdentity) {
+		t.Fatal("Cleared verified mark was restored")
+	}
+}
+
+func TestIdentityTrustOnFirstUse(t *testing.T) {
+	pin := common.StringToByte("1234")
+	internalKey := keys.NewInternalKeyBundle()
+	bIdentity := keys.NewInternalKeyBundle().IdentityKey.PublicKey()
+	if internalKey.Identities.Get("bob") != nil {
+		t.Fatal("Contact is known before first use")
+	}
+	if err := internalKey.TrustIdentity("bob", bIdentity); err != nil {
+		t.Fatal(err)
+	}
+	if err := internalKey.TrustIdentity("", bIdentity); err == nil {
+		t.Fatal("Identity key was trusted without a username")
+	}
+
+	keyJson := saveInternalKey(t, internalKey, pin)
+	loadedKey := loadInternalKey(t, keyJson, pin)
+	if loadedKey.Identities.Get("bob") == nil {
+		t.Fatal("Trusted identity was not restored")
+	}
+	if err := loadedKey.TrustIdentity("bob", bIdentity); err != nil {
+		t.Fatal("Trusted identity key was refused")
+	}
+
+	newIdentity := keys.NewInternalKeyBundle().IdentityKey.PublicKey()
+	loadedKey.MarkVerified("bob", bIdentity)
+	if err := loadedKey.TrustIdentity("bob", newIdentity); !errors.Is(err, keys.ErrIdentityKeyChanged) {
+		t.Fatal("Changed identity key was not detected")
+	}
+	if len(loadedKey.Identities.Get("bob").ChangedKey) == 0 {
+		t.Fatal("Changed identity key was not recorded")
+	}
+	if err := loadedKey.TrustIdentity("bob", newIdentity); !errors.Is(err, keys.ErrIdentityKeyChanged) {
+		t.Fatal("Changed identity key was trusted without being accepted")
+	}
+
+	if err := loadedKey.AcceptIdentityChange("bob", newIdentity); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadedKey.TrustIdentity("bob", newIdentity); err != nil {
+		t.Fatal("Accepted identity key was refused")
+	}
+	if loadedKey.IsVerified("bob", bIdentity) {
+		t.Fatal("Verified mark survived an identity key change")
+	}
+	if err := loadedKey.TrustIdentity("bob", bIdentity); !errors.Is(err, keys.ErrIdentityKeyChanged) {
+		t.Fatal("Old identity key is still trusted")
+	}
+}
+
+func TestIdentityStoreNeedsPin(t *testing.T) {
+	internalKey := keys.NewInternalKeyBundle()
+	internalKey.TrustIdentity("bob", keys.NewInternalKeyBundle().IdentityKey.PublicKey())
+	keyStore, err := internalKey.Save(common.StringToByte("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyStore.Identities == "" {
+		t.Fatal("Identity store was not saved")
+	}
+	if bytes.Contains([]byte(keyStore.Identities), []byte("bob")) {
+		t.Fatal("Identity store is not encrypted")
+	}
+	if _, err := keys.LoadIdentityStore(keyStore.Identities, common.StringToByte("1234")); err == nil {
+		t.Fatal("Identity store opened without the stretched PIN")
+	}
+}
+
+func saveInternalKey(t *testing.T, internalKey *keys.InternalKeyBundle, pin []byte) []byte {
+	store, err := internalKey.Save(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeJson, _ := json.Marshal(store)
+	return storeJson
+}
+
+func loadInternalKey(t *testing.T, storeJson []byte, pin []byte) *keys.InternalKeyBundle {
+	internalKey, err := keys.LoadInternalKey(string(storeJson), pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return internalKey
+}
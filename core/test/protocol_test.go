@@ -1,71 +1,1094 @@
 package test
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
 	"lidx-core-lib/keys"
 	"lidx-core-lib/ratchet"
 	"testing"
+	"time"
 )
 
+func newSessionPair(t *testing.T) (*ratchet.Ratchet, *ratchet.Ratchet) {
+	return newSessionPairWithSuite(t, ecc.DEFAULT_KEY_SUITE)
+}
+
+func newSessionPairWithSuite(t *testing.T, suite ecc.KeySuite) (*ratchet.Ratchet, *ratchet.Ratchet) {
+	aKey := keys.NewInternalKeyBundleWithSuite(suite)
+	bKey := keys.NewInternalKeyBundleWithSuite(suite)
+
+	aExternalKeyBundle := aKey.GenerateExternalKey()
+	bExternalKeyBundle := bKey.GenerateExternalKey()
+
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bExternalKeyBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aExternalKeyBundle, aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, aRachet.OneTimeKeyId, aRachet.GetPQCipherText(), aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aRachet, bRachet
+}
+
+func sendAndReceive(t *testing.T, sender, receiver *ratchet.Ratchet, content string) {
+	msg := sender.PopulateMessage([]byte(content))
+	if err := sender.OnSend(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	msgJson, _ := json.Marshal(msg.ToDto())
+	recvMsg, err := ratchet.CreateMessageFromJson(string(msgJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receiver.OnRecieved(recvMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recvMsg.PlainMessage, []byte(content)) {
+		t.Fatalf("Expected %q but got %q", content, recvMsg.PlainMessage)
+	}
+}
+
 func TestProtocol(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+
+	for i := 0; i < 10; i++ {
+		sendAndReceive(t, aRachet, bRachet, fmt.Sprintf("THIS IS MESSAGE %d", i))
+	}
+}
+
+func TestProtocolRatchetStep(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+
+	// The responder is able to talk first
+	sendAndReceive(t, bRachet, aRachet, "HELLO FROM B")
+
+	for i := 0; i < 5; i++ {
+		sendAndReceive(t, aRachet, bRachet, fmt.Sprintf("A %d", i))
+		before := aRachet.DHSendKey
+		sendAndReceive(t, bRachet, aRachet, fmt.Sprintf("B %d", i))
+		if aRachet.DHSendKey == before {
+			t.Fatal("Ratchet key was not rotated")
+		}
+	}
+}
+
+func TestProtocolSaveAndLoad(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, bRachet := newSessionPair(t)
+
+	sendAndReceive(t, aRachet, bRachet, "BEFORE RELOAD")
+	sendAndReceive(t, bRachet, aRachet, "REPLY BEFORE RELOAD")
+
+	aJson := saveRatchet(t, aRachet, pin)
+	bJson := saveRatchet(t, bRachet, pin)
+
+	aLoaded := loadRatchet(t, aJson, pin)
+	bLoaded := loadRatchet(t, bJson, pin)
+	if aLoaded == nil || bLoaded == nil {
+		t.Fatal("Cannot load ratchet")
+	}
+
+	sendAndReceive(t, aLoaded, bLoaded, "AFTER RELOAD")
+	sendAndReceive(t, bLoaded, aLoaded, "REPLY AFTER RELOAD")
+}
+
+func TestProtocolSnapshot(t *testing.T) {
+	pin := common.StringToByte("1234")
 	aKey := keys.NewInternalKeyBundle()
 	bKey := keys.NewInternalKeyBundle()
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, aRachet.OneTimeKeyId, aRachet.GetPQCipherText(), aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAndReceive(t, aRachet, bRachet, "BEFORE RELOAD")
 
-	aExternalKeyBundle := aKey.GenerateExternalKey()
+	aLoaded := loadRatchet(t, saveRatchet(t, aRachet, pin), pin)
+	if aLoaded.MyKeyBundle != nil || aLoaded.YourKeyBundle == nil {
+		t.Fatal("Loaded ratchet does not know the other identity key")
+	}
+	bIdentityKey, _ := bKey.IdentityKey.PublicKey().Serialize()
+	yourIdentityKey, _ := aLoaded.YourKeyBundle.GetIdentityKey().Serialize()
+	if !bytes.Equal(bIdentityKey, yourIdentityKey) {
+		t.Fatal("Loaded ratchet has another identity key for the other user")
+	}
+	if aLoaded.ProtocolVersion != aRachet.ProtocolVersion || aLoaded.CreatedAt != aRachet.CreatedAt || aLoaded.LastUsedAt != aRachet.LastUsedAt || aLoaded.CreatedAt == 0 {
+		t.Fatal("Loaded ratchet lost its version or timestamps")
+	}
+
+	if err := aLoaded.AttachKeyBundle(bKey); !errors.Is(err, ratchet.ErrWrongRatchet) {
+		t.Fatalf("Ratchet took the key bundle of another identity: %v", err)
+	}
+	if err := aLoaded.AttachKeyBundle(aKey); err != nil {
+		t.Fatal(err)
+	}
+	sendAndReceive(t, aLoaded, bRachet, "AFTER RELOAD")
+	if aLoaded.LastUsedAt < aRachet.LastUsedAt {
+		t.Fatal("Sending did not update the last use")
+	}
+}
+
+func TestProtocolTamperedStore(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, _ := newSessionPair(t)
+	aJson := saveRatchet(t, aRachet, pin)
+
+	var store map[string]any
+	json.Unmarshal(aJson, &store)
+	store["total_message_sent"] = float64(42)
+	tamperedJson, _ := json.Marshal(store)
+	if _, err := ratchet.LoadRachet(string(tamperedJson), pin); !errors.Is(err, ratchet.ErrTamperedStore) {
+		t.Fatalf("Tampered ratchet store was loaded: %v", err)
+	}
+	if _, err := ratchet.LoadRachet(string(tamperedJson), common.StringToByte("4321")); !errors.Is(err, common.ErrWrongPIN) {
+		t.Fatalf("Expected a wrong PIN error but got %v", err)
+	}
+
+	// Only stores from before the PIN KDF may come without a MAC
+	json.Unmarshal(aJson, &store)
+	delete(store, "mac")
+	strippedJson, _ := json.Marshal(store)
+	if _, err := ratchet.LoadRachet(string(strippedJson), pin); !errors.Is(err, ratchet.ErrTamperedStore) {
+		t.Fatalf("Ratchet store without a MAC was loaded: %v", err)
+	}
+	store["total_message_sent"] = float64(42)
+	strippedJson, _ = json.Marshal(store)
+	if _, err := ratchet.LoadRachet(string(strippedJson), pin); !errors.Is(err, ratchet.ErrTamperedStore) {
+		t.Fatalf("Tampered ratchet store without a MAC was loaded: %v", err)
+	}
+}
+
+func TestProtocolSharedPinKdf(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, _ := newSessionPair(t)
+	cRachet, _ := newSessionPair(t)
+
+	var aStore, cStore ratchet.RachetStore
+	json.Unmarshal(saveRatchet(t, aRachet, pin), &aStore)
+	json.Unmarshal(saveRatchet(t, cRachet, pin), &cStore)
+	if aStore.PinKdf == nil || !aStore.PinKdf.Shared || *aStore.PinKdf != *cStore.PinKdf {
+		t.Fatal("Ratchets do not share their PIN KDF")
+	}
+
+	// Each ratchet still has a key of its own
+	movedStore := aStore
+	movedStore.RachetId = cStore.RachetId
+	movedJson, _ := json.Marshal(&movedStore)
+	if _, err := ratchet.LoadRachet(string(movedJson), pin); !errors.Is(err, common.ErrWrongPIN) {
+		t.Fatalf("Ratchet store opened under another id: %v", err)
+	}
+
+	costlyKdf := *aStore.PinKdf
+	costlyKdf.Time = 1 << 20
+	costlyStore := aStore
+	costlyStore.PinKdf = &costlyKdf
+	costlyJson, _ := json.Marshal(&costlyStore)
+	if _, err := ratchet.LoadRachet(string(costlyJson), pin); err == nil {
+		t.Fatal("Ratchet store with an unbounded PIN KDF time was loaded")
+	}
+}
+
+func sendOnly(sender *ratchet.Ratchet, content string) *ratchet.Message {
+	msg := sender.PopulateMessage([]byte(content))
+	sender.OnSend(msg)
+	msgJson, _ := json.Marshal(msg.ToDto())
+	recvMsg, _ := ratchet.CreateMessageFromJson(string(msgJson))
+	return recvMsg
+}
+
+func TestProtocolOutOfOrder(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, bRachet := newSessionPair(t)
+
+	first := sendOnly(aRachet, "FIRST")
+	second := sendOnly(aRachet, "SECOND")
+	third := sendOnly(aRachet, "THIRD")
+
+	bRachet.OnRecieved(third)
+	if string(third.PlainMessage) != "THIRD" {
+		t.Fatal("Cannot decrypt message ahead of the chain")
+	}
+
+	// Skipped keys survive a reload
+	bJson := saveRatchet(t, bRachet, pin)
+	bRachet = loadRatchet(t, bJson, pin)
+	if len(bRachet.MissingMessageKeys) != 2 {
+		t.Fatalf("Expected 2 missing keys but got %d", len(bRachet.MissingMessageKeys))
+	}
+
+	bRachet.OnRecieved(first)
+	bRachet.OnRecieved(second)
+	if string(first.PlainMessage) != "FIRST" || string(second.PlainMessage) != "SECOND" {
+		t.Fatal("Cannot decrypt skipped message")
+	}
+	if len(bRachet.MissingMessageKeys) != 0 {
+		t.Fatal("Missing key was not consumed")
+	}
+
+	// A replayed message has no key left
+	replayed := readMessage(t, first.ToDto())
+	if err := bRachet.OnRecieved(replayed); err == nil || replayed.PlainMessage != nil {
+		t.Fatal("Replayed message was decrypted")
+	}
+}
+
+func TestProtocolOutOfOrderAcrossRatchetStep(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+
+	sendAndReceive(t, bRachet, aRachet, "B STARTS")
+	late := sendOnly(aRachet, "LATE")
+	sendAndReceive(t, bRachet, aRachet, "B AGAIN")
+	// A did not ratchet in between, both messages share one chain
+	early := sendOnly(aRachet, "EARLY")
+
+	bRachet.OnRecieved(early)
+	bRachet.OnRecieved(late)
+	if string(early.PlainMessage) != "EARLY" || string(late.PlainMessage) != "LATE" {
+		t.Fatal("Cannot decrypt reordered messages")
+	}
+
+	aLate := sendOnly(aRachet, "A OLD CHAIN")
+	sendAndReceive(t, bRachet, aRachet, "B STEP")
+	aNew := sendOnly(aRachet, "A NEW CHAIN")
+
+	bRachet.OnRecieved(aNew)
+	bRachet.OnRecieved(aLate)
+	if string(aNew.PlainMessage) != "A NEW CHAIN" || string(aLate.PlainMessage) != "A OLD CHAIN" {
+		t.Fatal("Cannot decrypt message from previous chain")
+	}
+}
+
+func TestProtocolMaxSkip(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	bRachet.MaxSkip = 3
+	bRachet.MaxMissingKeys = 2
+
+	var msg *ratchet.Message
+	for i := 0; i < 5; i++ {
+		msg = sendOnly(aRachet, "SKIPPED")
+	}
+	if err := bRachet.OnRecieved(msg); err == nil || msg.PlainMessage != nil {
+		t.Fatal("Message skipping over the limit was decrypted")
+	}
+
+	sendOnly(aRachet, "SKIPPED")
+	first := sendOnly(aRachet, "EVICTED")
+	sendOnly(aRachet, "SKIPPED")
+	sendOnly(aRachet, "SKIPPED")
+	last := sendOnly(aRachet, "LAST")
+	bRachet.MaxSkip = 10
+	bRachet.OnRecieved(last)
+	if string(last.PlainMessage) != "LAST" {
+		t.Fatal("Cannot decrypt message within the limit")
+	}
+	if len(bRachet.MissingMessageKeys) != 2 {
+		t.Fatalf("Expected 2 missing keys but got %d", len(bRachet.MissingMessageKeys))
+	}
+	bRachet.OnRecieved(first)
+	if first.PlainMessage != nil {
+		t.Fatal("Evicted message key was used")
+	}
+}
+
+func TestProtocolOneTimeKey(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	batch, err := bKey.GenerateOneTimeKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.OneTimeKeys) != 2 || len(bKey.OneTimeKeys) != 2 {
+		t.Fatal("Cannot generate one-time keys")
+	}
+
+	// What the server hands out, the pre key bundle plus one one-time key
+	bundleDto := bKey.GenerateExternalKey().ToDto()
+	bundleDto.OneTimeKeyId = batch.OneTimeKeys[0].KeyId
+	bundleDto.OneTimeKey = batch.OneTimeKeys[0].Key
+	bundleDto.OneTimeKeySig = batch.OneTimeKeys[0].KeySig
+	bundleJson, _ := json.Marshal(bundleDto)
+	bExternalKeyBundle, err := keys.NewExternalKeyFromJson(string(bundleJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signature covers a digest of the whole key, not the raw key ECDSA
+	// would cut to the size of the curve order
+	rawSig, _ := ecc.FromKeyPair(bKey.IdentityKey).Sign(common.DecodeToByte(batch.OneTimeKeys[0].Key))
+	rawSignedBundle := *bExternalKeyBundle
+	rawSignedBundle.OneTimeKeySig = rawSig
+	if _, err := ratchet.NewRachetFromInternal(aKey, &rawSignedBundle); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("One-time key signed over the raw key was accepted: %v", err)
+	}
+
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bExternalKeyBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aRachet.OneTimeKeyId != batch.OneTimeKeys[0].KeyId {
+		t.Fatal("One-time key was not used")
+	}
+
+	if _, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "unknown", aRachet.GetPQCipherText(), aRachet.ProtocolVersion); err == nil {
+		t.Fatal("Unknown one-time key was accepted")
+	}
+
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, aRachet.OneTimeKeyId, aRachet.GetPQCipherText(), aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bKey.OneTimeKeys) != 1 {
+		t.Fatal("One-time key was not deleted")
+	}
+
+	sendAndReceive(t, aRachet, bRachet, "WITH ONE-TIME KEY")
+	sendAndReceive(t, bRachet, aRachet, "REPLY WITH ONE-TIME KEY")
+
+	pin := common.StringToByte("1234")
+	bKeyJson := saveInternalKey(t, bKey, pin)
+	if len(loadInternalKey(t, bKeyJson, pin).OneTimeKeys) != 1 {
+		t.Fatal("One-time keys were not saved")
+	}
+}
+
+func TestProtocolRotatedPreKey(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	// A fetched the bundle of B right before B rotated its pre key
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		bKey.GeneratePreKey(time.Hour)
+	}
+	if aRachet.PreKeyId == bKey.PreKeyId {
+		t.Fatal("Pre key was not rotated")
+	}
+
+	if _, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), "unknown", "", aRachet.GetPQCipherText(), aRachet.ProtocolVersion); err == nil {
+		t.Fatal("Unknown pre key was accepted")
+	}
+
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", aRachet.GetPQCipherText(), aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAndReceive(t, aRachet, bRachet, "WITH OLD PRE KEY")
+	sendAndReceive(t, bRachet, aRachet, "REPLY WITH OLD PRE KEY")
+}
+
+func TestProtocolFreshEphemeralKey(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	firstRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey, _ := firstRachet.GetEphemeralKey().Serialize()
+	secondKey, _ := secondRachet.GetEphemeralKey().Serialize()
+	if bytes.Equal(firstKey, secondKey) {
+		t.Fatal("Ephemeral key was reused across sessions")
+	}
+	// The ephemeral key only serves the handshake, the ratchet has its own
+	ratchetKey, _ := firstRachet.DHSendKey.PublicKey().Serialize()
+	if bytes.Equal(firstKey, ratchetKey) {
+		t.Fatal("Ephemeral key is kept as the first ratchet key")
+	}
+}
+
+func TestProtocolResponderSendsFirst(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, bRachet := newSessionPair(t)
+
+	// The responder does not know a ratchet key of the initiator yet
+	bRachet = loadRatchet(t, saveRatchet(t, bRachet, pin), pin)
+	first := sendOnly(bRachet, "FIRST FROM RESPONDER")
+	sendAndReceive(t, bRachet, aRachet, "SECOND FROM RESPONDER")
+	sendAndReceive(t, aRachet, bRachet, "REPLY")
+	if err := aRachet.OnRecieved(first); err != nil || string(first.PlainMessage) != "FIRST FROM RESPONDER" {
+		t.Fatalf("Cannot decrypt the first message of the responder: %v", err)
+	}
+	sendAndReceive(t, bRachet, aRachet, "AFTER RATCHET STEP")
+	sendAndReceive(t, aRachet, bRachet, "REPLY AFTER RATCHET STEP")
+}
+
+func TestProtocolCurve25519(t *testing.T) {
+	aRachet, bRachet := newSessionPairWithSuite(t, ecc.SUITE_CURVE25519)
+	sendAndReceive(t, aRachet, bRachet, "HELLO OVER CURVE25519")
+	sendAndReceive(t, bRachet, aRachet, "REPLY OVER CURVE25519")
+	sendAndReceive(t, aRachet, bRachet, "AFTER RATCHET STEP")
+
+	// The suite travels with the bundle so the other side can reject it
+	bundleJson, _ := json.Marshal(aRachet.MyKeyBundle.GenerateExternalKey().ToDto())
+	bundle, err := keys.NewExternalKeyFromJson(string(bundleJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Suite != ecc.SUITE_CURVE25519 {
+		t.Fatal("Bundle does not advertise its key suite")
+	}
+	if _, err := ratchet.NewRachetFromInternal(keys.NewInternalKeyBundle(), bundle); err == nil {
+		t.Fatal("Session across key suites was accepted")
+	}
+}
+
+func TestProtocolPostQuantum(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	if !aRachet.PostQuantum || !bRachet.PostQuantum || aRachet.GetPQCipherText() == nil {
+		t.Fatal("Handshake did not use the post-quantum pre key")
+	}
+	sendAndReceive(t, aRachet, bRachet, "HELLO AFTER PQXDH")
+	sendAndReceive(t, bRachet, aRachet, "REPLY AFTER PQXDH")
+
+	pin := common.StringToByte("1234")
+	bKey := keys.NewInternalKeyBundle()
+	bKeyJson := saveInternalKey(t, bKey, pin)
+	bKey = loadInternalKey(t, bKeyJson, pin)
+
+	// A tampered cipher text decapsulates to another secret, so the two
+	// sides end up with different keys instead of a weaker session
+	aKey := keys.NewInternalKeyBundle()
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pqCipherText := append([]byte(nil), aRachet.GetPQCipherText()...)
+	pqCipherText[0] ^= 0xff
+	bRachet, err = ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", pqCipherText, aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(aRachet.GetSharedSecret(), bRachet.GetSharedSecret()) {
+		t.Fatal("Tampered cipher text gave the same shared secret")
+	}
+}
+
+func TestProtocolWithoutPostQuantum(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	// A bundle from a client that does not publish a post-quantum pre key
 	bExternalKeyBundle := bKey.GenerateExternalKey()
+	bExternalKeyBundle.PQPreKey = nil
+	bExternalKeyBundle.PQPreKeySig = nil
 
-	fmt.Print(aExternalKeyBundle)
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bExternalKeyBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aRachet.PostQuantum || aRachet.GetPQCipherText() != nil {
+		t.Fatal("Post-quantum handshake without a pre key")
+	}
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", nil, aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAndReceive(t, aRachet, bRachet, "HELLO WITHOUT PQXDH")
+	sendAndReceive(t, bRachet, aRachet, "REPLY WITHOUT PQXDH")
+}
 
-	aKey.GenerateEphemeralKey()
+func TestProtocolTamperedHeader(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	sendAndReceive(t, aRachet, bRachet, "BEFORE TAMPERING")
 
-	aRachet, _ := ratchet.NewRachetFromInternal(aKey, bExternalKeyBundle)
+	msg := aRachet.PopulateMessage([]byte("TAMPERED"))
+	if err := aRachet.OnSend(msg); err != nil {
+		t.Fatal(err)
+	}
+	tampers := map[string]func(dto *ratchet.MessageDto){
+		"index":               func(dto *ratchet.MessageDto) { dto.Index++ },
+		"isBinary":            func(dto *ratchet.MessageDto) { dto.IsBinary = !dto.IsBinary },
+		"previousChainLength": func(dto *ratchet.MessageDto) { dto.PreviousChainLength++ },
+		"ratchetKey": func(dto *ratchet.MessageDto) {
+			otherKey, _ := ecc.GenerateKeyPair().PublicKey().Serialize()
+			dto.RatchetKey = common.EncodeToString(otherKey)
+		},
+	}
+	for field, tamper := range tampers {
+		dto := msg.ToDto()
+		tamper(dto)
+		tampered := readMessage(t, dto)
+		if err := bRachet.OnRecieved(tampered); err == nil || tampered.PlainMessage != nil {
+			t.Fatalf("Message with tampered %s was decrypted", field)
+		}
+	}
 
-	bRachet, _ := ratchet.NewRachetFromExternal(bKey, aExternalKeyBundle, aKey.EphemeralKey.PublicKey(), aRachet.GetId())
+	// The rejected messages left the ratchet untouched
+	original := readMessage(t, msg.ToDto())
+	if err := bRachet.OnRecieved(original); err != nil {
+		t.Fatal(err)
+	}
+	if string(original.PlainMessage) != "TAMPERED" {
+		t.Fatal("Cannot decrypt the original message")
+	}
+	sendAndReceive(t, bRachet, aRachet, "AFTER TAMPERING")
+}
 
-	for i := 0; i < 10; i++ {
-		msg := aRachet.PopulateMessage([]byte("THIS IS MESSAGE"))
-		aRachet.OnSend(msg)
+func TestProtocolWireFormat(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	for _, isBinary := range []bool{false, true} {
+		msg := aRachet.PopulateMessage([]byte("OVER THE WIRE"))
+		msg.IsBinary = isBinary
+		if err := aRachet.OnSend(msg); err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jsonMsg, _ := json.Marshal(msg.ToDto())
+		if len(envelope) >= len(jsonMsg) {
+			t.Fatalf("Envelope of %d bytes is not smaller than json of %d bytes", len(envelope), len(jsonMsg))
+		}
+		if envelope[0] != ratchet.CURRENT_WIRE_VERSION {
+			t.Fatal("Envelope does not start with the wire version")
+		}
 
-		sendedMsg := msg.ToDto()
+		decoded, err := ratchet.DecodeMessage(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.IsBinary != isBinary {
+			t.Fatal("Binary flag lost in the envelope")
+		}
+		if err := bRachet.OnRecieved(decoded); err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded.PlainMessage) != "OVER THE WIRE" {
+			t.Fatal("Cannot decrypt message read from the envelope")
+		}
+	}
 
-		t.Log(sendedMsg)
+	msg := sendOnly(bRachet, "NEXT VERSION")
+	envelope, _ := msg.Encode()
+	unknownVersion := append([]byte{0x7f}, envelope[1:]...)
+	if _, err := ratchet.DecodeMessage(unknownVersion); err == nil {
+		t.Fatal("Envelope of an unknown version was decoded")
+	}
+	if _, err := ratchet.DecodeMessage(envelope[:len(envelope)-1]); err == nil {
+		t.Fatal("Truncated envelope was decoded")
+	}
+	if _, err := ratchet.DecodeMessage(append(envelope, 0)); err == nil {
+		t.Fatal("Envelope with trailing data was decoded")
+	}
+	reservedFlag := bytes.Clone(envelope)
+	reservedFlag[1] |= 0x08
+	if _, err := ratchet.DecodeMessage(reservedFlag); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Envelope with a reserved flag was decoded: %v", err)
+	}
+}
 
-		msgJson, _ := json.Marshal(sendedMsg)
+// Written by encodeBinaryFrame of the server for a binary CHAT_TEXT message
+// from alice with the file id file-id, padding 2 and index 300
+const serverSocketFrame = "000000e47b2274797065223a22434841545f54455854222c2273656e646572557365726e616d65223a22616c696365222c22706c61696e4d657373616765223a6e756c6c2c226368617453657373696f6e4964223a22222c22696e646578223a302c22636861696e496e646578223a302c2270726576696f7573436861696e4c656e677468223a302c22726174636865744b6579223a22222c226369706865724d657373616765223a22222c2266696c6550617468223a2266696c652d6964222c22697342696e617279223a66616c73652c226164646974696f6e616c44617461223a6e756c6c7d0105002435353835383131332d636164372d313166312d623234342d656166336336353937666234ac0202010021052733db72f3178301cba4355cb8c0acbe9e2af90fa9c2401728190f808780bb250000001d5345414c454420434f4e54454e54204f46205448452046495854555245"
+
+func TestProtocolServerSocketFrame(t *testing.T) {
+	frame, _ := hex.DecodeString(serverSocketFrame)
+	metadataJson, envelope, err := ratchet.SplitSocketFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal(metadataJson, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata["type"] != "CHAT_TEXT" || metadata["senderUsername"] != "alice" || metadata["filePath"] != "file-id" {
+		t.Fatalf("Frame metadata was not kept: %s", metadataJson)
+	}
 
-		recvMsg := ratchet.CreateMessageFromJson(string(msgJson))
+	msg, err := ratchet.DecodeMessage(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto := msg.ToDto()
+	expected := ratchet.MessageDto{
+		RatchetID:           "55858113-cad7-11f1-b244-eaf3c6597fb4",
+		Index:               300,
+		ChainIndex:          2,
+		PreviousChainLength: 1,
+		RatchetKey:          "BScz23LzF4MBy6Q1XLjArL6eKvkPqcJAFygZD4CHgLsl",
+		CipherMessage:       common.EncodeToString([]byte("SEALED CONTENT OF THE FIXTURE")),
+		IsBinary:            true,
+		Padding:             uint8(ratchet.PADDING_PADME),
+	}
+	if *dto != expected {
+		t.Fatalf("Expected %+v but got %+v", expected, *dto)
+	}
 
-		bRachet.OnRecieved(recvMsg)
-		t.Log(string(recvMsg.PlainMessage))
+	if _, _, err := ratchet.SplitSocketFrame(frame[:3]); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
+	}
+	if _, _, err := ratchet.SplitSocketFrame(frame[:100]); !errors.Is(err, ratchet.ErrInvalidMessage) {
+		t.Fatalf("Expected an invalid message error but got %v", err)
 	}
 }
 
-func TestProtocol2(t *testing.T) {
-	//aKey := keys.LoadInternalKey("{\n  \"identity_key\": {\n    \"public_hash\": \"fMWLlqA45tstM_vmfCnr6s1ZxItCa66n6VAEV_FmSc0\",\n    \"public_key\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEPGpNsPAahwbMdGJKAQqz5f5fOj2TQ-JoxzSPN7-54czLOK2Jy3Dq5Az_8RT6KDVYGdl2ueeof3Y3jNn421l6-dFohUCgbyFpLVa61cR6MOXUNx5u5ks2vk9ewviYM5kp\",\n    \"private_key\": \"VKOLxkY7OxshBqGrXJafEunKbzIr38JhcQSK5463_D75muWpoKgHjnvsCyCo5rLaZ6BGY8gSaHA4c6Aj1Jh9lb36hxe1vIFKsj8FblgiL-JgLn7iTaGPH5b2zps_sNlePiNIkbsZOt69yyqJcLCvIpwGy62YFgqlYY3LlrUj1rkyhVMsM9Vt7lQ_Kzo5hLaol7IcrkclWRg60AAdLnNlENpQ1I_L6asa_1vBsqNelFaq4M6WFn6gPfvWEOGM3z3-WycWyF1CbITDRItDb6xu7P-Sl5NeUcqYtWH5aQWt0nKEFWI\",\n    \"private_hash\": \"rSrgc3lKJmTksbtHjBVghGQM0GVkoKhMmrEVUWFlQMg\"\n  },\n  \"pre_key\": {\n    \"private_key\": \"TNwQjzx03hC4Vh_wBvOEhvETvO0lS-R9kcAIAlQG-It9gpXafu_SyXtXurz7nnCAAQd6hX4fdAgHGGZYlUln9oHg_lyA-9TfL4ZDF5QFCvN1FWmN8upDGZ76vLjxMkqVn3gAV8Z65sRSWRFjgVHMk8tJkCrsZn8hCfrzUAahp-W4EfjDw_TVnbT4wnFf-ESnTVjyeAq0-r2w4QZNTC-F8Vqt_wR1C4uTd6UCNBQEMqCPpV_geyXUvZexwaqXk5UtPcmzZNST7e25bFaVBoZ5NjjPgpxtnoPAABeb3vk_L-msC_A\",\n    \"private_hash\": \"2NdnQFywKpGCEVw71gb-SOiYUV2ltGDjFwzbzZXydzI\",\n    \"public_hash\": \"jDoIO6jPjOgA-tOqOMgYkYmkBakwjlzixalyYOTZbyo\",\n    \"public_key\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEqIbdkL-T8UCqnHNbobJsy5ExJYUIH3nN2afpDf4VfwSVuJXFfvDvhO4zFrrbZnabrSA_aBwa82nIUu1o3PTSD_z0ecrVWqCVRy2_yEWwluWQkrJxMRa2Pf4SxwSjEspz\"\n  },\n  \"one_time_key\": {\n    \"60449810-90e6-11ee-8f43-9af30e14a1a4\": {\n      \"public_key\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAE0kevJK2oG8ygTx_AcJcEjLzQ_ttG1Xe5EiXZXNw-FmuT77Fl8hPMAjfvLjODma4gLAPa9RRCiBdR1ChCGVRw2wMmdZ3oozK9Y_jmg9Y2UKObKsWjGVD52Hm9ONzppv6o\",\n      \"private_key\": \"ZY6hedVsthcls8F1GiAYXgc_nCL-Zf4KpvHIO6b3qUZWwXNEILIhfDzgdRrbr5DyA8bO1xI20i4EuGuzhmEdZQWNDMnRsJR0wgungdvqHBnBCHGdpSrPam6cnd2RPPnGN-pAynTCAdCTCrmeJHw1vxvrFDjvuEeT59e7prpyRcE6y6AbNsius0wbLS7wODVAz1AUtL2nZ3_6GFxOwyvBU8N0EmReyNMuAWqiR-v0mOBgpjkkXZ5mZc8fADAEpKQxlnUv4b-zml3CzJUj_yhnVkRk6Tdx7Y-LDodx7zwWTcbprLY\",\n      \"private_hash\": \"nm3Z5hFTbkbABo_ToaL5qm_51ycLs0jLSNgUI7va4V0\",\n      \"public_hash\": \"3CJbLfCuV8sXXnrw8nicdbL48qLXhH_5kK7-zcJXl-E\"\n    }\n  }\n}", common.StringToByte("1234"))
+func TestProtocolLegacyRatchetStore(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, bRachet := newSessionPair(t)
+	sendAndReceive(t, aRachet, bRachet, "BEFORE SAVING")
 
-	//aKey.GenerateEphemeralKey()
+	// A store encrypted with the PIN itself but holding ratchet keys was
+	// never written, without a MAC it is refused
+	rootKey, _ := common.EncryptAndHash(aRachet.RootKey, pin)
+	chainSendKey, _ := common.EncryptAndHash(aRachet.ChainSendKey, pin)
+	chainRecvKey, _ := common.EncryptAndHash(aRachet.ChainRecieveKey, pin)
+	dhRecvKey, _ := aRachet.DHRecvKey.Serialize()
+	legacyJson, _ := json.Marshal(&ratchet.RachetStore{
+		RachetId:            aRachet.RatchetId,
+		RootKey:             common.EncodeToString(rootKey),
+		ChainSendKey:        common.EncodeToString(chainSendKey),
+		ChainRecvKey:        common.EncodeToString(chainRecvKey),
+		DHSendKey:           aRachet.DHSendKey.SaveWithKey(pin),
+		DHRecvKey:           common.EncodeToString(dhRecvKey),
+		SendChainLength:     aRachet.SendChainLength,
+		RecvChainLength:     aRachet.RecvChainLength,
+		PreviousChainLength: aRachet.PreviousChainLength,
+		TotalMessageSent:    aRachet.GetTotalSent(),
+		TotalMessageRecv:    aRachet.GetTotalRecieved(),
+		AssociatedData:      common.EncodeToString(aRachet.AssociatedData),
+	})
+	if _, err := ratchet.LoadRachet(string(legacyJson), pin); !errors.Is(err, ratchet.ErrTamperedStore) {
+		t.Fatalf("Ratchet store with ratchet keys but without a MAC was loaded: %v", err)
+	}
 
-	aRachet := ratchet.LoadRachet("{\n      \"ephemeralKey\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAE3yRHeEgU8jCj8ymEefj5kJF75-9iSuRAMr4CY64ShJzejTSQ4NXZuU9EcO217pbupeCXLwFXfENRZyYtkBy7Y-0qfbstcUq6Vht0Ofxl0sr7ccj14usVSETPOTZyFM8R\",\n      \"keyBundle\": {\n        \"identityKey\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEPGpNsPAahwbMdGJKAQqz5f5fOj2TQ-JoxzSPN7-54czLOK2Jy3Dq5Az_8RT6KDVYGdl2ueeof3Y3jNn421l6-dFohUCgbyFpLVa61cR6MOXUNx5u5ks2vk9ewviYM5kp\",\n        \"preKey\": \"MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAEqIbdkL-T8UCqnHNbobJsy5ExJYUIH3nN2afpDf4VfwSVuJXFfvDvhO4zFrrbZnabrSA_aBwa82nIUu1o3PTSD_z0ecrVWqCVRy2_yEWwluWQkrJxMRa2Pf4SxwSjEspz\",\n        \"preKeySig\": \"MGUCMFLdULjTsEt0cld3MrvgrriL0HlU6tkva3w23Wf1T15svt7yAjXY-Y_juMwhXjDikQIxAP0XH1MdV7GquzM3wiceS2nKOwDbaaGGbRABbIb2NEF_0c3CxO3_xwRY0fLdogsW7g\",\n        \"oneTimeKeyId\": \"00000000-0000-0000-0000-000000000000\"\n      },\n      \"ratchetId\": \"5dadca20-90f2-11ee-97d2-40f50bb6d5eb\"\n    }", common.StringToByte("1234"))
+	aLoaded := loadRatchet(t, saveRatchet(t, aRachet, pin), pin)
+	if err := aLoaded.AttachKeyBundle(keys.NewInternalKeyBundle()); !errors.Is(err, ratchet.ErrWrongRatchet) {
+		t.Fatalf("Ratchet took the key bundle of another identity: %v", err)
+	}
+	if err := aLoaded.AttachKeyBundle(aRachet.MyKeyBundle); err != nil {
+		t.Fatal(err)
+	}
+	loadedIdentityKey, _ := aLoaded.YourKeyBundle.GetIdentityKey().Serialize()
+	bIdentityKey, _ := aRachet.YourKeyBundle.GetIdentityKey().Serialize()
+	if !bytes.Equal(loadedIdentityKey, bIdentityKey) {
+		t.Fatal("Loaded ratchet does not know the other identity key")
+	}
 
-	for i := 0; i < 10; i++ {
-		//msg := aRachet.PopulateMessage([]byte("THIS IS MESSAGE"))
-		//aRachet.OnSend(msg)
-		//
-		//sendedMsg := msg.ToDto()
-		//
-		//t.Log(sendedMsg)
-		//
-		//msgJson, _ := json.Marshal(sendedMsg)
+	sendAndReceive(t, aLoaded, bRachet, "AFTER LOADING")
+	sendAndReceive(t, bRachet, aLoaded, "REPLY AFTER LOADING")
+}
+
+// Written by the code before the ratchet step: a sent three messages to b,
+// b read the first one and both saved their ratchet with the PIN 1234
+const (
+	baselineStoreA   = `{"rachet_id":"55858113-cad7-11f1-b244-eaf3c6597fb4","root_key":"i8wRq2_nAJ9n8eg3wzoiHtz9CBfCFxTmScj8M54BOo2BzTJUFLqve5LFg1YkKr7k5K8Cotgm0kwu5RAxmGSUE0yXRnlQx2mGNLZulA","chain_send_key":"EzvFHswL5bGg02BYqmVoE7OFt6s-zRKV8Jdph2nkeBwT01GeEad4Ub-Zh1a4DG154tKJHpAcLBuLKtfJcoNBiq4lzWqfoqIAlL5-BQ","chain_recv_key":"47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFW9HCITYWmLjy_dXZRhtrxR_fh4HMnV_NULUDpA","total_message_sent":3,"total_message_recv":0,"missing_message_keys":null}`
+	baselineStoreB   = `{"rachet_id":"55858113-cad7-11f1-b244-eaf3c6597fb4","root_key":"i8wRq2_nAJ9n8eg3wzoiHtz9CBfCFxTmScj8M54BOo2Z7TdjJUjdIBCRv3HYU1gy1K327XWnmPcRNaxLCnH2K5YklkJGMuV4NtejIg","chain_send_key":"47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFWxTgdYaDR0Nx582baebQV34nl0pMmjnrsAqgnm","chain_recv_key":"g4TD47ObWn-FHJM4hKyqEGSCvAPx2JA1I5UbQYOz43wbdD8Hc318Bh_jT1fTLQBAVcWUBDOFblwXsHFVAROwgrBYhnvyyV4OSt_E8A","total_message_sent":0,"total_message_recv":1,"missing_message_keys":null}`
+	baselineMessage2 = `{"chatSessionId":"55858113-cad7-11f1-b244-eaf3c6597fb4","index":2,"cipherMessage":"-ltKzOUFhLCI5nqZFRU-y80rFg7U76w9vIvzdwEFrW7OKg5tr1coSN4faC3psvj6or73L_B-l9ARKaDsTAhq3_PQ5jWpqyq9_rFHMZEMP03QaZI","isBinary":false}`
+	baselineMessage3 = `{"chatSessionId":"55858113-cad7-11f1-b244-eaf3c6597fb4","index":3,"cipherMessage":"O9qb1NldR7Iz0yfZIro15q364kcPI_nAHFZgBk3XYnxTlEZnHApSLQg6GPUYAoRknU9nGuFQ6w2EZSpZYmD5DLL9G8nC8Pn_xUMe2MKeMoDSiA","isBinary":false}`
+)
+
+func receiveJson(t *testing.T, receiver *ratchet.Ratchet, msgJson string, expected string) {
+	msg, err := ratchet.CreateMessageFromJson(msgJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.OnRecieved(msg); err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.PlainMessage) != expected {
+		t.Fatalf("Expected %q but got %q", expected, msg.PlainMessage)
+	}
+}
+
+func TestProtocolBaselineStore(t *testing.T) {
+	pin := common.StringToByte("1234")
+	bRachet := loadRatchet(t, []byte(baselineStoreB), pin)
+	if !bRachet.NeedsMigration() {
+		t.Fatal("Baseline ratchet is not marked for migration")
+	}
+	if err := bRachet.AttachKeyBundle(keys.NewInternalKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	receiveJson(t, bRachet, baselineMessage3, "THIRD BASELINE MESSAGE")
+	receiveJson(t, bRachet, baselineMessage2, "SECOND BASELINE MESSAGE")
+	replayed, _ := ratchet.CreateMessageFromJson(baselineMessage2)
+	if err := bRachet.OnRecieved(replayed); !errors.Is(err, ratchet.ErrDuplicateMessage) {
+		t.Fatalf("Expected a duplicate message error but got %v", err)
+	}
+
+	// The session keeps working across a save in the current store format
+	bRachet = loadRatchet(t, saveRatchet(t, bRachet, pin), pin)
+	if bRachet.NeedsMigration() {
+		t.Fatal("Baseline ratchet was not migrated")
+	}
+	aRachet := loadRatchet(t, []byte(baselineStoreA), pin)
+	sendAndReceive(t, bRachet, aRachet, "REPLY AFTER THE SERIES")
+	sendAndReceive(t, aRachet, bRachet, "FOURTH MESSAGE")
+	aRachet = loadRatchet(t, saveRatchet(t, aRachet, pin), pin)
+	sendAndReceive(t, aRachet, bRachet, "FIFTH MESSAGE")
+}
+
+func TestProtocolVersion2(t *testing.T) {
+	aRachet, bRachet := newSessionPair(t)
+	if aRachet.ProtocolVersion != keys.PROTOCOL_VERSION_2 || bRachet.ProtocolVersion != keys.PROTOCOL_VERSION_2 {
+		t.Fatal("New sessions do not use protocol v2")
+	}
+	if len(aRachet.RootKey) != 32 || len(aRachet.ChainSendKey) != 32 || len(bRachet.ChainSendKey) != 32 {
+		t.Fatal("Protocol v2 keys are not 32 bytes")
+	}
+	chainKey := aRachet.ChainSendKey
+	sendAndReceive(t, aRachet, bRachet, "V2")
+	if bytes.Equal(chainKey, aRachet.ChainSendKey) {
+		t.Fatal("Sending chain did not move")
+	}
+	sendAndReceive(t, bRachet, aRachet, "V2 REPLY")
+}
+
+// version1Bundle is the bundle of a client from before versioning, it does
+// not advertise a version and signs its pre key as is
+func version1Bundle(t *testing.T, internalKey *keys.InternalKeyBundle) *keys.ExternalKeyBundle {
+	bundle := internalKey.GenerateExternalKey()
+	preKey, _ := bundle.PreKey.Serialize()
+	bundle.PreKeySig, _ = ecc.FromKeyPair(internalKey.IdentityKey).Sign(preKey)
+	bundleDto := bundle.ToDto()
+	bundleDto.ProtocolVersion = 0
+	bundleJson, _ := json.Marshal(bundleDto)
+	v1Bundle, err := keys.NewExternalKeyFromJson(string(bundleJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1Bundle
+}
+
+func TestProtocolVersionDowngrade(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	// A v2 bundle passed on as one that advertises no version
+	bDto := bKey.GenerateExternalKey().ToDto()
+	bDto.ProtocolVersion = 0
+	bJson, _ := json.Marshal(bDto)
+	downgraded, err := keys.NewExternalKeyFromJson(string(bJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ratchet.NewRachetFromInternal(aKey, downgraded); !errors.Is(err, ecc.ErrBadSignature) {
+		t.Fatalf("Expected a bad signature error but got %v", err)
+	}
+}
+
+func TestProtocolVersion1Coexists(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, version1Bundle(t, bKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aRachet.ProtocolVersion != keys.PROTOCOL_VERSION_1 {
+		t.Fatal("Session with a v1 bundle does not fall back to v1")
+	}
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, aRachet.OneTimeKeyId, aRachet.GetPQCipherText(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aRachet.RootKey) != 16 {
+		t.Fatal("Protocol v1 keys changed size")
+	}
+
+	msg := sendOnly(aRachet, "V1")
+	if msg.CipherMessage[0] != common.CIPHER_FORMAT_V2 {
+		t.Fatal("Protocol v1 message is not sealed with the v2 format")
+	}
+	received := readMessage(t, msg.ToDto())
+	if err := bRachet.OnRecieved(received); err != nil || string(received.PlainMessage) != "V1" {
+		t.Fatal("Cannot decrypt protocol v1 message")
+	}
 
-		//recvMsg := ratchet.CreateMessageFromJson(string(msgJson))
+	aJson := saveRatchet(t, aRachet, pin)
+	aLoaded := loadRatchet(t, aJson, pin)
+	if aLoaded == nil || aLoaded.ProtocolVersion != keys.PROTOCOL_VERSION_1 {
+		t.Fatal("Protocol version was not restored")
+	}
+	sendAndReceive(t, bRachet, aLoaded, "V1 REPLY")
+	sendAndReceive(t, aLoaded, bRachet, "V1 AFTER RELOAD")
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", aRachet.GetPQCipherText(), keys.CURRENT_PROTOCOL_VERSION+1); err == nil {
+		t.Fatal("Session was set up with an unsupported protocol version")
+	}
+
+	// The responder believing in another version cannot read anything
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, "", aRachet.GetPQCipherText(), keys.PROTOCOL_VERSION_1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := readMessage(t, sendOnly(aRachet, "MISMATCH").ToDto())
+	if err := bRachet.OnRecieved(msg); err == nil {
+		t.Fatal("Message was decrypted across protocol versions")
+	}
+}
+
+func TestPaddingSchemes(t *testing.T) {
+	for _, scheme := range []ratchet.PaddingScheme{ratchet.PADDING_NONE, ratchet.PADDING_BUCKET, ratchet.PADDING_PADME} {
+		for length := 0; length < 2048; length++ {
+			plainText := bytes.Repeat([]byte{0x80}, length)
+			padded, err := scheme.Pad(plainText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(padded) != scheme.PaddedLength(length) || len(padded) < length {
+				t.Fatalf("%s padded %d bytes to %d", scheme, length, len(padded))
+			}
+			unpadded, err := scheme.Unpad(padded)
+			if err != nil || !bytes.Equal(unpadded, plainText) {
+				t.Fatalf("%s cannot strip the padding of %d bytes", scheme, length)
+			}
+		}
+	}
+
+	if ratchet.PADDING_BUCKET.PaddedLength(1) != ratchet.PADDING_BUCKET.PaddedLength(200) {
+		t.Fatal("Lengths in one bucket are told apart")
+	}
+	// Padmé keeps the overhead small while only the top bits of the length are left
+	for _, length := range []int{100, 1000, 10000, 100000} {
+		paddedLength := ratchet.PADDING_PADME.PaddedLength(length)
+		if float64(paddedLength) > float64(length+1)*1.12 {
+			t.Fatalf("Padmé overhead of %d bytes is too large, got %d", length, paddedLength)
+		}
+	}
+	if ratchet.PADDING_PADME.PaddedLength(9990) != ratchet.PADDING_PADME.PaddedLength(10000) {
+		t.Fatal("Padmé tells close lengths apart")
+	}
 
-		var msg ratchet.MessageDto
+	if _, err := ratchet.PADDING_PADME.Unpad([]byte("NO MARKER")); err == nil {
+		t.Fatal("Content without padding was stripped")
+	}
+	if _, err := ratchet.PaddingScheme(7).Pad([]byte("UNKNOWN")); err == nil {
+		t.Fatal("Unknown padding scheme was used")
+	}
+}
+
+func TestProtocolPadding(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aRachet, bRachet := newSessionPair(t)
+	if aRachet.Padding != ratchet.PADDING_PADME || bRachet.Padding != ratchet.PADDING_PADME {
+		t.Fatal("New sessions are not padded")
+	}
+	if err := aRachet.SetPadding(ratchet.PADDING_BUCKET); err != nil {
+		t.Fatal(err)
+	}
+	short := sendOnly(aRachet, "HI")
+	long := sendOnly(aRachet, "A SOMEWHAT LONGER MESSAGE OF THE SAME BUCKET")
+	if len(short.CipherMessage) != len(long.CipherMessage) {
+		t.Fatal("Cipher text length shows the plain text length")
+	}
+	for _, msg := range []*ratchet.Message{short, long} {
+		envelope, err := msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ratchet.DecodeMessage(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Padding != ratchet.PADDING_BUCKET {
+			t.Fatal("Padding scheme lost in the envelope")
+		}
+		if err := bRachet.OnRecieved(decoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The padding scheme is authenticated with the header
+	msg := readMessage(t, sendOnly(aRachet, "TAMPERED PADDING").ToDto())
+	msg.Padding = ratchet.PADDING_PADME
+	if err := bRachet.OnRecieved(msg); err == nil {
+		t.Fatal("Message with a tampered padding scheme was decrypted")
+	}
+
+	if err := aRachet.SetPadding(ratchet.PADDING_NONE); err != nil {
+		t.Fatal(err)
+	}
+	unpadded := sendOnly(aRachet, "UNPADDED")
+	if unpadded.Padding != ratchet.PADDING_NONE {
+		t.Fatal("Padding scheme was not changed")
+	}
+	if err := bRachet.OnRecieved(readMessage(t, unpadded.ToDto())); err != nil {
+		t.Fatal(err)
+	}
+
+	aRachet.SetPadding(ratchet.PADDING_BUCKET)
+	aJson := saveRatchet(t, aRachet, pin)
+	aLoaded := loadRatchet(t, aJson, pin)
+	if aLoaded == nil || aLoaded.Padding != ratchet.PADDING_BUCKET {
+		t.Fatal("Padding scheme was not restored")
+	}
+	sendAndReceive(t, aLoaded, bRachet, "PADDED AFTER RELOAD")
+	sendAndReceive(t, bRachet, aLoaded, "PADME REPLY")
+}
+
+func TestProtocolPaddingVersion1(t *testing.T) {
+	pin := common.StringToByte("1234")
+	aKey := keys.NewInternalKeyBundle()
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, version1Bundle(t, keys.NewInternalKeyBundle()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aRachet.Padding != ratchet.PADDING_NONE {
+		t.Fatal("Protocol v1 session is padded")
+	}
+	if err := aRachet.SetPadding(ratchet.PADDING_PADME); err == nil {
+		t.Fatal("Protocol v1 session was set to pad")
+	}
 
-		json.Unmarshal(common.StringToByte("{\"chatSessionId\":\"5dadca20-90f2-11ee-97d2-40f50bb6d5eb\",\"index\":1,\"cipherMessage\":\"zbPTRSOKzbArJ-A6x_VgHwASGrtRhkanEDpiqxxrDVnGUZwsjY3KG-QMwv4opqUrAmvlY6Sj4yRHjtHkFjubmc0YJBuf7FQVSGmg\",\"isBinary\":false}"), &msg)
+	// Sessions saved before padding load unpadded
+	var store map[string]any
+	aJson := saveRatchet(t, aRachet, pin)
+	json.Unmarshal(aJson, &store)
+	delete(store, "padding")
+	legacyJson, _ := json.Marshal(store)
+	aLoaded := loadRatchet(t, legacyJson, pin)
+	if aLoaded == nil || aLoaded.Padding != ratchet.PADDING_NONE {
+		t.Fatal("Ratchet saved without padding does not load unpadded")
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	aRachet, err := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bRachet, err := ratchet.NewRachetFromExternal(bKey, aKey.GenerateExternalKey(), aRachet.GetEphemeralKey(), aRachet.GetId(), aRachet.PreKeyId, aRachet.OneTimeKeyId, aRachet.GetPQCipherText(), aRachet.ProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAndReceive(t, aRachet, bRachet, "BEFORE RESET")
+	sendOnly(aRachet, "LOST")
+	sendOnly(aRachet, "LOST TOO")
+
+	// b cannot decrypt the second message and resets with the bundle a has now
+	bReset, reset, err := ratchet.NewSessionReset(bKey, aKey.GenerateExternalKey(), bRachet.GetId(), bRachet, []uint{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bReset.GetId() != aRachet.GetId() {
+		t.Fatal("Session reset changed the ratchet id")
+	}
+	resetJson, _ := json.Marshal(reset.ToDto())
+	received, err := ratchet.NewSessionResetFromJson(string(resetJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aReset, unrecoverable, err := ratchet.AcceptSessionReset(aKey, bKey.GenerateExternalKey(), received, aRachet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(unrecoverable) != "[2 3]" {
+		t.Fatalf("Expected messages 2 and 3 to be unrecoverable but got %v", unrecoverable)
+	}
+	sendAndReceive(t, bReset, aReset, "AFTER RESET")
+	sendAndReceive(t, aReset, bReset, "REPLY AFTER RESET")
+
+	// A lost store resets from scratch, everything sent is reported
+	_, reset, err = ratchet.NewSessionReset(bKey, aKey.GenerateExternalKey(), aReset.GetId(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unrecoverable, err = ratchet.AcceptSessionReset(aKey, bKey.GenerateExternalKey(), reset, aReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(unrecoverable) != "[1]" {
+		t.Fatalf("Expected message 1 to be unrecoverable but got %v", unrecoverable)
+	}
+}
+
+func TestSessionResetRefused(t *testing.T) {
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	mKey := keys.NewInternalKeyBundle()
+	aRachet, _ := ratchet.NewRachetFromInternal(aKey, bKey.GenerateExternalKey())
+
+	// Someone else cannot take over the session by resetting it, nor burn
+	// our one-time key trying
+	batch, err := aKey.GenerateOneTimeKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleDto := aKey.GenerateExternalKey().ToDto()
+	bundleDto.OneTimeKeyId = batch.OneTimeKeys[0].KeyId
+	bundleDto.OneTimeKey = batch.OneTimeKeys[0].Key
+	bundleDto.OneTimeKeySig = batch.OneTimeKeys[0].KeySig
+	bundleJson, _ := json.Marshal(bundleDto)
+	aExternalKeyBundle, err := keys.NewExternalKeyFromJson(string(bundleJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, reset, err := ratchet.NewSessionReset(mKey, aExternalKeyBundle, aRachet.GetId(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reset.OneTimeKeyId != batch.OneTimeKeys[0].KeyId {
+		t.Fatal("One-time key was not used")
+	}
+	if _, _, err := ratchet.AcceptSessionReset(aKey, mKey.GenerateExternalKey(), reset, aRachet); !errors.Is(err, ratchet.ErrWrongRatchet) {
+		t.Fatalf("Session reset from another identity key was accepted: %v", err)
+	}
+	if aKey.OneTimeKeys[batch.OneTimeKeys[0].KeyId] == nil {
+		t.Fatal("Refused session reset consumed the one-time key")
+	}
+
+	_, reset, _ = ratchet.NewSessionReset(bKey, aKey.GenerateExternalKey(), "another-session", nil, nil)
+	if _, _, err := ratchet.AcceptSessionReset(aKey, bKey.GenerateExternalKey(), reset, aRachet); err == nil {
+		t.Fatal("Session reset of another session was accepted")
+	}
+	if _, _, err := ratchet.NewSessionReset(bKey, aKey.GenerateExternalKey(), "another-session", aRachet, nil); err == nil {
+		t.Fatal("Session reset was set up for another session")
+	}
+}
+
+func saveRatchet(t *testing.T, r *ratchet.Ratchet, pin []byte) []byte {
+	store, err := r.Save(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeJson, _ := json.Marshal(store)
+	return storeJson
+}
+
+func loadRatchet(t *testing.T, storeJson []byte, pin []byte) *ratchet.Ratchet {
+	r, err := ratchet.LoadRachet(string(storeJson), pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
 
-		revMsg := ratchet.CreateMessageFromDto(&msg)
-		aRachet.OnRecieved(revMsg)
-		t.Log(revMsg.PlainMessage)
+func readMessage(t *testing.T, dto *ratchet.MessageDto) *ratchet.Message {
+	msg, err := ratchet.CreateMessageFromDto(dto)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return msg
 }
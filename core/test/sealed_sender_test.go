@@ -0,0 +1,98 @@
+package test
+
+import (
+	"bytes"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/ecc"
+	"lidx-core-lib/keys"
+	"testing"
+	"time"
+)
+
+func TestSenderCertificate(t *testing.T) {
+	serverKey := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+	aKey := keys.NewInternalKeyBundle()
+	certificate, err := keys.NewSenderCertificate(serverKey, "alice", aKey.IdentityKey.PublicKey(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := keys.ParseSenderCertificate(certificate.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Username != "alice" || !parsed.HasIdentityKey(aKey.IdentityKey.PublicKey()) {
+		t.Fatal("Sender certificate was not restored")
+	}
+	if err := parsed.Verify(serverKey.PublicKey(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Verify(serverKey.PublicKey(), time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatal("Expired sender certificate was accepted")
+	}
+	otherServerKey := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+	if err := parsed.Verify(otherServerKey.PublicKey(), time.Now()); err == nil {
+		t.Fatal("Sender certificate of another server was accepted")
+	}
+
+	tampered := certificate.Serialize()
+	tampered[len(tampered)-1] ^= 0x01
+	tamperedCertificate, err := keys.ParseSenderCertificate(tampered)
+	if err == nil && tamperedCertificate.Verify(serverKey.PublicKey(), time.Now()) == nil {
+		t.Fatal("Tampered sender certificate was accepted")
+	}
+}
+
+func TestSealedSender(t *testing.T) {
+	for _, suite := range []ecc.KeySuite{ecc.SUITE_P384, ecc.SUITE_CURVE25519} {
+		serverKey := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+		aKey := keys.NewInternalKeyBundleWithSuite(suite)
+		bKey := keys.NewInternalKeyBundleWithSuite(suite)
+		certificate, _ := keys.NewSenderCertificate(serverKey, "alice", aKey.IdentityKey.PublicKey(), time.Now().Add(time.Hour))
+		token := common.StringToByte("reply token")
+		message := common.StringToByte("SEALED")
+
+		envelope, err := keys.SealMessage(aKey, certificate, token, bKey.IdentityKey.PublicKey(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(envelope, common.StringToByte("alice")) {
+			t.Fatal("Envelope shows the sender")
+		}
+		opened, err := keys.OpenSealedMessage(bKey, serverKey.PublicKey(), envelope, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened.Certificate.Username != "alice" || !bytes.Equal(opened.Message, message) || !bytes.Equal(opened.DeliveryToken, token) {
+			t.Fatal("Sealed message was not restored")
+		}
+
+		if _, err := keys.OpenSealedMessage(keys.NewInternalKeyBundleWithSuite(suite), serverKey.PublicKey(), envelope, time.Now()); err == nil {
+			t.Fatal("Sealed message was opened by another recipient")
+		}
+		if _, err := keys.OpenSealedMessage(bKey, serverKey.PublicKey(), envelope, time.Now().Add(2*time.Hour)); err == nil {
+			t.Fatal("Sealed message with an expired certificate was opened")
+		}
+		tampered := append([]byte(nil), envelope...)
+		tampered[len(tampered)-1] ^= 0x01
+		if _, err := keys.OpenSealedMessage(bKey, serverKey.PublicKey(), tampered, time.Now()); err == nil {
+			t.Fatal("Tampered sealed message was opened")
+		}
+	}
+}
+
+func TestSealedSenderCertificateBinding(t *testing.T) {
+	serverKey := ecc.GenerateKeyPairWithSuite(ecc.SUITE_CURVE25519)
+	aKey := keys.NewInternalKeyBundle()
+	bKey := keys.NewInternalKeyBundle()
+	mKey := keys.NewInternalKeyBundle()
+	aCertificate, _ := keys.NewSenderCertificate(serverKey, "alice", aKey.IdentityKey.PublicKey(), time.Now().Add(time.Hour))
+
+	// Someone else cannot reuse the certificate of alice
+	if _, err := keys.SealMessage(mKey, aCertificate, nil, bKey.IdentityKey.PublicKey(), []byte("FORGED")); err == nil {
+		t.Fatal("Message was sealed with the certificate of another user")
+	}
+	if _, err := keys.SealMessage(aKey, aCertificate, nil, keys.NewInternalKeyBundleWithSuite(ecc.SUITE_CURVE25519).IdentityKey.PublicKey(), []byte("SUITE")); err == nil {
+		t.Fatal("Message was sealed across key suites")
+	}
+}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/aes"
+	"testing"
+)
+
+const testChunkSize = 16
+
+func sealStream(t *testing.T, key, content []byte, writeSize int) []byte {
+	var sealed bytes.Buffer
+	stream, err := aes.NewStreamWriterWithChunkSize(&sealed, key, testChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(content) > 0 {
+		n := min(writeSize, len(content))
+		if _, err := stream.Write(content[:n]); err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func openStream(key, sealed []byte) ([]byte, error) {
+	stream, err := aes.NewStreamReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(stream)
+}
+
+// sealedChunk is chunk index of a stream sealed with testChunkSize
+func sealedChunk(sealed []byte, index int) []byte {
+	start := aes.STREAM_HEADER_SIZE + index*(testChunkSize+aes.STREAM_TAG_SIZE)
+	return sealed[start:min(start+testChunkSize+aes.STREAM_TAG_SIZE, len(sealed))]
+}
+
+func TestStream(t *testing.T) {
+	key, _ := common.RandomByt(32)
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, 3 * testChunkSize, 3*testChunkSize + 5} {
+		content, _ := common.RandomByt(size)
+		for _, writeSize := range []int{1, 7, testChunkSize, 1000} {
+			sealed := sealStream(t, key, content, writeSize)
+			chunkCount := max((size+testChunkSize-1)/testChunkSize, 1)
+			if len(sealed) != aes.STREAM_HEADER_SIZE+size+chunkCount*aes.STREAM_TAG_SIZE {
+				t.Fatalf("Stream of %d bytes has an unexpected size %d", size, len(sealed))
+			}
+			opened, err := openStream(key, sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, content) {
+				t.Fatalf("Stream of %d bytes written %d at a time does not round trip", size, writeSize)
+			}
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key, _ := common.RandomByt(32)
+	content, _ := common.RandomByt(3*testChunkSize + 5)
+	sealed := sealStream(t, key, content, len(content))
+
+	otherKey, _ := common.RandomByt(32)
+	if _, err := openStream(otherKey, sealed); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Stream opened with another key: %v", err)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[aes.STREAM_HEADER_SIZE+1] ^= 0x01
+	if _, err := openStream(key, tampered); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Tampered chunk was opened: %v", err)
+	}
+
+	// The header is authenticated with every chunk
+	tampered = bytes.Clone(sealed)
+	tampered[aes.STREAM_HEADER_SIZE-1] ^= 0x01
+	if _, err := openStream(key, tampered); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Stream with a tampered header was opened: %v", err)
+	}
+
+	// Cut at a chunk boundary, the new last chunk was not sealed as the last
+	truncated := sealed[:aes.STREAM_HEADER_SIZE+2*(testChunkSize+aes.STREAM_TAG_SIZE)]
+	if _, err := openStream(key, truncated); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Truncated stream was opened: %v", err)
+	}
+	if _, err := openStream(key, sealed[:aes.STREAM_HEADER_SIZE]); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Stream without chunks was opened: %v", err)
+	}
+
+	reordered := common.ConcatBytes(sealed[:aes.STREAM_HEADER_SIZE], sealedChunk(sealed, 1), sealedChunk(sealed, 0), sealedChunk(sealed, 2), sealedChunk(sealed, 3))
+	if _, err := openStream(key, reordered); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Reordered stream was opened: %v", err)
+	}
+
+	if _, err := openStream(key, common.ConcatBytes(sealed, []byte{0x00})); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Stream with trailing data was opened: %v", err)
+	}
+	if _, err := openStream(key, []byte{0x7f}); !errors.Is(err, aes.ErrInvalidStream) {
+		t.Fatalf("Expected an invalid stream error but got %v", err)
+	}
+}
+
+func TestStreamReaderAt(t *testing.T) {
+	key, _ := common.RandomByt(32)
+	content, _ := common.RandomByt(5*testChunkSize + 3)
+	sealed := sealStream(t, key, content, len(content))
+
+	stream, err := aes.NewStreamReaderAt(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Size() != int64(len(content)) {
+		t.Fatalf("Expected a plain size of %d but got %d", len(content), stream.Size())
+	}
+	for _, r := range [][2]int{{0, 1}, {3, 10}, {testChunkSize - 2, 4}, {testChunkSize, testChunkSize}, {20, 50}, {len(content) - 4, 4}} {
+		p := make([]byte, r[1])
+		n, err := stream.ReadAt(p, int64(r[0]))
+		if err != nil || n != r[1] {
+			t.Fatalf("Cannot read %d bytes at %d: %v", r[1], r[0], err)
+		}
+		if !bytes.Equal(p, content[r[0]:r[0]+r[1]]) {
+			t.Fatalf("Range of %d bytes at %d does not match", r[1], r[0])
+		}
+	}
+	p := make([]byte, 10)
+	if n, err := stream.ReadAt(p, int64(len(content)-4)); n != 4 || err != io.EOF {
+		t.Fatalf("Expected 4 bytes and EOF but got %d and %v", n, err)
+	}
+
+	// Ranges before the cut still read, the end does not
+	truncated := sealed[:aes.STREAM_HEADER_SIZE+2*(testChunkSize+aes.STREAM_TAG_SIZE)]
+	truncatedStream, err := aes.NewStreamReaderAt(bytes.NewReader(truncated), int64(len(truncated)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := truncatedStream.ReadAt(make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := truncatedStream.ReadAt(make([]byte, 4), testChunkSize); !errors.Is(err, aes.ErrStreamAuth) {
+		t.Fatalf("Last chunk of a truncated stream was read: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"lidx-core-lib/common"
+	"lidx-core-lib/voip"
+	"testing"
+)
+
+func newCall(t *testing.T) (*voip.Session, *voip.Session) {
+	callSecret, _ := common.RandomByt(32)
+	caller, err := voip.NewSession(callSecret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	callee, err := voip.NewSession(callSecret, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller, callee
+}
+
+func sealFrame(t *testing.T, session *voip.Session, frame string) []byte {
+	sealed, err := session.Encrypt(common.StringToByte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func openFrame(t *testing.T, session *voip.Session, sealed []byte, expected string) {
+	frame, err := session.Decrypt(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != expected {
+		t.Fatalf("Expected frame %q but got %q", expected, frame)
+	}
+}
+
+func TestVoip(t *testing.T) {
+	caller, callee := newCall(t)
+	for i := 0; i < 3; i++ {
+		openFrame(t, callee, sealFrame(t, caller, "HELLO FROM CALLER"), "HELLO FROM CALLER")
+		openFrame(t, caller, sealFrame(t, callee, "HELLO FROM CALLEE"), "HELLO FROM CALLEE")
+	}
+
+	// Each direction has a key of its own, a frame we sent does not open on
+	// our side
+	sealed := sealFrame(t, caller, "ECHO")
+	if _, err := caller.Decrypt(sealed); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Own frame was opened: %v", err)
+	}
+	if bytes.Contains(sealed, common.StringToByte("ECHO")) {
+		t.Fatal("Sealed frame contains the plain frame")
+	}
+
+	_, otherCallee := newCall(t)
+	if _, err := otherCallee.Decrypt(sealFrame(t, caller, "OTHER CALL")); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Frame of another call was opened: %v", err)
+	}
+}
+
+func TestVoipReplay(t *testing.T) {
+	caller, callee := newCall(t)
+	first := sealFrame(t, caller, "FIRST")
+	second := sealFrame(t, caller, "SECOND")
+	third := sealFrame(t, caller, "THIRD")
+
+	// Frames may arrive out of order, but only once
+	openFrame(t, callee, third, "THIRD")
+	openFrame(t, callee, first, "FIRST")
+	if _, err := callee.Decrypt(first); !errors.Is(err, voip.ErrReplayedFrame) {
+		t.Fatalf("Expected a replayed frame error but got %v", err)
+	}
+	openFrame(t, callee, second, "SECOND")
+
+	// A frame too far behind the newest one is dropped
+	late := sealFrame(t, caller, "LATE")
+	for i := 0; i < voip.REPLAY_WINDOW_SIZE; i++ {
+		openFrame(t, callee, sealFrame(t, caller, "FRAME"), "FRAME")
+	}
+	if _, err := callee.Decrypt(late); !errors.Is(err, voip.ErrReplayedFrame) {
+		t.Fatalf("Expected a replayed frame error but got %v", err)
+	}
+}
+
+func TestVoipRekey(t *testing.T) {
+	caller, callee := newCall(t)
+	beforeRekey := sealFrame(t, caller, "BEFORE REKEY")
+	if err := caller.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if caller.Epoch() != 1 {
+		t.Fatalf("Expected epoch 1 but got %d", caller.Epoch())
+	}
+	openFrame(t, callee, sealFrame(t, caller, "AFTER REKEY"), "AFTER REKEY")
+	// The previous epoch stays open for frames still on their way
+	openFrame(t, callee, beforeRekey, "BEFORE REKEY")
+
+	// The receiver follows several epochs at once
+	for i := 0; i < 3; i++ {
+		_ = caller.Rekey()
+	}
+	openFrame(t, callee, sealFrame(t, caller, "EPOCH 4"), "EPOCH 4")
+
+	// Older epochs are gone
+	if _, err := callee.Decrypt(beforeRekey); !errors.Is(err, voip.ErrReplayedFrame) {
+		t.Fatalf("Expected a replayed frame error but got %v", err)
+	}
+
+	for i := 0; i <= voip.MAX_EPOCH_SKIP; i++ {
+		_ = caller.Rekey()
+	}
+	if _, err := callee.Decrypt(sealFrame(t, caller, "TOO FAR")); !errors.Is(err, voip.ErrInvalidFrame) {
+		t.Fatalf("Expected an invalid frame error but got %v", err)
+	}
+
+	// The other direction is not rekeyed along
+	openFrame(t, caller, sealFrame(t, callee, "CALLEE"), "CALLEE")
+}
+
+func TestVoipAutoRekey(t *testing.T) {
+	caller, callee := newCall(t)
+	caller.RekeyFrames = 2
+	for i := 0; i < 5; i++ {
+		openFrame(t, callee, sealFrame(t, caller, "FRAME"), "FRAME")
+	}
+	if caller.Epoch() != 2 {
+		t.Fatalf("Expected epoch 2 but got %d", caller.Epoch())
+	}
+
+	caller.RekeyInterval = 0
+	openFrame(t, callee, sealFrame(t, caller, "FRAME"), "FRAME")
+	if caller.Epoch() != 3 {
+		t.Fatalf("Expected epoch 3 but got %d", caller.Epoch())
+	}
+}
+
+func TestVoipTampered(t *testing.T) {
+	caller, callee := newCall(t)
+	sealed := sealFrame(t, caller, "FRAME")
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := callee.Decrypt(tampered); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+
+	// The header is authenticated, a frame cannot be moved to another counter
+	tampered = bytes.Clone(sealed)
+	tampered[12] ^= 0x01
+	if _, err := callee.Decrypt(tampered); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+
+	// A failed frame does not use up its counter
+	openFrame(t, callee, sealed, "FRAME")
+
+	if _, err := callee.Decrypt(sealed[:10]); !errors.Is(err, voip.ErrInvalidFrame) {
+		t.Fatalf("Expected an invalid frame error but got %v", err)
+	}
+
+	// A failed frame of a later epoch leaves the current one in place
+	caller.Rekey()
+	rekeyed := sealFrame(t, caller, "NEXT EPOCH")
+	tampered = bytes.Clone(rekeyed)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := callee.Decrypt(tampered); !errors.Is(err, common.ErrDecryptFailed) {
+		t.Fatalf("Expected a decrypt error but got %v", err)
+	}
+	openFrame(t, callee, rekeyed, "NEXT EPOCH")
+
+	caller.Close()
+	callee.Close()
+	if _, err := caller.Encrypt(common.StringToByte("AFTER CLOSE")); err == nil {
+		t.Fatal("Closed call sealed a frame")
+	}
+	if _, err := callee.Decrypt(rekeyed); err == nil {
+		t.Fatal("Closed call opened a frame")
+	}
+}
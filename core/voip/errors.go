@@ -0,0 +1,12 @@
+package voip
+
+import "errors"
+
+var (
+	// ErrInvalidFrame is returned for a frame that cannot be read or whose
+	// epoch is too far ahead of ours
+	ErrInvalidFrame = errors.New("Invalid media frame")
+	// ErrReplayedFrame is returned for a frame that was already opened or is
+	// too old for the replay window
+	ErrReplayedFrame = errors.New("Replayed media frame")
+)
@@ -0,0 +1,283 @@
+package voip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"lidx-core-lib/common"
+	"lidx-core-lib/crypto/kdf"
+	"math"
+	"time"
+)
+
+// A call gets media keys of its own from the call secret of its handshake,
+// one for each direction so the two sides never seal under the same key
+//
+//	version 1 byte
+//	epoch   uint32, how many times the sender rekeyed
+//	counter uint64, number of the frame within the epoch
+//	frame   AES-256-GCM, the nonce is epoch and counter and the header
+//	        above is the associated data
+//
+// The sender moves to the next epoch every RekeyFrames frames or after
+// RekeyInterval, the next key is derived from the current one which is then
+// dropped. The receiver follows once a frame of a later epoch opens and keeps
+// the previous epoch for frames still on their way
+const FRAME_VERSION_1 byte = 0x01
+
+const (
+	DEFAULT_REKEY_FRAMES   = 1 << 16
+	DEFAULT_REKEY_INTERVAL = 10 * time.Minute
+	// How many epochs a frame may be ahead of the last one we opened
+	MAX_EPOCH_SKIP = 8
+	// How far behind the newest frame a frame may arrive and still open
+	REPLAY_WINDOW_SIZE = 64
+	frameHeaderSize    = 13
+	frameTagSize       = 16
+)
+
+// Session seals the frames we send and opens the frames of the other side,
+// its keys never leave it
+type Session struct {
+	send          *mediaKey
+	sendCounter   uint64
+	sendStartedAt time.Time
+	recv          *mediaKey
+	previousRecv  *mediaKey
+	RekeyFrames   uint64
+	RekeyInterval time.Duration
+}
+
+// mediaKey is the key of one direction for one epoch, along with the frames
+// it already opened
+type mediaKey struct {
+	epoch  uint32
+	key    []byte
+	aead   cipher.AEAD
+	window replayWindow
+}
+
+// NewSession derives the media keys of both directions from callSecret, the
+// caller and the callee pass the same secret and tell which side they are
+func NewSession(callSecret []byte, isCaller bool) (*Session, error) {
+	callerKey, err := kdf.DeriveKey(callSecret, kdf.LABEL_VOIP_CALLER)
+	if err != nil {
+		return nil, err
+	}
+	calleeKey, err := kdf.DeriveKey(callSecret, kdf.LABEL_VOIP_CALLEE)
+	if err != nil {
+		return nil, err
+	}
+	if !isCaller {
+		callerKey, calleeKey = calleeKey, callerKey
+	}
+	send, err := newMediaKey(0, callerKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newMediaKey(0, calleeKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		send:          send,
+		sendStartedAt: time.Now(),
+		recv:          recv,
+		RekeyFrames:   DEFAULT_REKEY_FRAMES,
+		RekeyInterval: DEFAULT_REKEY_INTERVAL,
+	}, nil
+}
+
+func newMediaKey(epoch uint32, key []byte) (*mediaKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	return &mediaKey{epoch: epoch, key: key, aead: aesgcm}, nil
+}
+
+// next derives the key of the following epoch
+func (k *mediaKey) next() (*mediaKey, error) {
+	if k.epoch == math.MaxUint32 {
+		return nil, fmt.Errorf("Call is out of epochs")
+	}
+	nextKey, err := kdf.DeriveKey(k.key, kdf.LABEL_VOIP_REKEY)
+	if err != nil {
+		return nil, err
+	}
+	return newMediaKey(k.epoch+1, nextKey)
+}
+
+// wipe clears the key and drops the cipher, which holds the expanded key
+func (k *mediaKey) wipe() {
+	if k != nil {
+		clear(k.key)
+		k.aead = nil
+	}
+}
+
+// Epoch is the epoch of the frames we send
+func (s *Session) Epoch() uint32 {
+	return s.send.epoch
+}
+
+// Rekey moves the frames we send to the next epoch, it happens on its own
+// every RekeyFrames frames or RekeyInterval
+func (s *Session) Rekey() error {
+	next, err := s.send.next()
+	if err != nil {
+		return err
+	}
+	s.send.wipe()
+	s.send = next
+	s.sendCounter = 0
+	s.sendStartedAt = time.Now()
+	return nil
+}
+
+func (s *Session) Encrypt(frame []byte) ([]byte, error) {
+	if s.send.aead == nil {
+		return nil, fmt.Errorf("Call is closed")
+	}
+	if s.sendCounter >= s.RekeyFrames || time.Since(s.sendStartedAt) >= s.RekeyInterval {
+		if err := s.Rekey(); err != nil {
+			return nil, err
+		}
+	}
+	header := frameHeader(s.send.epoch, s.sendCounter)
+	sealed := make([]byte, 0, frameHeaderSize+len(frame)+frameTagSize)
+	sealed = append(sealed, header...)
+	sealed = s.send.aead.Seal(sealed, frameNonce(s.send.epoch, s.sendCounter), frame, header)
+	s.sendCounter++
+	return sealed, nil
+}
+
+// Decrypt opens a frame of the other side, a frame is only opened once and
+// the session only follows a rekey once a frame of the new epoch opened
+func (s *Session) Decrypt(sealed []byte) ([]byte, error) {
+	if len(sealed) < frameHeaderSize+frameTagSize || sealed[0] != FRAME_VERSION_1 {
+		return nil, fmt.Errorf("%w: unknown frame format", ErrInvalidFrame)
+	}
+	if s.recv.aead == nil {
+		return nil, fmt.Errorf("Call is closed")
+	}
+	header := sealed[:frameHeaderSize]
+	epoch := binary.BigEndian.Uint32(header[1:5])
+	counter := binary.BigEndian.Uint64(header[5:])
+
+	key, previous, err := s.recvKey(epoch)
+	if err != nil {
+		return nil, err
+	}
+	if !key.window.check(counter) {
+		return nil, fmt.Errorf("%w: frame %d of epoch %d", ErrReplayedFrame, counter, epoch)
+	}
+	frame, err := key.aead.Open(nil, frameNonce(epoch, counter), sealed[frameHeaderSize:], header)
+	if err != nil {
+		// Keys derived for a later epoch are only kept once a frame opens
+		if key.epoch > s.recv.epoch {
+			key.wipe()
+			if previous != s.recv {
+				previous.wipe()
+			}
+		}
+		return nil, fmt.Errorf("%w: frame %d of epoch %d", common.ErrDecryptFailed, counter, epoch)
+	}
+	key.window.mark(counter)
+	if key.epoch > s.recv.epoch {
+		s.previousRecv.wipe()
+		if previous != s.recv {
+			s.recv.wipe()
+		}
+		s.previousRecv, s.recv = previous, key
+	}
+	return frame, nil
+}
+
+// recvKey finds the key of epoch, for a later epoch it is derived along with
+// the key of the epoch right before it, nothing is kept until a frame opens
+func (s *Session) recvKey(epoch uint32) (*mediaKey, *mediaKey, error) {
+	switch {
+	case epoch == s.recv.epoch:
+		return s.recv, s.previousRecv, nil
+	case s.previousRecv != nil && epoch == s.previousRecv.epoch:
+		return s.previousRecv, nil, nil
+	case epoch < s.recv.epoch:
+		return nil, nil, fmt.Errorf("%w: epoch %d is over", ErrReplayedFrame, epoch)
+	case epoch-s.recv.epoch > MAX_EPOCH_SKIP:
+		return nil, nil, fmt.Errorf("%w: epoch %d is too far ahead", ErrInvalidFrame, epoch)
+	}
+	var previous *mediaKey
+	key := s.recv
+	for key.epoch < epoch {
+		next, err := key.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if previous != nil && previous != s.recv {
+			previous.wipe()
+		}
+		previous, key = key, next
+	}
+	return key, previous, nil
+}
+
+// Close wipes the keys, the session cannot be used anymore
+func (s *Session) Close() {
+	s.send.wipe()
+	s.recv.wipe()
+	s.previousRecv.wipe()
+}
+
+func frameHeader(epoch uint32, counter uint64) []byte {
+	header := make([]byte, frameHeaderSize)
+	header[0] = FRAME_VERSION_1
+	binary.BigEndian.PutUint32(header[1:5], epoch)
+	binary.BigEndian.PutUint64(header[5:], counter)
+	return header
+}
+
+func frameNonce(epoch uint32, counter uint64) []byte {
+	nonce := binary.BigEndian.AppendUint32(make([]byte, 0, 12), epoch)
+	return binary.BigEndian.AppendUint64(nonce, counter)
+}
+
+// replayWindow remembers which of the last REPLAY_WINDOW_SIZE counters were
+// opened, bit i of seen is highest - i
+type replayWindow struct {
+	highest uint64
+	seen    uint64
+	used    bool
+}
+
+func (w *replayWindow) check(counter uint64) bool {
+	if !w.used || counter > w.highest {
+		return true
+	}
+	behind := w.highest - counter
+	return behind < REPLAY_WINDOW_SIZE && w.seen&(1<<behind) == 0
+}
+
+func (w *replayWindow) mark(counter uint64) {
+	switch {
+	case !w.used:
+		w.used = true
+		w.highest = counter
+		w.seen = 1
+	case counter > w.highest:
+		ahead := counter - w.highest
+		if ahead >= REPLAY_WINDOW_SIZE {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<ahead | 1
+		}
+		w.highest = counter
+	default:
+		w.seen |= 1 << (w.highest - counter)
+	}
+}
@@ -98,7 +98,7 @@ func EncryptAndHash(plainText, key []byte) ([]byte, error) {
 	}
 	cipherText, nonce, err := crypto.AesGCMEncrypt(encrypKey, plainText)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot encrypt ", err)
+		return nil, fmt.Errorf("Cannot encrypt: %w", err)
 	}
 	hash := sha256.Sum256(plainText)
 	return ConcatBytes(hash[:], nonce, cipherText), nil
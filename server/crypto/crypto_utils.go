@@ -13,7 +13,7 @@ import (
 func AesGCMEncrypt(key, plainText []byte) ([]byte, []byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, fmt.Errorf("", err)
+		return nil, nil, fmt.Errorf("%w", err)
 	}
 
 	nonce := make([]byte, 12)
@@ -23,7 +23,7 @@ func AesGCMEncrypt(key, plainText []byte) ([]byte, []byte, error) {
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, nil, fmt.Errorf("", err)
+		return nil, nil, fmt.Errorf("%w", err)
 	}
 
 	ciphertext := aesgcm.Seal(nil, nonce, plainText, nil)
@@ -33,12 +33,12 @@ func AesGCMEncrypt(key, plainText []byte) ([]byte, []byte, error) {
 func AesGCMDecrypt(key, cipherText, nonce []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
 	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
 	return aesgcm.Open(nil, nonce, cipherText, nil)
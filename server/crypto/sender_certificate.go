@@ -0,0 +1,39 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Sender certificates are laid out as core/keys/sender_certificate.go reads
+// them
+//
+//	version     1 byte
+//	expiresAt   uint64 unix milli
+//	username    uint16 length + bytes
+//	identityKey uint16 length + serialized key
+//	signature   uint16 length + Ed25519 signature over everything before
+const SENDER_CERTIFICATE_VERSION_1 byte = 0x01
+
+func NewSenderCertificate(signingKey ed25519.PrivateKey, username string, identityKey []byte, expiresAt time.Time) ([]byte, error) {
+	if len(username) > 0xffff || len(identityKey) > 0xffff {
+		return nil, fmt.Errorf("Sender certificate field too long")
+	}
+	certificate := []byte{SENDER_CERTIFICATE_VERSION_1}
+	certificate = binary.BigEndian.AppendUint64(certificate, uint64(expiresAt.UnixMilli()))
+	certificate = binary.BigEndian.AppendUint16(certificate, uint16(len(username)))
+	certificate = append(certificate, username...)
+	certificate = binary.BigEndian.AppendUint16(certificate, uint16(len(identityKey)))
+	certificate = append(certificate, identityKey...)
+	signature := ed25519.Sign(signingKey, certificate)
+	certificate = binary.BigEndian.AppendUint16(certificate, uint16(len(signature)))
+	return append(certificate, signature...), nil
+}
+
+// SerializeSigningKey encodes the certificate key the way the core library
+// reads public keys
+func SerializeSigningKey(publicKey ed25519.PublicKey) []byte {
+	return append([]byte{SUITE_CURVE25519}, publicKey...)
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"crypto/x509"
+	"fmt"
+)
+
+// Public keys are read the way core/crypto/ecc serializes them, the first byte
+// is the key suite
+//
+//	0x01 P-384 x509 DER, signatures are ASN.1 ECDSA over the signed bytes
+//	0x05 Ed25519 public key, signatures are Ed25519
+//	0x30 untagged P-384 x509 DER written before suites existed
+const (
+	SUITE_P384       byte = 0x01
+	SUITE_CURVE25519 byte = 0x05
+	legacyDerTag     byte = 0x30
+)
+
+// ONE_TIME_KEY_SIGNATURE_LABEL leads the signed digest of a one-time key, the
+// same as in the core library
+const ONE_TIME_KEY_SIGNATURE_LABEL = "strix/v2/one-time-key"
+
+// VerifySignature checks that sig over message was made by the private part
+// of identityKey, both keys are serialized by the core library
+func VerifySignature(identityKey, message, sig []byte) error {
+	if len(identityKey) == 0 {
+		return fmt.Errorf("Missing identity key")
+	}
+	switch identityKey[0] {
+	case legacyDerTag:
+		return verifyP384(identityKey, message, sig)
+	case SUITE_P384:
+		return verifyP384(identityKey[1:], message, sig)
+	case SUITE_CURVE25519:
+		pubKey := identityKey[1:]
+		if len(pubKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("Cannot read identity key")
+		}
+		if !ed25519.Verify(pubKey, message, sig) {
+			return fmt.Errorf("Invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown key suite %d", identityKey[0])
+	}
+}
+
+// PreKeySignedPayload is what the identity key signs for a pre key, from
+// protocol v2 on a digest of the advertised version and the key so clients
+// notice a bundle whose version was lowered
+func PreKeySignedPayload(preKey []byte, protocolVersion int) []byte {
+	if protocolVersion < 2 {
+		return preKey
+	}
+	digest := sha512.Sum384(append([]byte{byte(protocolVersion)}, preKey...))
+	return digest[:]
+}
+
+// OneTimeKeySignedPayload is what the identity key signs for a one-time key, a
+// digest of a label, the protocol version and the key
+func OneTimeKeySignedPayload(oneTimeKey []byte, protocolVersion int) []byte {
+	payload := append([]byte(ONE_TIME_KEY_SIGNATURE_LABEL), byte(protocolVersion))
+	digest := sha512.Sum384(append(payload, oneTimeKey...))
+	return digest[:]
+}
+
+// PQPreKeyDigest is what the identity key signs for a post-quantum pre key,
+// the key is too long to be signed as is by ECDSA
+func PQPreKeyDigest(pqPreKey []byte) []byte {
+	digest := sha512.Sum384(pqPreKey)
+	return digest[:]
+}
+
+func verifyP384(der, message, sig []byte) error {
+	pubKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("Cannot read identity key")
+	}
+	ecdsaKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok || ecdsaKey.Curve != elliptic.P384() {
+		return fmt.Errorf("Cannot read identity key")
+	}
+	// Messages longer than the curve order are truncated by ECDSA, the core
+	// library signs the post-quantum pre key by its digest for that reason
+	if !ecdsa.VerifyASN1(ecdsaKey, message, sig) {
+		return fmt.Errorf("Invalid signature")
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"strix-server/system"
+	"time"
 )
 
 var DatabaseContext *gorm.DB
@@ -34,11 +35,27 @@ func migrate() {
 	system.Logger.Info("Creating database")
 	DatabaseContext.Exec("CREATE EXTENSION IF NOT EXISTS \"uuid-ossp\"")
 	_migrate(User{})
+	_migrate(IdentityKeyHistory{})
 	_migrate(PreKeys{})
+	_migrate(OneTimeKey{})
 	_migrate(Device{})
 	_migrate(ChatSession{})
 	_migrate(PendingMessage{})
+	_migrate(SealedMessage{})
 	_migrate(UploadedFile{})
+	backfillPreKeyCreatedAt()
+}
+
+// backfillPreKeyCreatedAt starts the rotation window of pre keys uploaded
+// before their upload time was kept at the migration, otherwise every one of
+// them looks stale at once
+func backfillPreKeyCreatedAt() {
+	err := DatabaseContext.Model(&User{}).
+		Where("pre_key_created_at IS NULL AND EXISTS (SELECT 1 FROM pre_keys WHERE pre_keys.user_id = users.id)").
+		Update("pre_key_created_at", time.Now()).Error
+	if err != nil {
+		system.Logger.Fatal("Cannot backfill pre key upload time")
+	}
 }
 
 func _migrate(model interface{}) {
@@ -13,15 +13,41 @@ type User struct {
 	Email             string     `gorm:"type:varchar(255)"`
 	Avatar            *string    `gorm:"type:varchar(500)"`
 	IdentityKey       string     `gorm:"type:varchar(255)"`
-	PreKeyCreatedTime *time.Time `gorm:"type:time"`
+	KeySuite          string     `gorm:"type:varchar(32)"`
+	ProtocolVersion   int        `gorm:"default:1"`
+	DeliveryTokenHash string     `gorm:"type:varchar(255)"`
+	PreKeyCreatedTime *time.Time `gorm:"column:pre_key_created_at;type:timestamp"`
 	PreKeys           []*PreKeys `gorm:"foreignKey:UserId"`
 	Devices           []*Device  `gorm:"foreignKey:UserId"`
 	CreatedAt         time.Time  `gorm:"type:time;default:current_timestamp;not null"`
 }
 
+// IdentityKeyHistory is append only, a row is added every time a user uploads
+// an identity key different from the current one
+type IdentityKeyHistory struct {
+	ID          uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
+	UserId      uuid.UUID `gorm:"type:uuid;index"`
+	IdentityKey string    `gorm:"type:varchar(255);not null"`
+	KeySuite    string    `gorm:"type:varchar(32)"`
+	CreatedAt   time.Time `gorm:"type:timestamp;default:current_timestamp;not null"`
+	Owner       *User     `gorm:"foreignKey:UserId"`
+}
+
 type PreKeys struct {
-	ID           uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
-	UserId       uuid.UUID `gorm:"type:uuid"`
+	ID           uuid.UUID  `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
+	UserId       uuid.UUID  `gorm:"type:uuid"`
+	Key          string     `gorm:"type:varchar(255);not null"`
+	KeySignature string     `gorm:"type:varchar(255);not null"`
+	PQKey        string     `gorm:"type:text"`
+	PQKeySig     string     `gorm:"type:varchar(255)"`
+	CreatedAt    time.Time  `gorm:"type:time;default:current_timestamp;not null"`
+	ExpiredAt    *time.Time `gorm:"type:timestamp"`
+	Owner        *User      `gorm:"foreignKey:UserId"`
+}
+
+type OneTimeKey struct {
+	ID           uuid.UUID `gorm:"type:uuid;primary_key"`
+	UserId       uuid.UUID `gorm:"type:uuid;index"`
 	Key          string    `gorm:"type:varchar(255);not null"`
 	KeySignature string    `gorm:"type:varchar(255);not null"`
 	CreatedAt    time.Time `gorm:"type:time;default:current_timestamp;not null"`
@@ -40,34 +66,54 @@ type Device struct {
 }
 
 type ChatSession struct {
-	ID            uuid.UUID  `gorm:"type:uuid;primary_key"`
-	SenderId      uuid.UUID  `gorm:"type:uuid"`
-	ReceiverId    uuid.UUID  `gorm:"type:uuid"`
-	IsInitialized bool       `gorm:"default:false"`
-	EphemeralKey  string     `gorm:"type:varchar(255)"`
-	DeletedAt     *time.Time `gorm:"type:time"`
-	CreatedAt     time.Time  `gorm:"type:time;default:current_timestamp;not null"`
-	Sender        *User      `gorm:"foreignKey:SenderId"`
-	Receiver      *User      `gorm:"foreignKey:ReceiverId"`
+	ID            uuid.UUID `gorm:"type:uuid;primary_key"`
+	SenderId      uuid.UUID `gorm:"type:uuid"`
+	ReceiverId    uuid.UUID `gorm:"type:uuid"`
+	IsInitialized bool      `gorm:"default:false"`
+	EphemeralKey  string    `gorm:"type:varchar(255)"`
+	PreKeyId      string    `gorm:"type:varchar(255)"`
+	OneTimeKeyId  string    `gorm:"type:varchar(255)"`
+	PQCipherText  string    `gorm:"type:text"`
+	// Session protocol version the initiator picked
+	ProtocolVersion int        `gorm:"default:1"`
+	DeletedAt       *time.Time `gorm:"type:time"`
+	CreatedAt       time.Time  `gorm:"type:time;default:current_timestamp;not null"`
+	Sender          *User      `gorm:"foreignKey:SenderId"`
+	Receiver        *User      `gorm:"foreignKey:ReceiverId"`
 }
 
 type PendingMessage struct {
-	ID             uuid.UUID    `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
-	Type           string       `gorm:"type:varchar(255)"`
-	Index          uint64       `gorm:"type:bigint"`
-	OwnerId        uuid.UUID    `gorm:"type:uuid"`
-	SenderId       uuid.UUID    `gorm:"type:uuid"`
-	SenderUsername string       `gorm:"type:varchar(255)"`
-	ChatSessionId  uuid.UUID    `gorm:"type:uuid"`
-	CipherMessage  string       `gorm:"type:text"`
-	PlainMessage   *string      `gorm:"type:text"`
-	FilePath       *string      `gorm:"type:text"`
-	IsBinary       bool         `gorm:"default:false"`
-	IsRead         bool         `gorm:"default:false"`
-	Owner          *User        `gorm:"foreignKey:OwnerId"`
-	Sender         *User        `gorm:"foreignKey:SenderId"`
-	ChatSession    *ChatSession `gorm:"foreignKey:ChatSessionId"`
-	CreatedAt      time.Time    `gorm:"type:time;default:current_timestamp;not null"`
+	ID                  uuid.UUID    `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
+	Type                string       `gorm:"type:varchar(255)"`
+	Index               uint64       `gorm:"type:bigint"`
+	ChainIndex          uint64       `gorm:"type:bigint"`
+	PreviousChainLength uint64       `gorm:"type:bigint"`
+	RatchetKey          string       `gorm:"type:text"`
+	OwnerId             uuid.UUID    `gorm:"type:uuid"`
+	SenderId            uuid.UUID    `gorm:"type:uuid"`
+	SenderUsername      string       `gorm:"type:varchar(255)"`
+	ChatSessionId       uuid.UUID    `gorm:"type:uuid"`
+	CipherMessage       string       `gorm:"type:text"`
+	PlainMessage        *string      `gorm:"type:text"`
+	FilePath            *string      `gorm:"type:text"`
+	AdditionalData      *string      `gorm:"type:text"`
+	IsBinary            bool         `gorm:"default:false"`
+	Padding             uint8        `gorm:"type:smallint;default:0"`
+	IsRead              bool         `gorm:"default:false"`
+	Owner               *User        `gorm:"foreignKey:OwnerId"`
+	Sender              *User        `gorm:"foreignKey:SenderId"`
+	ChatSession         *ChatSession `gorm:"foreignKey:ChatSessionId"`
+	CreatedAt           time.Time    `gorm:"type:time;default:current_timestamp;not null"`
+}
+
+// SealedMessage waits for an offline recipient of sealed sender, nothing
+// about the sender is kept
+type SealedMessage struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
+	OwnerId   uuid.UUID `gorm:"type:uuid;index"`
+	Envelope  string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"type:timestamp;default:current_timestamp;not null"`
+	Owner     *User     `gorm:"foreignKey:OwnerId"`
 }
 
 type UploadedFile struct {
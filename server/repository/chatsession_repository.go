@@ -39,6 +39,17 @@ func (u *ChatSessionRepositoryPostgres) FindAllPending(userId string, target *[]
 	return err
 }
 
+// FindAllOpenByUser finds the sessions not deleted where the user is on either side
+func (u *ChatSessionRepositoryPostgres) FindAllOpenByUser(userId string, target *[]persistence.ChatSession) error {
+	userid := common.GetUUIDFromString(userId)
+	err := u.DbContext.Preload("Sender").Preload("Receiver").
+		Where("sender_id = ? OR receiver_id = ?", &userid, &userid).
+		Where("deleted_at IS NULL").
+		Find(target).
+		Error
+	return err
+}
+
 func (u *ChatSessionRepositoryPostgres) Save(target *persistence.ChatSession) error {
 	return u.DbContext.Transaction(func(context *gorm.DB) error {
 		err := u.DbContext.Save(target).Error
@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"strix-server/common"
+	"strix-server/persistence"
+)
+
+type IdentityKeyHistoryRepository struct {
+	DbContext *gorm.DB
+}
+
+func NewIdentityKeyHistoryRepository(context *gorm.DB) (u *IdentityKeyHistoryRepository) {
+	return &IdentityKeyHistoryRepository{
+		DbContext: context,
+	}
+}
+
+// Append only ever inserts, the history is never updated nor deleted
+func (u *IdentityKeyHistoryRepository) Append(target *persistence.IdentityKeyHistory) error {
+	return u.DbContext.Transaction(func(context *gorm.DB) error {
+		err := context.Create(target).Error
+		return err
+	})
+}
+
+func (u *IdentityKeyHistoryRepository) FindAllByUserId(userId string, target *[]persistence.IdentityKeyHistory) error {
+	userid := common.GetUUIDFromString(userId)
+	err := u.DbContext.Where("user_id = ?", &userid).Order("created_at").Find(target).Error
+	return err
+}
@@ -2,6 +2,8 @@ package repository
 
 import (
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strix-server/common"
 	"strix-server/persistence"
 )
 
@@ -15,9 +17,40 @@ func NewOneTimeKeyRepository(context *gorm.DB) (u *OneTimeKeyRepository) {
 	}
 }
 
-func (u *OneTimeKeyRepository) Save(target *persistence.PreKeys) error {
+func (u *OneTimeKeyRepository) SaveAll(target *[]persistence.OneTimeKey) error {
 	return u.DbContext.Transaction(func(context *gorm.DB) error {
-		err := u.DbContext.Save(target).Error
+		err := context.Create(target).Error
 		return err
 	})
 }
+
+func (u *OneTimeKeyRepository) CountByUserId(userId string, count *int64) error {
+	userid := common.GetUUIDFromString(userId)
+	err := u.DbContext.Model(&persistence.OneTimeKey{}).Where("user_id = ?", &userid).Count(count).Error
+	return err
+}
+
+// DeleteAllByUserId drops every one-time key of the user, they are signed by
+// an identity key the user replaced
+func (u *OneTimeKeyRepository) DeleteAllByUserId(userId string) error {
+	userid := common.GetUUIDFromString(userId)
+	return u.DbContext.Transaction(func(context *gorm.DB) error {
+		return context.Where("user_id = ?", &userid).Delete(&persistence.OneTimeKey{}).Error
+	})
+}
+
+// ConsumeByUserId takes one of the user's one-time keys and deletes it in the
+// same transaction, concurrent callers never get the same key
+func (u *OneTimeKeyRepository) ConsumeByUserId(userId string, target *persistence.OneTimeKey) error {
+	userid := common.GetUUIDFromString(userId)
+	return u.DbContext.Transaction(func(context *gorm.DB) error {
+		err := context.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("user_id = ?", &userid).
+			First(target).
+			Error
+		if err != nil {
+			return err
+		}
+		return context.Delete(target).Error
+	})
+}
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"gorm.io/gorm"
+	"strix-server/persistence"
+	"time"
+)
+
+type PreKeyRepository struct {
+	DbContext *gorm.DB
+}
+
+func NewPreKeyRepository(context *gorm.DB) (u *PreKeyRepository) {
+	return &PreKeyRepository{
+		DbContext: context,
+	}
+}
+
+func (u *PreKeyRepository) Save(target *persistence.PreKeys) error {
+	return u.DbContext.Transaction(func(tx *gorm.DB) error {
+		return tx.Save(target).Error
+	})
+}
+
+// Rotate saves the new signed pre key of a user, the pre keys it replaces stay
+// valid until expiredAt and the ones whose grace period already ended are removed
+func (u *PreKeyRepository) Rotate(target *persistence.PreKeys, expiredAt time.Time) error {
+	return u.DbContext.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&persistence.PreKeys{}).
+			Where("user_id = ? AND id <> ? AND expired_at IS NULL", target.UserId, target.ID).
+			Update("expired_at", expiredAt).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("user_id = ? AND expired_at < ?", target.UserId, time.Now()).
+			Delete(&persistence.PreKeys{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Save(target).Error
+	})
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"strix-server/common"
+	"strix-server/persistence"
+)
+
+type SealedMessageRepository struct {
+	DbContext *gorm.DB
+}
+
+func NewSealedMessageRepository(context *gorm.DB) (u *SealedMessageRepository) {
+	return &SealedMessageRepository{
+		DbContext: context,
+	}
+}
+
+func (u *SealedMessageRepository) Insert(target *persistence.SealedMessage) error {
+	return u.DbContext.Transaction(func(context *gorm.DB) error {
+		err := context.Create(target).Error
+		return err
+	})
+}
+
+func (u *SealedMessageRepository) FindAllByOwnerId(ownerId string, target *[]persistence.SealedMessage) error {
+	ownerid := common.GetUUIDFromString(ownerId)
+	err := u.DbContext.Where("owner_id = ?", &ownerid).Order("created_at").Find(target).Error
+	return err
+}
+
+func (u *SealedMessageRepository) DeleteAll(ids []uuid.UUID) error {
+	return u.DbContext.Transaction(func(context *gorm.DB) error {
+		err := context.Delete(&persistence.SealedMessage{}, ids).Error
+		return err
+	})
+}
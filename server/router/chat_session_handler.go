@@ -41,15 +41,19 @@ func initChatSession(context *gin.Context) {
 	}
 
 	newChatSession := persistence.ChatSession{
-		ID:            common.GetUUIDFromString(chatSessionDto.ChatSessionId),
-		SenderId:      currentUser.ID,
-		ReceiverId:    otherUser.ID,
-		IsInitialized: false,
-		EphemeralKey:  chatSessionDto.EphemeralKey,
-		DeletedAt:     nil,
-		CreatedAt:     time.Now(),
-		Sender:        currentUser,
-		Receiver:      &otherUser,
+		ID:              common.GetUUIDFromString(chatSessionDto.ChatSessionId),
+		SenderId:        currentUser.ID,
+		ReceiverId:      otherUser.ID,
+		IsInitialized:   false,
+		EphemeralKey:    chatSessionDto.EphemeralKey,
+		PreKeyId:        chatSessionDto.PreKeyId,
+		OneTimeKeyId:    chatSessionDto.OneTimeKeyId,
+		PQCipherText:    chatSessionDto.PQCipherText,
+		ProtocolVersion: chatSessionDto.ProtocolVersion,
+		DeletedAt:       nil,
+		CreatedAt:       time.Now(),
+		Sender:          currentUser,
+		Receiver:        &otherUser,
 	}
 
 	err = chatSessionRepository.Save(&newChatSession)
@@ -61,10 +65,7 @@ func initChatSession(context *gin.Context) {
 	otherConn, existed := CURRENT_USER_ACTIVE.Get(otherUser.ID.String())
 	if existed && otherConn != nil {
 		helloMessage := fmt.Sprintf("User %s want to chat with you", currentUser.Username)
-		var lastedOneTimeKey persistence.PreKeys
-		for _, element := range currentUser.PreKeys {
-			lastedOneTimeKey = *element
-		}
+		lastedOneTimeKey := getActivePreKey(currentUser)
 		msg := MessageDto{
 			Type:           CHAT_NEW,
 			SenderUsername: currentUser.Username,
@@ -76,13 +77,19 @@ func initChatSession(context *gin.Context) {
 			AdditionalData: &ChatSessionDto{
 				ChatSessionId:    newChatSession.ID.String(),
 				EphemeralKey:     newChatSession.EphemeralKey,
+				PreKeyId:         newChatSession.PreKeyId,
+				OneTimeKeyId:     newChatSession.OneTimeKeyId,
+				PQCipherText:     newChatSession.PQCipherText,
+				ProtocolVersion:  newChatSession.ProtocolVersion,
 				ReceiverUserName: currentUser.Username,
 				SenderUserName:   otherUser.Username,
 				SenderKeyBundle: ExternalKeyBundleDto{
-					IdentityKey: currentUser.IdentityKey,
-					PreKeyId:    lastedOneTimeKey.ID.String(),
-					PreKey:      lastedOneTimeKey.Key,
-					PreKeySig:   lastedOneTimeKey.KeySignature,
+					Suite:           currentUser.KeySuite,
+					ProtocolVersion: currentUser.ProtocolVersion,
+					IdentityKey:     currentUser.IdentityKey,
+					PreKeyId:        lastedOneTimeKey.ID.String(),
+					PreKey:          lastedOneTimeKey.Key,
+					PreKeySig:       lastedOneTimeKey.KeySignature,
 				},
 			},
 		}
@@ -124,20 +131,23 @@ func retrieveChatSession(context *gin.Context) {
 		currentChatSession := chatSessionList[i]
 		sender := currentChatSession.Sender
 		reciever := currentChatSession.Receiver
-		var lastedOneTimeKey persistence.PreKeys
-		for _, element := range sender.PreKeys {
-			lastedOneTimeKey = *element
-		}
+		lastedOneTimeKey := getActivePreKey(sender)
 		result = append(result, ChatSessionDto{
 			ChatSessionId:    currentChatSession.ID.String(),
 			EphemeralKey:     currentChatSession.EphemeralKey,
+			PreKeyId:         currentChatSession.PreKeyId,
+			OneTimeKeyId:     currentChatSession.OneTimeKeyId,
+			PQCipherText:     currentChatSession.PQCipherText,
+			ProtocolVersion:  currentChatSession.ProtocolVersion,
 			ReceiverUserName: reciever.Username,
 			SenderUserName:   sender.Username,
 			SenderKeyBundle: ExternalKeyBundleDto{
-				IdentityKey: sender.IdentityKey,
-				PreKeyId:    lastedOneTimeKey.ID.String(),
-				PreKey:      lastedOneTimeKey.Key,
-				PreKeySig:   lastedOneTimeKey.KeySignature,
+				Suite:           sender.KeySuite,
+				ProtocolVersion: sender.ProtocolVersion,
+				IdentityKey:     sender.IdentityKey,
+				PreKeyId:        lastedOneTimeKey.ID.String(),
+				PreKey:          lastedOneTimeKey.Key,
+				PreKeySig:       lastedOneTimeKey.KeySignature,
 			},
 		})
 	}
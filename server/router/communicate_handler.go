@@ -8,10 +8,12 @@ import (
 	"github.com/gorilla/websocket"
 	cmap "github.com/orcaman/concurrent-map/v2"
 	"net/http"
+	"strconv"
 	"strix-server/common"
 	"strix-server/persistence"
 	"strix-server/repository"
 	"strix-server/system"
+	"sync"
 	"time"
 )
 
@@ -28,10 +30,26 @@ type VOIPSession struct {
 	RecieverConn *websocket.Conn
 }
 
-var CURRENT_USER_ACTIVE = cmap.New[*websocket.Conn]()
+// UserConn is the chat socket of a user, the read loop of the user is not the
+// only one writing to it so every write goes through the lock
+type UserConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (c *UserConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+var CURRENT_USER_ACTIVE = cmap.New[*UserConn]()
 var SOCKET_SESSION_TOKEN = cmap.New[*SocketSession]()
 var VOIP_SESSION_TOKEN = cmap.New[*VOIPSession]()
 
+// Users whose socket asked for messages as binary frames
+var BINARY_FRAME_USERS = cmap.New[bool]()
+
 var myUpgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
@@ -70,6 +88,123 @@ func cleanUpVoipSocketSession() {
 	}
 }
 
+func notifyStalePreKeys() {
+	for {
+		userRepository := repository.NewUserRepository(persistence.DatabaseContext)
+		for k, conn := range CURRENT_USER_ACTIVE.Items() {
+			if conn == nil {
+				continue
+			}
+			var user persistence.User
+			err := userRepository.FindById(k, &user)
+			if err != nil {
+				system.Logger.Error(err)
+				continue
+			}
+			sendPreKeyStaleNotice(conn, &user)
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+// sendPreKeyStaleNotice asks the client to rotate its signed pre key when the
+// current one is older than the rotation time, users that never uploaded one
+// have nothing to rotate
+func sendPreKeyStaleNotice(conn *UserConn, user *persistence.User) {
+	activePreKey := getActivePreKey(user)
+	if activePreKey.ID == uuid.Nil || !isPreKeyStale(user) {
+		return
+	}
+	msg := MessageDto{
+		Type:           PRE_KEY_STALE,
+		SenderUsername: user.Username,
+		AdditionalData: &PreKeyStaleDto{
+			PreKeyId:          activePreKey.ID.String(),
+			PreKeyGracePeriod: system.SystemConfig.Key.PreKeyGracePeriod,
+		},
+	}
+	binMsg, err := json.Marshal(&msg)
+	if err != nil {
+		system.Logger.Error(err)
+		return
+	}
+	err = conn.WriteMessage(websocket.TextMessage, binMsg)
+	if err != nil {
+		system.Logger.Error(err)
+	}
+}
+
+// notifyIdentityKeyChanged tells everyone with an open chat session with the
+// user about the new identity key, offline peers find it in their pending messages
+func notifyIdentityKeyChanged(user *persistence.User, previousIdentityKey string, changedAt time.Time) {
+	chatSessionRepository := repository.NewChatSessionRepository(persistence.DatabaseContext)
+	pendingMessageRepository := repository.NewPendingMessageRepository(persistence.DatabaseContext)
+	var chatSessions []persistence.ChatSession
+	err := chatSessionRepository.FindAllOpenByUser(user.ID.String(), &chatSessions)
+	if err != nil {
+		system.Logger.Error(err)
+		return
+	}
+	for i := range chatSessions {
+		chatSession := &chatSessions[i]
+		msg := MessageDto{
+			Type:           KEY_CHANGED,
+			SenderUsername: user.Username,
+			ChatSessionId:  chatSession.ID.String(),
+			AdditionalData: &KeyChangedDto{
+				IdentityKey:         user.IdentityKey,
+				PreviousIdentityKey: previousIdentityKey,
+				Suite:               user.KeySuite,
+				ChangedAt:           changedAt,
+			},
+		}
+		sendMessage(&msg, chatSession.SenderId == user.ID, chatSession, pendingMessageRepository)
+	}
+}
+
+// relaySessionReset forwards a SESSION_RESET to the other user of the chat
+// session with the current identity key of the sender, only a user of the
+// session may reset it
+func relaySessionReset(msgDto *MessageDto, currentUser *persistence.User, chatSessionRepository *repository.ChatSessionRepositoryPostgres, pendingMessageRepository *repository.PendingMessageRepositoryPostgres) error {
+	resetJson, err := json.Marshal(msgDto.AdditionalData)
+	if err != nil {
+		return err
+	}
+	var sessionReset SessionResetDto
+	err = json.Unmarshal(resetJson, &sessionReset)
+	if err != nil {
+		return err
+	}
+	if sessionReset.ChatSessionId != msgDto.ChatSessionId || sessionReset.EphemeralKey == "" {
+		return fmt.Errorf("Invalid session reset")
+	}
+
+	var chatSession persistence.ChatSession
+	err = chatSessionRepository.FindById(msgDto.ChatSessionId, &chatSession)
+	if err != nil {
+		return err
+	}
+	fromSender := chatSession.SenderId == currentUser.ID
+	if !fromSender && chatSession.ReceiverId != currentUser.ID {
+		return fmt.Errorf("User %s is not part of chat session %s", currentUser.Username, msgDto.ChatSessionId)
+	}
+	var sender persistence.User
+	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
+	err = userRepository.FindByUserName(currentUser.Username, &sender)
+	if err != nil {
+		return err
+	}
+	sessionReset.SenderKeyBundle = &ExternalKeyBundleDto{
+		Suite:           sender.KeySuite,
+		ProtocolVersion: sender.ProtocolVersion,
+		IdentityKey:     sender.IdentityKey,
+	}
+	msgDto.AdditionalData = &sessionReset
+	msgDto.CipherMessage = ""
+	sendMessage(msgDto, fromSender, &chatSession, pendingMessageRepository)
+	return nil
+}
+
 // Communicate
 func initSocketSession(context *gin.Context) {
 	user := getLoggedInUser(context)
@@ -92,6 +227,26 @@ func initVoipSession(context *gin.Context) {
 		handleError(context, 400, fmt.Errorf("Missing userId"))
 		return
 	}
+	// The callee needs the protocol version the caller derived the call keys
+	// with, older clients do not send it
+	var protocolVersion interface{}
+	if rawVersion := context.Query("protocolVersion"); rawVersion != "" {
+		version, err := strconv.Atoi(rawVersion)
+		if err != nil {
+			handleError(context, 400, fmt.Errorf("Invalid protocolVersion"))
+			return
+		}
+		protocolVersion = version
+	}
+	// and the pre key the call keys were derived with, the callee may have
+	// rotated it since
+	preKeyId := context.Query("preKeyId")
+	if preKeyId != "" {
+		if _, err := uuid.Parse(preKeyId); err != nil {
+			handleError(context, 400, fmt.Errorf("Invalid preKeyId"))
+			return
+		}
+	}
 
 	var recievedUser persistence.User
 	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
@@ -117,7 +272,7 @@ func initVoipSession(context *gin.Context) {
 		RecieverConn: nil,
 	})
 
-	sendCallingMessage(currentUser.Username, recievedUser.ID.String(), randomToken, callType, ephemeralKey)
+	sendCallingMessage(currentUser.Username, recievedUser.ID.String(), randomToken, callType, ephemeralKey, preKeyId, protocolVersion)
 
 	context.JSON(200, gin.H{
 		"voipSession": randomToken,
@@ -212,7 +367,12 @@ func webSocket(context *gin.Context) {
 		return
 	}
 
-	CURRENT_USER_ACTIVE.Set(currentUser.ID.String(), conn)
+	userConn := &UserConn{conn: conn}
+	CURRENT_USER_ACTIVE.Set(currentUser.ID.String(), userConn)
+	if system.SystemConfig.WebSocket.BinaryFrames && context.Query("binaryFrames") == "true" {
+		BINARY_FRAME_USERS.Set(currentUser.ID.String(), true)
+	}
+	sendPreKeyStaleNotice(userConn, currentUser)
 
 	chatSessionRepository := repository.NewChatSessionRepository(persistence.DatabaseContext)
 	pendingMessageRepository := repository.NewPendingMessageRepository(persistence.DatabaseContext)
@@ -221,6 +381,7 @@ func webSocket(context *gin.Context) {
 
 	defer func(conn *websocket.Conn) {
 		CURRENT_USER_ACTIVE.Set(currentUser.ID.String(), nil)
+		BINARY_FRAME_USERS.Remove(currentUser.ID.String())
 		err := conn.Close()
 		if err != nil {
 			system.Logger.Error("What the fuck can i do ", err)
@@ -235,25 +396,39 @@ func webSocket(context *gin.Context) {
 			continue
 		}
 		var msgDto MessageDto
-		err = json.Unmarshal(msgData, &msgDto)
-		if err != nil {
-			// TODO handle error here
-			fmt.Println(err.Error())
-			system.Logger.Error(err)
-			continue
+		if mt == websocket.BinaryMessage {
+			if !system.SystemConfig.WebSocket.BinaryFrames {
+				system.Logger.Error("Binary frames are disabled")
+				continue
+			}
+			frameDto, err := decodeBinaryFrame(msgData)
+			if err != nil {
+				system.Logger.Error(err)
+				continue
+			}
+			msgDto = *frameDto
+		} else {
+			err = json.Unmarshal(msgData, &msgDto)
+			if err != nil {
+				// TODO handle error here
+				fmt.Println(err.Error())
+				system.Logger.Error(err)
+				continue
+			}
 		}
 
 		msgDto.SenderUsername = currentUser.Username
 
-		targetChatSession := cachedConversation[msgDto.ChatSessionId]
-
-		msgData, err = json.Marshal(&msgDto)
-		if err != nil {
-			// TODO handle error here
-			system.Logger.Error(err)
+		if msgDto.Type == SESSION_RESET {
+			err := relaySessionReset(&msgDto, currentUser, chatSessionRepository, pendingMessageRepository)
+			if err != nil {
+				system.Logger.Error(err)
+			}
 			continue
 		}
 
+		targetChatSession := cachedConversation[msgDto.ChatSessionId]
+
 		if msgDto.Type == CHAT_ACCEPT || msgDto.Type == CHAT_CLOSE {
 			var recievedUser persistence.User
 			userRepository := repository.NewUserRepository(persistence.DatabaseContext)
@@ -262,8 +437,11 @@ func webSocket(context *gin.Context) {
 				system.Logger.Errorf(err.Error())
 				continue
 			}
-			otherConn, _ := CURRENT_USER_ACTIVE.Get(recievedUser.ID.String())
-			err = otherConn.WriteMessage(mt, msgData)
+			otherConn, existed := CURRENT_USER_ACTIVE.Get(recievedUser.ID.String())
+			if !existed || otherConn == nil {
+				continue
+			}
+			err = writeMessageFrame(otherConn, recievedUser.ID.String(), &msgDto)
 			if err != nil {
 				system.Logger.Errorf(err.Error())
 				continue
@@ -273,7 +451,7 @@ func webSocket(context *gin.Context) {
 
 		if targetChatSession != nil {
 			fromSender := targetChatSession.SenderId.String() == currentUser.ID.String()
-			result := sendMessage(mt, &msgDto, fromSender, targetChatSession, pendingMessageRepository)
+			result := sendMessage(&msgDto, fromSender, targetChatSession, pendingMessageRepository)
 			if result == 0 {
 
 			} else if result == 2 {
@@ -289,7 +467,7 @@ func webSocket(context *gin.Context) {
 			}
 			fromSender := chatSessionInDb.SenderId.String() == currentUser.ID.String()
 			cachedConversation[msgDto.ChatSessionId] = &chatSessionInDb
-			result := sendMessage(mt, &msgDto, fromSender, &chatSessionInDb, pendingMessageRepository)
+			result := sendMessage(&msgDto, fromSender, &chatSessionInDb, pendingMessageRepository)
 			if result == 0 {
 				// TODO Handle error
 				continue
@@ -301,7 +479,7 @@ func webSocket(context *gin.Context) {
 	}
 }
 
-func sendMessage(mt int, msgDto *MessageDto, fromSender bool, chatSession *persistence.ChatSession, pendingMessageRepository *repository.PendingMessageRepositoryPostgres) int {
+func sendMessage(msgDto *MessageDto, fromSender bool, chatSession *persistence.ChatSession, pendingMessageRepository *repository.PendingMessageRepositoryPostgres) int {
 	var targetUser *persistence.User
 	if fromSender {
 		targetUser = chatSession.Receiver
@@ -309,10 +487,9 @@ func sendMessage(mt int, msgDto *MessageDto, fromSender bool, chatSession *persi
 		targetUser = chatSession.Sender
 	}
 	otherConn, existed := CURRENT_USER_ACTIVE.Get(targetUser.ID.String())
-	msgData, _ := json.Marshal(msgDto)
 	if existed && otherConn != nil {
 		// if user is online
-		err := otherConn.WriteMessage(mt, msgData)
+		err := writeMessageFrame(otherConn, targetUser.ID.String(), msgDto)
 		if err != nil {
 			system.Logger.Error(err)
 			err := savePendingMessage(msgDto, fromSender, chatSession, pendingMessageRepository)
@@ -333,6 +510,23 @@ func sendMessage(mt int, msgDto *MessageDto, fromSender bool, chatSession *persi
 	}
 }
 
+// writeMessageFrame sends the message as a binary frame when the user asked for
+// them and the message carries cipher text, as json otherwise
+func writeMessageFrame(conn *UserConn, userId string, msgDto *MessageDto) error {
+	if BINARY_FRAME_USERS.Has(userId) && msgDto.CipherMessage != "" {
+		frame, err := encodeBinaryFrame(msgDto)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.BinaryMessage, frame)
+	}
+	msgData, err := json.Marshal(msgDto)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.TextMessage, msgData)
+}
+
 func savePendingMessage(msg *MessageDto, fromSender bool, chatSession *persistence.ChatSession, pendingMessageRepository *repository.PendingMessageRepositoryPostgres) error {
 	pendingId, _ := uuid.NewUUID()
 	var owner *persistence.User
@@ -345,23 +539,38 @@ func savePendingMessage(msg *MessageDto, fromSender bool, chatSession *persisten
 		sender = chatSession.Receiver
 	}
 
+	var additionalData *string
+	if msg.AdditionalData != nil {
+		additionalJson, err := json.Marshal(msg.AdditionalData)
+		if err != nil {
+			return err
+		}
+		additionalString := string(additionalJson)
+		additionalData = &additionalString
+	}
+
 	pendingMessage := persistence.PendingMessage{
-		ID:             pendingId,
-		Type:           msg.Type,
-		Index:          msg.Index,
-		OwnerId:        owner.ID,
-		SenderId:       sender.ID,
-		SenderUsername: msg.SenderUsername,
-		ChatSessionId:  chatSession.ID,
-		CipherMessage:  msg.CipherMessage,
-		PlainMessage:   msg.PlainMessage,
-		FilePath:       msg.FilePath,
-		IsBinary:       msg.IsBinary,
-		IsRead:         false,
-		Owner:          owner,
-		Sender:         sender,
-		ChatSession:    chatSession,
-		CreatedAt:      time.Now(),
+		ID:                  pendingId,
+		Type:                msg.Type,
+		Index:               msg.Index,
+		ChainIndex:          msg.ChainIndex,
+		PreviousChainLength: msg.PreviousChainLength,
+		RatchetKey:          msg.RatchetKey,
+		OwnerId:             owner.ID,
+		SenderId:            sender.ID,
+		SenderUsername:      msg.SenderUsername,
+		ChatSessionId:       chatSession.ID,
+		CipherMessage:       msg.CipherMessage,
+		PlainMessage:        msg.PlainMessage,
+		FilePath:            msg.FilePath,
+		AdditionalData:      additionalData,
+		IsBinary:            msg.IsBinary,
+		Padding:             msg.Padding,
+		IsRead:              false,
+		Owner:               owner,
+		Sender:              sender,
+		ChatSession:         chatSession,
+		CreatedAt:           time.Now(),
 	}
 	err := pendingMessageRepository.Insert(&pendingMessage)
 	if err != nil {
@@ -371,12 +580,14 @@ func savePendingMessage(msg *MessageDto, fromSender bool, chatSession *persisten
 	return nil
 }
 
-func sendCallingMessage(senderUsername, recvUsername string, voipToken, callType, ephemeralKey string) {
+func sendCallingMessage(senderUsername, recvUsername string, voipToken, callType, ephemeralKey, preKeyId string, protocolVersion interface{}) {
 	msgDto := MessageDto{
 		Type:           callType,
 		PlainMessage:   &ephemeralKey,
 		CipherMessage:  voipToken,
 		SenderUsername: senderUsername,
+		AdditionalData: protocolVersion,
+		PreKeyId:       preKeyId,
 	}
 	msgBin, err := json.Marshal(&msgDto)
 	if err != nil {
@@ -1,5 +1,7 @@
 package router
 
+import "time"
+
 type RegisterDto struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
@@ -22,10 +24,78 @@ type LoginResponseDto struct {
 }
 
 type ExternalKeyBundleDto struct {
-	IdentityKey string `json:"identityKey,omitempty"`
-	PreKeyId    string `json:"preKeyId,omitempty"`
-	PreKey      string `json:"preKey,omitempty"`
-	PreKeySig   string `json:"preKeySig,omitempty"`
+	Suite           string `json:"suite,omitempty"`
+	ProtocolVersion int    `json:"protocolVersion,omitempty"`
+	IdentityKey     string `json:"identityKey,omitempty"`
+	PreKeyId        string `json:"preKeyId,omitempty"`
+	PreKey          string `json:"preKey,omitempty"`
+	PreKeySig       string `json:"preKeySig,omitempty"`
+	PQPreKey        string `json:"pqPreKey,omitempty"`
+	PQPreKeySig     string `json:"pqPreKeySig,omitempty"`
+	OneTimeKeyId    string `json:"oneTimeKeyId,omitempty"`
+	OneTimeKey      string `json:"oneTimeKey,omitempty"`
+	OneTimeKeySig   string `json:"oneTimeKeySig,omitempty"`
+}
+
+type OneTimeKeyDto struct {
+	KeyId  string `json:"keyId"`
+	Key    string `json:"key"`
+	KeySig string `json:"keySig"`
+}
+
+type OneTimeKeyBatchDto struct {
+	OneTimeKeys []OneTimeKeyDto `json:"oneTimeKeys"`
+}
+
+type PreKeyStaleDto struct {
+	PreKeyId          string `json:"preKeyId"`
+	PreKeyGracePeriod uint64 `json:"preKeyGracePeriod"`
+}
+
+// IdentityKeyHistoryDto is one identity key a user has published, oldest first
+type IdentityKeyHistoryDto struct {
+	IdentityKey string    `json:"identityKey"`
+	Suite       string    `json:"suite,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// KeyChangedDto tells a peer that the user published another identity key
+type KeyChangedDto struct {
+	IdentityKey         string    `json:"identityKey"`
+	PreviousIdentityKey string    `json:"previousIdentityKey"`
+	Suite               string    `json:"suite,omitempty"`
+	ChangedAt           time.Time `json:"changedAt"`
+}
+
+// SessionResetDto replaces a ratchet the sender cannot decrypt with anymore,
+// the server attaches the identity key of the sender for the other side to check
+type SessionResetDto struct {
+	ChatSessionId   string                `json:"chatSessionId"`
+	EphemeralKey    string                `json:"ephemeralKey"`
+	PreKeyId        string                `json:"preKeyId,omitempty"`
+	OneTimeKeyId    string                `json:"oneTimeKeyId,omitempty"`
+	PQCipherText    string                `json:"pqCipherText,omitempty"`
+	ProtocolVersion int                   `json:"protocolVersion"`
+	ReceivedIndex   uint64                `json:"receivedIndex"`
+	FailedIndexes   []uint64              `json:"failedIndexes,omitempty"`
+	SenderKeyBundle *ExternalKeyBundleDto `json:"senderKeyBundle,omitempty"`
+}
+
+type SenderCertificateDto struct {
+	Certificate string `json:"certificate"`
+	ExpiresAt   int64  `json:"expiresAt"`
+	ServerKey   string `json:"serverKey"`
+}
+
+type DeliveryTokenDto struct {
+	DeliveryToken string `json:"deliveryToken"`
+}
+
+// SealedMessageDto is posted with the delivery token of the receiver, the
+// envelope is built by the core library
+type SealedMessageDto struct {
+	ReceiverUserName string `json:"receiverUserName"`
+	Envelope         string `json:"envelope"`
 }
 
 type UserDto struct {
@@ -48,23 +118,41 @@ const (
 	CHAT_AUDIO  = "CHAT_AUDIO"
 	CHAT_ACCEPT = "CHAT_ACCEPT"
 	CHAT_CLOSE  = "CHAT_CLOSE"
+
+	PRE_KEY_STALE = "PRE_KEY_STALE"
+	KEY_CHANGED   = "KEY_CHANGED"
+
+	SESSION_RESET     = "SESSION_RESET"
+	SESSION_RESET_ACK = "SESSION_RESET_ACK"
+
+	SEALED_MESSAGE = "SEALED_MESSAGE"
 )
 
 type MessageDto struct {
-	Type           string      `json:"type"`
-	SenderUsername string      `json:"senderUsername"`
-	PlainMessage   *string     `json:"plainMessage"`
-	ChatSessionId  string      `json:"chatSessionId"`
-	Index          uint64      `json:"index"`
-	CipherMessage  string      `json:"cipherMessage"`
-	FilePath       *string     `json:"filePath"`
-	IsBinary       bool        `json:"isBinary"`
-	AdditionalData interface{} `json:"additionalData"`
+	Type                string      `json:"type"`
+	SenderUsername      string      `json:"senderUsername"`
+	PlainMessage        *string     `json:"plainMessage"`
+	ChatSessionId       string      `json:"chatSessionId"`
+	Index               uint64      `json:"index"`
+	ChainIndex          uint64      `json:"chainIndex"`
+	PreviousChainLength uint64      `json:"previousChainLength"`
+	RatchetKey          string      `json:"ratchetKey"`
+	CipherMessage       string      `json:"cipherMessage"`
+	FilePath            *string     `json:"filePath"`
+	IsBinary            bool        `json:"isBinary"`
+	Padding             uint8       `json:"padding,omitempty"`
+	AdditionalData      interface{} `json:"additionalData"`
+	// The pre key of the callee a call was set up with
+	PreKeyId string `json:"preKeyId,omitempty"`
 }
 
 type ChatSessionDto struct {
 	ChatSessionId    string               `json:"chatSessionId"`
 	EphemeralKey     string               `json:"ephemeralKey"`
+	PreKeyId         string               `json:"preKeyId,omitempty"`
+	OneTimeKeyId     string               `json:"oneTimeKeyId,omitempty"`
+	PQCipherText     string               `json:"pqCipherText,omitempty"`
+	ProtocolVersion  int                  `json:"protocolVersion,omitempty"`
 	ReceiverUserName string               `json:"receiverUserName"`
 	SenderUserName   string               `json:"senderUserName"`
 	SenderKeyBundle  ExternalKeyBundleDto `json:"senderKeyBundle"`
@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
+	"io"
 	"mime/multipart"
 	"strconv"
 	"strings"
@@ -14,7 +15,13 @@ import (
 	"time"
 )
 
+// OPAQUE_CONTENT_TYPE is what attachment blobs are stored as, the server
+// cannot tell what is inside
+const OPAQUE_CONTENT_TYPE = "application/octet-stream"
+
 // File
+// uploadFile stores an attachment blob the client encrypted, its name and
+// content type only travel in the descriptor the receiver gets
 func uploadFile(c *gin.Context) {
 	currentUser := getLoggedInUser(c)
 	file, err := c.FormFile("upload")
@@ -34,14 +41,6 @@ func uploadFile(c *gin.Context) {
 		}
 	}(fileBuffer)
 	fileSize := file.Size
-	var fileType string
-	if c.PostForm("fileType") != "" {
-		fileType = c.GetHeader("fileType")
-	}
-	fileNameAndExtension := strings.Split(file.Filename, ".")
-	if len(fileNameAndExtension) > 1 {
-		fileType = fileNameAndExtension[1]
-	}
 	newId, err := uuid.NewUUID()
 	if err != nil {
 		handleError(c, 500, err)
@@ -49,7 +48,7 @@ func uploadFile(c *gin.Context) {
 	}
 	bucketName := system.SystemConfig.Binary.Bucket
 	ctx := context.Background()
-	_, err = persistence.MinioClient.PutObject(ctx, bucketName, newId.String(), fileBuffer, fileSize, minio.PutObjectOptions{ContentType: fileType})
+	_, err = persistence.MinioClient.PutObject(ctx, bucketName, newId.String(), fileBuffer, fileSize, minio.PutObjectOptions{ContentType: OPAQUE_CONTENT_TYPE})
 	if err != nil {
 		handleError(c, 500, err)
 		return
@@ -57,7 +56,6 @@ func uploadFile(c *gin.Context) {
 	fileRepo := repository.NewFileRepository(persistence.DatabaseContext)
 	fileInfo := persistence.UploadedFile{
 		ID:        newId,
-		Type:      fileType,
 		Size:      uint64(fileSize),
 		CreatedAt: time.Now(),
 		OwnerId:   currentUser.ID,
@@ -157,17 +155,21 @@ func getFile(c *gin.Context) {
 			return
 		}
 	}
+	// a single Read may stop short, the client checks the digest of the
+	// whole blob
 	fileData := make([]byte, storedFile.Size)
-	_, err = object.Read(fileData)
+	_, err = io.ReadFull(object, fileData)
 	if err != nil {
-		if err.Error() != "EOF" {
-			handleError(c, 500, err)
-			return
-		}
+		handleError(c, 500, err)
+		return
+	}
+	fileName := fileId
+	if storedFile.Type != "" {
+		fileName += "." + storedFile.Type
 	}
 	c.Header("Content-Description", "File Transfer")
 	c.Header("Content-Transfer-Encoding", "binary")
-	c.Header("Content-Disposition", "attachment; filename="+fileId+"."+storedFile.Type)
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
 	c.Header("Content-Length", strconv.FormatUint(storedFile.Size, 10))
 	c.Data(200, "application/octet-stream", fileData)
 }
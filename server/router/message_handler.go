@@ -1,6 +1,7 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -26,15 +27,24 @@ func retrievePendingMessage(context *gin.Context) {
 	var deletedIds []uuid.UUID
 	for i := range pendingMessages {
 		currentMsg := pendingMessages[i]
+		var additionalData interface{}
+		if currentMsg.AdditionalData != nil {
+			additionalData = json.RawMessage(*currentMsg.AdditionalData)
+		}
 		result = append(result, MessageDto{
-			Type:           currentMsg.Type,
-			SenderUsername: currentMsg.SenderUsername,
-			PlainMessage:   currentMsg.PlainMessage,
-			ChatSessionId:  currentMsg.ChatSessionId.String(),
-			FilePath:       currentMsg.FilePath,
-			Index:          currentMsg.Index,
-			CipherMessage:  currentMsg.CipherMessage,
-			IsBinary:       currentMsg.IsBinary,
+			Type:                currentMsg.Type,
+			SenderUsername:      currentMsg.SenderUsername,
+			PlainMessage:        currentMsg.PlainMessage,
+			ChatSessionId:       currentMsg.ChatSessionId.String(),
+			FilePath:            currentMsg.FilePath,
+			Index:               currentMsg.Index,
+			ChainIndex:          currentMsg.ChainIndex,
+			PreviousChainLength: currentMsg.PreviousChainLength,
+			RatchetKey:          currentMsg.RatchetKey,
+			CipherMessage:       currentMsg.CipherMessage,
+			IsBinary:            currentMsg.IsBinary,
+			Padding:             currentMsg.Padding,
+			AdditionalData:      additionalData,
 		})
 		currentMsg.IsRead = true
 		deletedIds = append(deletedIds, currentMsg.ID)
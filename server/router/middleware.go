@@ -66,7 +66,7 @@ func errorHandlerMiddleWare(context *gin.Context) {
 
 func authenticationMiddleWare(context *gin.Context) {
 	path := context.Request.URL.Path
-	if path == "/api/v1/auth/register" || path == "/api/v1/auth/login" || path == "/ws" || path == "/voip" || path == "/api/v1/file/get" {
+	if path == "/api/v1/auth/register" || path == "/api/v1/auth/login" || path == "/ws" || path == "/voip" || path == "/api/v1/file/get" || path == SEALED_MESSAGE_PATH {
 		context.Next()
 		return
 	}
@@ -18,12 +18,17 @@ const REQUEST_ID = "X-Request-ID"
 const BCRYPT_COST = 12
 const USER = "user"
 
+// Key uploads whose signature does not verify against the identity key
+const INVALID_KEY_SIGNATURE = 422
+
 var router *gin.Engine
 
 var upgrader = websocket.Upgrader{}
 
 func Init() {
 	go cleanUpChatSocketSession()
+	go notifyStalePreKeys()
+	initSenderCertificateKey()
 	router = gin.New()
 	// Middleware
 	router.Use(
@@ -40,7 +45,7 @@ func Init() {
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     system.SystemConfig.Server.AllowOrigins,
 		AllowMethods:     system.SystemConfig.Server.AllowMethods,
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", "authorization", DELIVERY_TOKEN},
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -67,6 +72,9 @@ func Init() {
 	userGroup := router.Group("/api/v1/user")
 	userGroup.POST("/uploadKey", uploadKey)
 	userGroup.GET("/:userName/externalKey", getExternalKeyBundle)
+	userGroup.GET("/:userName/keyHistory", getIdentityKeyHistory)
+	userGroup.POST("/oneTimeKeys", uploadOneTimeKeys)
+	userGroup.GET("/oneTimeKeys/count", countOneTimeKeys)
 	userGroup.GET("", getUserInfo)
 	userGroup.GET("/search", searchUser)
 	userGroup.POST("/userInfos", getUserInfos)
@@ -80,6 +88,13 @@ func Init() {
 	// Message
 	messageGroup := router.Group("/api/v1/message")
 	messageGroup.GET("", retrievePendingMessage)
+	messageGroup.GET("/sealed", retrieveSealedMessages)
+
+	// Sealed sender
+	sealedSenderGroup := router.Group("/api/v1/sealedSender")
+	sealedSenderGroup.GET("/certificate", getSenderCertificate)
+	sealedSenderGroup.PUT("/deliveryToken", registerDeliveryToken)
+	sealedSenderGroup.POST("/message", sendSealedMessage)
 
 	// File
 	fileGroup := router.Group("/api/v1/file")
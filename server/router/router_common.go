@@ -1,9 +1,11 @@
 package router
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"strix-server/common"
+	"strix-server/crypto"
 	"strix-server/persistence"
 	"strix-server/system"
 	"time"
@@ -40,3 +42,56 @@ func getLoggedInUser(context *gin.Context) *persistence.User {
 	}
 	return u.(*persistence.User)
 }
+
+// getActivePreKey returns the signed pre key handed out to new handshakes, pre
+// keys that were replaced and are only kept for their grace period are skipped
+func getActivePreKey(user *persistence.User) persistence.PreKeys {
+	var activePreKey persistence.PreKeys
+	for _, element := range user.PreKeys {
+		if element.ExpiredAt == nil {
+			activePreKey = *element
+		}
+	}
+	return activePreKey
+}
+
+func isPreKeyStale(user *persistence.User) bool {
+	if user.PreKeyCreatedTime == nil {
+		return true
+	}
+	rotationTime := time.Duration(system.SystemConfig.Key.PreKeyRotationTime) * time.Millisecond
+	return time.Since(*user.PreKeyCreatedTime) > rotationTime
+}
+
+// verifyOneTimeKeySignature checks a one-time key uploaded by a client, all
+// three values are base64 as sent in the key bundle
+func verifyOneTimeKeySignature(identityKey, key, keySig string, protocolVersion int) error {
+	keyBytes := common.DecodeToByte(key)
+	sigBytes := common.DecodeToByte(keySig)
+	if len(keyBytes) == 0 || len(sigBytes) == 0 {
+		return fmt.Errorf("Missing key signature")
+	}
+	return crypto.VerifySignature(common.DecodeToByte(identityKey), crypto.OneTimeKeySignedPayload(keyBytes, protocolVersion), sigBytes)
+}
+
+// verifyPreKeySignature checks the signature of a pre key, it covers the
+// protocol version the bundle advertises
+func verifyPreKeySignature(identityKey, key, keySig string, protocolVersion int) error {
+	keyBytes := common.DecodeToByte(key)
+	sigBytes := common.DecodeToByte(keySig)
+	if len(keyBytes) == 0 || len(sigBytes) == 0 {
+		return fmt.Errorf("Missing key signature")
+	}
+	return crypto.VerifySignature(common.DecodeToByte(identityKey), crypto.PreKeySignedPayload(keyBytes, protocolVersion), sigBytes)
+}
+
+// verifyPQKeySignature checks the signature over the digest of a post-quantum
+// pre key, the way the core library signs it
+func verifyPQKeySignature(identityKey, key, keySig string) error {
+	keyBytes := common.DecodeToByte(key)
+	sigBytes := common.DecodeToByte(keySig)
+	if len(keyBytes) == 0 || len(sigBytes) == 0 {
+		return fmt.Errorf("Missing key signature")
+	}
+	return crypto.VerifySignature(common.DecodeToByte(identityKey), crypto.PQPreKeyDigest(keyBytes), sigBytes)
+}
@@ -0,0 +1,183 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"strix-server/common"
+	"strix-server/crypto"
+	"strix-server/persistence"
+	"strix-server/repository"
+	"strix-server/system"
+	"time"
+)
+
+// Sealed sender messages are posted with the delivery token of the recipient
+// instead of a JWT, the server only learns who a message is for
+const DELIVERY_TOKEN = "X-Delivery-Token"
+const SEALED_MESSAGE_PATH = "/api/v1/sealedSender/message"
+
+var senderCertificateKey ed25519.PrivateKey
+
+// initSenderCertificateKey reads the certificate signing key, without one a
+// key is generated and certificates do not survive a restart
+func initSenderCertificateKey() {
+	seed := common.DecodeToByte(system.SystemConfig.SealedSender.SigningKey)
+	if len(seed) == ed25519.SeedSize {
+		senderCertificateKey = ed25519.NewKeyFromSeed(seed)
+		return
+	}
+	if system.SystemConfig.SealedSender.Enabled {
+		system.Logger.Warn("No sealed sender signing key configured, using a random one")
+	}
+	_, senderCertificateKey, _ = ed25519.GenerateKey(rand.Reader)
+}
+
+func getSenderCertificate(context *gin.Context) {
+	if !system.SystemConfig.SealedSender.Enabled {
+		handleError(context, 404, fmt.Errorf("Sealed sender disabled"))
+		return
+	}
+	user := getLoggedInUser(context)
+	if user.IdentityKey == "" {
+		handleError(context, 400, fmt.Errorf("Missing identity key"))
+		return
+	}
+	expiresAt := time.Now().Add(time.Duration(system.SystemConfig.SealedSender.CertificateTTL) * time.Millisecond)
+	certificate, err := crypto.NewSenderCertificate(senderCertificateKey, user.Username, common.DecodeToByte(user.IdentityKey), expiresAt)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	context.JSON(200, SenderCertificateDto{
+		Certificate: common.EncodeToString(certificate),
+		ExpiresAt:   expiresAt.UnixMilli(),
+		ServerKey:   common.EncodeToString(crypto.SerializeSigningKey(senderCertificateKey.Public().(ed25519.PublicKey))),
+	})
+}
+
+// registerDeliveryToken replaces the token others need to send sealed messages
+// to the user, only its hash is kept
+func registerDeliveryToken(context *gin.Context) {
+	var deliveryTokenDto DeliveryTokenDto
+	err := context.BindJSON(&deliveryTokenDto)
+	if err != nil {
+		handleError(context, 400, fmt.Errorf(err.Error()))
+		return
+	}
+	token := common.DecodeToByte(deliveryTokenDto.DeliveryToken)
+	if len(token) < 16 {
+		handleError(context, 400, fmt.Errorf("Invalid delivery token"))
+		return
+	}
+	user := getLoggedInUser(context)
+	user.DeliveryTokenHash = hashDeliveryToken(token)
+	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
+	err = userRepository.Save(user)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	context.JSON(200, gin.H{
+		"message": "Delivery token registered",
+	})
+}
+
+func sendSealedMessage(context *gin.Context) {
+	if !system.SystemConfig.SealedSender.Enabled {
+		handleError(context, 404, fmt.Errorf("Sealed sender disabled"))
+		return
+	}
+	var sealedMessageDto SealedMessageDto
+	err := context.BindJSON(&sealedMessageDto)
+	if err != nil {
+		handleError(context, 400, fmt.Errorf(err.Error()))
+		return
+	}
+	if len(common.DecodeToByte(sealedMessageDto.Envelope)) == 0 {
+		handleError(context, 400, fmt.Errorf("Missing envelope"))
+		return
+	}
+	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
+	var receiver persistence.User
+	err = userRepository.FindByUserName(sealedMessageDto.ReceiverUserName, &receiver)
+	// Unknown users and wrong tokens look the same to the caller
+	token := common.DecodeToByte(context.GetHeader(DELIVERY_TOKEN))
+	if err != nil || receiver.DeliveryTokenHash == "" || len(token) == 0 ||
+		subtle.ConstantTimeCompare([]byte(hashDeliveryToken(token)), []byte(receiver.DeliveryTokenHash)) != 1 {
+		handleError(context, 401, fmt.Errorf("Unauthorized"))
+		return
+	}
+
+	msg := MessageDto{
+		Type:          SEALED_MESSAGE,
+		CipherMessage: sealedMessageDto.Envelope,
+	}
+	delivered := false
+	conn, existed := CURRENT_USER_ACTIVE.Get(receiver.ID.String())
+	if existed && conn != nil {
+		msgData, err := json.Marshal(&msg)
+		if err == nil {
+			err = conn.WriteMessage(websocket.TextMessage, msgData)
+		}
+		if err != nil {
+			system.Logger.Error(err)
+		} else {
+			delivered = true
+		}
+	}
+	if !delivered {
+		sealedMessageRepository := repository.NewSealedMessageRepository(persistence.DatabaseContext)
+		err = sealedMessageRepository.Insert(&persistence.SealedMessage{
+			OwnerId:   receiver.ID,
+			Envelope:  sealedMessageDto.Envelope,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			handleError(context, 500, fmt.Errorf(err.Error()))
+			return
+		}
+	}
+	context.JSON(200, gin.H{
+		"message": "ok",
+	})
+}
+
+func retrieveSealedMessages(context *gin.Context) {
+	currentUser := getLoggedInUser(context)
+	sealedMessageRepository := repository.NewSealedMessageRepository(persistence.DatabaseContext)
+	var sealedMessages []persistence.SealedMessage
+	err := sealedMessageRepository.FindAllByOwnerId(currentUser.ID.String(), &sealedMessages)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	result := make([]MessageDto, 0, len(sealedMessages))
+	var deletedIds []uuid.UUID
+	for i := range sealedMessages {
+		result = append(result, MessageDto{
+			Type:          SEALED_MESSAGE,
+			CipherMessage: sealedMessages[i].Envelope,
+		})
+		deletedIds = append(deletedIds, sealedMessages[i].ID)
+	}
+	if len(deletedIds) != 0 {
+		err = sealedMessageRepository.DeleteAll(deletedIds)
+		if err != nil {
+			handleError(context, 500, fmt.Errorf(err.Error()))
+			return
+		}
+	}
+	context.JSON(200, result)
+}
+
+func hashDeliveryToken(token []byte) string {
+	hash := sha256.Sum256(token)
+	return common.EncodeToString(hash[:])
+}
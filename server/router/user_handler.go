@@ -1,11 +1,15 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"strix-server/common"
 	"strix-server/persistence"
 	"strix-server/repository"
+	"strix-server/system"
 	"time"
 )
 
@@ -15,32 +19,105 @@ func uploadKey(context *gin.Context) {
 	err := context.BindJSON(&externalKeyBundle)
 	if err != nil {
 		handleError(context, 400, fmt.Errorf(err.Error()))
+		return
 	}
 	user := getLoggedInUser(context)
-	user.IdentityKey = externalKeyBundle.IdentityKey
-
-	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
-	err = userRepository.Save(user)
-	if err != nil {
-		handleError(context, 500, fmt.Errorf(err.Error()))
+	identityKey := externalKeyBundle.IdentityKey
+	if identityKey == "" {
+		identityKey = user.IdentityKey
+	}
+	if externalKeyBundle.PreKeyId != "" {
+		err = verifyPreKeySignature(identityKey, externalKeyBundle.PreKey, externalKeyBundle.PreKeySig, externalKeyBundle.ProtocolVersion)
+		if err != nil {
+			handleError(context, INVALID_KEY_SIGNATURE, fmt.Errorf("Invalid pre key signature: %s", err.Error()))
+			return
+		}
+		if externalKeyBundle.PQPreKey != "" {
+			err = verifyPQKeySignature(identityKey, externalKeyBundle.PQPreKey, externalKeyBundle.PQPreKeySig)
+			if err != nil {
+				handleError(context, INVALID_KEY_SIGNATURE, fmt.Errorf("Invalid post-quantum pre key signature: %s", err.Error()))
+				return
+			}
+		}
+	}
+	previousIdentityKey := user.IdentityKey
+	identityChanged := externalKeyBundle.IdentityKey != "" && externalKeyBundle.IdentityKey != previousIdentityKey
+	// The pre keys and one-time keys on file are signed by the old identity
+	// key, a new one has to come with a pre key of its own
+	if identityChanged && previousIdentityKey != "" && externalKeyBundle.PreKeyId == "" {
+		handleError(context, 400, fmt.Errorf("Identity key change without a new pre key"))
 		return
 	}
-
+	// A pre key upload without an identity key keeps the stored identity
+	if externalKeyBundle.IdentityKey != "" {
+		user.IdentityKey = externalKeyBundle.IdentityKey
+		user.KeySuite = externalKeyBundle.Suite
+	}
+	currentTime := time.Now()
 	if externalKeyBundle.PreKeyId != "" {
-		userOneTimeKey := persistence.PreKeys{
+		user.PreKeyCreatedTime = &currentTime
+		// The version is signed along with the pre key, bundles without
+		// one are v1
+		user.ProtocolVersion = externalKeyBundle.ProtocolVersion
+		if user.ProtocolVersion == 0 {
+			user.ProtocolVersion = 1
+		}
+	}
+
+	// The user, its identity key history and its pre keys change together or
+	// not at all
+	err = persistence.DatabaseContext.Transaction(func(tx *gorm.DB) error {
+		userRepository := repository.NewUserRepository(tx)
+		if err := userRepository.Save(user); err != nil {
+			return err
+		}
+		if identityChanged {
+			historyRepo := repository.NewIdentityKeyHistoryRepository(tx)
+			err := historyRepo.Append(&persistence.IdentityKeyHistory{
+				UserId:      user.ID,
+				IdentityKey: externalKeyBundle.IdentityKey,
+				KeySuite:    externalKeyBundle.Suite,
+				CreatedAt:   currentTime,
+			})
+			if err != nil {
+				return err
+			}
+			oneTimeKeyRepo := repository.NewOneTimeKeyRepository(tx)
+			if err := oneTimeKeyRepo.DeleteAllByUserId(user.ID.String()); err != nil {
+				return err
+			}
+		}
+		if externalKeyBundle.PreKeyId == "" {
+			return nil
+		}
+		userPreKey := persistence.PreKeys{
 			ID:           common.GetUUIDFromString(externalKeyBundle.PreKeyId),
 			UserId:       user.ID,
 			Key:          externalKeyBundle.PreKey,
 			KeySignature: externalKeyBundle.PreKeySig,
-			CreatedAt:    time.Now(),
+			PQKey:        externalKeyBundle.PQPreKey,
+			PQKeySig:     externalKeyBundle.PQPreKeySig,
+			CreatedAt:    currentTime,
 			Owner:        user,
 		}
-		oneTimeKeyRepo := repository.NewOneTimeKeyRepository(persistence.DatabaseContext)
-		err = oneTimeKeyRepo.Save(&userOneTimeKey)
-		if err != nil {
-			handleError(context, 500, fmt.Errorf(err.Error()))
-			return
+		// The replaced pre key is kept for a grace period so handshakes that
+		// already fetched it can still be completed, unless it was signed by
+		// an identity key that is gone
+		expiredAt := currentTime.Add(time.Duration(system.SystemConfig.Key.PreKeyGracePeriod) * time.Millisecond)
+		if identityChanged {
+			expiredAt = currentTime
 		}
+		preKeyRepo := repository.NewPreKeyRepository(tx)
+		return preKeyRepo.Rotate(&userPreKey, expiredAt)
+	})
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+
+	// The first upload is not a change, there is no peer to tell yet
+	if identityChanged && previousIdentityKey != "" {
+		go notifyIdentityKeyChanged(user, previousIdentityKey, currentTime)
 	}
 
 	context.JSON(200, gin.H{
@@ -64,21 +141,122 @@ func getExternalKeyBundle(context *gin.Context) {
 		return
 	}
 
-	var lastedOneTimeKey persistence.PreKeys
-	for _, element := range otherUser.PreKeys {
-		lastedOneTimeKey = *element
-	}
+	lastedOneTimeKey := getActivePreKey(&otherUser)
 
 	result := ExternalKeyBundleDto{
-		IdentityKey: otherUser.IdentityKey,
-		PreKeyId:    lastedOneTimeKey.ID.String(),
-		PreKey:      lastedOneTimeKey.Key,
-		PreKeySig:   lastedOneTimeKey.KeySignature,
+		Suite:           otherUser.KeySuite,
+		ProtocolVersion: otherUser.ProtocolVersion,
+		IdentityKey:     otherUser.IdentityKey,
+		PreKeyId:        lastedOneTimeKey.ID.String(),
+		PreKey:          lastedOneTimeKey.Key,
+		PreKeySig:       lastedOneTimeKey.KeySignature,
+		PQPreKey:        lastedOneTimeKey.PQKey,
+		PQPreKeySig:     lastedOneTimeKey.PQKeySig,
+	}
+
+	// Hand out at most one one-time key per bundle, when the pool is empty the
+	// handshake falls back to the signed pre key only
+	oneTimeKeyRepo := repository.NewOneTimeKeyRepository(persistence.DatabaseContext)
+	var oneTimeKey persistence.OneTimeKey
+	err = oneTimeKeyRepo.ConsumeByUserId(otherUser.ID.String(), &oneTimeKey)
+	if err == nil {
+		result.OneTimeKeyId = oneTimeKey.ID.String()
+		result.OneTimeKey = oneTimeKey.Key
+		result.OneTimeKeySig = oneTimeKey.KeySignature
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
 	}
 
 	context.JSON(200, result)
 }
 
+func getIdentityKeyHistory(context *gin.Context) {
+	username := context.Param("userName")
+	userRepository := repository.NewUserRepository(persistence.DatabaseContext)
+	var user persistence.User
+	err := userRepository.FindByUserName(username, &user)
+	if err != nil {
+		handleError(context, 400, fmt.Errorf(err.Error()))
+		return
+	}
+	historyRepo := repository.NewIdentityKeyHistoryRepository(persistence.DatabaseContext)
+	var history []persistence.IdentityKeyHistory
+	err = historyRepo.FindAllByUserId(user.ID.String(), &history)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	result := make([]IdentityKeyHistoryDto, 0, len(history))
+	for i := range history {
+		result = append(result, IdentityKeyHistoryDto{
+			IdentityKey: history[i].IdentityKey,
+			Suite:       history[i].KeySuite,
+			CreatedAt:   history[i].CreatedAt,
+		})
+	}
+	context.JSON(200, result)
+}
+
+func uploadOneTimeKeys(context *gin.Context) {
+	var oneTimeKeyBatch OneTimeKeyBatchDto
+	err := context.BindJSON(&oneTimeKeyBatch)
+	if err != nil {
+		handleError(context, 400, fmt.Errorf(err.Error()))
+		return
+	}
+	user := getLoggedInUser(context)
+	var oneTimeKeys []persistence.OneTimeKey
+	for _, element := range oneTimeKeyBatch.OneTimeKeys {
+		keyId, err := uuid.Parse(element.KeyId)
+		if err != nil || element.Key == "" || element.KeySig == "" {
+			handleError(context, 400, fmt.Errorf("Invalid one-time key"))
+			return
+		}
+		err = verifyOneTimeKeySignature(user.IdentityKey, element.Key, element.KeySig, user.ProtocolVersion)
+		if err != nil {
+			handleError(context, INVALID_KEY_SIGNATURE, fmt.Errorf("Invalid one-time key signature: %s", err.Error()))
+			return
+		}
+		oneTimeKeys = append(oneTimeKeys, persistence.OneTimeKey{
+			ID:           keyId,
+			UserId:       user.ID,
+			Key:          element.Key,
+			KeySignature: element.KeySig,
+			CreatedAt:    time.Now(),
+		})
+	}
+	if len(oneTimeKeys) == 0 {
+		handleError(context, 400, fmt.Errorf("Missing one-time keys"))
+		return
+	}
+	oneTimeKeyRepo := repository.NewOneTimeKeyRepository(persistence.DatabaseContext)
+	err = oneTimeKeyRepo.SaveAll(&oneTimeKeys)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	context.JSON(200, gin.H{
+		"user":    user.Username,
+		"message": "One-time keys uploaded",
+		"count":   len(oneTimeKeys),
+	})
+}
+
+func countOneTimeKeys(context *gin.Context) {
+	user := getLoggedInUser(context)
+	oneTimeKeyRepo := repository.NewOneTimeKeyRepository(persistence.DatabaseContext)
+	var count int64
+	err := oneTimeKeyRepo.CountByUserId(user.ID.String(), &count)
+	if err != nil {
+		handleError(context, 500, fmt.Errorf(err.Error()))
+		return
+	}
+	context.JSON(200, gin.H{
+		"count": count,
+	})
+}
+
 func getUserInfo(context *gin.Context) {
 	user := getLoggedInUser(context)
 	var avt string
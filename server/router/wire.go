@@ -0,0 +1,160 @@
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strix-server/common"
+)
+
+// A binary socket frame carries what the server routes on as json and the
+// message itself as the versioned envelope built by the core library
+//
+//	uint32 length + MessageDto json without the ratchet fields
+//	envelope, see core/ratchet/wire.go
+//
+// The server only reads the envelope header, the sealed content is relayed
+// untouched. Clients split the frame with SplitSocketFrame of the core library
+const (
+	WIRE_VERSION_1       byte = 0x01
+	wireFlagBinary       byte = 0x01
+	wireFlagPaddingShift      = 1
+	wireFlagPaddingMask  byte = 0x03
+)
+
+func decodeBinaryFrame(frame []byte) (*MessageDto, error) {
+	if len(frame) < 4 {
+		return nil, fmt.Errorf("Frame too short")
+	}
+	metadataLength := binary.BigEndian.Uint32(frame)
+	if uint64(len(frame)-4) < uint64(metadataLength) {
+		return nil, fmt.Errorf("Frame too short")
+	}
+	var msgDto MessageDto
+	err := json.Unmarshal(frame[4:4+metadataLength], &msgDto)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read frame metadata: %w", err)
+	}
+	err = decodeEnvelope(frame[4+metadataLength:], &msgDto)
+	if err != nil {
+		return nil, err
+	}
+	return &msgDto, nil
+}
+
+func encodeBinaryFrame(msgDto *MessageDto) ([]byte, error) {
+	envelope, err := encodeEnvelope(msgDto)
+	if err != nil {
+		return nil, err
+	}
+	metadata := *msgDto
+	metadata.ChatSessionId = ""
+	metadata.Index = 0
+	metadata.ChainIndex = 0
+	metadata.PreviousChainLength = 0
+	metadata.RatchetKey = ""
+	metadata.CipherMessage = ""
+	metadata.IsBinary = false
+	metadata.Padding = 0
+	metadataJson, err := json.Marshal(&metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot write frame metadata: %w", err)
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(metadataJson)))
+	frame = append(frame, metadataJson...)
+	return append(frame, envelope...), nil
+}
+
+func decodeEnvelope(envelope []byte, msgDto *MessageDto) error {
+	if len(envelope) < 2 {
+		return fmt.Errorf("Envelope too short")
+	}
+	if envelope[0] != WIRE_VERSION_1 {
+		return fmt.Errorf("Unsupported wire version %d", envelope[0])
+	}
+	flags := envelope[1]
+	rest := envelope[2:]
+
+	ratchetId, rest, err := readPrefixed(rest, 2)
+	if err != nil {
+		return err
+	}
+	var counters [3]uint64
+	for i := range counters {
+		value, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return fmt.Errorf("Invalid envelope counter")
+		}
+		counters[i] = value
+		rest = rest[n:]
+	}
+	ratchetKey, rest, err := readPrefixed(rest, 2)
+	if err != nil {
+		return err
+	}
+	cipherMessage, rest, err := readPrefixed(rest, 4)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("Trailing data after envelope")
+	}
+
+	msgDto.ChatSessionId = string(ratchetId)
+	msgDto.Index = counters[0]
+	msgDto.ChainIndex = counters[1]
+	msgDto.PreviousChainLength = counters[2]
+	msgDto.RatchetKey = common.EncodeToString(ratchetKey)
+	msgDto.CipherMessage = common.EncodeToString(cipherMessage)
+	msgDto.IsBinary = flags&wireFlagBinary != 0
+	msgDto.Padding = flags >> wireFlagPaddingShift & wireFlagPaddingMask
+	return nil
+}
+
+func encodeEnvelope(msgDto *MessageDto) ([]byte, error) {
+	ratchetKey := common.DecodeToByte(msgDto.RatchetKey)
+	cipherMessage := common.DecodeToByte(msgDto.CipherMessage)
+	if len(cipherMessage) == 0 {
+		return nil, fmt.Errorf("Message has no cipher text")
+	}
+	if len(msgDto.ChatSessionId) > 0xffff || len(ratchetKey) > 0xffff {
+		return nil, fmt.Errorf("Message header too long")
+	}
+	var flags byte
+	if msgDto.IsBinary {
+		flags |= wireFlagBinary
+	}
+	if msgDto.Padding > wireFlagPaddingMask {
+		return nil, fmt.Errorf("Unknown padding scheme %d", msgDto.Padding)
+	}
+	flags |= msgDto.Padding << wireFlagPaddingShift
+	envelope := []byte{WIRE_VERSION_1, flags}
+	envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(msgDto.ChatSessionId)))
+	envelope = append(envelope, msgDto.ChatSessionId...)
+	envelope = binary.AppendUvarint(envelope, msgDto.Index)
+	envelope = binary.AppendUvarint(envelope, msgDto.ChainIndex)
+	envelope = binary.AppendUvarint(envelope, msgDto.PreviousChainLength)
+	envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(ratchetKey)))
+	envelope = append(envelope, ratchetKey...)
+	envelope = binary.BigEndian.AppendUint32(envelope, uint32(len(cipherMessage)))
+	return append(envelope, cipherMessage...), nil
+}
+
+// readPrefixed splits off a field stored behind a big endian length of
+// lengthSize bytes
+func readPrefixed(data []byte, lengthSize int) ([]byte, []byte, error) {
+	if len(data) < lengthSize {
+		return nil, nil, fmt.Errorf("Envelope too short")
+	}
+	var length uint64
+	if lengthSize == 2 {
+		length = uint64(binary.BigEndian.Uint16(data))
+	} else {
+		length = uint64(binary.BigEndian.Uint32(data))
+	}
+	data = data[lengthSize:]
+	if uint64(len(data)) < length {
+		return nil, nil, fmt.Errorf("Envelope too short")
+	}
+	return data[:length], data[length:], nil
+}
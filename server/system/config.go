@@ -15,16 +15,24 @@ const (
 	APP_NODE           = "app.node"
 	ACCESS_TOKEN_TIME  = "auth.accessTokenExpireTime"
 	REFRESH_TOEKN_TIME = "auth.refreshTokenExpireTime"
+	PRE_KEY_ROTATION   = "key.preKeyRotationTime"
+	PRE_KEY_GRACE_TIME = "key.preKeyGracePeriod"
+	WEBSOCKET_BINARY   = "websocket.binaryFrames"
+	SEALED_SENDER      = "sealedSender.enabled"
+	SEALED_SENDER_TTL  = "sealedSender.certificateTTL"
 )
 
 type Config struct {
-	Db     DbConfig            `mapstructure:"db"`
-	Server ServerConfig        `mapstructure:"server"`
-	Log    LogConfig           `mapstructure:"log"`
-	App    AppConfig           `mapstructure:"app"`
-	JwtKey string              `mapstructure:"jwt_key"`
-	Auth   AuthConfig          `mapstructure:"auth"`
-	Binary BinaryStorageConfig `mapstructure:"bin"`
+	Db           DbConfig            `mapstructure:"db"`
+	Server       ServerConfig        `mapstructure:"server"`
+	Log          LogConfig           `mapstructure:"log"`
+	App          AppConfig           `mapstructure:"app"`
+	JwtKey       string              `mapstructure:"jwt_key"`
+	Auth         AuthConfig          `mapstructure:"auth"`
+	Binary       BinaryStorageConfig `mapstructure:"bin"`
+	Key          KeyConfig           `mapstructure:"key"`
+	WebSocket    WebSocketConfig     `mapstructure:"websocket"`
+	SealedSender SealedSenderConfig  `mapstructure:"sealedSender"`
 }
 
 type DbConfig struct {
@@ -58,6 +66,29 @@ type AuthConfig struct {
 	AccessTokenExpireTime  uint64 `mapstructure:"accessTokenExpireTime"`
 }
 
+// KeyConfig holds the signed pre key lifecycle, a pre key older than
+// PreKeyRotationTime is stale and a replaced pre key is still handed out to
+// pending handshakes for PreKeyGracePeriod, both in milliseconds
+type KeyConfig struct {
+	PreKeyRotationTime uint64 `mapstructure:"preKeyRotationTime"`
+	PreKeyGracePeriod  uint64 `mapstructure:"preKeyGracePeriod"`
+}
+
+// WebSocketConfig lets the /ws handler take and relay messages as binary
+// frames, sockets still have to ask for them with binaryFrames=true
+type WebSocketConfig struct {
+	BinaryFrames bool `mapstructure:"binaryFrames"`
+}
+
+// SealedSenderConfig enables delivery without the sender being known to the
+// server, SigningKey is the base64 Ed25519 seed signing sender certificates
+// and CertificateTTL how long a certificate is valid in milliseconds
+type SealedSenderConfig struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	SigningKey     string `mapstructure:"signingKey"`
+	CertificateTTL uint64 `mapstructure:"certificateTTL"`
+}
+
 type BinaryStorageConfig struct {
 	ServerAddress string `mapstructure:"serverAddress"`
 	Username      string `mapstructure:"username"`
@@ -92,5 +123,10 @@ func setDefaultConfig() {
 	viper.SetDefault(SERVER_ADDRESS, "localhost")
 	viper.SetDefault(ACCESS_TOKEN_TIME, 1800000)
 	viper.SetDefault(REFRESH_TOEKN_TIME, 2592000000)
+	viper.SetDefault(PRE_KEY_ROTATION, 604800000)
+	viper.SetDefault(PRE_KEY_GRACE_TIME, 172800000)
+	viper.SetDefault(WEBSOCKET_BINARY, false)
+	viper.SetDefault(SEALED_SENDER, false)
+	viper.SetDefault(SEALED_SENDER_TTL, 86400000)
 	viper.Set(APP_NODE, "1")
 }